@@ -0,0 +1,84 @@
+package cliutils
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fredyk/westack-go/westack"
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+// issueApiKey boots the app of the current directory and issues a key for the user with the given username or email.
+// The scopes are not checked against the roles of the user, as the CLI is run by the operators of the app
+func issueApiKey(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing username or email")
+	}
+	flags := flag.NewFlagSet("apikey issue", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the key")
+	scopes := flags.String("scopes", "", "comma separated roles of the key")
+	ttl := flags.Duration("ttl", 0, "lifetime of the key, e.g. 720h. Never expires by default")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	app := westack.New()
+	app.Boot()
+	userModels := app.FindModelsWithClass("User")
+	if len(userModels) == 0 {
+		return fmt.Errorf("user model not found")
+	}
+	user, err := userModels[0].FindOne(&wst.Filter{Where: &wst.Where{
+		"$or": []wst.M{{"username": args[0]}, {"email": args[0]}},
+	}}, systemContext())
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %v not found", args[0])
+	}
+
+	scopeList := []string{}
+	for _, scope := range strings.Split(*scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopeList = append(scopeList, scope)
+		}
+	}
+	key, apiKey, err := westack.IssueApiKey(app, westack.ApiKeyToIssue{
+		UserId: model.GetIDAsString(user.Id),
+		Name:   *name,
+		Scopes: scopeList,
+		Ttl:    *ttl,
+	}, systemContext())
+	if err != nil {
+		return err
+	}
+	log.Printf("Issued API key %v for user %v, it will not be shown again:\n", model.GetIDAsString(apiKey.Id), args[0])
+	fmt.Println(key)
+	return nil
+}
+
+func revokeApiKey(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing API key id")
+	}
+	app := westack.New()
+	app.Boot()
+	_, err := westack.RevokeApiKey(app, args[0], systemContext())
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked API key %v at %v\n", args[0], time.Now().Format(time.RFC3339))
+	return nil
+}
+
+func systemContext() *model.EventContext {
+	return &model.EventContext{
+		Bearer: &model.BearerToken{User: &model.BearerUser{System: true}},
+	}
+}
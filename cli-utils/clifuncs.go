@@ -4,8 +4,10 @@ import "log"
 
 func printHelp() {
 	log.Println("Usage: cli <command>")
-	log.Println("\tinit <target> \tInitializes a new project in the <target> directory")
+	log.Println("\tinit <target> [--connector mongodb|file] \tInitializes a new project in the <target> directory")
 	log.Println("\tmodel add <model name> <datasource> \tCreates a new model with the given <model name> and attaches it to <datasource>")
 	log.Println("\tserver start \tStarts the server")
+	log.Println("\tapikey issue <username or email> [--name <name>] [--scopes <role1,role2>] [--ttl <duration>] \tIssues an API key for the user and prints it")
+	log.Println("\tapikey revoke <API key id> \tRevokes an API key")
 	log.Println()
 }
@@ -91,7 +91,9 @@ var DefaultConfig = AppConfig{
 	StrictSingleRelatedDocumentCheck: true,
 }
 
-func initProject(cwd string) error {
+// initProject creates the server and common directories of a new project. The "db" datasource uses the given
+// connector, which can be "mongodb" or "file"
+func initProject(cwd string, connector string) error {
 	err := os.Chdir(cwd)
 	if err != nil {
 		return err
@@ -115,11 +117,23 @@ func initProject(cwd string) error {
 
 	if _, err := os.Stat("server/datasources.json"); os.IsNotExist(err) {
 		config := DefaultDatasources["db"]
-		dbName := regexp.MustCompile("[^a-zA-Z0-9]+").ReplaceAllString(cwdName, "_")
-		if dbName == "" {
-			dbName = "example_db"
+		switch connector {
+		case "", "mongodb":
+			dbName := regexp.MustCompile("[^a-zA-Z0-9]+").ReplaceAllString(cwdName, "_")
+			if dbName == "" {
+				dbName = "example_db"
+			}
+			config.Database = dbName
+		case "file":
+			// no server required, collections are stored as json files under data/
+			config = model.DataSourceConfig{
+				Name:      "db",
+				Connector: "file",
+				Directory: "data",
+			}
+		default:
+			return fmt.Errorf("unsupported connector %v", connector)
 		}
-		config.Database = dbName
 		DefaultDatasources["db"] = config
 		bytes, err := json.MarshalIndent(DefaultDatasources, "", "  ")
 		err = os.WriteFile("server/datasources.json", bytes, 0600)
@@ -24,7 +24,11 @@ func RunCli() {
 			return
 		}
 
-		err := initProject(os.Args[2])
+		connector := ""
+		if len(os.Args) >= 5 && os.Args[3] == "--connector" {
+			connector = os.Args[4]
+		}
+		err := initProject(os.Args[2], connector)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -71,6 +75,26 @@ func RunCli() {
 				break
 			}
 		}
+	case "apikey":
+		if len(os.Args) < 3 {
+			printHelp()
+			return
+		}
+
+		var err error
+		switch os.Args[2] {
+		case "issue":
+			err = issueApiKey(os.Args[3:])
+		case "revoke":
+			err = revokeApiKey(os.Args[3:])
+		default:
+			printHelp()
+			return
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		break
 	case "help":
 		printHelp()
 		break
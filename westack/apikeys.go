@@ -0,0 +1,274 @@
+package westack
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+// apiKeyPrefix starts every API key, followed by the id of the ApiKey instance and the secret
+const apiKeyPrefix = "wsk_"
+
+// apiKeyLastUsedInterval limits the writes of "lastUsedAt" to one per key and interval
+const apiKeyLastUsedInterval = time.Minute
+
+// apiKeyClaimsTtl is the lifetime of the claims built for a key without expiration. They are built again on every
+// request, so it only has to be longer than a request
+const apiKeyClaimsTtl = time.Hour
+
+type ApiKeyToIssue struct {
+	// UserId is the id of the owner of the key
+	UserId string   `json:"userId"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Ttl is the lifetime of the key, which never expires when zero
+	Ttl time.Duration `json:"ttl"`
+}
+
+// IssueApiKey creates an ApiKey instance and returns the key, which is not stored and cannot be recovered. The scopes
+// of the key are its roles, so they are not checked here, see the "issue" handler
+func IssueApiKey(app *WeStack, toIssue ApiKeyToIssue, eventContext *model.EventContext) (key string, apiKey *model.Instance, err error) {
+	if app.apiKeyModel == nil {
+		return "", nil, fmt.Errorf("api key model not found")
+	}
+	ownerId, err := primitive.ObjectIDFromHex(toIssue.UserId)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid userId: %w", err)
+	}
+	if toIssue.Scopes == nil {
+		toIssue.Scopes = []string{}
+	}
+
+	id := primitive.NewObjectID()
+	key = apiKeyPrefix + id.Hex() + "_" + randomTokenValue()
+	data := wst.M{
+		"_id":     id,
+		"name":    toIssue.Name,
+		"keyHash": hashApiKey(key),
+		"userId":  ownerId,
+		"scopes":  toIssue.Scopes,
+	}
+	if toIssue.Ttl > 0 {
+		data["expiresAt"] = time.Now().Add(toIssue.Ttl)
+	}
+	apiKey, err = app.apiKeyModel.Create(data, eventContext)
+	if err != nil {
+		return "", nil, err
+	}
+	app.apiKeyModel.Logger().Info("Issued API key", "apiKeyId", id.Hex(), "userId", toIssue.UserId, "scopes", toIssue.Scopes)
+	return key, apiKey, nil
+}
+
+// RevokeApiKey marks the key as revoked, so that it is rejected from the next request
+func RevokeApiKey(app *WeStack, apiKeyId string, eventContext *model.EventContext) (*model.Instance, error) {
+	if app.apiKeyModel == nil {
+		return nil, fmt.Errorf("api key model not found")
+	}
+	apiKey, err := app.apiKeyModel.FindById(apiKeyId, nil, eventContext)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == nil {
+		return nil, wst.CreateError(fiber.ErrNotFound, "API_KEY_NOT_FOUND", fiber.Map{"message": fmt.Sprintf("API key %v not found", apiKeyId)}, "Error")
+	}
+	apiKey, err = apiKey.UpdateAttributes(wst.M{"revokedAt": time.Now()}, eventContext)
+	if err != nil {
+		return nil, err
+	}
+	app.apiKeyModel.Logger().Info("Revoked API key", "apiKeyId", apiKeyId)
+	return apiKey, nil
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// authenticateApiKey checks the key and returns the claims of its bearer. The subject of the key for casbin is the
+// key itself, with the scopes as roles, so that a key never grants more than its scopes
+func (app *WeStack) authenticateApiKey(ctx context.Context, rawKey string) (wst.M, error) {
+	if app.apiKeyModel == nil || !strings.HasPrefix(rawKey, apiKeyPrefix) {
+		return nil, nil
+	}
+	idAndSecret := strings.TrimPrefix(rawKey, apiKeyPrefix)
+	if len(idAndSecret) < 26 || idAndSecret[24] != '_' {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(idAndSecret[:24])
+	if err != nil {
+		return nil, nil
+	}
+
+	systemContext := &model.EventContext{
+		Bearer:  &model.BearerToken{User: &model.BearerUser{System: true}},
+		Context: ctx,
+	}
+	apiKey, err := app.apiKeyModel.FindOne(&wst.Filter{Where: &wst.Where{"_id": id}}, systemContext)
+	if err != nil || apiKey == nil {
+		return nil, err
+	}
+	data := apiKey.ToJSON()
+	if subtle.ConstantTimeCompare([]byte(hashApiKey(rawKey)), []byte(data.GetString("keyHash"))) != 1 {
+		return nil, nil
+	}
+	if data["revokedAt"] != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	claimsTtl := apiKeyClaimsTtl
+	if expiresAt, ok := instanceTime(data["expiresAt"]); ok {
+		if now.After(expiresAt) {
+			return nil, nil
+		}
+		claimsTtl = expiresAt.Sub(now)
+	}
+	if lastUsedAt, ok := instanceTime(data["lastUsedAt"]); !ok || now.Sub(lastUsedAt) > apiKeyLastUsedInterval {
+		_, err := apiKey.UpdateAttributes(wst.M{"lastUsedAt": now}, systemContext)
+		if err != nil {
+			app.apiKeyModel.Logger().Warn("Could not update the last use of the API key", "apiKeyId", id.Hex(), "error", err)
+		}
+	}
+
+	roles := []interface{}{}
+	for _, scope := range instanceStrings(data["scopes"]) {
+		roles = append(roles, scope)
+	}
+	claims := wst.M{
+		"typ":      model.ApiKeyTokenType,
+		"userId":   id.Hex(),
+		"apiKeyId": id.Hex(),
+		"ownerId":  model.GetIDAsString(data["userId"]),
+		"roles":    roles,
+		"created":  now.UnixMilli(),
+		"ttl":      claimsTtl.Milliseconds(),
+	}
+	if app.apiKeyModel.IsMultiTenant() {
+		// the keys are issued in a tenant, and cannot be used in other ones
+		claims[model.TenantClaim(app.Viper)] = data.GetString(app.apiKeyModel.TenantField())
+	}
+	return claims, nil
+}
+
+// issueApiKeyFromRequest handles POST /<api keys>/issue. The bearer must be a user, and the scopes must be roles of
+// their token, except the metricsScope, which only requires the readMetricsAction
+func (app *WeStack) issueApiKeyFromRequest(ctx *model.EventContext) error {
+	bearer := ctx.Bearer
+	if bearer == nil || bearer.User == nil || bearer.Claims["typ"] == model.ApiKeyTokenType {
+		return wst.CreateError(fiber.ErrForbidden, "API_KEY_ISSUER_NOT_ALLOWED", fiber.Map{"message": "API keys must be issued by a user"}, "Error")
+	}
+	heldRoles := make(map[string]bool, len(bearer.Roles))
+	for _, role := range bearer.Roles {
+		heldRoles[role.Name] = true
+	}
+	scopes := instanceStrings((*ctx.Data)["scopes"])
+	for _, scope := range scopes {
+		if scope == metricsScope && app.canReadMetrics(ctx) {
+			continue
+		}
+		if !heldRoles[scope] {
+			return wst.CreateError(fiber.ErrForbidden, "SCOPE_NOT_ALLOWED", fiber.Map{"message": fmt.Sprintf("scope %v is not a role of the user", scope)}, "Error")
+		}
+	}
+	var ttl time.Duration
+	if seconds, ok := (*ctx.Data)["ttl"].(float64); ok && seconds > 0 {
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+
+	key, apiKey, err := IssueApiKey(app, ApiKeyToIssue{
+		UserId: model.GetIDAsString(bearer.User.Id),
+		Name:   ctx.Data.GetString("name"),
+		Scopes: scopes,
+		Ttl:    ttl,
+	}, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	apiKey.HideProperties()
+	result := apiKey.ToJSON()
+	result["key"] = key
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = result
+	return nil
+}
+
+// canReadMetrics reports whether the bearer of the context is allowed the readMetricsAction of the User model
+func (app *WeStack) canReadMetrics(ctx *model.EventContext) bool {
+	userModels := app.FindModelsWithClass("User")
+	if len(userModels) == 0 {
+		return false
+	}
+	err, allowed := userModels[0].EnforceEx(ctx.Bearer, "*", readMetricsAction, ctx)
+	return err == nil && allowed
+}
+
+// revokeApiKeyFromRequest handles POST /<api keys>/:id/revoke
+func (app *WeStack) revokeApiKeyFromRequest(ctx *model.EventContext) error {
+	_, err := RevokeApiKey(app, ctx.Ctx.Params("id"), systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// checkApiKeyWrite keeps the keys read-only for the REST API, so that the hashes and scopes are only written by
+// IssueApiKey, RevokeApiKey and the authentication
+func checkApiKeyWrite(ctx *model.EventContext) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	return wst.CreateError(fiber.ErrForbidden, "API_KEY_READ_ONLY", fiber.Map{"message": "API keys can only be issued and revoked"}, "Error")
+}
+
+// isSystemContext reports whether the closest bearer of the context chain is the system
+func isSystemContext(ctx *model.EventContext) bool {
+	for current := ctx; current != nil; current = current.BaseContext {
+		if current.Bearer != nil {
+			return current.Bearer.User != nil && current.Bearer.User.System
+		}
+	}
+	return false
+}
+
+// instanceTime reads a date of an instance, which depends on the datasource
+func instanceTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case primitive.DateTime:
+		return v.Time(), true
+	case string:
+		parsed, err := wst.ParseDate(v)
+		return parsed, err == nil
+	}
+	return time.Time{}, false
+}
+
+func instanceStrings(value interface{}) []string {
+	var values []interface{}
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		values = v
+	case primitive.A:
+		values = v
+	}
+	result := make([]string, 0, len(values))
+	for _, item := range values {
+		if st, ok := item.(string); ok {
+			result = append(result, st)
+		}
+	}
+	return result
+}
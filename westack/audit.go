@@ -0,0 +1,136 @@
+package westack
+
+import (
+	"context"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+// readAuditAction is the casbin action of the User models that allows reading the audit log, allowed to the "admin"
+// role by default
+const readAuditAction = "readAudit"
+
+// maxAuditLimit bounds the "limit" of the audit log route
+const maxAuditLimit = 1000
+
+// loadAuditLog stores the audit entries in the collection of the "audit.model" model or, else, in the "audit.datasource"
+// datasource. By default, they are kept in memory, so they are lost on restart, which is warned about when a model is
+// audited. With "audit.enabled", the app does not start unless the entries are stored in a persistent datasource. It is
+// called once the models are loaded
+func (app *WeStack) loadAuditLog() {
+	required := app.Viper.GetBool("audit.enabled")
+	if modelName := app.Viper.GetString("audit.model"); modelName != "" {
+		auditModel, err := app.FindModel(modelName)
+		if err != nil {
+			log.Fatalf("Invalid audit.model: %v", err)
+		}
+		if auditModel.Config.Audit {
+			log.Fatalf("Invalid audit.model: %v cannot be audited itself", modelName)
+		}
+		if required && !isPersistentDatasource(auditModel.Datasource) {
+			log.Fatalf("Invalid audit.model: the datasource %v of %v is not persistent", auditModel.Datasource.Name, modelName)
+		}
+		app.auditLog = model.NewAuditLog(auditModel.Datasource, auditModel.CollectionName)
+		return
+	}
+	dsName := app.Viper.GetString("audit.datasource")
+	var ds *datasource.Datasource
+	if dsName != "" {
+		var err error
+		ds, err = app.FindDatasource(dsName)
+		if err != nil {
+			log.Fatalf("Invalid audit.datasource: %v", err)
+		}
+		if required && !isPersistentDatasource(ds) {
+			log.Fatalf("Invalid audit.datasource: %v is not persistent", dsName)
+		}
+	} else {
+		if required {
+			log.Fatalf("audit.enabled requires audit.model or audit.datasource, to store the audit log in a persistent datasource")
+		}
+		for _, loadedModel := range *app.modelRegistry {
+			if loadedModel.Config.Audit {
+				app.logger.Warn("The audit log is kept in memory, so it grows until the app restarts and is lost then. Set audit.model or audit.datasource", "model", loadedModel.Name)
+				break
+			}
+		}
+		dsViper := viper.New()
+		dsViper.Set("auditLog.connector", "memorykv")
+		ds = datasource.New("auditLog", dsViper, context.Background())
+		err := ds.Initialize()
+		if err != nil {
+			log.Fatalf("Could not create the audit log: %v", err)
+		}
+	}
+	app.auditLog = model.NewAuditLog(ds, model.AuditCollection)
+}
+
+// isPersistentDatasource reports whether the datasource keeps its data across restarts, unlike memorykv
+func isPersistentDatasource(ds *datasource.Datasource) bool {
+	return ds.SubViper.GetString("connector") != "memorykv"
+}
+
+// AuditLog returns the audit log of the app, to read the entries from custom routes
+func (app *WeStack) AuditLog() *model.AuditLog {
+	return app.auditLog
+}
+
+func (app *WeStack) recordAudit(ctx context.Context, entry wst.M) error {
+	if app.auditLog == nil {
+		return nil
+	}
+	return app.auditLog.Record(ctx, entry)
+}
+
+func (app *WeStack) updateAudit(ctx context.Context, entryId string, fields wst.M) error {
+	if app.auditLog == nil {
+		return nil
+	}
+	return app.auditLog.Update(ctx, entryId, fields)
+}
+
+// loadAuditRoutes mounts GET /system/audit, which returns the latest entries of the audit log, filtered by the "model"
+// and "id" query params. The bearer must be allowed the readAuditAction of the User model
+func (app *WeStack) loadAuditRoutes() {
+	userModels := app.FindModelsWithClass("User")
+	if len(userModels) == 0 {
+		app.logger.Error("Could not load the audit routes", "error", "user model not found")
+		return
+	}
+	userModel := userModels[0]
+
+	app.Server.Get("/system/audit", func(c *fiber.Ctx) error {
+		eventContext := &model.EventContext{
+			Ctx:       c,
+			Context:   c.UserContext(),
+			RequestID: model.RequestID(c),
+		}
+		err, token := eventContext.GetBearer(userModel)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		err, allowed := userModel.EnforceEx(token, "*", readAuditAction, eventContext)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		if !allowed {
+			return fiber.ErrUnauthorized
+		}
+		limit := c.QueryInt("limit", model.DefaultAuditLimit)
+		if limit <= 0 || limit > maxAuditLimit {
+			return userModel.SendError(c, wst.CreateError(fiber.ErrBadRequest, "INVALID_LIMIT", fiber.Map{"message": "the limit must be between 1 and 1000"}, "ValidationError"))
+		}
+		// the admins of a tenant only see the entries of their tenant
+		entries, err := app.auditLog.Find(eventContext.GetContext(), c.Query("model"), c.Query("id"), eventContext.GetTenant(), limit)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		return c.JSON(entries)
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io/fs"
-	"log"
 	"os"
 	"regexp"
 	"strings"
@@ -14,12 +13,8 @@ import (
 	swaggerhelper2 "github.com/fredyk/westack-go/westack/lib/swaggerhelperinterface"
 
 	casbinmodel "github.com/casbin/casbin/v2/model"
-	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	fiber "github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt"
 	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/datasource"
@@ -60,7 +55,7 @@ func (app *WeStack) loadModels() error {
 		var config *model.Config
 		err := wst.LoadFile("./common/models/"+fileInfo.Name(), &config)
 		if err != nil {
-			fmt.Printf("Error while loading model %v: %v\n", fileInfo.Name(), err)
+			app.logger.Error("Error while loading model", "file", fileInfo.Name(), "error", err)
 			panic(err)
 		}
 		if config.Relations == nil {
@@ -121,7 +116,7 @@ func (app *WeStack) loadDataSources() {
 	if err != nil {               // Handle errors reading the config file
 		switch err.(type) {
 		case viper.ConfigFileNotFoundError:
-			log.Println(fmt.Sprintf("WARNING: %v.json not found, fallback to datasources.json", fileToLoad))
+			app.logger.Warn("Config file not found, fallback to datasources.json", "file", fileToLoad+".json")
 			dsViper.SetConfigName("datasources") // name of config file (without extension)
 			err := dsViper.ReadInConfig()        // Find and read the config file
 			if err != nil {
@@ -141,7 +136,7 @@ func (app *WeStack) loadDataSources() {
 			dsName = key
 		}
 		connector := dsViper.GetString(key + ".connector")
-		if connector == "mongodb" || connector == "memorykv" {
+		if datasource.IsConnectorRegistered(connector) {
 			ds := datasource.New(key, dsViper, ctx)
 
 			if app.dataSourceOptions != nil {
@@ -157,15 +152,26 @@ func (app *WeStack) loadDataSources() {
 				panic(err)
 			}
 			(*app.datasources)[dsName] = ds
-			if app.debug {
-				log.Println("Connected to database", dsViper.GetString(key+".database"))
-			}
+			app.logger.Debug("Connected to database", "datasource", dsName, "database", dsViper.GetString(key+".database"))
 		} else {
 			panic("ERROR: connector " + connector + " not supported")
 		}
 	}
 }
 
+// hideProperties adds the properties to the hidden ones of the model, if they are not yet
+func hideProperties(config *model.Config, properties ...string) {
+	for _, property := range properties {
+		hidden := false
+		for _, hiddenProperty := range config.Hidden {
+			hidden = hidden || hiddenProperty == property
+		}
+		if !hidden {
+			config.Hidden = append(config.Hidden, property)
+		}
+	}
+}
+
 func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.Datasource) {
 
 	loadedModel.App = app.asInterface()
@@ -173,6 +179,16 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 
 	config := loadedModel.Config
 
+	if config.Base == "ApiKey" {
+		// the hashes are never returned
+		hideProperties(config, "keyHash")
+		app.apiKeyModel = loadedModel
+	}
+	if config.Base == "User" {
+		hideProperties(config, mfaProperties...)
+		hideProperties(config, "passwordHistory")
+	}
+
 	loadedModel.Initialize()
 
 	if config.Base == "Role" {
@@ -222,8 +238,18 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 				return wst.CreateError(fiber.ErrBadRequest, "USERNAME_EMAIL_REQUIRED", fiber.Map{"message": "username or email is required"}, "ValidationError")
 			}
 
-			if (*data)["password"] == nil || strings.TrimSpace((*data)["password"].(string)) == "" {
-				return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+			account := email
+			if account == "" {
+				account = username
+			}
+			err := app.checkLoginLockout(ctx, account)
+			if err != nil {
+				return err
+			}
+
+			password, _ := (*data)["password"].(string)
+			if strings.TrimSpace(password) == "" {
+				return app.loginFailed(loadedModel, ctx, account, "PASSWORD_REQUIRED")
 			}
 
 			var where wst.Where
@@ -236,66 +262,144 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 				Where: &where,
 			}, ctx).All()
 			if len(users) == 0 {
-				return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+				return app.loginFailed(loadedModel, ctx, account, "USER_NOT_FOUND")
 			}
 			firstUser := users[0]
 			ctx.Instance = &firstUser
 
-			firstUserData := firstUser.ToJSON()
-			savedPassword := firstUserData["password"]
-			err = bcrypt.CompareHashAndPassword([]byte(savedPassword.(string)), []byte((*data)["password"].(string)))
+			if !app.verifyUserPassword(&firstUser, password, ctx) {
+				return app.loginFailed(loadedModel, ctx, account, "INVALID_PASSWORD")
+			}
+			app.loginSucceeded(ctx, account)
+
+			result, err := app.loginResult(&firstUser, ctx)
 			if err != nil {
-				return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+				return err
 			}
 
-			userIdHex := firstUser.Id.(primitive.ObjectID).Hex()
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = result
+			return nil
+		})
 
-			roleNames := []string{"USER"}
-			if app.roleMappingModel != nil {
-				ctx.Bearer = &model.BearerToken{
-					User: &model.BearerUser{
-						System: true,
-					},
-					Roles: []model.BearerRole{},
-				}
-				roleContext := &model.EventContext{
-					BaseContext:            ctx,
-					DisableTypeConversions: true,
-				}
-				roleEntries, err := app.roleMappingModel.FindMany(&wst.Filter{Where: &wst.Where{
-					"principalType": "USER",
-					"$or": []wst.M{
-						{
-							"principalId": userIdHex,
-						},
-						{
-							"principalId": firstUser.Id,
-						},
-					},
-				}, Include: &wst.Include{{Relation: "role"}}}, roleContext).All()
+		loadedModel.On("refresh", func(ctx *model.EventContext) error {
+			rawToken := ctx.Data.GetString("refreshToken")
+			if rawToken == "" {
+				return wst.CreateError(fiber.ErrBadRequest, "REFRESH_TOKEN_REQUIRED", fiber.Map{"message": "refreshToken is required"}, "ValidationError")
+			}
+			claims, err := app.parseRefreshToken(rawToken)
+			if err != nil {
+				return err
+			}
+
+			family := model.TokenFamily(claims)
+			if family != "" {
+				revoked, err := app.tokenDenylist.IsRevoked(ctx.GetContext(), model.TokenFamilyKey(family))
 				if err != nil {
 					return err
 				}
-				for _, roleEntry := range roleEntries {
-					role := roleEntry.GetOne("role")
-					roleNames = append(roleNames, role.ToJSON()["name"].(string))
+				if revoked {
+					return invalidRefreshTokenError()
 				}
 			}
+			revoked, err := app.tokenDenylist.IsUserTokenRevoked(ctx.GetContext(), claims)
+			if err != nil {
+				return err
+			}
+			if revoked {
+				return invalidRefreshTokenError()
+			}
 
-			token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-				"userId":  userIdHex,
-				"created": time.Now().UnixMilli(),
-				"ttl":     604800 * 2 * 1000,
-				"roles":   roleNames,
-			})
+			// Refresh tokens are rotated: each one is revoked when used, so a stolen token can only be used once. A reuse
+			// means that either the user or the thief has the newer tokens, so all the tokens of the family are revoked
+			err = app.tokenDenylist.Revoke(ctx.GetContext(), model.TokenID(claims), model.TokenExpiresAt(claims))
+			if err == model.ErrTokenRevoked {
+				ctx.Logger().Warn("Reused refresh token, revoking its family", "userId", claims["userId"], "jti", model.TokenID(claims), "family", family)
+				if family != "" {
+					err = app.tokenDenylist.RevokeFamily(ctx.GetContext(), family, time.Now().Add(app.tokenTtl("refreshTokenTtl", defaultRefreshTokenTtl)))
+					if err != nil {
+						return err
+					}
+				}
+				return invalidRefreshTokenError()
+			} else if err != nil {
+				return err
+			}
 
-			tokenString, err := token.SignedString(loadedModel.App.JwtSecretKey)
+			user, err := loadedModel.FindById(claims["userId"], nil, ctx)
+			if err != nil || user == nil {
+				return invalidRefreshTokenError()
+			}
+			roleNames, err := app.userRoleNames(*user, ctx)
+			if err != nil {
+				return err
+			}
+
+			result, err := app.issueTokens(user, roleNames, family)
+			if err != nil {
+				return err
+			}
 
 			ctx.StatusCode = fiber.StatusOK
-			ctx.Result = fiber.Map{"id": tokenString, "userId": userIdHex}
+			ctx.Result = result
+			return nil
+		})
+
+		loadedModel.On("logout", func(ctx *model.EventContext) error {
+			claims := ctx.Bearer.Claims
+			if model.TokenID(claims) == "" {
+				return wst.CreateError(fiber.ErrBadRequest, "TOKEN_NOT_REVOCABLE", fiber.Map{"message": "the token has no id and cannot be revoked"}, "Error")
+			}
+			err := app.tokenDenylist.Revoke(ctx.GetContext(), model.TokenID(claims), model.TokenExpiresAt(claims))
+			if err != nil && err != model.ErrTokenRevoked {
+				return err
+			}
+
+			if rawToken := ctx.Data.GetString("refreshToken"); rawToken != "" {
+				refreshClaims, err := app.parseRefreshToken(rawToken)
+				if err == nil && refreshClaims["userId"] == claims["userId"] {
+					err = app.tokenDenylist.Revoke(ctx.GetContext(), model.TokenID(refreshClaims), model.TokenExpiresAt(refreshClaims))
+					if err != nil && err != model.ErrTokenRevoked {
+						return err
+					}
+				}
+			}
+
+			ctx.StatusCode = fiber.StatusNoContent
 			return nil
 		})
 
+		loadedModel.On("resetPassword", func(ctx *model.EventContext) error {
+			return app.resetPasswordFromRequest(loadedModel, ctx)
+		})
+		loadedModel.On("confirmResetPassword", func(ctx *model.EventContext) error {
+			return app.confirmResetPasswordFromRequest(loadedModel, ctx)
+		})
+		loadedModel.On("changePassword", func(ctx *model.EventContext) error {
+			return app.changePasswordFromRequest(loadedModel, ctx)
+		})
+		loadedModel.On("setupMfa", func(ctx *model.EventContext) error {
+			return app.setupMfaFromRequest(loadedModel, ctx)
+		})
+		loadedModel.On(model.MfaVerifyMethod, func(ctx *model.EventContext) error {
+			return app.verifyMfaFromRequest(loadedModel, ctx)
+		})
+		loadedModel.On("listRoles", app.listRolesFromRequest)
+		loadedModel.On("createRole", app.createRoleFromRequest)
+		loadedModel.On("setRoleInherits", app.setRoleInheritsFromRequest)
+		loadedModel.On("deleteRole", app.deleteRoleFromRequest)
+		loadedModel.On("assignRole", func(ctx *model.EventContext) error {
+			return app.assignRoleFromRequest(loadedModel, ctx)
+		})
+		loadedModel.On("unassignRole", func(ctx *model.EventContext) error {
+			return app.unassignRoleFromRequest(loadedModel, ctx)
+		})
+
+	}
+
+	if config.Base == "ApiKey" {
+		loadedModel.On("issue", app.issueApiKeyFromRequest)
+		loadedModel.On("revoke", app.revokeApiKeyFromRequest)
 	}
 
 	var plural string
@@ -308,29 +412,7 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 
 	casbModel := casbinmodel.NewModel()
 
-	basePoliciesDirectory := app.Viper.GetString("casbin.policies.outputDirectory")
-	_, err := os.Stat(basePoliciesDirectory)
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(basePoliciesDirectory, os.ModePerm)
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			panic(err)
-		}
-	}
-
-	f, err := os.OpenFile(fmt.Sprintf("%v/%v.policies.csv", basePoliciesDirectory, loadedModel.Name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
-	}
-	err = f.Close()
-	if err != nil {
-		panic(err)
-	}
-
-	adapter := fileadapter.NewAdapter(fmt.Sprintf("%v/%v.policies.csv", basePoliciesDirectory, loadedModel.Name))
+	adapter := app.newCasbinAdapter(loadedModel)
 
 	requestDefinition := "sub, obj, act"
 	policyDefinition := "sub, obj, act, eft"
@@ -340,6 +422,16 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 		"(" +
 		"	((p.sub == '$owner' && isOwner(r.sub, r.obj, p.obj)) || g(r.sub, p.sub)) && keyMatch(r.obj, p.obj) && (g(r.act, p.act) || keyMatch(r.act, p.act))" +
 		")")
+	if loadedModel.IsMultiTenant() {
+		// the tenants are casbin domains, so that the roles of the users are per tenant
+		requestDefinition = "sub, dom, obj, act"
+		policyDefinition = "sub, dom, obj, act, eft"
+		roleDefinition = "_, _, _"
+		matchersDefinition = fmt.Sprintf("" +
+			"(" +
+			"	((p.sub == '$owner' && isOwner(r.sub, r.obj, p.obj)) || g(r.sub, p.sub, r.dom)) && keyMatch(r.dom, p.dom) && keyMatch(r.obj, p.obj) && (g(r.act, p.act, r.dom) || keyMatch(r.act, p.act))" +
+			")")
+	}
 	if loadedModel.Config.Casbin.RequestDefinition != "" {
 		requestDefinition = loadedModel.Config.Casbin.RequestDefinition
 	}
@@ -362,26 +454,53 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 	casbModel.AddDef("e", "e", replaceVarNames(policyEffect))
 	casbModel.AddDef("m", "m", replaceVarNames(matchersDefinition))
 
+	addPolicy := func(policy string) {
+		rule := policyRule(replaceVarNames(policy))
+		if loadedModel.IsMultiTenant() && len(rule) == 4 {
+			// the policies without domain apply to all the tenants
+			rule = append([]string{rule[0], model.AnyTenant}, rule[1:]...)
+		}
+		casbModel.AddPolicy("p", "p", rule)
+	}
+
 	if len(loadedModel.Config.Casbin.Policies) > 0 {
 		for _, p := range loadedModel.Config.Casbin.Policies {
-			casbModel.AddPolicy("p", "p", []string{replaceVarNames(p)})
+			addPolicy(p)
 		}
 	} else {
-		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,read,allow")})
-		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$owner,*,write,allow")})
+		addPolicy("$authenticated,*,read,allow")
+		addPolicy("$owner,*,write,allow")
 	}
 
 	if config.Base == "User" {
-		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,create,allow")})
-		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,login,allow")})
-		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$owner,*,*,allow")})
-		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,findSelf,allow")})
+		addPolicy("$everyone,*,create,allow")
+		addPolicy("$everyone,*,login,allow")
+		addPolicy("$everyone,*,refresh,allow")
+		addPolicy("$authenticated,*,logout,allow")
+		addPolicy("$owner,*,*,allow")
+		addPolicy("$authenticated,*,findSelf,allow")
+		addPolicy("$everyone,*,resetPassword,allow")
+		addPolicy("$everyone,*,confirmResetPassword,allow")
+		addPolicy("$authenticated,*,changePassword,allow")
+		addPolicy("$authenticated,*,sendVerificationEmail,allow")
+		addPolicy("$authenticated,*,performEmailVerification,allow")
+		addPolicy("$authenticated,*,setupMfa,allow")
+		addPolicy("$authenticated,*,verifyMfa,allow")
+		addPolicy("admin,*," + manageRolesAction + ",allow")
+		addPolicy("admin,*," + readAuditAction + ",allow")
+		addPolicy("admin,*," + readMetricsAction + ",allow")
+		addPolicy(metricsScope + ",*," + readMetricsAction + ",allow")
+	}
+
+	if config.Base == "ApiKey" {
+		addPolicy("$authenticated,*,issue,allow")
+		addPolicy("$owner,*,revoke,allow")
 	}
 
 	loadedModel.CasbinModel = &casbModel
-	loadedModel.CasbinAdapter = &adapter
+	loadedModel.CasbinAdapter = adapter
 
-	err = adapter.SavePolicy(casbModel)
+	err := app.seedPolicies(adapter, casbModel)
 	if err != nil {
 		panic(err)
 	}
@@ -422,6 +541,19 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 		loadedModel.Observe("before save", func(ctx *model.EventContext) error {
 			data := ctx.Data
 
+			if config.Base == "ApiKey" {
+				err := checkApiKeyWrite(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			if config.Base == "User" {
+				err := checkMfaWrite(ctx)
+				if err != nil {
+					return err
+				}
+			}
+
 			if (*data)["modified"] == nil {
 				timeNow := time.Now()
 				(*data)["modified"] = timeNow
@@ -463,29 +595,19 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 						}
 					}
 
-					if (*data)["password"] == nil || strings.TrimSpace((*data)["password"].(string)) == "" {
-						return wst.CreateError(fiber.ErrBadRequest, "PASSWORD_BLANK", fiber.Map{"message": "Invalid password"}, "ValidationError")
-					}
-					hashed, err := bcrypt.GenerateFromPassword([]byte((*data)["password"].(string)), 10)
+					err := app.hashUserPassword(loadedModel, ctx)
 					if err != nil {
 						return err
 					}
-					(*data)["password"] = string(hashed)
 
-					if app.debug {
-						fmt.Printf("Create User: ('%v', '%v')\n", (*data)["username"], (*data)["email"])
-					}
+					ctx.Logger().Debug("Create user", "username", (*data)["username"], "email", (*data)["email"])
 				}
 
 			} else {
 				if config.Base == "User" {
-					if (*data)["password"] != nil && (*data)["password"] != "" {
-						log.Println("Update User password")
-						hashed, err := bcrypt.GenerateFromPassword([]byte((*data)["password"].(string)), 10)
-						if err != nil {
-							return err
-						}
-						(*data)["password"] = string(hashed)
+					err := app.hashUserPassword(loadedModel, ctx)
+					if err != nil {
+						return err
 					}
 				}
 			}
@@ -508,6 +630,10 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 			if err != nil {
 				return err
 			}
+			if inst == nil {
+				// also the instances of other tenants
+				return wst.CreateError(fiber.ErrNotFound, "NOT_FOUND", fiber.Map{"message": fmt.Sprintf("%v %v not found", loadedModel.Name, ctx.ModelID)}, "Error")
+			}
 
 			updated, err := inst.UpdateAttributes(ctx.Data, ctx)
 			if err != nil {
@@ -519,11 +645,15 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 		})
 
 		deleteByIdHandler := func(ctx *model.EventContext) error {
-			deleteResult, err := loadedModel.DeleteById(ctx.ModelID)
+			deleteResult, err := loadedModel.DeleteById(ctx.ModelID, ctx)
 			if err != nil {
 				return err
 			}
 			deletedCount := deleteResult.DeletedCount
+			if deletedCount == 0 {
+				// also the instances of other tenants, like in instance_updateAttributes
+				return wst.CreateError(fiber.ErrNotFound, "NOT_FOUND", fiber.Map{"message": fmt.Sprintf("%v %v not found", loadedModel.Name, ctx.ModelID)}, "Error")
+			}
 			if deletedCount != 1 {
 				return wst.CreateError(fiber.ErrBadRequest, "BAD_REQUEST", fiber.Map{"message": fmt.Sprintf("Deleted %v instances for %v", deletedCount, ctx.ModelID)}, "Error")
 			}
@@ -537,9 +667,7 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 }
 
 func handleFindMany(loadedModel *model.Model, ctx *model.EventContext) error {
-	if loadedModel.App.Debug {
-		fmt.Println("DEBUG: handleFindMany")
-	}
+	ctx.Logger().Debug("handleFindMany")
 
 	cursor := loadedModel.FindMany(ctx.Filter, ctx)
 
@@ -566,10 +694,20 @@ func handleFindMany(loadedModel *model.Model, ctx *model.EventContext) error {
 
 func (app *WeStack) asInterface() *wst.IApp {
 	return &wst.IApp{
-		Debug:        app.debug,
-		JwtSecretKey: app.jwtSecretKey,
-		Viper:        app.Viper,
-		Bson:         app.Bson,
+		Debug:              app.debug,
+		Logger:             app.logger,
+		JwtSecretKey:       app.jwtSecretKey,
+		JwtKeys:            app.jwtKeys,
+		IsTokenRevoked:     app.isTokenRevoked,
+		IsUserTokenRevoked: app.isUserTokenRevoked,
+		AuthenticateApiKey: app.authenticateApiKey,
+		UserRoles:          app.currentUserRoles,
+		IsTenantMember:     app.isTenantMember,
+		RecordAudit:        app.recordAudit,
+		UpdateAudit:        app.updateAudit,
+		RateLimiter:        app.rateLimiter,
+		Viper:              app.Viper,
+		Bson:               app.Bson,
 		FindModel: func(modelName string) (interface{}, error) {
 			return app.FindModel(modelName)
 		},
@@ -593,9 +731,7 @@ func fixRelations(loadedModel *model.Model) error {
 		relatedLoadedModel := (*loadedModel.GetModelRegistry())[relatedModelName]
 
 		if relatedLoadedModel == nil {
-			log.Println()
-			log.Printf("WARNING: related model %v not found for relation %v.%v", relatedModelName, loadedModel.Name, relationName)
-			log.Println()
+			loadedModel.Logger().Warn("Related model not found", "relation", relationName, "relatedModel", relatedModelName)
 			continue
 		}
 
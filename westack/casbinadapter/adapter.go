@@ -0,0 +1,177 @@
+package casbinadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	casbinmodel "github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// RulesCollection is the collection of the casbin rules. It is shared by all the models, whose rules are told apart
+// by the "model" property
+const RulesCollection = "CasbinRule"
+
+// ruleFields are the properties of the values of a rule, like the columns of the casbin CSV files
+var ruleFields = []string{"v0", "v1", "v2", "v3", "v4", "v5"}
+
+// Adapter stores the casbin rules of a model in a datasource. Each rule is a document, so that the enforcers with
+// auto-save add and remove single rules instead of rewriting all of them
+type Adapter struct {
+	Datasource *datasource.Datasource
+	// Model is the name of the model whose rules are stored
+	Model string
+}
+
+func NewAdapter(ds *datasource.Datasource, modelName string) *Adapter {
+	return &Adapter{Datasource: ds, Model: modelName}
+}
+
+// LoadPolicy loads all the rules of the model
+func (adapter *Adapter) LoadPolicy(model casbinmodel.Model) error {
+	ctx := context.Background()
+	cursor, err := adapter.Datasource.FindMany(ctx, RulesCollection, &wst.A{{"$match": wst.M{"model": adapter.Model}}})
+	if err != nil {
+		return err
+	}
+	var documents []wst.M
+	err = cursor.All(ctx, &documents)
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		line := []string{document.GetString("ptype")}
+		for _, field := range ruleFields {
+			value, ok := document[field].(string)
+			if !ok {
+				break
+			}
+			line = append(line, value)
+		}
+		err = persist.LoadPolicyArray(line, model)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePolicy replaces all the rules of the model
+func (adapter *Adapter) SavePolicy(model casbinmodel.Model) error {
+	_, err := adapter.Datasource.DeleteMany(context.Background(), RulesCollection, &wst.A{
+		{"$match": wst.M{"model": adapter.Model}},
+	})
+	if err != nil {
+		return err
+	}
+	for _, sec := range []string{"p", "g"} {
+		for ptype, assertion := range model[sec] {
+			err = adapter.AddPolicies(sec, ptype, assertion.Policy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SeedPolicy adds the rules of the model that are not stored yet, keeping the ones added at runtime. Unlike SavePolicy,
+// it never removes rules, so it is safe while other instances use them
+func (adapter *Adapter) SeedPolicy(model casbinmodel.Model) error {
+	for _, sec := range []string{"p", "g"} {
+		for ptype, assertion := range model[sec] {
+			err := adapter.AddPolicies(sec, ptype, assertion.Policy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddPolicy adds a rule. Adding a rule that is already stored, for example by another instance, is not an error
+func (adapter *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	if len(rule) > len(ruleFields) {
+		return fmt.Errorf("the rule %v has more than %v values", rule, len(ruleFields))
+	}
+	ctx := context.Background()
+	id := adapter.ruleId(ptype, rule)
+	document := wst.M{"_id": id, "model": adapter.Model, "ptype": ptype}
+	for i, value := range rule {
+		document[ruleFields[i]] = value
+	}
+	_, err := adapter.Datasource.Create(ctx, RulesCollection, &document)
+	if err != nil {
+		if stored, checkErr := adapter.isStored(ctx, id); checkErr == nil && stored {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (adapter *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	for _, rule := range rules {
+		err := adapter.AddPolicy(sec, ptype, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (adapter *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	_, err := adapter.Datasource.DeleteById(context.Background(), RulesCollection, adapter.ruleId(ptype, rule))
+	return err
+}
+
+func (adapter *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	for _, rule := range rules {
+		err := adapter.RemovePolicy(sec, ptype, rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveFilteredPolicy removes the rules whose values from fieldIndex are fieldValues. Empty values match any value
+func (adapter *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	if fieldIndex < 0 || fieldIndex+len(fieldValues) > len(ruleFields) {
+		return fmt.Errorf("invalid rule filter at %v with %v values", fieldIndex, len(fieldValues))
+	}
+	match := wst.M{"model": adapter.Model, "ptype": ptype}
+	for i, value := range fieldValues {
+		if value != "" {
+			match[ruleFields[fieldIndex+i]] = value
+		}
+	}
+	_, err := adapter.Datasource.DeleteMany(context.Background(), RulesCollection, &wst.A{{"$match": match}})
+	return err
+}
+
+// ruleId is the primary key of a rule, derived from its values so that the instances that add the same rule at the
+// same time do not store it twice
+func (adapter *Adapter) ruleId(ptype string, rule []string) string {
+	hash := sha256.Sum256([]byte(adapter.Model + "\x00" + ptype + "\x00" + strings.Join(rule, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+func (adapter *Adapter) isStored(ctx context.Context, id string) (bool, error) {
+	cursor, err := adapter.Datasource.FindMany(ctx, RulesCollection, &wst.A{{"$match": wst.M{"_id": id}}})
+	if err != nil {
+		return false, err
+	}
+	var documents []wst.M
+	err = cursor.All(ctx, &documents)
+	if err != nil {
+		return false, err
+	}
+	return len(documents) > 0, nil
+}
@@ -0,0 +1,165 @@
+package casbinadapter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// ChangesCollection is where the watchers publish that the rules of a model changed
+const ChangesCollection = "CasbinRuleChange"
+
+// minChangesRetention is how long the changes are kept at least, so that the clocks of the instances may differ a bit
+const minChangesRetention = time.Minute
+
+// Watcher tells the other instances of the app that the rules of a model changed, by storing a change in the
+// datasource, and polls the changes of the other instances every interval. Each change is a new document, so that
+// concurrent changes are never lost
+type Watcher struct {
+	datasource *datasource.Datasource
+	model      string
+	// origin identifies the changes of this instance, which are not notified back to it
+	origin    string
+	interval  time.Duration
+	retention time.Duration
+
+	mutex    sync.Mutex
+	callback func(string)
+	// seen are the changes already notified, with the local time when they were received
+	seen map[string]int64
+	stop chan struct{}
+}
+
+// NewWatcher starts polling the changes of the model. The changes that already exist are not notified, as the rules
+// are loaded after them
+func NewWatcher(ds *datasource.Datasource, modelName string, interval time.Duration) (*Watcher, error) {
+	retention := 10 * interval
+	if retention < minChangesRetention {
+		retention = minChangesRetention
+	}
+	watcher := &Watcher{
+		datasource: ds,
+		model:      modelName,
+		origin:     uuid.NewString(),
+		interval:   interval,
+		retention:  retention,
+		seen:       map[string]int64{},
+		stop:       make(chan struct{}),
+	}
+	_, err := watcher.poll()
+	if err != nil {
+		return nil, err
+	}
+	go watcher.run()
+	return watcher, nil
+}
+
+// SetUpdateCallback sets the function called when another instance changed the rules, usually to reload them
+func (watcher *Watcher) SetUpdateCallback(callback func(string)) error {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	watcher.callback = callback
+	return nil
+}
+
+// Update publishes a change of the rules of this instance
+func (watcher *Watcher) Update() error {
+	ctx := context.Background()
+	now := time.Now()
+	_, err := watcher.datasource.Create(ctx, ChangesCollection, &wst.M{
+		"_id":    uuid.NewString(),
+		"model":  watcher.model,
+		"origin": watcher.origin,
+		"at":     now.UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = watcher.datasource.DeleteMany(ctx, ChangesCollection, &wst.A{
+		{"$match": wst.M{"model": watcher.model, "at": wst.M{"$lt": now.Add(-watcher.retention).UnixMilli()}}},
+	})
+	return err
+}
+
+// Close stops the polling
+func (watcher *Watcher) Close() {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	select {
+	case <-watcher.stop:
+	default:
+		close(watcher.stop)
+	}
+}
+
+func (watcher *Watcher) run() {
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+			changed, err := watcher.poll()
+			if err != nil || !changed {
+				// a failed poll is retried on the next tick, and the changes are still there
+				continue
+			}
+			watcher.mutex.Lock()
+			callback := watcher.callback
+			watcher.mutex.Unlock()
+			if callback != nil {
+				callback(watcher.model)
+			}
+		}
+	}
+}
+
+// poll reports whether there are changes of other instances that were not seen yet
+func (watcher *Watcher) poll() (bool, error) {
+	ctx := context.Background()
+	since := time.Now().Add(-watcher.retention).UnixMilli()
+	cursor, err := watcher.datasource.FindMany(ctx, ChangesCollection, &wst.A{
+		{"$match": wst.M{
+			"model":  watcher.model,
+			"origin": wst.M{"$ne": watcher.origin},
+			"at":     wst.M{"$gte": since},
+		}},
+	})
+	if err != nil {
+		return false, err
+	}
+	var changes []wst.M
+	err = cursor.All(ctx, &changes)
+	if err != nil {
+		return false, err
+	}
+
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	changed := false
+	now := time.Now().UnixMilli()
+	polled := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		id := change.GetString("_id")
+		polled[id] = true
+		if _, ok := watcher.seen[id]; !ok {
+			watcher.seen[id] = now
+			changed = true
+		}
+	}
+	// the "at" of the changes comes from the clocks of the other instances, so a change is only forgotten once it was
+	// received longer than the retention ago, by the local clock, and it is no longer polled
+	receivedBefore := now - watcher.retention.Milliseconds()
+	for id, seenAt := range watcher.seen {
+		if seenAt < receivedBefore && !polled[id] {
+			delete(watcher.seen, id)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,107 @@
+package westack
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	casbinmodel "github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+
+	"github.com/fredyk/westack-go/westack/casbinadapter"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const defaultPoliciesSyncInterval = 5 * time.Second
+
+// loadPoliciesDatasource reads the "casbin.policies.datasource" datasource, where the casbin rules are stored instead
+// of the CSV files, so that they are shared by the instances of the app
+func (app *WeStack) loadPoliciesDatasource() {
+	dsName := app.Viper.GetString("casbin.policies.datasource")
+	if dsName == "" {
+		return
+	}
+	ds, err := app.FindDatasource(dsName)
+	if err != nil {
+		log.Fatalf("Invalid casbin.policies.datasource: %v", err)
+	}
+	app.policiesDatasource = ds
+}
+
+// newCasbinAdapter returns the adapter of the casbin rules of the model, which uses the policies datasource if any, or
+// a CSV file in "casbin.policies.outputDirectory"
+func (app *WeStack) newCasbinAdapter(loadedModel *model.Model) persist.Adapter {
+	if app.policiesDatasource != nil {
+		return casbinadapter.NewAdapter(app.policiesDatasource, loadedModel.Name)
+	}
+
+	basePoliciesDirectory := app.Viper.GetString("casbin.policies.outputDirectory")
+	_, err := os.Stat(basePoliciesDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(basePoliciesDirectory, os.ModePerm)
+			if err != nil {
+				panic(err)
+			}
+		} else {
+			panic(err)
+		}
+	}
+
+	f, err := os.OpenFile(fmt.Sprintf("%v/%v.policies.csv", basePoliciesDirectory, loadedModel.Name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = f.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	return fileadapter.NewAdapter(fmt.Sprintf("%v/%v.policies.csv", basePoliciesDirectory, loadedModel.Name))
+}
+
+// seedPolicies stores the rules of the config. The policies datasource is shared with the other instances and keeps the
+// rules added at runtime, so only the missing rules are added. Every instance adds the rules of its own config, so they
+// are not notified to the others. The CSV file is rewritten with the rules of the config
+func (app *WeStack) seedPolicies(adapter persist.Adapter, casbModel casbinmodel.Model) error {
+	if datasourceAdapter, ok := adapter.(*casbinadapter.Adapter); ok {
+		return datasourceAdapter.SeedPolicy(casbModel)
+	}
+	return adapter.SavePolicy(casbModel)
+}
+
+// watchPolicies reloads the casbin rules of the model when another instance of the app changes them, checking every
+// "casbin.policies.syncInterval" seconds. A negative interval disables it
+func (app *WeStack) watchPolicies(loadedModel *model.Model) {
+	if app.policiesDatasource == nil {
+		return
+	}
+	interval := defaultPoliciesSyncInterval
+	if app.Viper.IsSet("casbin.policies.syncInterval") {
+		interval = time.Duration(app.Viper.GetFloat64("casbin.policies.syncInterval") * float64(time.Second))
+	}
+	if interval <= 0 {
+		return
+	}
+	watcher, err := casbinadapter.NewWatcher(app.policiesDatasource, loadedModel.Name, interval)
+	if err != nil {
+		panic(err)
+	}
+	err = loadedModel.Enforcer.SetWatcher(watcher)
+	if err != nil {
+		panic(err)
+	}
+	err = watcher.SetUpdateCallback(func(string) {
+		err := loadedModel.ReloadPolicy()
+		if err != nil {
+			loadedModel.Logger().Error("Could not reload the casbin rules", "error", err)
+		} else {
+			loadedModel.Logger().Debug("Reloaded the casbin rules changed by another instance")
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+}
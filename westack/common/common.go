@@ -1,14 +1,17 @@
 package wst
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/fredyk/westack-go/westack/jwtkeys"
 	"github.com/fredyk/westack-go/westack/lib/swaggerhelperinterface"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/ratelimit"
 	"github.com/mailru/easyjson/jlexer"
 
 	"github.com/goccy/go-json"
@@ -204,7 +207,7 @@ func AFromGenericSlice(in *[]interface{}) *A {
 		if vv, ok := inDoc.(M); ok {
 			out[idx] = vv
 		} else {
-			log.Println("ERROR: AFromGenericSlice: not an M")
+			logging.Default().Error("AFromGenericSlice: not an M", "type", fmt.Sprintf("%T", inDoc))
 			out[idx] = M{}
 		}
 	}
@@ -234,7 +237,7 @@ func AFromPrimitiveSlice(in *primitive.A) *A {
 		} else if vv, ok := inDoc.(M); ok {
 			out[idx] = vv
 		} else {
-			log.Println("ERROR: AFromPrimitiveSlice: not a primitive.M")
+			logging.Default().Error("AFromPrimitiveSlice: not a primitive.M", "type", fmt.Sprintf("%T", inDoc))
 			out[idx] = M{}
 		}
 	}
@@ -271,13 +274,34 @@ type BsonOptions struct {
 }
 
 type IApp struct {
+	// Debug is true when the app logger writes debug lines
 	Debug          bool
+	Logger         logging.Logger
 	SwaggerHelper  func() swaggerhelperinterface.SwaggerHelper
 	FindModel      func(modelName string) (interface{}, error)
 	FindDatasource func(datasource string) (interface{}, error)
 	JwtSecretKey   []byte
-	Viper          *viper.Viper
-	Bson           BsonOptions
+	// JwtKeys signs the tokens and selects the key that verifies them
+	JwtKeys *jwtkeys.KeySet
+	// IsTokenRevoked reports whether the token with the given "jti" claim was revoked
+	IsTokenRevoked func(ctx context.Context, jti string) (bool, error)
+	// IsUserTokenRevoked reports whether the token of the claims was issued before the tokens of its user were revoked
+	IsUserTokenRevoked func(ctx context.Context, claims M) (bool, error)
+	// AuthenticateApiKey returns the claims of the bearer of an API key, or nil if the key is not valid
+	AuthenticateApiKey func(ctx context.Context, rawKey string) (M, error)
+	// UserRoles returns the current roles of a user in a tenant, "" for none, which replace the ones of the claims of
+	// the access tokens
+	UserRoles func(ctx context.Context, userId string, tenant string) ([]string, error)
+	// IsTenantMember reports whether the user was assigned a role in the tenant, which allows it to request the tenant
+	IsTenantMember func(ctx context.Context, userId string, tenant string) (bool, error)
+	// RecordAudit stores an entry of the audit log, for the models with the "audit" option
+	RecordAudit func(ctx context.Context, entry M) error
+	// UpdateAudit sets fields of an entry of the audit log, to complete it once the operation is performed
+	UpdateAudit func(ctx context.Context, entryId string, fields M) error
+	// RateLimiter counts the failed logins and the requests of the remote methods with a RateLimit
+	RateLimiter *ratelimit.Limiter
+	Viper       *viper.Viper
+	Bson        BsonOptions
 }
 
 var RegexpIdEntire = regexp.MustCompile("^([0-9a-f]{24})$")
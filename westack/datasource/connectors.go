@@ -2,6 +2,8 @@ package datasource
 
 import (
 	"context"
+	"sync"
+
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/spf13/viper"
 )
@@ -19,20 +21,19 @@ type PersistedConnector interface {
 	SetConfig(dsViper *viper.Viper)
 	// Connect Connects to the datasource
 	Connect(parentContext context.Context) error
-	// FindMany Finds many documents in the datasource
-	FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error)
-	// findObjectById Finds a document in the datasource
-	findByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error)
+	// FindMany Finds many documents in the datasource. The operations must give up and return ctx.Err() when ctx is
+	// done, so that the requests can be cancelled
+	FindMany(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error)
 	// Count Counts documents in the datasource
-	Count(collectionName string, lookups *wst.A) (int64, error)
+	Count(ctx context.Context, collectionName string, lookups *wst.A) (int64, error)
 	// Create Creates a document in the datasource
-	Create(collectionName string, data *wst.M) (*wst.M, error)
+	Create(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error)
 	// UpdateById Updates a document in the datasource
-	UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error)
+	UpdateById(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error)
 	// DeleteById Deletes a document in the datasource
-	DeleteById(collectionName string, id interface{}) (DeleteResult, error)
+	DeleteById(ctx context.Context, collectionName string, id interface{}) (DeleteResult, error)
 	// DeleteMany Deletes many documents in the datasource
-	DeleteMany(collectionName string, whereLookups *wst.A) (DeleteResult, error)
+	DeleteMany(ctx context.Context, collectionName string, whereLookups *wst.A) (DeleteResult, error)
 	// Disconnect Disconnects from the datasource
 	Disconnect() error
 	// Ping Pings the datasource
@@ -42,3 +43,54 @@ type PersistedConnector interface {
 	// SetTimeout Sets the timeout for the datasource
 	SetTimeout(seconds float32)
 }
+
+// LocalConnector is implemented by the connectors that keep their data in the process or in local files.
+// Their connection cannot be lost, so the datasource does not monitor it
+type LocalConnector interface {
+	IsLocal() bool
+}
+
+// ConnectorFactory creates a connector for the datasource dsKey. cfg is the configuration of the datasource, and
+// opts the options passed to the app, which can be nil
+type ConnectorFactory func(dsKey string, cfg *viper.Viper, opts *Options) (PersistedConnector, error)
+
+var connectorFactories = map[string]ConnectorFactory{}
+var connectorFactoriesLock sync.RWMutex
+
+// RegisterConnector makes a connector available to the datasources with "connector": name in datasources.json.
+// Registering the same name twice replaces the previous factory, so the built-in connectors can be overridden
+func RegisterConnector(name string, factory ConnectorFactory) {
+	if factory == nil {
+		panic("datasource: RegisterConnector factory is nil for connector " + name)
+	}
+	connectorFactoriesLock.Lock()
+	defer connectorFactoriesLock.Unlock()
+	connectorFactories[name] = factory
+}
+
+// IsConnectorRegistered returns whether a connector with the given name was registered
+func IsConnectorRegistered(name string) bool {
+	connectorFactoriesLock.RLock()
+	defer connectorFactoriesLock.RUnlock()
+	_, ok := connectorFactories[name]
+	return ok
+}
+
+func init() {
+	RegisterConnector("mongodb", func(dsKey string, cfg *viper.Viper, opts *Options) (PersistedConnector, error) {
+		var mongoOptions *MongoDBDatasourceOptions
+		if opts != nil {
+			mongoOptions = opts.MongoDB
+		}
+		return NewMongoDBConnector(mongoOptions), nil
+	})
+	RegisterConnector("memorykv", func(dsKey string, cfg *viper.Viper, opts *Options) (PersistedConnector, error) {
+		return NewMemoryKVConnector(dsKey), nil
+	})
+	RegisterConnector("sql", func(dsKey string, cfg *viper.Viper, opts *Options) (PersistedConnector, error) {
+		return NewSQLConnector(), nil
+	})
+	RegisterConnector("file", func(dsKey string, cfg *viper.Viper, opts *Options) (PersistedConnector, error) {
+		return NewFileConnector(dsKey), nil
+	})
+}
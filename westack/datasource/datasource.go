@@ -3,17 +3,24 @@ package datasource
 import (
 	"context"
 	"errors"
-	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/metrics"
 	"github.com/spf13/viper"
 )
 
+var datasourceOperationDuration = metrics.DefaultRegistry.NewHistogramVec("westack_datasource_operation_duration_seconds", "Latency of the datasource operations", nil, "datasource", "operation")
+var datasourceOperationErrors = metrics.DefaultRegistry.NewCounterVec("westack_datasource_operation_errors_total", "Datasource operations that returned an error", "datasource", "operation")
+
 type Options struct {
+	// RetryOnError is kept for compatibility. Datasources always retry to reconnect now, see HealthCheck
 	RetryOnError bool
 	MongoDB      *MongoDBDatasourceOptions
+	// HealthCheck configures the connection monitor and the circuit breaker of the datasource
+	HealthCheck *HealthCheckOptions
 }
 
 type Datasource struct {
@@ -27,21 +34,25 @@ type Datasource struct {
 	ctxCancelFn       context.CancelFunc
 	SubViper          *viper.Viper
 	connectorInstance PersistedConnector
+
+	healthLock      sync.RWMutex
+	health          HealthStatus
+	monitorCancelFn context.CancelFunc
+	monitorDone     chan struct{}
 }
 
 func getConnectorByName(name string, dsKey string, dsViper *viper.Viper, options *Options) (PersistedConnector, error) {
-	switch name {
-	case "mongodb":
-		var mongoOptions *MongoDBDatasourceOptions
-		if options != nil {
-			mongoOptions = options.MongoDB
-		}
-		return NewMongoDBConnector(mongoOptions), nil
-	case "memorykv":
-		return NewMemoryKVConnector(dsKey), nil
-	default:
+	connectorFactoriesLock.RLock()
+	factory, ok := connectorFactories[name]
+	connectorFactoriesLock.RUnlock()
+	if !ok {
 		return nil, errors.New("invalid connector " + name)
 	}
+	connector, err := factory(dsKey, dsViper, options)
+	if err == nil && connector == nil {
+		err = errors.New("connector factory returned nil for " + name)
+	}
+	return connector, err
 }
 
 func (ds *Datasource) Initialize() error {
@@ -54,86 +65,87 @@ func (ds *Datasource) Initialize() error {
 		return err
 	}
 	connector.SetConfig(dsViper)
-	fmt.Printf("Connecting to datasource %v...\n", ds.Key)
+	logger := ds.logger()
+	logger.Info("Connecting to datasource", "connector", connectorName)
 	err = connector.Connect(ds.Context)
 	if err != nil {
-		fmt.Printf("Could not connect to datasource %v: %v\n", ds.Key, err)
+		logger.Error("Could not connect to datasource", "error", err)
 		return err
 	} else {
-		fmt.Printf("DEBUG: Connected to datasource %v\n", ds.Key)
+		logger.Debug("Connected to datasource")
 	}
 
-	fmt.Printf("Pinging datasource %v...\n", ds.Key)
+	pingStart := time.Now()
 	err = connector.Ping(ds.Context)
 	if err != nil {
-		fmt.Printf("Could not ping datasource %v: %v\n", ds.Key, err)
+		logger.Error("Could not ping datasource", "error", err)
 		return err
 	} else {
-		fmt.Printf("DEBUG: Ping result OK for datasource %v\n", ds.Key)
+		logger.Debug("Ping result OK", "latency", time.Since(pingStart))
 		ds.Db = connector.GetClient()
 	}
 
-	// Start a goroutine to reconnect to the datasource if it gets disconnected
-	init := time.Now().UnixMilli()
-	go func() {
-		initialCtx := ds.Context
-		for {
-			time.Sleep(time.Second * 5)
-
-			err := connector.Ping(initialCtx)
-			if err != nil {
-				log.Printf("Reconnecting datasource %v...\n", ds.Key)
-				err := connector.Connect(initialCtx)
-				if err != nil {
-					if ds.Options == nil || !ds.Options.RetryOnError {
-						log.Fatalf("Could not reconnect %v: %v\n", ds.Key, err)
-					}
-				} else {
-					err = connector.Ping(initialCtx)
-					if err != nil {
-						if ds.Options == nil || !ds.Options.RetryOnError {
-							log.Fatalf("Mongo client disconnected after %vms: %v", time.Now().UnixMilli()-init, err)
-						}
-					} else {
-						log.Printf("successfully reconnected to %v\n", ds.Key)
-						ds.Db = connector.GetClient()
-					}
-				}
-			}
-		}
-	}()
-
 	ds.connectorInstance = connector
+	ds.recordCheck(nil, time.Since(pingStart), 0)
+	if local, ok := connector.(LocalConnector); ok && local.IsLocal() {
+		return nil
+	}
+
+	// Monitor the connection and reconnect the datasource if it gets disconnected
+	ds.startMonitor(connector, resolveHealthCheckOptions(dsViper, ds.Options))
+
 	return nil
 }
 
 // FindMany retrieves data from the specified collection based on the provided lookup conditions using the appropriate
 // data source connector specified in the configuration file.
+// @param ctx context.Context: cancels the query, like when the request times out. The mongodb cursor keeps using it.
 // @param collectionName string: the name of the collection from which to retrieve data.
 // @param lookups *wst.A: a pointer to an array of conditions to be used as lookup criteria. If nil, all data in the
 // collection will be returned.
 // @return MongoCursorI: a cursor to the result set that matches the lookup criteria, or an error if an error occurs
 // while attempting to retrieve the data.
 // The cursor needs to be closed outside of the function.
-// Implementations for Redis and memorykv connectors are not yet implemented and will result in an error.
-func (ds *Datasource) FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error) {
-	return ds.connectorInstance.FindMany(collectionName, lookups)
+// The memorykv connector evaluates the stages in memory, and the sql connector translates the leading $match, $sort,
+// $skip and $limit stages to SQL. Both support the subset of stages generated by Model.ExtractLookupsFromFilter.
+func (ds *Datasource) FindMany(ctx context.Context, collectionName string, lookups *wst.A) (cursor MongoCursorI, err error) {
+	defer ds.observeOperation("findMany", time.Now(), &err)
+	if err = ds.checkOperation(ctx); err != nil {
+		return nil, err
+	}
+	return ds.connectorInstance.FindMany(ctx, collectionName, lookups)
 }
 
-func (ds *Datasource) Count(collectionName string, lookups *wst.A) (int64, error) {
-	return ds.connectorInstance.Count(collectionName, lookups)
+func (ds *Datasource) Count(ctx context.Context, collectionName string, lookups *wst.A) (count int64, err error) {
+	defer ds.observeOperation("count", time.Now(), &err)
+	if err = ds.checkOperation(ctx); err != nil {
+		return 0, err
+	}
+	return ds.connectorInstance.Count(ctx, collectionName, lookups)
 }
 
-func (ds *Datasource) Create(collectionName string, data *wst.M) (*wst.M, error) {
-	return ds.connectorInstance.Create(collectionName, data)
+func (ds *Datasource) Create(ctx context.Context, collectionName string, data *wst.M) (created *wst.M, err error) {
+	defer ds.observeOperation("create", time.Now(), &err)
+	if err = ds.checkOperation(ctx); err != nil {
+		return nil, err
+	}
+	return ds.connectorInstance.Create(ctx, collectionName, data)
 }
 
-func (ds *Datasource) UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
-	return ds.connectorInstance.UpdateById(collectionName, id, data)
+func (ds *Datasource) UpdateById(ctx context.Context, collectionName string, id interface{}, data *wst.M) (updated *wst.M, err error) {
+	defer ds.observeOperation("updateById", time.Now(), &err)
+	if err = ds.checkOperation(ctx); err != nil {
+		return nil, err
+	}
+	return ds.connectorInstance.UpdateById(ctx, collectionName, id, data)
 }
 
-func (ds *Datasource) DeleteById(collectionName string, id interface{}) (DeleteResult, error) {
-	return ds.connectorInstance.DeleteById(collectionName, id)
+func (ds *Datasource) DeleteById(ctx context.Context, collectionName string, id interface{}) (result DeleteResult, err error) {
+	defer ds.observeOperation("deleteById", time.Now(), &err)
+	if err = ds.checkOperation(ctx); err != nil {
+		return DeleteResult{}, err
+	}
+	return ds.connectorInstance.DeleteById(ctx, collectionName, id)
 }
 
 // whereLookups is in the form of
@@ -148,7 +160,8 @@ func (ds *Datasource) DeleteById(collectionName string, id interface{}) (DeleteR
 // ]
 // and is used to filter the documents to delete.
 // It cannot be nil or empty.
-func (ds *Datasource) DeleteMany(collectionName string, whereLookups *wst.A) (result DeleteResult, err error) {
+func (ds *Datasource) DeleteMany(ctx context.Context, collectionName string, whereLookups *wst.A) (result DeleteResult, err error) {
+	defer ds.observeOperation("deleteMany", time.Now(), &err)
 	if whereLookups == nil {
 		return result, errors.New("whereLookups cannot be nil")
 	}
@@ -167,22 +180,46 @@ func (ds *Datasource) DeleteMany(collectionName string, whereLookups *wst.A) (re
 	if len((*whereLookups)[0]["$match"].(wst.M)) == 0 {
 		return result, errors.New("first element of whereLookups must be a single and non-empty $match stage")
 	}
+	if err = ds.checkOperation(ctx); err != nil {
+		return result, err
+	}
+
+	return ds.connectorInstance.DeleteMany(ctx, collectionName, whereLookups)
 
-	return ds.connectorInstance.DeleteMany(collectionName, whereLookups)
+}
 
+// checkOperation fails fast when ctx is already done or the circuit is open
+func (ds *Datasource) checkOperation(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ds.checkCircuit()
+}
+
+func (ds *Datasource) observeOperation(operation string, start time.Time, err *error) {
+	datasourceOperationDuration.Observe(time.Since(start).Seconds(), ds.Name, operation)
+	if *err != nil {
+		datasourceOperationErrors.Inc(ds.Name, operation)
+	}
 }
 
 func (ds *Datasource) Close() error {
+	ds.stopMonitor()
 	err := ds.connectorInstance.Disconnect()
 	if err != nil {
-		fmt.Printf("ERROR: Could not close datasource %v: %v\n", ds.Key, err)
+		ds.logger().Error("Could not close datasource", "error", err)
 		return err
 	}
 	ds.ctxCancelFn()
-	fmt.Printf("INFO: Closed datasource %v\n", ds.Key)
+	ds.logger().Info("Closed datasource")
 	return nil
 }
 
+// logger is the default logger with the datasource key, as datasources are not bound to an app
+func (ds *Datasource) logger() logging.Logger {
+	return logging.Default().With("datasource", ds.Key)
+}
+
 func (ds *Datasource) SetTimeout(seconds float32) {
 	ds.connectorInstance.SetTimeout(seconds)
 }
@@ -0,0 +1,485 @@
+package datasource
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FileConnector implements the PersistedConnector interface storing each collection as a file under a directory.
+// Collections are loaded in memory the first time they are used, the pipelines are evaluated like in the memorykv
+// connector, and every write rewrites the whole file. It is meant for development and tests, not for big datasets.
+// Datasource config:
+//
+//	{
+//	  "connector": "file",
+//	  "directory": "data", // optional, defaults to data/<datasource key>
+//	  "format": "json" // optional, one of json (relaxed extended JSON) or bson
+//	}
+type FileConnector struct {
+	dsKey     string
+	dsViper   *viper.Viper
+	directory string
+	format    string
+
+	// lock protects collections and the files
+	lock        sync.Mutex
+	collections map[string]*fileCollection
+}
+
+type fileCollection struct {
+	// keys keeps the insertion order, which is the natural order of the results
+	keys      []string
+	documents map[string]bson.Raw
+}
+
+// clone returns a copy of the collection to apply a write to, so that the loaded collection only changes once the write
+// is persisted
+func (collection *fileCollection) clone() *fileCollection {
+	documents := make(map[string]bson.Raw, len(collection.documents)+1)
+	for key, rawDocument := range collection.documents {
+		documents[key] = rawDocument
+	}
+	return &fileCollection{keys: append([]string(nil), collection.keys...), documents: documents}
+}
+
+func (connector *FileConnector) GetName() string {
+	return "file"
+}
+
+func (connector *FileConnector) SetConfig(dsViper *viper.Viper) {
+	connector.dsViper = dsViper
+}
+
+func (connector *FileConnector) Connect(parentContext context.Context) error {
+	connector.directory = connector.dsViper.GetString("directory")
+	if connector.directory == "" {
+		connector.directory = filepath.Join("data", connector.dsKey)
+	}
+	connector.format = connector.dsViper.GetString("format")
+	if connector.format == "" {
+		connector.format = "json"
+	}
+	if connector.format != "json" && connector.format != "bson" {
+		return fmt.Errorf("invalid format %v for file datasource %v", connector.format, connector.dsKey)
+	}
+	err := os.MkdirAll(connector.directory, 0755)
+	if err != nil {
+		return err
+	}
+	connector.lock.Lock()
+	connector.collections = make(map[string]*fileCollection)
+	connector.lock.Unlock()
+	return nil
+}
+
+// IsLocal implements LocalConnector
+func (connector *FileConnector) IsLocal() bool {
+	return true
+}
+
+func (connector *FileConnector) collectionPath(collectionName string) (string, error) {
+	if collectionName == "" || filepath.Base(collectionName) != collectionName || collectionName == "." || collectionName == ".." {
+		return "", fmt.Errorf("invalid collection name %q", collectionName)
+	}
+	return filepath.Join(connector.directory, collectionName+"."+connector.format), nil
+}
+
+// getCollection must be called with connector.lock held
+func (connector *FileConnector) getCollection(collectionName string) (*fileCollection, error) {
+	if connector.collections == nil {
+		return nil, errors.New("the file datasource is closed")
+	}
+	if collection, ok := connector.collections[collectionName]; ok {
+		return collection, nil
+	}
+	path, err := connector.collectionPath(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	collection := &fileCollection{documents: make(map[string]bson.Raw)}
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		var rawDocuments []bson.Raw
+		if connector.format == "json" {
+			rawDocuments, err = decodeJSONCollection(content)
+		} else {
+			rawDocuments, err = decodeBSONCollection(content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %w", path, err)
+		}
+		for _, rawDocument := range rawDocuments {
+			var _id interface{}
+			rawId, err := rawDocument.LookupErr("_id")
+			if err == nil {
+				err = rawId.Unmarshal(&_id)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not read _id of a document in %v: %w", path, err)
+			}
+			key := idToKey(_id)
+			if _, exists := collection.documents[key]; !exists {
+				collection.keys = append(collection.keys, key)
+			}
+			collection.documents[key] = rawDocument
+		}
+	}
+	connector.collections[collectionName] = collection
+	return collection, nil
+}
+
+// commit persists the new state of a collection and then replaces the loaded one with it, so that a failed write leaves
+// the collection as it is in the file. It must be called with connector.lock held
+func (connector *FileConnector) commit(collectionName string, next *fileCollection) error {
+	err := connector.persist(collectionName, next)
+	if err != nil {
+		return err
+	}
+	connector.collections[collectionName] = next
+	return nil
+}
+
+// persist writes the collection to a temporary file and then renames it, so the file is never left half written.
+// It must be called with connector.lock held
+func (connector *FileConnector) persist(collectionName string, collection *fileCollection) error {
+	path, err := connector.collectionPath(collectionName)
+	if err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if connector.format == "json" {
+		content.WriteString("[")
+		for idx, key := range collection.keys {
+			encoded, err := bson.MarshalExtJSON(collection.documents[key], false, false)
+			if err != nil {
+				return err
+			}
+			if idx > 0 {
+				content.WriteString(",")
+			}
+			content.WriteString("\n  ")
+			content.Write(encoded)
+		}
+		content.WriteString("\n]\n")
+	} else {
+		for _, key := range collection.keys {
+			content.Write(collection.documents[key])
+		}
+	}
+	tmpFile, err := os.CreateTemp(connector.directory, collectionName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(content.Bytes())
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+func decodeJSONCollection(content []byte) ([]bson.Raw, error) {
+	var items []json.RawMessage
+	err := json.Unmarshal(content, &items)
+	if err != nil {
+		return nil, err
+	}
+	rawDocuments := make([]bson.Raw, len(items))
+	for idx, item := range items {
+		err = bson.UnmarshalExtJSON(item, false, &rawDocuments[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rawDocuments, nil
+}
+
+func decodeBSONCollection(content []byte) ([]bson.Raw, error) {
+	var rawDocuments []bson.Raw
+	for len(content) > 0 {
+		if len(content) < 4 {
+			return nil, errors.New("truncated bson document")
+		}
+		length := int(binary.LittleEndian.Uint32(content[:4]))
+		if length < 5 || length > len(content) {
+			return nil, errors.New("truncated bson document")
+		}
+		rawDocument := bson.Raw(content[:length])
+		err := rawDocument.Validate()
+		if err != nil {
+			return nil, err
+		}
+		rawDocuments = append(rawDocuments, rawDocument)
+		content = content[length:]
+	}
+	return rawDocuments, nil
+}
+
+// loadDocuments decodes a snapshot of the collection, so that the pipeline is evaluated without holding the lock
+func (connector *FileConnector) loadDocuments(collectionName string) ([]wst.M, error) {
+	connector.lock.Lock()
+	collection, err := connector.getCollection(collectionName)
+	if err != nil {
+		connector.lock.Unlock()
+		return nil, err
+	}
+	rawDocuments := make([]bson.Raw, len(collection.keys))
+	for idx, key := range collection.keys {
+		rawDocuments[idx] = collection.documents[key]
+	}
+	connector.lock.Unlock()
+
+	documents := make([]wst.M, len(rawDocuments))
+	for idx, rawDocument := range rawDocuments {
+		err := bson.Unmarshal(rawDocument, &documents[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return documents, nil
+}
+
+// findDocuments evaluates the pipeline in memory. $lookup stages are resolved against the other collections of the
+// same directory
+func (connector *FileConnector) findDocuments(ctx context.Context, collectionName string, pipeline wst.A) ([]wst.M, error) {
+	// checked on every $lookup resolution too, which runs once per document
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	documents, err := connector.loadDocuments(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	return evaluatePipeline(documents, pipeline, func(collectionName string, pipeline wst.A) ([]wst.M, error) {
+		return connector.findDocuments(ctx, collectionName, pipeline)
+	})
+}
+
+func (connector *FileConnector) FindMany(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	var pipeline wst.A
+	if lookups != nil {
+		pipeline = *lookups
+	}
+	results, err := connector.findDocuments(ctx, collectionName, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	rawResults := make([][]byte, len(results))
+	for idx, result := range results {
+		rawResults[idx], err = bson.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewFixedMongoCursor(rawResults), nil
+}
+
+func (connector *FileConnector) findByObjectId(ctx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	wrappedLookups := wst.A{{"$match": wst.M{"_id": _id}}}
+	if lookups != nil {
+		wrappedLookups = append(wrappedLookups, *lookups...)
+	}
+	results, err := connector.findDocuments(ctx, collectionName, wrappedLookups)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("document not found")
+	}
+	return &results[0], nil
+}
+
+func (connector *FileConnector) Count(ctx context.Context, collectionName string, lookups *wst.A) (int64, error) {
+	var pipeline wst.A
+	if lookups != nil {
+		pipeline = *lookups
+	}
+	results, err := connector.findDocuments(ctx, collectionName, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(results)), nil
+}
+
+// Create stores the document under its "_id", generating a new ObjectID if not present
+func (connector *FileConnector) Create(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	data = documentToCreate(data)
+	rawDocument, err := bson.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	connector.lock.Lock()
+	collection, err := connector.getCollection(collectionName)
+	if err != nil {
+		connector.lock.Unlock()
+		return nil, err
+	}
+	key := idToKey((*data)["_id"])
+	if _, exists := collection.documents[key]; exists {
+		connector.lock.Unlock()
+		return nil, fmt.Errorf("duplicate key error: %v already exists in %v", key, collectionName)
+	}
+	next := collection.clone()
+	next.keys = append(next.keys, key)
+	next.documents[key] = rawDocument
+	err = connector.commit(collectionName, next)
+	connector.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return connector.findByObjectId(ctx, collectionName, (*data)["_id"], nil)
+}
+
+func (connector *FileConnector) UpdateById(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	delete(*data, "id")
+	delete(*data, "_id")
+
+	connector.lock.Lock()
+	collection, err := connector.getCollection(collectionName)
+	if err != nil {
+		connector.lock.Unlock()
+		return nil, err
+	}
+	key := idToKey(id)
+	current, exists := collection.documents[key]
+	if !exists {
+		connector.lock.Unlock()
+		return nil, errors.New("document not found")
+	}
+	var document wst.M
+	err = bson.Unmarshal(current, &document)
+	if err == nil {
+		for k, v := range *data {
+			document[k] = v
+		}
+		next := collection.clone()
+		next.documents[key], err = bson.Marshal(document)
+		if err == nil {
+			err = connector.commit(collectionName, next)
+		}
+	}
+	connector.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return connector.findByObjectId(ctx, collectionName, id, nil)
+}
+
+// deleteKeys must be called with connector.lock held
+func (connector *FileConnector) deleteKeys(collectionName string, collection *fileCollection, keys map[string]bool) (DeleteResult, error) {
+	var result DeleteResult
+	next := collection.clone()
+	next.keys = next.keys[:0]
+	for _, key := range collection.keys {
+		if keys[key] {
+			delete(next.documents, key)
+			result.DeletedCount++
+		} else {
+			next.keys = append(next.keys, key)
+		}
+	}
+	if result.DeletedCount == 0 {
+		return result, nil
+	}
+	err := connector.commit(collectionName, next)
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	return result, nil
+}
+
+func (connector *FileConnector) DeleteById(ctx context.Context, collectionName string, id interface{}) (DeleteResult, error) {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	collection, err := connector.getCollection(collectionName)
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	return connector.deleteKeys(collectionName, collection, map[string]bool{idToKey(id): true})
+}
+
+func (connector *FileConnector) DeleteMany(ctx context.Context, collectionName string, whereLookups *wst.A) (DeleteResult, error) {
+	where, ok := toM((*whereLookups)[0]["$match"])
+	if !ok {
+		return DeleteResult{}, errors.New("invalid $match stage")
+	}
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	collection, err := connector.getCollection(collectionName)
+	if err != nil {
+		return DeleteResult{}, err
+	}
+	keysToDelete := make(map[string]bool)
+	for key, rawDocument := range collection.documents {
+		var document wst.M
+		err := bson.Unmarshal(rawDocument, &document)
+		if err != nil {
+			return DeleteResult{}, err
+		}
+		matches, err := matchesWhere(document, where)
+		if err != nil {
+			return DeleteResult{}, err
+		}
+		if matches {
+			keysToDelete[key] = true
+		}
+	}
+	return connector.deleteKeys(collectionName, collection, keysToDelete)
+}
+
+func (connector *FileConnector) Disconnect() error {
+	// every write is already persisted, so only the loaded collections are released until it connects again
+	connector.lock.Lock()
+	connector.collections = nil
+	connector.lock.Unlock()
+	return nil
+}
+
+func (connector *FileConnector) Ping(parentCtx context.Context) error {
+	info, err := os.Stat(connector.directory)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", connector.directory)
+	}
+	return nil
+}
+
+func (connector *FileConnector) SetTimeout(seconds float32) {
+	// We don't need to set timeout for files
+}
+
+func (connector *FileConnector) GetClient() interface{} {
+	return connector.directory
+}
+
+// NewFileConnector Factory method for FileConnector
+func NewFileConnector(dsKey string) PersistedConnector {
+	return &FileConnector{
+		dsKey: dsKey,
+	}
+}
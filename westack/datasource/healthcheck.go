@@ -0,0 +1,242 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// CircuitState is the state of the circuit breaker of a datasource
+type CircuitState int
+
+const (
+	// CircuitClosed means the datasource is healthy and operations are allowed
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means the datasource failed too many consecutive health checks. Operations fail fast with
+	// ErrCircuitOpen until a reconnection succeeds
+	CircuitOpen
+	// CircuitHalfOpen means the datasource is trying to reconnect after being open
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(state))
+	}
+}
+
+// ErrCircuitOpen is returned by the datasource operations while the circuit breaker is open
+var ErrCircuitOpen = errors.New("datasource circuit breaker is open")
+
+// HealthCheckOptions configures how a datasource monitors its connection. Zero values take the defaults.
+// They can also be set in datasources.json with the keys "healthCheckInterval" and "reconnectMaxBackoff", in
+// seconds, and "circuitBreakerThreshold"
+type HealthCheckOptions struct {
+	// Interval between two pings while the datasource is healthy. Defaults to 5 seconds
+	Interval time.Duration
+	// MaxBackoff caps the exponential delay between reconnection attempts. Defaults to 1 minute
+	MaxBackoff time.Duration
+	// FailureThreshold is the number of consecutive failed checks that opens the circuit. Defaults to 3
+	FailureThreshold int
+}
+
+// HealthStatus is a snapshot of the health of a datasource
+type HealthStatus struct {
+	State               CircuitState
+	ConsecutiveFailures int
+	// LastError is the error of the last failed check, or nil after a successful one
+	LastError error
+	// LastCheck is the time of the last check, zero if the datasource was never checked
+	LastCheck time.Time
+	// LastLatency is the duration of the last successful ping
+	LastLatency time.Duration
+}
+
+const (
+	defaultHealthCheckInterval     = 5 * time.Second
+	defaultReconnectMaxBackoff     = time.Minute
+	defaultCircuitBreakerThreshold = 3
+)
+
+func resolveHealthCheckOptions(dsViper *viper.Viper, options *Options) HealthCheckOptions {
+	resolved := HealthCheckOptions{
+		Interval:         defaultHealthCheckInterval,
+		MaxBackoff:       defaultReconnectMaxBackoff,
+		FailureThreshold: defaultCircuitBreakerThreshold,
+	}
+	if dsViper.IsSet("healthCheckInterval") {
+		resolved.Interval = time.Duration(dsViper.GetFloat64("healthCheckInterval") * float64(time.Second))
+	}
+	if dsViper.IsSet("reconnectMaxBackoff") {
+		resolved.MaxBackoff = time.Duration(dsViper.GetFloat64("reconnectMaxBackoff") * float64(time.Second))
+	}
+	if dsViper.IsSet("circuitBreakerThreshold") {
+		resolved.FailureThreshold = dsViper.GetInt("circuitBreakerThreshold")
+	}
+	if options != nil && options.HealthCheck != nil {
+		if options.HealthCheck.Interval > 0 {
+			resolved.Interval = options.HealthCheck.Interval
+		}
+		if options.HealthCheck.MaxBackoff > 0 {
+			resolved.MaxBackoff = options.HealthCheck.MaxBackoff
+		}
+		if options.HealthCheck.FailureThreshold > 0 {
+			resolved.FailureThreshold = options.HealthCheck.FailureThreshold
+		}
+	}
+	if resolved.Interval <= 0 {
+		resolved.Interval = defaultHealthCheckInterval
+	}
+	if resolved.MaxBackoff < resolved.Interval {
+		resolved.MaxBackoff = resolved.Interval
+	}
+	if resolved.FailureThreshold <= 0 {
+		resolved.FailureThreshold = defaultCircuitBreakerThreshold
+	}
+	return resolved
+}
+
+// reconnectDelay doubles the interval for each consecutive failure up to MaxBackoff, and picks a random delay
+// between half and the whole of it, so that many instances do not reconnect at the same time
+func reconnectDelay(options HealthCheckOptions, failures int) time.Duration {
+	delay := options.Interval
+	for i := 1; i < failures && delay < options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > options.MaxBackoff {
+		delay = options.MaxBackoff
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// Health returns the current health of the datasource. Local connectors are not monitored and are always closed
+func (ds *Datasource) Health() HealthStatus {
+	ds.healthLock.RLock()
+	defer ds.healthLock.RUnlock()
+	return ds.health
+}
+
+// CircuitState returns the current state of the circuit breaker of the datasource
+func (ds *Datasource) CircuitState() CircuitState {
+	return ds.Health().State
+}
+
+func (ds *Datasource) checkCircuit() error {
+	if ds.CircuitState() == CircuitOpen {
+		return fmt.Errorf("%w: %v", ErrCircuitOpen, ds.Key)
+	}
+	return nil
+}
+
+func (ds *Datasource) recordCheck(err error, latency time.Duration, threshold int) {
+	ds.healthLock.Lock()
+	defer ds.healthLock.Unlock()
+	ds.health.LastCheck = time.Now()
+	ds.health.LastError = err
+	if err == nil {
+		ds.health.LastLatency = latency
+		ds.health.ConsecutiveFailures = 0
+		ds.health.State = CircuitClosed
+		return
+	}
+	ds.health.ConsecutiveFailures++
+	if ds.health.State != CircuitClosed || ds.health.ConsecutiveFailures >= threshold {
+		ds.health.State = CircuitOpen
+	}
+}
+
+func (ds *Datasource) setCircuitState(state CircuitState) {
+	ds.healthLock.Lock()
+	defer ds.healthLock.Unlock()
+	ds.health.State = state
+}
+
+// startMonitor pings the connector periodically and reconnects it when the ping fails, until the datasource is
+// closed
+func (ds *Datasource) startMonitor(connector PersistedConnector, options HealthCheckOptions) {
+	ds.stopMonitor()
+	ctx, cancelFn := context.WithCancel(ds.Context)
+	done := make(chan struct{})
+	ds.monitorCancelFn = cancelFn
+	ds.monitorDone = done
+
+	go func() {
+		defer close(done)
+		delay := options.Interval
+		for {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if ds.CircuitState() == CircuitOpen {
+				ds.setCircuitState(CircuitHalfOpen)
+			}
+			pingStart := time.Now()
+			err := connector.Ping(ctx)
+			latency := time.Since(pingStart)
+			if err != nil {
+				ds.logger().Warn("Reconnecting datasource", "error", err)
+				// connectors may keep the context for later operations, so it must outlive the monitor
+				err = connector.Connect(ds.Context)
+				if err == nil {
+					pingStart = time.Now()
+					err = connector.Ping(ctx)
+					latency = time.Since(pingStart)
+				}
+				if err == nil {
+					ds.logger().Info("Reconnected datasource")
+					ds.Db = connector.GetClient()
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			ds.recordCheck(err, latency, options.FailureThreshold)
+
+			health := ds.Health()
+			if err == nil {
+				delay = options.Interval
+			} else {
+				delay = reconnectDelay(options, health.ConsecutiveFailures)
+				ds.logger().Warn("Could not reconnect datasource", "consecutiveFailures", health.ConsecutiveFailures, "circuit", health.State, "retryIn", delay, "error", err)
+			}
+		}
+	}()
+}
+
+// Ping checks the connection of the datasource and returns how long it took
+func (ds *Datasource) Ping(parentCtx context.Context) (time.Duration, error) {
+	if ds.connectorInstance == nil {
+		return 0, fmt.Errorf("datasource %v is not initialized", ds.Key)
+	}
+	pingStart := time.Now()
+	err := ds.connectorInstance.Ping(parentCtx)
+	return time.Since(pingStart), err
+}
+
+// stopMonitor stops the health check goroutine, if any, and waits for it to finish
+func (ds *Datasource) stopMonitor() {
+	if ds.monitorCancelFn == nil {
+		return
+	}
+	ds.monitorCancelFn()
+	<-ds.monitorDone
+	ds.monitorCancelFn = nil
+	ds.monitorDone = nil
+}
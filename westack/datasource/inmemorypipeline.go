@@ -0,0 +1,1141 @@
+package datasource
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// lookupResolver runs a pipeline against another collection of the same datasource. It is used to evaluate $lookup stages
+type lookupResolver func(collectionName string, pipeline wst.A) ([]wst.M, error)
+
+// evaluatePipeline applies an aggregation pipeline to a list of documents in memory.
+// Only the subset of stages generated by Model.ExtractLookupsFromFilter is supported:
+// $match, $sort, $skip, $limit, $lookup, $unwind, $project, $addFields, $set and $unset.
+// $lookup stages are only available when a resolver is provided
+func evaluatePipeline(documents []wst.M, pipeline wst.A, resolver lookupResolver) ([]wst.M, error) {
+	result := documents
+	for _, stage := range pipeline {
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("invalid pipeline stage %v: expected exactly one key", stage)
+		}
+		for stageName, stageValue := range stage {
+			var err error
+			switch stageName {
+			case "$match":
+				result, err = filterDocuments(result, stageValue)
+			case "$sort":
+				result, err = sortDocuments(result, stageValue)
+			case "$skip":
+				var skip int64
+				skip, err = toInt64(stageValue)
+				if err == nil {
+					if skip >= int64(len(result)) {
+						result = []wst.M{}
+					} else if skip > 0 {
+						result = result[skip:]
+					}
+				}
+			case "$limit":
+				var limit int64
+				limit, err = toInt64(stageValue)
+				if err == nil && limit > 0 && limit < int64(len(result)) {
+					result = result[:limit]
+				}
+			case "$lookup":
+				if resolver == nil {
+					err = fmt.Errorf("unsupported pipeline stage %v", stageName)
+				} else {
+					result, err = lookupDocuments(result, stageValue, resolver)
+				}
+			case "$unwind":
+				result, err = unwindDocuments(result, stageValue)
+			case "$project":
+				result, err = projectDocuments(result, stageValue)
+			case "$addFields", "$set":
+				result, err = addFieldsToDocuments(result, stageValue)
+			case "$unset":
+				result, err = unsetDocumentFields(result, stageValue)
+			default:
+				err = fmt.Errorf("unsupported pipeline stage %v", stageName)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func filterDocuments(documents []wst.M, rawWhere interface{}) ([]wst.M, error) {
+	where, ok := toM(rawWhere)
+	if !ok {
+		return nil, fmt.Errorf("invalid $match value type %T", rawWhere)
+	}
+	result := make([]wst.M, 0, len(documents))
+	for _, document := range documents {
+		matches, err := matchesWhere(document, where)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			result = append(result, document)
+		}
+	}
+	return result, nil
+}
+
+// matchesWhere reports whether the document satisfies a mongo-like where clause
+func matchesWhere(document wst.M, where wst.M) (bool, error) {
+	for key, condition := range where {
+		switch key {
+		case "$and", "$or", "$nor":
+			clauses, ok := toSlice(condition)
+			if !ok {
+				return false, fmt.Errorf("%v expects an array", key)
+			}
+			var matchedCount int
+			for _, rawClause := range clauses {
+				clause, ok := toM(rawClause)
+				if !ok {
+					return false, fmt.Errorf("invalid %v clause type %T", key, rawClause)
+				}
+				matches, err := matchesWhere(document, clause)
+				if err != nil {
+					return false, err
+				}
+				if matches {
+					matchedCount++
+				}
+			}
+			switch key {
+			case "$and":
+				if matchedCount != len(clauses) {
+					return false, nil
+				}
+			case "$or":
+				if matchedCount == 0 {
+					return false, nil
+				}
+			case "$nor":
+				if matchedCount > 0 {
+					return false, nil
+				}
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported operator %v", key)
+			}
+			value, exists := lookupPath(document, key)
+			matches, err := matchesCondition(value, exists, condition)
+			if err != nil {
+				return false, err
+			}
+			if !matches {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func matchesCondition(value interface{}, exists bool, condition interface{}) (bool, error) {
+	operators, isOperatorMap := toM(condition)
+	if isOperatorMap && len(operators) > 0 {
+		for operator := range operators {
+			if !strings.HasPrefix(operator, "$") {
+				// not an operator map, but an embedded document to compare with
+				isOperatorMap = false
+				break
+			}
+		}
+	}
+	if !isOperatorMap {
+		if regex, ok := condition.(primitive.Regex); ok {
+			return matchesRegex(value, regex.Pattern, regex.Options)
+		}
+		return fieldEquals(value, exists, condition), nil
+	}
+
+	for operator, operand := range operators {
+		var matches bool
+		var err error
+		switch operator {
+		case "$eq":
+			matches = fieldEquals(value, exists, operand)
+		case "$ne":
+			matches = !fieldEquals(value, exists, operand)
+		case "$gt", "$gte", "$lt", "$lte":
+			matches = exists && matchesComparison(value, operator, operand)
+		case "$in", "$nin":
+			candidates, ok := toSlice(operand)
+			if !ok {
+				return false, fmt.Errorf("%v expects an array", operator)
+			}
+			found := false
+			for _, candidate := range candidates {
+				if fieldEquals(value, exists, candidate) {
+					found = true
+					break
+				}
+			}
+			matches = found == (operator == "$in")
+		case "$exists":
+			shouldExist, _ := operand.(bool)
+			matches = exists == shouldExist
+		case "$regex":
+			options, _ := operators["$options"].(string)
+			var pattern string
+			switch operand.(type) {
+			case string:
+				pattern = operand.(string)
+			case primitive.Regex:
+				pattern = operand.(primitive.Regex).Pattern
+				if options == "" {
+					options = operand.(primitive.Regex).Options
+				}
+			default:
+				return false, fmt.Errorf("invalid $regex value type %T", operand)
+			}
+			matches, err = matchesRegex(value, pattern, options)
+		case "$options":
+			// consumed by $regex
+			matches = true
+		default:
+			return false, fmt.Errorf("unsupported operator %v", operator)
+		}
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// fieldEquals is true for missing fields only when comparing with null, like mongo does
+func fieldEquals(value interface{}, exists bool, expected interface{}) bool {
+	if !exists {
+		return typeRank(expected) == 1
+	}
+	return valuesMatch(value, expected)
+}
+
+// valuesMatch implements the mongo equality semantics, where an array field matches if any of its elements matches
+func valuesMatch(value interface{}, expected interface{}) bool {
+	if compareValues(value, expected) == 0 {
+		return true
+	}
+	if _, expectedIsSlice := toSlice(expected); expectedIsSlice {
+		return false
+	}
+	if items, ok := toSlice(value); ok {
+		for _, item := range items {
+			if compareValues(item, expected) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesComparison(value interface{}, operator string, operand interface{}) bool {
+	if typeRank(value) != typeRank(operand) {
+		if items, ok := toSlice(value); ok {
+			for _, item := range items {
+				if matchesComparison(item, operator, operand) {
+					return true
+				}
+			}
+		}
+		// mongo only compares values of the same type family
+		return false
+	}
+	cmp := compareValues(value, operand)
+	switch operator {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
+
+func matchesRegex(value interface{}, pattern string, options string) (bool, error) {
+	flags := ""
+	for _, option := range options {
+		switch option {
+		case 'i', 'm', 's':
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		pattern = fmt.Sprintf("(?%v)%v", flags, pattern)
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	if items, ok := toSlice(value); ok {
+		for _, item := range items {
+			if asString, ok := item.(string); ok && compiled.MatchString(asString) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	asString, ok := value.(string)
+	return ok && compiled.MatchString(asString), nil
+}
+
+func sortDocuments(documents []wst.M, rawSort interface{}) ([]wst.M, error) {
+	var sortKeys bson.D
+	switch rawSort.(type) {
+	case bson.D:
+		sortKeys = rawSort.(bson.D)
+	default:
+		asM, ok := toM(rawSort)
+		if !ok {
+			return nil, fmt.Errorf("invalid $sort value type %T", rawSort)
+		}
+		// maps are not ordered, so sort keys alphabetically to be deterministic
+		keys := make([]string, 0, len(asM))
+		for key := range asM {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sortKeys = append(sortKeys, bson.E{Key: key, Value: asM[key]})
+		}
+	}
+	directions := make([]int64, len(sortKeys))
+	for idx, sortKey := range sortKeys {
+		direction, err := toInt64(sortKey.Value)
+		if err != nil || (direction != 1 && direction != -1) {
+			return nil, fmt.Errorf("invalid sort direction %v for %v", sortKey.Value, sortKey.Key)
+		}
+		directions[idx] = direction
+	}
+	sorted := make([]wst.M, len(documents))
+	copy(sorted, documents)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for idx, sortKey := range sortKeys {
+			a, _ := lookupPath(sorted[i], sortKey.Key)
+			b, _ := lookupPath(sorted[j], sortKey.Key)
+			cmp := compareValues(a, b)
+			if cmp != 0 {
+				return cmp*int(directions[idx]) < 0
+			}
+		}
+		return false
+	})
+	return sorted, nil
+}
+
+// lookupSpec is a parsed $lookup stage
+type lookupSpec struct {
+	from         string
+	as           string
+	localField   string
+	foreignField string
+	stages       []wst.M
+	let          wst.M
+}
+
+func parseLookup(rawLookup interface{}) (*lookupSpec, error) {
+	spec, ok := toM(rawLookup)
+	if !ok {
+		return nil, fmt.Errorf("invalid $lookup value type %T", rawLookup)
+	}
+	lookup := &lookupSpec{}
+	lookup.from, _ = spec["from"].(string)
+	lookup.as, _ = spec["as"].(string)
+	if lookup.from == "" || lookup.as == "" {
+		return nil, errors.New("$lookup requires both from and as")
+	}
+	lookup.localField, _ = spec["localField"].(string)
+	lookup.foreignField, _ = spec["foreignField"].(string)
+	if spec["pipeline"] != nil {
+		rawStages, ok := toSlice(spec["pipeline"])
+		if !ok {
+			return nil, fmt.Errorf("invalid $lookup pipeline type %T", spec["pipeline"])
+		}
+		for _, rawStage := range rawStages {
+			stage, ok := toM(rawStage)
+			if !ok {
+				return nil, fmt.Errorf("invalid $lookup pipeline stage type %T", rawStage)
+			}
+			lookup.stages = append(lookup.stages, stage)
+		}
+	}
+	lookup.let, _ = toM(spec["let"])
+	return lookup, nil
+}
+
+// pipelineFor returns the pipeline that finds the related documents of a single document
+func (lookup *lookupSpec) pipelineFor(document wst.M) (wst.A, error) {
+	var pipeline wst.A
+	if lookup.localField != "" && lookup.foreignField != "" {
+		localValue, _ := lookupPath(document, lookup.localField)
+		if items, isSlice := toSlice(localValue); isSlice {
+			pipeline = append(pipeline, wst.M{"$match": wst.M{lookup.foreignField: wst.M{"$in": items}}})
+		} else {
+			pipeline = append(pipeline, wst.M{"$match": wst.M{lookup.foreignField: localValue}})
+		}
+	}
+	variables := make(wst.M, len(lookup.let))
+	for name, expression := range lookup.let {
+		variables[name] = resolveExpression(document, expression)
+	}
+	for _, stage := range lookup.stages {
+		boundStage, err := bindLookupVariables(stage, variables)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, boundStage)
+	}
+	return pipeline, nil
+}
+
+// equalityJoin returns the fields of a $lookup that only relates the documents by the equality of two fields, like the
+// ones of the relations, and the stages that follow that equality
+func (lookup *lookupSpec) equalityJoin() (localPath string, foreignField string, rest []wst.M, ok bool) {
+	if lookup.localField != "" && lookup.foreignField != "" {
+		localPath, foreignField, rest = lookup.localField, lookup.foreignField, lookup.stages
+	} else if len(lookup.stages) > 0 {
+		match, isMatch := toM(lookup.stages[0]["$match"])
+		if !isMatch || len(match) != 1 || match["$expr"] == nil {
+			return "", "", nil, false
+		}
+		expr, _ := toM(match["$expr"])
+		if conditions, isAnd := toSlice(expr["$and"]); isAnd && len(expr) == 1 && len(conditions) == 1 {
+			expr, _ = toM(conditions[0])
+		}
+		arguments, isEq := toSlice(expr["$eq"])
+		if !isEq || len(expr) != 1 || len(arguments) != 2 {
+			return "", "", nil, false
+		}
+		for idx, argument := range arguments {
+			field, _ := argument.(string)
+			variable, _ := arguments[1-idx].(string)
+			if strings.HasPrefix(field, "$") && !strings.HasPrefix(field, "$$") && strings.HasPrefix(variable, "$$") {
+				foreignField = field[1:]
+				localExpression, _ := lookup.let[variable[2:]].(string)
+				if strings.HasPrefix(localExpression, "$") && !strings.HasPrefix(localExpression, "$$") {
+					localPath = localExpression[1:]
+				}
+			}
+		}
+		if localPath == "" || foreignField == "" {
+			return "", "", nil, false
+		}
+		rest = lookup.stages[1:]
+	} else {
+		return "", "", nil, false
+	}
+	for _, stage := range rest {
+		if match, isMatch := toM(stage["$match"]); isMatch && match["$expr"] != nil {
+			return "", "", nil, false
+		}
+	}
+	return localPath, foreignField, rest, true
+}
+
+// lookupDocuments adds the related documents of each document. The lookups that relate the documents by the equality of
+// two fields find the related documents of all of them at once, instead of one query per document
+func lookupDocuments(documents []wst.M, rawLookup interface{}, resolver lookupResolver) ([]wst.M, error) {
+	lookup, err := parseLookup(rawLookup)
+	if err != nil {
+		return nil, err
+	}
+	related, err := batchLookup(documents, lookup, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]wst.M, len(documents))
+	for idx, document := range documents {
+		documentRelated, batched := related[idx]
+		if !batched {
+			pipeline, err := lookup.pipelineFor(document)
+			if err != nil {
+				return nil, err
+			}
+			documentRelated, err = resolver(lookup.from, pipeline)
+			if err != nil {
+				return nil, err
+			}
+		}
+		relatedAsSlice := make([]interface{}, len(documentRelated))
+		for relatedIdx, relatedDocument := range documentRelated {
+			relatedAsSlice[relatedIdx] = relatedDocument
+		}
+		result[idx] = withPath(document, lookup.as, relatedAsSlice)
+	}
+	return result, nil
+}
+
+// batchLookup finds with a single pipeline the related documents of the documents with a scalar value in the local
+// field, by index. The stages that apply to each related document on its own run in that pipeline too, and the ones
+// that depend on the other related documents of the same document, like $sort or $limit, run for each document after
+func batchLookup(documents []wst.M, lookup *lookupSpec, resolver lookupResolver) (map[int][]wst.M, error) {
+	localPath, foreignField, rest, ok := lookup.equalityJoin()
+	if !ok {
+		return nil, nil
+	}
+	localValues := make(map[int]interface{}, len(documents))
+	var values []interface{}
+	seen := make(map[string]bool, len(documents))
+	for idx, document := range documents {
+		value, exists := lookupPath(document, localPath)
+		if _, isSlice := toSlice(value); !exists || isSlice || typeRank(value) == 1 {
+			// the missing, null and array values keep the semantics of the query of a single document
+			continue
+		}
+		localValues[idx] = value
+		if key := lookupBatchKey(value); !seen[key] {
+			seen[key] = true
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	perDocument := 0
+	for perDocument < len(rest) && appliesToEachDocument(rest[perDocument], foreignField) {
+		perDocument++
+	}
+	pipeline := wst.A{{"$match": wst.M{foreignField: wst.M{"$in": values}}}}
+	pipeline = append(pipeline, rest[:perDocument]...)
+	candidates, err := resolver(lookup.from, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string][]wst.M, len(values))
+	for _, candidate := range candidates {
+		foreignValue, _ := lookupPath(candidate, foreignField)
+		keys := []string{lookupBatchKey(foreignValue)}
+		if items, isSlice := toSlice(foreignValue); isSlice {
+			for _, item := range items {
+				keys = append(keys, lookupBatchKey(item))
+			}
+		}
+		added := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if !added[key] {
+				added[key] = true
+				byKey[key] = append(byKey[key], candidate)
+			}
+		}
+	}
+
+	related := make(map[int][]wst.M, len(localValues))
+	for idx, value := range localValues {
+		var matching []wst.M
+		for _, candidate := range byKey[lookupBatchKey(value)] {
+			if foreignValue, exists := lookupPath(candidate, foreignField); fieldEquals(foreignValue, exists, value) {
+				matching = append(matching, candidate)
+			}
+		}
+		if perDocument < len(rest) {
+			matching, err = evaluatePipeline(matching, rest[perDocument:], resolver)
+			if err != nil {
+				return nil, err
+			}
+		}
+		related[idx] = matching
+	}
+	return related, nil
+}
+
+// lookupBatchKey groups the values that may be equal. The candidates of each group are compared with valuesMatch after
+func lookupBatchKey(value interface{}) string {
+	switch typeRank(value) {
+	case 2:
+		return fmt.Sprintf("number:%v", toFloat64(value))
+	case 9:
+		return fmt.Sprintf("date:%v", toTime(value).UnixNano())
+	}
+	return fmt.Sprintf("%T:%v", value, value)
+}
+
+// appliesToEachDocument reports whether the stage of a $lookup pipeline transforms each related document on its own,
+// without removing the foreign field, so that it gives the same result for all the documents at once
+func appliesToEachDocument(stage wst.M, foreignField string) bool {
+	for stageName, stageValue := range stage {
+		switch stageName {
+		case "$match":
+			return true
+		case "$project":
+			projection, ok := toM(stageValue)
+			if !ok {
+				return false
+			}
+			for field, value := range projection {
+				if included, isFlag := projectionFlag(value); !isFlag || included || pathsOverlap(field, foreignField) {
+					return false
+				}
+			}
+			return true
+		case "$lookup":
+			spec, _ := toM(stageValue)
+			as, _ := spec["as"].(string)
+			return as != "" && !pathsOverlap(as, foreignField)
+		case "$unwind":
+			path, _ := stageValue.(string)
+			if spec, ok := toM(stageValue); ok {
+				path, _ = spec["path"].(string)
+			}
+			return strings.HasPrefix(path, "$") && !pathsOverlap(path[1:], foreignField)
+		}
+	}
+	return false
+}
+
+func pathsOverlap(a string, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// bindLookupVariables replaces the $expr of a $match stage by a plain where clause, using the values of the $lookup
+// variables. Other stages are returned as they are
+func bindLookupVariables(stage wst.M, variables wst.M) (wst.M, error) {
+	match, isMatch := toM(stage["$match"])
+	if !isMatch || match["$expr"] == nil {
+		return stage, nil
+	}
+	exprWhere, err := exprToWhere(match["$expr"], variables)
+	if err != nil {
+		return nil, err
+	}
+	rest := make(wst.M, len(match))
+	for key, value := range match {
+		if key != "$expr" {
+			rest[key] = value
+		}
+	}
+	if len(rest) == 0 {
+		return wst.M{"$match": exprWhere}, nil
+	}
+	return wst.M{"$match": wst.M{"$and": []interface{}{rest, exprWhere}}}, nil
+}
+
+// exprToWhere supports the $expr expressions generated for relations: $and of comparisons between a field and a
+// variable or a literal value
+func exprToWhere(rawExpr interface{}, variables wst.M) (wst.M, error) {
+	expr, ok := toM(rawExpr)
+	if !ok || len(expr) != 1 {
+		return nil, fmt.Errorf("unsupported $expr %v", rawExpr)
+	}
+	for operator, rawArguments := range expr {
+		arguments, ok := toSlice(rawArguments)
+		if !ok {
+			return nil, fmt.Errorf("%v expects an array", operator)
+		}
+		switch operator {
+		case "$and", "$or":
+			clauses := make([]interface{}, len(arguments))
+			for idx, argument := range arguments {
+				clause, err := exprToWhere(argument, variables)
+				if err != nil {
+					return nil, err
+				}
+				clauses[idx] = clause
+			}
+			return wst.M{operator: clauses}, nil
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			if len(arguments) != 2 {
+				return nil, fmt.Errorf("%v expects exactly two arguments", operator)
+			}
+			fieldIdx := -1
+			for idx, argument := range arguments {
+				if asString, ok := argument.(string); ok && strings.HasPrefix(asString, "$") && !strings.HasPrefix(asString, "$$") {
+					fieldIdx = idx
+					break
+				}
+			}
+			if fieldIdx == -1 {
+				return nil, fmt.Errorf("unsupported $expr %v: one of the arguments must be a field path", rawExpr)
+			}
+			field := arguments[fieldIdx].(string)[1:]
+			value := arguments[1-fieldIdx]
+			if asString, ok := value.(string); ok && strings.HasPrefix(asString, "$$") {
+				value = variables[asString[2:]]
+			}
+			if fieldIdx == 1 {
+				// the field is on the right side, so the comparison must be reversed
+				switch operator {
+				case "$gt":
+					operator = "$lt"
+				case "$gte":
+					operator = "$lte"
+				case "$lt":
+					operator = "$gt"
+				case "$lte":
+					operator = "$gte"
+				}
+			}
+			return wst.M{field: wst.M{operator: value}}, nil
+		}
+		return nil, fmt.Errorf("unsupported $expr operator %v", operator)
+	}
+	return nil, nil
+}
+
+func unwindDocuments(documents []wst.M, rawUnwind interface{}) ([]wst.M, error) {
+	var path string
+	var preserveNullAndEmptyArrays bool
+	switch rawUnwind.(type) {
+	case string:
+		path = rawUnwind.(string)
+	default:
+		spec, ok := toM(rawUnwind)
+		if !ok {
+			return nil, fmt.Errorf("invalid $unwind value type %T", rawUnwind)
+		}
+		path, _ = spec["path"].(string)
+		preserveNullAndEmptyArrays, _ = spec["preserveNullAndEmptyArrays"].(bool)
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid $unwind path %v", path)
+	}
+	path = path[1:]
+	result := make([]wst.M, 0, len(documents))
+	for _, document := range documents {
+		value, exists := lookupPath(document, path)
+		items, isSlice := toSlice(value)
+		if !isSlice {
+			if exists && value != nil {
+				result = append(result, document)
+			} else if preserveNullAndEmptyArrays {
+				result = append(result, document)
+			}
+			continue
+		}
+		if len(items) == 0 {
+			if preserveNullAndEmptyArrays {
+				result = append(result, withoutPath(document, path))
+			}
+			continue
+		}
+		for _, item := range items {
+			result = append(result, withPath(document, path, item))
+		}
+	}
+	return result, nil
+}
+
+func projectDocuments(documents []wst.M, rawProjection interface{}) ([]wst.M, error) {
+	projection, ok := toM(rawProjection)
+	if !ok {
+		return nil, fmt.Errorf("invalid $project value type %T", rawProjection)
+	}
+	inclusion := false
+	exclusion := false
+	for field, value := range projection {
+		included, isFlag := projectionFlag(value)
+		if field == "_id" && isFlag {
+			continue
+		}
+		if !isFlag || included {
+			inclusion = true
+		} else {
+			exclusion = true
+		}
+	}
+	if inclusion && exclusion {
+		return nil, errors.New("$project cannot mix inclusion and exclusion")
+	}
+
+	result := make([]wst.M, len(documents))
+	for idx, document := range documents {
+		if !inclusion {
+			for field, value := range projection {
+				if included, _ := projectionFlag(value); !included {
+					document = withoutPath(document, field)
+				}
+			}
+			result[idx] = document
+			continue
+		}
+		projected := wst.M{}
+		if idValue, hasId := document["_id"]; hasId {
+			if included, isFlag := projectionFlag(projection["_id"]); !isFlag || included {
+				projected["_id"] = idValue
+			}
+		}
+		for field, value := range projection {
+			if field == "_id" {
+				continue
+			}
+			var fieldValue interface{}
+			var exists bool
+			if _, isFlag := projectionFlag(value); isFlag {
+				fieldValue, exists = lookupPath(document, field)
+			} else if asString, ok := value.(string); ok && strings.HasPrefix(asString, "$") {
+				fieldValue, exists = lookupPath(document, asString[1:])
+			} else {
+				return nil, fmt.Errorf("unsupported $project expression %v for %v", value, field)
+			}
+			if exists {
+				projected = withPath(projected, field, fieldValue)
+			}
+		}
+		result[idx] = projected
+	}
+	return result, nil
+}
+
+// projectionFlag reports whether a $project value is a boolean-like flag, and whether it includes the field
+func projectionFlag(value interface{}) (included bool, isFlag bool) {
+	switch value.(type) {
+	case bool:
+		return value.(bool), true
+	case nil:
+		return false, false
+	}
+	if typeRank(value) == 2 {
+		return toFloat64(value) != 0, true
+	}
+	return false, false
+}
+
+func addFieldsToDocuments(documents []wst.M, rawFields interface{}) ([]wst.M, error) {
+	fields, ok := toM(rawFields)
+	if !ok {
+		return nil, fmt.Errorf("invalid $addFields value type %T", rawFields)
+	}
+	for _, value := range fields {
+		if asM, ok := toM(value); ok {
+			for key := range asM {
+				if strings.HasPrefix(key, "$") && (key != "$concat" || len(asM) != 1) {
+					return nil, fmt.Errorf("unsupported expression %v", value)
+				}
+			}
+		}
+	}
+	result := make([]wst.M, len(documents))
+	for idx, document := range documents {
+		for field, value := range fields {
+			if asString, ok := value.(string); ok && strings.HasPrefix(asString, "$") {
+				fieldValue, exists := lookupPath(document, asString[1:])
+				if !exists {
+					continue
+				}
+				value = fieldValue
+			} else if asM, ok := toM(value); ok && asM["$concat"] != nil {
+				concatenated, err := concatExpression(document, asM["$concat"])
+				if err != nil {
+					return nil, err
+				}
+				value = concatenated
+			}
+			document = withPath(document, field, value)
+		}
+		result[idx] = document
+	}
+	return result, nil
+}
+
+// concatExpression joins the strings of a $concat expression. As in mongodb, the result is nil when any of them is
+// missing or nil
+func concatExpression(document wst.M, rawItems interface{}) (interface{}, error) {
+	items, ok := toSlice(rawItems)
+	if !ok {
+		return nil, fmt.Errorf("invalid $concat value type %T", rawItems)
+	}
+	var builder strings.Builder
+	for _, item := range items {
+		resolved := resolveExpression(document, item)
+		if resolved == nil {
+			return nil, nil
+		}
+		asString, ok := resolved.(string)
+		if !ok {
+			return nil, fmt.Errorf("$concat only supports strings, not %T", resolved)
+		}
+		builder.WriteString(asString)
+	}
+	return builder.String(), nil
+}
+
+func unsetDocumentFields(documents []wst.M, rawFields interface{}) ([]wst.M, error) {
+	var fields []string
+	if asString, ok := rawFields.(string); ok {
+		fields = []string{asString}
+	} else if items, ok := toSlice(rawFields); ok {
+		for _, item := range items {
+			asString, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid $unset field type %T", item)
+			}
+			fields = append(fields, asString)
+		}
+	} else {
+		return nil, fmt.Errorf("invalid $unset value type %T", rawFields)
+	}
+	result := make([]wst.M, len(documents))
+	for idx, document := range documents {
+		for _, field := range fields {
+			document = withoutPath(document, field)
+		}
+		result[idx] = document
+	}
+	return result, nil
+}
+
+// resolveExpression returns the value of the "$field" references, or the expression itself for literals
+func resolveExpression(document wst.M, expression interface{}) interface{} {
+	if asString, ok := expression.(string); ok && strings.HasPrefix(asString, "$") && !strings.HasPrefix(asString, "$$") {
+		value, _ := lookupPath(document, asString[1:])
+		return value
+	}
+	return expression
+}
+
+// withPath returns a shallow copy of the document where the dotted path is set to value.
+// The original document is never modified
+func withPath(document wst.M, path string, value interface{}) wst.M {
+	out := make(wst.M, len(document)+1)
+	for key, existing := range document {
+		out[key] = existing
+	}
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) == 1 {
+		out[path] = value
+		return out
+	}
+	nested, ok := toM(out[parts[0]])
+	if !ok {
+		nested = wst.M{}
+	}
+	out[parts[0]] = withPath(nested, parts[1], value)
+	return out
+}
+
+// withoutPath returns a shallow copy of the document without the dotted path
+func withoutPath(document wst.M, path string) wst.M {
+	parts := strings.SplitN(path, ".", 2)
+	existing, exists := document[parts[0]]
+	if !exists {
+		return document
+	}
+	out := make(wst.M, len(document))
+	for key, value := range document {
+		out[key] = value
+	}
+	if len(parts) == 1 {
+		delete(out, path)
+		return out
+	}
+	if nested, ok := toM(existing); ok {
+		out[parts[0]] = withoutPath(nested, parts[1])
+	}
+	return out
+}
+
+// lookupPath resolves dotted paths like "address.city" inside nested documents
+func lookupPath(document wst.M, path string) (interface{}, bool) {
+	var current interface{} = document
+	for _, part := range strings.Split(path, ".") {
+		asM, ok := toM(current)
+		if !ok {
+			return nil, false
+		}
+		current, ok = asM[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// typeRank follows the mongo BSON comparison order for the supported types
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case time.Time, primitive.DateTime, primitive.Timestamp:
+		return 9
+	}
+	if _, ok := toM(value); ok {
+		return 4
+	}
+	if _, ok := toSlice(value); ok {
+		return 5
+	}
+	return 6
+}
+
+// compareValues returns -1, 0 or 1. Values of different types are ordered by their typeRank
+func compareValues(a interface{}, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+	switch rankA {
+	case 1:
+		return 0
+	case 2:
+		fa, fb := toFloat64(a), toFloat64(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+	case 7:
+		oidA, oidB := a.(primitive.ObjectID), b.(primitive.ObjectID)
+		return bytes.Compare(oidA[:], oidB[:])
+	case 8:
+		boolA, boolB := a.(bool), b.(bool)
+		if boolA == boolB {
+			return 0
+		} else if !boolA {
+			return -1
+		}
+		return 1
+	case 9:
+		timeA, timeB := toTime(a), toTime(b)
+		switch {
+		case timeA.Before(timeB):
+			return -1
+		case timeA.After(timeB):
+			return 1
+		}
+		return 0
+	case 4:
+		docA, _ := toM(a)
+		docB, _ := toM(b)
+		if reflect.DeepEqual(docA, docB) {
+			return 0
+		}
+		return strings.Compare(fmt.Sprintf("%v", docA), fmt.Sprintf("%v", docB))
+	case 5:
+		itemsA, _ := toSlice(a)
+		itemsB, _ := toSlice(b)
+		for idx := 0; idx < len(itemsA) && idx < len(itemsB); idx++ {
+			if cmp := compareValues(itemsA[idx], itemsB[idx]); cmp != 0 {
+				return cmp
+			}
+		}
+		return compareValues(len(itemsA), len(itemsB))
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func toM(value interface{}) (wst.M, bool) {
+	switch value.(type) {
+	case wst.M:
+		return value.(wst.M), true
+	case wst.Where:
+		return wst.M(value.(wst.Where)), true
+	case map[string]interface{}:
+		return value.(map[string]interface{}), true
+	case primitive.M:
+		return wst.M(value.(primitive.M)), true
+	case primitive.D:
+		out := make(wst.M, len(value.(primitive.D)))
+		for _, e := range value.(primitive.D) {
+			out[e.Key] = e.Value
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func toSlice(value interface{}) ([]interface{}, bool) {
+	switch value.(type) {
+	case []interface{}:
+		return value.([]interface{}), true
+	case primitive.A:
+		return value.(primitive.A), true
+	case nil, string, []byte, primitive.D, primitive.ObjectID:
+		return nil, false
+	}
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return nil, false
+	}
+	out := make([]interface{}, reflected.Len())
+	for idx := 0; idx < reflected.Len(); idx++ {
+		out[idx] = reflected.Index(idx).Interface()
+	}
+	return out, true
+}
+
+func toFloat64(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func toInt64(value interface{}) (int64, error) {
+	if typeRank(value) != 2 {
+		return 0, errors.New(fmt.Sprintf("expected a number, found %T", value))
+	}
+	return int64(toFloat64(value)), nil
+}
+
+func toTime(value interface{}) time.Time {
+	switch v := value.(type) {
+	case time.Time:
+		return v
+	case primitive.DateTime:
+		return v.Time()
+	case primitive.Timestamp:
+		return time.Unix(int64(v.T), 0)
+	}
+	return time.Time{}
+}
@@ -30,80 +30,196 @@ func (connector *MemoryKVConnector) Connect(parentContext context.Context) error
 	return nil
 }
 
+// IsLocal implements LocalConnector
+func (connector *MemoryKVConnector) IsLocal() bool {
+	return true
+}
+
 func (connector *MemoryKVConnector) SetConfig(dsViper *viper.Viper) {
 	connector.dsConfig = dsViper
 }
 
-func (connector *MemoryKVConnector) FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error) {
-	db := connector.db
-	if lookups == nil || len(*lookups) == 0 {
-		return nil, errors.New("empty query")
+// FindMany evaluates the lookups in memory against the documents stored in the bucket named after the collection.
+// Cache entries, created with "_redId" and "_entries", are retrieved with a single {"$match": {"_redId": key}} stage
+func (connector *MemoryKVConnector) FindMany(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	bucket := connector.db.GetBucket(collectionName)
+
+	var pipeline wst.A
+	if lookups != nil {
+		pipeline = *lookups
 	}
 
-	potentialMatchStage := (*lookups)[0]
+	if len(pipeline) > 0 {
+		if cacheKey, isCacheLookup := extractCacheKey(pipeline[0]); isCacheLookup {
+			// fmt.Println("QUERYING CACHE: collection=", collectionName, "id=", cacheKey) TODO: check debug
+			documents, err := bucket.Get(cacheKey)
+			if err != nil {
+				return nil, err
+			}
+			return NewFixedMongoCursor(documents), nil
+		}
+	}
 
-	var _id interface{}
-	if match, isPresent := potentialMatchStage["$match"]; !isPresent {
-		return nil, errors.New("invalid first stage for memorykv. First stage must contain $match")
-	} else {
-		if asM, ok := match.(wst.M); !ok {
-			return nil, errors.New(fmt.Sprintf("invalid $match value type %s", asM))
-		} else {
-			if len(asM) == 0 {
-				return nil, errors.New("empty $match")
-			} else {
-				for _, v := range asM {
-					//key := fmt.Sprintf("%v:%v:%v", ds.Viper.GetString(ds.Keys+".database"), collectionName, k)
-					_id = v
-					break
-				}
+	results, err := connector.findDocuments(ctx, collectionName, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	rawResults := make([][]byte, len(results))
+	for idx, result := range results {
+		rawResults[idx], err = bson.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewFixedMongoCursor(rawResults), nil
+}
+
+// findDocuments evaluates the pipeline against the documents of the collection. $lookup stages are resolved
+// against the other buckets of the same datasource
+func (connector *MemoryKVConnector) findDocuments(ctx context.Context, collectionName string, pipeline wst.A) ([]wst.M, error) {
+	// checked on every $lookup resolution too, which runs once per document
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	documents, err := connector.loadDocuments(connector.db.GetBucket(collectionName), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return evaluatePipeline(documents, pipeline, func(collectionName string, pipeline wst.A) ([]wst.M, error) {
+		return connector.findDocuments(ctx, collectionName, pipeline)
+	})
+}
+
+// loadDocuments decodes the documents of the bucket that may match the pipeline.
+// If the first stage only filters by "_id", the bucket is not scanned
+func (connector *MemoryKVConnector) loadDocuments(bucket memorykv.MemoryKvBucket, pipeline wst.A) ([]wst.M, error) {
+	keys := bucket.Keys()
+	if len(pipeline) > 0 {
+		if match, ok := toM(pipeline[0]["$match"]); ok && len(match) == 1 {
+			if _id, ok := match["_id"]; ok && typeRank(_id) != 4 && typeRank(_id) != 5 {
+				keys = []string{idToKey(_id)}
 			}
 		}
 	}
+	documents := make([]wst.M, 0, len(keys))
+	for _, key := range keys {
+		entries, err := bucket.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			var document wst.M
+			err := bson.Unmarshal(entry, &document)
+			if err != nil {
+				return nil, err
+			}
+			documents = append(documents, document)
+		}
+	}
+	return documents, nil
+}
+
+func extractCacheKey(stage wst.M) (string, bool) {
+	match, ok := toM(stage["$match"])
+	if !ok || len(stage) != 1 || len(match) != 1 {
+		return "", false
+	}
+	cacheKey, ok := match["_redId"].(string)
+	return cacheKey, ok
+}
+
+// documentToCreate returns a copy of data with its "_id", taken from "id" or generated when missing, so that the
+// caller can reuse its data for other creates, as it can with mongodb
+func documentToCreate(data *wst.M) *wst.M {
+	document := make(wst.M, len(*data)+1)
+	for key, value := range *data {
+		document[key] = value
+	}
+	if document["_id"] == nil {
+		if document["id"] != nil {
+			document["_id"] = document["id"]
+		} else {
+			document["_id"] = primitive.NewObjectID()
+		}
+	}
+	delete(document, "id")
+	return &document
+}
 
-	var idAsString string
-	switch _id.(type) {
+func idToKey(id interface{}) string {
+	switch id.(type) {
 	case string:
-		idAsString = _id.(string)
+		return id.(string)
 	case primitive.ObjectID:
-		idAsString = _id.(primitive.ObjectID).Hex()
+		return id.(primitive.ObjectID).Hex()
+	case *primitive.ObjectID:
+		return id.(*primitive.ObjectID).Hex()
 	case uuid.UUID:
-		idAsString = _id.(uuid.UUID).String()
+		return id.(uuid.UUID).String()
+	default:
+		return fmt.Sprintf("%v", id)
 	}
-	bucket := db.GetBucket(collectionName)
-
-	// fmt.Println("QUERYING CACHE: collection=", collectionName, "id=", idAsString) TODO: check debug
+}
 
-	bytes, err := bucket.Get(idAsString)
-	var documents [][]byte
+func (connector *MemoryKVConnector) findByObjectId(ctx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	wrappedLookups := wst.A{{"$match": wst.M{"_id": _id}}}
+	if lookups != nil {
+		wrappedLookups = append(wrappedLookups, *lookups...)
+	}
+	results, err := connector.findDocuments(ctx, collectionName, wrappedLookups)
 	if err != nil {
 		return nil, err
-	} else if bytes == nil {
-		// TODO: Check if we should return an error or not
-		//return &wst.A{}, nil
-		documents = nil
-	} else {
-		documents = bytes
 	}
-	return NewFixedMongoCursor(documents), nil
+	if len(results) == 0 {
+		return nil, errors.New("document not found")
+	}
+	return &results[0], nil
 }
 
-func (connector *MemoryKVConnector) findByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
-	panic("Not implemented")
+func (connector *MemoryKVConnector) Count(ctx context.Context, collectionName string, lookups *wst.A) (int64, error) {
+	var pipeline wst.A
+	if lookups != nil {
+		pipeline = *lookups
+	}
+	results, err := connector.findDocuments(ctx, collectionName, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(results)), nil
 }
 
-func (connector *MemoryKVConnector) Count(collectionName string, lookups *wst.A) (int64, error) {
-	//TODO implement me
-	panic("implement me")
+// Create stores a document under its "_id", generating a new ObjectID if not present.
+// When data contains "_entries", all of them are stored together as a cache entry with key "_redId"
+func (connector *MemoryKVConnector) Create(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	if _, isCacheEntry := (*data)["_entries"]; isCacheEntry {
+		return connector.createCacheEntry(collectionName, data)
+	}
+
+	data = documentToCreate(data)
+
+	bucket := connector.db.GetBucket(collectionName)
+	key := idToKey((*data)["_id"])
+	bytes, err := bson.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	// checked and set at once, so that the concurrent creates of the same id cannot both succeed
+	created, err := bucket.SetNX(key, [][]byte{bytes})
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, fmt.Errorf("duplicate key error: %v already exists in %v", key, collectionName)
+	}
+	return connector.findByObjectId(ctx, collectionName, (*data)["_id"], nil)
 }
 
-func (connector *MemoryKVConnector) Create(collectionName string, data *wst.M) (*wst.M, error) {
+func (connector *MemoryKVConnector) createCacheEntry(collectionName string, data *wst.M) (*wst.M, error) {
 	db := connector.db
 
 	var id interface{}
 
 	var allBytes [][]byte
-	var idAsStr string
 	if (*data)["_redId"] == nil {
 		id = uuid.New().String()
 		(*data)["_redId"] = id
@@ -111,13 +227,6 @@ func (connector *MemoryKVConnector) Create(collectionName string, data *wst.M) (
 		id = (*data)["_redId"]
 	}
 	for _, doc := range (*data)["_entries"].(wst.A) {
-		switch id.(type) {
-		case string:
-			idAsStr = id.(string)
-		case primitive.ObjectID:
-			idAsStr = id.(primitive.ObjectID).Hex()
-		}
-
 		bytes, err := bson.Marshal(doc)
 		if err != nil {
 			return nil, err
@@ -126,27 +235,86 @@ func (connector *MemoryKVConnector) Create(collectionName string, data *wst.M) (
 	}
 
 	//db[id] = data
-	err := db.GetBucket(collectionName).Set(idAsStr, allBytes)
+	err := db.GetBucket(collectionName).Set(idToKey(id), allBytes)
 	if err != nil {
 		return nil, err
 	}
-	//return findByObjectId(collectionName, id, ds, nil)
 	return data, nil
 }
 
-func (connector *MemoryKVConnector) UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
-	//TODO implement me
-	panic("implement me")
+func (connector *MemoryKVConnector) UpdateById(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	bucket := connector.db.GetBucket(collectionName)
+	key := idToKey(id)
+	document, err := connector.findByObjectId(ctx, collectionName, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	delete(*data, "id")
+	delete(*data, "_id")
+	for k, v := range *data {
+		(*document)[k] = v
+	}
+	bytes, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	err = bucket.Set(key, [][]byte{bytes})
+	if err != nil {
+		return nil, err
+	}
+	return connector.findByObjectId(ctx, collectionName, id, nil)
 }
 
-func (connector *MemoryKVConnector) DeleteById(collectionName string, id interface{}) (DeleteResult, error) {
-	//TODO implement me
-	panic("implement me")
+func (connector *MemoryKVConnector) DeleteById(ctx context.Context, collectionName string, id interface{}) (result DeleteResult, err error) {
+	bucket := connector.db.GetBucket(collectionName)
+	key := idToKey(id)
+	existing, err := bucket.Get(key)
+	if err != nil || existing == nil {
+		return result, err
+	}
+	err = bucket.Delete(key)
+	if err != nil {
+		return result, err
+	}
+	return DeleteResult{DeletedCount: 1}, nil
 }
 
-func (connector *MemoryKVConnector) DeleteMany(collectionName string, whereLookups *wst.A) (DeleteResult, error) {
-	//TODO implement me
-	panic("implement me")
+func (connector *MemoryKVConnector) DeleteMany(ctx context.Context, collectionName string, whereLookups *wst.A) (result DeleteResult, err error) {
+	bucket := connector.db.GetBucket(collectionName)
+	where, ok := toM((*whereLookups)[0]["$match"])
+	if !ok {
+		return result, errors.New("invalid $match stage")
+	}
+	for _, key := range bucket.Keys() {
+		entries, err := bucket.Get(key)
+		if err != nil {
+			return result, err
+		}
+		if len(entries) != 1 {
+			continue
+		}
+		var document wst.M
+		err = bson.Unmarshal(entries[0], &document)
+		if err != nil {
+			return result, err
+		}
+		if idToKey(document["_id"]) != key {
+			// cache entries are stored under their "_redId", and are never deleted by filter
+			continue
+		}
+		matches, err := matchesWhere(document, where)
+		if err != nil {
+			return result, err
+		}
+		if matches {
+			err = bucket.Delete(key)
+			if err != nil {
+				return result, err
+			}
+			result.DeletedCount++
+		}
+	}
+	return result, nil
 }
 
 func (connector *MemoryKVConnector) Disconnect() error {
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/metrics"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
@@ -12,7 +14,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"log"
 	"time"
 )
 
@@ -22,6 +23,34 @@ type MongoDBDatasourceOptions struct {
 	Timeout  float32
 }
 
+var mongoCommandDuration = metrics.DefaultRegistry.NewHistogramVec("westack_mongodb_command_duration_seconds", "Latency of the commands sent to mongo", nil, "database", "command")
+var mongoCommandFailures = metrics.DefaultRegistry.NewCounterVec("westack_mongodb_command_failures_total", "Commands sent to mongo that failed", "database", "command")
+
+// newMongoMetricsMonitor records the latency of every command and forwards the events to the monitor configured in
+// MongoDBDatasourceOptions, if any
+func newMongoMetricsMonitor(database string, userMonitor *event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, startedEvent *event.CommandStartedEvent) {
+			if userMonitor != nil && userMonitor.Started != nil {
+				userMonitor.Started(ctx, startedEvent)
+			}
+		},
+		Succeeded: func(ctx context.Context, succeededEvent *event.CommandSucceededEvent) {
+			mongoCommandDuration.Observe(time.Duration(succeededEvent.DurationNanos).Seconds(), database, succeededEvent.CommandName)
+			if userMonitor != nil && userMonitor.Succeeded != nil {
+				userMonitor.Succeeded(ctx, succeededEvent)
+			}
+		},
+		Failed: func(ctx context.Context, failedEvent *event.CommandFailedEvent) {
+			mongoCommandDuration.Observe(time.Duration(failedEvent.DurationNanos).Seconds(), database, failedEvent.CommandName)
+			mongoCommandFailures.Inc(database, failedEvent.CommandName)
+			if userMonitor != nil && userMonitor.Failed != nil {
+				userMonitor.Failed(ctx, failedEvent)
+			}
+		},
+	}
+}
+
 type MongoDBConnector struct {
 	db      *mongo.Client
 	options *MongoDBDatasourceOptions
@@ -43,7 +72,7 @@ func (connector *MongoDBConnector) Connect(parentContext context.Context) error
 	var mongoCtx context.Context
 	var cancelFn context.CancelFunc
 	if connector.options != nil && connector.options.Timeout > 0 {
-		fmt.Printf("DEBUG: Setting timeout to %v seconds\n", connector.options.Timeout)
+		logging.Default().Debug("Setting the mongodb timeout", "seconds", connector.options.Timeout)
 		mongoCtx, cancelFn = context.WithTimeout(parentContext, time.Duration(connector.options.Timeout)*time.Second)
 		defer cancelFn()
 	} else {
@@ -74,9 +103,11 @@ func (connector *MongoDBConnector) Connect(parentContext context.Context) error
 		clientOpts = clientOpts.SetRegistry(connector.options.Registry)
 	}
 
-	if connector.options != nil && connector.options.Monitor != nil {
-		clientOpts = clientOpts.SetMonitor(connector.options.Monitor)
+	var userMonitor *event.CommandMonitor
+	if connector.options != nil {
+		userMonitor = connector.options.Monitor
 	}
+	clientOpts = clientOpts.SetMonitor(newMongoMetricsMonitor(connector.dsViper.GetString("database"), userMonitor))
 
 	db, err := mongo.Connect(mongoCtx, clientOpts)
 	if err != nil {
@@ -89,7 +120,7 @@ func (connector *MongoDBConnector) Connect(parentContext context.Context) error
 	return nil
 }
 
-func (connector *MongoDBConnector) FindMany(collectionName string, lookups *wst.A) (MongoCursorI, error) {
+func (connector *MongoDBConnector) FindMany(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
 	var mongoClient = connector.db
 
 	database := mongoClient.Database(connector.dsViper.GetString("database"))
@@ -100,7 +131,6 @@ func (connector *MongoDBConnector) FindMany(collectionName string, lookups *wst.
 	if lookups != nil {
 		pipeline = append(pipeline, *lookups...)
 	}
-	ctx := connector.context
 	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true).SetBatchSize(16))
 	if err != nil {
 		return nil, err
@@ -121,7 +151,7 @@ func (connector *MongoDBConnector) FindMany(collectionName string, lookups *wst.
 	return cursor, nil
 }
 
-func (connector *MongoDBConnector) findByObjectId(collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+func (connector *MongoDBConnector) findByObjectId(ctx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
 	wrappedLookups := &wst.A{
 		{
 			"$match": wst.M{
@@ -132,7 +162,7 @@ func (connector *MongoDBConnector) findByObjectId(collectionName string, _id int
 	if lookups != nil {
 		*wrappedLookups = append(*wrappedLookups, *lookups...)
 	}
-	cursor, err := connector.FindMany(collectionName, wrappedLookups)
+	cursor, err := connector.FindMany(ctx, collectionName, wrappedLookups)
 	if err != nil {
 		return nil, err
 	}
@@ -141,9 +171,9 @@ func (connector *MongoDBConnector) findByObjectId(collectionName string, _id int
 		if err != nil {
 			panic(err)
 		}
-	}(cursor, connector.context)
+	}(cursor, ctx)
 	var results []wst.M
-	err = cursor.All(connector.context, &results)
+	err = cursor.All(ctx, &results)
 	if err != nil {
 		return nil, err
 	}
@@ -154,7 +184,7 @@ func (connector *MongoDBConnector) findByObjectId(collectionName string, _id int
 	}
 }
 
-func (connector *MongoDBConnector) Count(collectionName string, lookups *wst.A) (int64, error) {
+func (connector *MongoDBConnector) Count(ctx context.Context, collectionName string, lookups *wst.A) (int64, error) {
 	var db = connector.db
 
 	database := db.Database(connector.dsViper.GetString("database"))
@@ -172,12 +202,10 @@ func (connector *MongoDBConnector) Count(collectionName string, lookups *wst.A)
 		},
 	})
 	allowDiskUse := true
-	ctx := connector.context
 	cursor, err := collection.Aggregate(ctx, pipeline, &options.AggregateOptions{
 		AllowDiskUse: &allowDiskUse,
 	})
 	if err != nil {
-		fmt.Printf("error %v\n", err)
 		return 0, err
 	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
@@ -199,7 +227,7 @@ func (connector *MongoDBConnector) Count(collectionName string, lookups *wst.A)
 	return documents[0].Count, nil
 }
 
-func (connector *MongoDBConnector) Create(collectionName string, data *wst.M) (*wst.M, error) {
+func (connector *MongoDBConnector) Create(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
 	var db = connector.db
 
 	database := db.Database(connector.dsViper.GetString("database"))
@@ -207,44 +235,43 @@ func (connector *MongoDBConnector) Create(collectionName string, data *wst.M) (*
 	if (*data)["_id"] == nil && (*data)["id"] != nil {
 		(*data)["_id"] = (*data)["id"]
 	}
-	insertOneResult, err := collection.InsertOne(connector.context, data)
+	insertOneResult, err := collection.InsertOne(ctx, data)
 	if err != nil {
 		return nil, err
 	}
-	return connector.findByObjectId(collectionName, insertOneResult.InsertedID, nil)
+	return connector.findByObjectId(ctx, collectionName, insertOneResult.InsertedID, nil)
 }
 
-func (connector *MongoDBConnector) UpdateById(collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+func (connector *MongoDBConnector) UpdateById(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
 	var db = connector.db
 
 	database := db.Database(connector.dsViper.GetString("database"))
 	collection := database.Collection(collectionName)
 	delete(*data, "id")
 	delete(*data, "_id")
-	if _, err := collection.UpdateOne(connector.context, wst.M{"_id": id}, wst.M{"$set": *data}); err != nil {
-		panic(err)
+	if _, err := collection.UpdateOne(ctx, wst.M{"_id": id}, wst.M{"$set": *data}); err != nil {
+		return nil, err
 	}
-	return connector.findByObjectId(collectionName, id, nil)
+	return connector.findByObjectId(ctx, collectionName, id, nil)
 }
 
-func (connector *MongoDBConnector) DeleteById(collectionName string, id interface{}) (result DeleteResult, err error) {
+func (connector *MongoDBConnector) DeleteById(ctx context.Context, collectionName string, id interface{}) (result DeleteResult, err error) {
 	var db = connector.db
 
 	database := db.Database(connector.dsViper.GetString("database"))
 	collection := database.Collection(collectionName)
-	mongoResult, err := collection.DeleteOne(connector.context, wst.M{"_id": id})
+	mongoResult, err := collection.DeleteOne(ctx, wst.M{"_id": id})
 	if err != nil {
 		return result, err
 	}
 	return DeleteResult{DeletedCount: mongoResult.DeletedCount}, nil
 }
 
-func (connector *MongoDBConnector) DeleteMany(collectionName string, whereLookups *wst.A) (result DeleteResult, err error) {
+func (connector *MongoDBConnector) DeleteMany(ctx context.Context, collectionName string, whereLookups *wst.A) (result DeleteResult, err error) {
 	db := connector.db
 	database := db.Database(connector.dsViper.GetString("database"))
 	collection := database.Collection(collectionName)
 
-	ctx := connector.context
 	var mongoFilter bson.D
 	for key, value := range (*whereLookups)[0]["$match"].(wst.M) {
 		mongoFilter = append(mongoFilter, bson.E{Key: key, Value: value})
@@ -298,7 +325,7 @@ func getDbUrl(dsViper *viper.Viper) string {
 			port = dsViper.GetInt("port")
 		}
 		url = fmt.Sprintf("mongodb://%v:%v/%v", dsViper.GetString("host"), port, dsViper.GetString("database"))
-		log.Printf("Using composed url %v\n", url)
+		logging.Default().Debug("Using composed mongodb url", "url", url)
 	}
 	return url
 }
@@ -2,7 +2,6 @@ package datasource
 
 import (
 	"fmt"
-	"log"
 	"regexp"
 	"strconv"
 	"time"
@@ -10,6 +9,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/logging"
 )
 
 var (
@@ -61,7 +61,7 @@ func ReplaceObjectIds(data interface{}) (interface{}, error) {
 			newValue, err = wst.ParseDate(dataSt)
 		}
 		if err != nil {
-			log.Println("WARNING: ", err)
+			logging.Default().Warn("ReplaceObjectIds: could not convert value", "error", err)
 		}
 		if newValue != nil {
 			return newValue, nil
@@ -84,7 +84,7 @@ func ReplaceObjectIds(data interface{}) (interface{}, error) {
 		finalData = data.(map[string]interface{})
 		break
 	default:
-		log.Println(fmt.Sprintf("WARNING: Invalid input for ReplaceObjectIds() <- %s", data))
+		logging.Default().Warn("Invalid input for ReplaceObjectIds()", "type", fmt.Sprintf("%T", data))
 		return data, nil
 	}
 	for key, value := range finalData {
@@ -237,7 +237,7 @@ func ReplaceObjectIds(data interface{}) (interface{}, error) {
 										asList[i] = v.(wst.M)
 									}
 								} else {
-									log.Println(fmt.Sprintf("WARNING: What to do with %v (%s)?", value, value))
+									logging.Default().Warn("ReplaceObjectIds: unexpected value", "key", key, "type", fmt.Sprintf("%T", value))
 								}
 							}
 						}
@@ -256,11 +256,11 @@ func ReplaceObjectIds(data interface{}) (interface{}, error) {
 			case map[string]interface{}:
 				data.(map[string]interface{})[key] = newValue
 			default:
-				log.Println(fmt.Sprintf("WARNING: invalid input ReplaceObjectIds() <- %s", data))
+				logging.Default().Warn("Invalid input for ReplaceObjectIds()", "type", fmt.Sprintf("%T", data))
 				break
 			}
 		} else if err != nil {
-			log.Println("WARNING: ", err)
+			logging.Default().Warn("ReplaceObjectIds: could not convert value", "key", key, "error", err)
 		}
 	}
 	return data, nil
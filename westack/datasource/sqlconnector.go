@@ -0,0 +1,390 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SQLConnector implements the PersistedConnector interface on top of database/sql.
+// Each collection is mapped to a table storing one JSON document per row. The leading $match, $sort, $skip and $limit
+// stages of the pipelines are translated to SQL, and the rest of them are evaluated in memory. The $lookup stages are
+// not joins: the related documents of all the documents are found with one more query, see lookupDocuments.
+//
+// The driver is not imported by westack, so the application must import it, e.g. _ "github.com/mattn/go-sqlite3".
+// Datasource config:
+//
+//	{
+//	  "connector": "sql",
+//	  "driver": "sqlite3", // name of the database/sql driver
+//	  "dsn": "file:data.db",
+//	  "dialect": "sqlite", // optional, inferred from the driver. One of sqlite or postgres
+//	  "maxOpenConns": 1 // optional, defaults to 1 for sqlite
+//	}
+type SQLConnector struct {
+	db      *sql.DB
+	dialect sqlDialect
+	dsViper *viper.Viper
+	context context.Context
+	timeout float32
+
+	// tables caches the tables already created
+	tables sync.Map
+}
+
+func (connector *SQLConnector) GetName() string {
+	return "sql"
+}
+
+func (connector *SQLConnector) SetConfig(dsViper *viper.Viper) {
+	connector.dsViper = dsViper
+	connector.timeout = float32(dsViper.GetFloat64("timeout"))
+}
+
+func (connector *SQLConnector) Connect(parentContext context.Context) error {
+	driver := connector.dsViper.GetString("driver")
+	if driver == "" {
+		return errors.New("missing driver for sql datasource")
+	}
+	dialectName := connector.dsViper.GetString("dialect")
+	if dialectName == "" {
+		dialectName = driver
+	}
+	dialect, err := sqlDialectFor(dialectName)
+	if err != nil {
+		return err
+	}
+	dsn := connector.dsViper.GetString("dsn")
+	if dsn == "" {
+		dsn = connector.dsViper.GetString("url")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	maxOpenConns := connector.dsViper.GetInt("maxOpenConns")
+	if maxOpenConns <= 0 {
+		if _, isSqlite := dialect.(sqliteDialect); isSqlite {
+			// avoids "database is locked" errors, and keeps in-memory databases alive
+			maxOpenConns = 1
+		}
+	}
+	if maxOpenConns > 0 {
+		db.SetMaxOpenConns(maxOpenConns)
+	}
+
+	if connector.db != nil {
+		_ = connector.db.Close()
+	}
+	connector.db = db
+	connector.dialect = dialect
+	connector.context = parentContext
+	connector.tables = sync.Map{}
+	return nil
+}
+
+// operationContext bounds ctx with the timeout of the datasource, if any
+func (connector *SQLConnector) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if connector.timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(connector.timeout*float32(time.Second)))
+	}
+	return context.WithCancel(ctx)
+}
+
+// ensureTable creates the table of the collection the first time it is used, and returns its quoted name
+func (connector *SQLConnector) ensureTable(ctx context.Context, collectionName string) (string, error) {
+	table, err := quoteSQLIdentifier(collectionName)
+	if err != nil {
+		return "", err
+	}
+	if _, created := connector.tables.Load(collectionName); created {
+		return table, nil
+	}
+	_, err = connector.db.ExecContext(ctx, connector.dialect.createTableStatement(table))
+	if err != nil {
+		return "", err
+	}
+	connector.tables.Store(collectionName, true)
+	return table, nil
+}
+
+func (connector *SQLConnector) FindMany(ctx context.Context, collectionName string, lookups *wst.A) (MongoCursorI, error) {
+	var pipeline wst.A
+	if lookups != nil {
+		pipeline = *lookups
+	}
+	documents, err := connector.findDocuments(ctx, collectionName, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	rawResults := make([][]byte, len(documents))
+	for idx, document := range documents {
+		rawResults[idx], err = bson.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewFixedMongoCursor(rawResults), nil
+}
+
+// findDocuments runs the translatable part of the pipeline in the database, and evaluates the rest in memory.
+// $lookup stages query the related tables with the same strategy
+func (connector *SQLConnector) findDocuments(ctx context.Context, collectionName string, pipeline wst.A) ([]wst.M, error) {
+	plan := (&sqlQueryBuilder{dialect: connector.dialect}).planQuery(pipeline)
+	documents, err := connector.queryDocuments(ctx, collectionName, plan)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.remaining) == 0 {
+		return documents, nil
+	}
+	return evaluatePipeline(documents, plan.remaining, func(collectionName string, pipeline wst.A) ([]wst.M, error) {
+		return connector.findDocuments(ctx, collectionName, pipeline)
+	})
+}
+
+func (connector *SQLConnector) queryDocuments(ctx context.Context, collectionName string, plan *sqlQueryPlan) ([]wst.M, error) {
+	ctx, cancelFn := connector.operationContext(ctx)
+	defer cancelFn()
+	table, err := connector.ensureTable(ctx, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT data FROM " + table + plan.whereClause() + plan.orderByClause()
+	if plan.limit > 0 || plan.offset > 0 {
+		query += connector.dialect.limitOffset(plan.limit, plan.offset)
+	}
+	rows, err := connector.db.QueryContext(ctx, query, plan.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var documents []wst.M
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		document, err := decodeSQLDocument(data)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, rows.Err()
+}
+
+func (connector *SQLConnector) findByObjectId(ctx context.Context, collectionName string, _id interface{}, lookups *wst.A) (*wst.M, error) {
+	wrappedLookups := wst.A{{"$match": wst.M{"_id": _id}}}
+	if lookups != nil {
+		wrappedLookups = append(wrappedLookups, *lookups...)
+	}
+	results, err := connector.findDocuments(ctx, collectionName, wrappedLookups)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("document not found")
+	}
+	return &results[0], nil
+}
+
+func (connector *SQLConnector) Count(ctx context.Context, collectionName string, lookups *wst.A) (int64, error) {
+	var pipeline wst.A
+	if lookups != nil {
+		pipeline = *lookups
+	}
+	plan := (&sqlQueryBuilder{dialect: connector.dialect}).planQuery(pipeline)
+	if len(plan.remaining) > 0 {
+		documents, err := connector.findDocuments(ctx, collectionName, pipeline)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(documents)), nil
+	}
+
+	ctx, cancelFn := connector.operationContext(ctx)
+	defer cancelFn()
+	table, err := connector.ensureTable(ctx, collectionName)
+	if err != nil {
+		return 0, err
+	}
+	query := "SELECT COUNT(*) FROM " + table + plan.whereClause()
+	if plan.limit > 0 || plan.offset > 0 {
+		query = "SELECT COUNT(*) FROM (SELECT id FROM " + table + plan.whereClause() + connector.dialect.limitOffset(plan.limit, plan.offset) + ") AS counted"
+	}
+	var count int64
+	err = connector.db.QueryRowContext(ctx, query, plan.args...).Scan(&count)
+	return count, err
+}
+
+// Create stores the document under its "_id", generating a new ObjectID if not present
+func (connector *SQLConnector) Create(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	data = documentToCreate(data)
+
+	encoded, err := encodeSQLDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancelFn := connector.operationContext(ctx)
+	defer cancelFn()
+	table, err := connector.ensureTable(ctx, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	dialect := connector.dialect
+	_, err = connector.db.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %v (id, data) VALUES (%v, %v)", table, dialect.placeholder(1), dialect.placeholder(2)),
+		idToKey((*data)["_id"]), string(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return connector.findByObjectId(ctx, collectionName, (*data)["_id"], nil)
+}
+
+func (connector *SQLConnector) UpdateById(ctx context.Context, collectionName string, id interface{}, data *wst.M) (*wst.M, error) {
+	delete(*data, "id")
+	delete(*data, "_id")
+
+	ctx, cancelFn := connector.operationContext(ctx)
+	defer cancelFn()
+	table, err := connector.ensureTable(ctx, collectionName)
+	if err != nil {
+		return nil, err
+	}
+	dialect := connector.dialect
+	tx, err := connector.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// no-op if already committed
+		_ = tx.Rollback()
+	}()
+
+	var current []byte
+	err = tx.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT data FROM %v WHERE id = %v%v", table, dialect.placeholder(1), dialect.forUpdate()),
+		idToKey(id)).Scan(&current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("document not found")
+		}
+		return nil, err
+	}
+	document, err := decodeSQLDocument(current)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range *data {
+		document[k] = v
+	}
+	encoded, err := encodeSQLDocument(document)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("UPDATE %v SET data = %v WHERE id = %v", table, dialect.placeholder(1), dialect.placeholder(2)),
+		string(encoded), idToKey(id))
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return connector.findByObjectId(ctx, collectionName, id, nil)
+}
+
+func (connector *SQLConnector) DeleteById(ctx context.Context, collectionName string, id interface{}) (result DeleteResult, err error) {
+	ctx, cancelFn := connector.operationContext(ctx)
+	defer cancelFn()
+	table, err := connector.ensureTable(ctx, collectionName)
+	if err != nil {
+		return result, err
+	}
+	sqlResult, err := connector.db.ExecContext(ctx,
+		fmt.Sprintf("DELETE FROM %v WHERE id = %v", table, connector.dialect.placeholder(1)),
+		idToKey(id))
+	if err != nil {
+		return result, err
+	}
+	result.DeletedCount, err = sqlResult.RowsAffected()
+	return result, err
+}
+
+// DeleteMany deletes with a single statement when the filter can be translated to SQL.
+// Otherwise, the matching documents are found in memory and deleted by id
+func (connector *SQLConnector) DeleteMany(ctx context.Context, collectionName string, whereLookups *wst.A) (result DeleteResult, err error) {
+	where, ok := toM((*whereLookups)[0]["$match"])
+	if !ok {
+		return result, errors.New("invalid $match stage")
+	}
+	builder := &sqlQueryBuilder{dialect: connector.dialect}
+	clause, translated := builder.where(where)
+
+	var ids []string
+	if !translated {
+		documents, err := connector.findDocuments(ctx, collectionName, wst.A{{"$match": where}})
+		if err != nil {
+			return result, err
+		}
+		if len(documents) == 0 {
+			return result, nil
+		}
+		for _, document := range documents {
+			ids = append(ids, builder.bind(idToKey(document["_id"])))
+		}
+		clause = fmt.Sprintf("id IN (%v)", strings.Join(ids, ", "))
+	}
+
+	ctx, cancelFn := connector.operationContext(ctx)
+	defer cancelFn()
+	table, err := connector.ensureTable(ctx, collectionName)
+	if err != nil {
+		return result, err
+	}
+	sqlResult, err := connector.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE %v", table, clause), builder.args...)
+	if err != nil {
+		return result, err
+	}
+	result.DeletedCount, err = sqlResult.RowsAffected()
+	return result, err
+}
+
+func (connector *SQLConnector) Disconnect() error {
+	return connector.db.Close()
+}
+
+func (connector *SQLConnector) Ping(parentCtx context.Context) error {
+	ctx := parentCtx
+	if connector.timeout > 0 {
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(parentCtx, time.Duration(connector.timeout*float32(time.Second)))
+		defer cancelFn()
+	}
+	return connector.db.PingContext(ctx)
+}
+
+func (connector *SQLConnector) SetTimeout(seconds float32) {
+	connector.timeout = seconds
+	connector.dsViper.Set("timeout", seconds)
+}
+
+func (connector *SQLConnector) GetClient() interface{} {
+	return connector.db
+}
+
+// NewSQLConnector Factory method for SQLConnector
+func NewSQLConnector() PersistedConnector {
+	return &SQLConnector{}
+}
@@ -0,0 +1,226 @@
+package datasource
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sqlValueKind classifies the operands of the filters. Stored values are only compared against operands of the same
+// kind, like mongo does
+type sqlValueKind int
+
+const (
+	sqlKindNull sqlValueKind = iota
+	sqlKindNumber
+	sqlKindString
+	sqlKindBool
+	sqlKindObjectId
+	sqlKindDate
+	sqlKindArray
+)
+
+// sqlJSONRef points to a JSON value stored in the data column, which can be a document field or an array element
+type sqlJSONRef struct {
+	// typeExpr evaluates to the JSON type of the value, or NULL if it does not exist
+	typeExpr string
+	// valueExpr evaluates to the scalar value
+	valueExpr string
+	// member returns the expression of a key inside an object value, like "$oid" or "$date"
+	member func(key string) string
+	// elements is the table-valued expression that iterates over an array value
+	elements string
+}
+
+// sqlDialect abstracts the differences between the supported databases when querying the JSON documents.
+// Documents are stored in tables with two columns: "id", the primary key, and "data", the document in relaxed
+// extended JSON, where dates are stored as {"$date": <milliseconds>}
+type sqlDialect interface {
+	placeholder(index int) string
+	createTableStatement(table string) string
+	limitOffset(limit int64, offset int64) string
+	forUpdate() string
+	fieldRef(path []string) sqlJSONRef
+	elementRef(alias string) sqlJSONRef
+	typeIs(ref sqlJSONRef, kind sqlValueKind) string
+	value(ref sqlJSONRef, kind sqlValueKind) string
+}
+
+// Field names are inlined in the queries as JSON paths, so only safe characters are allowed.
+// Filters on other fields are evaluated in memory
+var sqlSafeFieldRegex = regexp.MustCompile(`^[A-Za-z0-9_$\-]+$`)
+
+func sqlDialectFor(name string) (sqlDialect, error) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "sqlite"):
+		return sqliteDialect{}, nil
+	case strings.Contains(name, "postgres"), name == "pgx", name == "pq":
+		return postgresDialect{}, nil
+	}
+	return nil, fmt.Errorf("unsupported sql dialect %v", name)
+}
+
+func quoteSQLIdentifier(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\"\x00") {
+		return "", fmt.Errorf("invalid table name %q", name)
+	}
+	return fmt.Sprintf(`"%v"`, name), nil
+}
+
+type sqliteDialect struct{}
+
+func (dialect sqliteDialect) placeholder(index int) string {
+	return "?"
+}
+
+func (dialect sqliteDialect) createTableStatement(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (id TEXT PRIMARY KEY, data TEXT NOT NULL)", table)
+}
+
+func (dialect sqliteDialect) limitOffset(limit int64, offset int64) string {
+	if limit <= 0 {
+		// sqlite does not allow OFFSET without LIMIT
+		limit = -1
+	}
+	return fmt.Sprintf(" LIMIT %v OFFSET %v", limit, offset)
+}
+
+func (dialect sqliteDialect) forUpdate() string {
+	// sqlite locks the whole database when the transaction writes
+	return ""
+}
+
+func (dialect sqliteDialect) jsonPath(path []string) string {
+	return fmt.Sprintf(`'$."%v"'`, strings.Join(path, `"."`))
+}
+
+func (dialect sqliteDialect) fieldRef(path []string) sqlJSONRef {
+	jsonPath := dialect.jsonPath(path)
+	return sqlJSONRef{
+		typeExpr:  fmt.Sprintf("json_type(data, %v)", jsonPath),
+		valueExpr: fmt.Sprintf("json_extract(data, %v)", jsonPath),
+		member: func(key string) string {
+			return fmt.Sprintf("json_extract(data, %v)", dialect.jsonPath(append(append([]string{}, path...), key)))
+		},
+		elements: fmt.Sprintf("json_each(data, %v)", jsonPath),
+	}
+}
+
+func (dialect sqliteDialect) elementRef(alias string) sqlJSONRef {
+	return sqlJSONRef{
+		typeExpr:  fmt.Sprintf("%v.type", alias),
+		valueExpr: fmt.Sprintf("%v.value", alias),
+		member: func(key string) string {
+			return fmt.Sprintf(`json_extract(%v.value, '$."%v"')`, alias, key)
+		},
+	}
+}
+
+func (dialect sqliteDialect) typeIs(ref sqlJSONRef, kind sqlValueKind) string {
+	switch kind {
+	case sqlKindNull:
+		return fmt.Sprintf("COALESCE(%v, 'null') = 'null'", ref.typeExpr)
+	case sqlKindNumber:
+		return fmt.Sprintf("COALESCE(%v, '') IN ('integer', 'real')", ref.typeExpr)
+	case sqlKindString:
+		return fmt.Sprintf("COALESCE(%v, '') = 'text'", ref.typeExpr)
+	case sqlKindBool:
+		return fmt.Sprintf("COALESCE(%v, '') IN ('true', 'false')", ref.typeExpr)
+	case sqlKindObjectId:
+		return fmt.Sprintf("(COALESCE(%v, '') = 'object' AND %v IS NOT NULL)", ref.typeExpr, ref.member("$oid"))
+	case sqlKindDate:
+		return fmt.Sprintf("(COALESCE(%v, '') = 'object' AND %v IS NOT NULL)", ref.typeExpr, ref.member("$date"))
+	default:
+		return fmt.Sprintf("COALESCE(%v, '') = 'array'", ref.typeExpr)
+	}
+}
+
+func (dialect sqliteDialect) value(ref sqlJSONRef, kind sqlValueKind) string {
+	switch kind {
+	case sqlKindObjectId:
+		return ref.member("$oid")
+	case sqlKindDate:
+		return ref.member("$date")
+	default:
+		// json_extract already returns numbers, strings, and booleans as 0 or 1
+		return ref.valueExpr
+	}
+}
+
+type postgresDialect struct{}
+
+func (dialect postgresDialect) placeholder(index int) string {
+	return fmt.Sprintf("$%v", index)
+}
+
+func (dialect postgresDialect) createTableStatement(table string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (id TEXT PRIMARY KEY, data JSONB NOT NULL)", table)
+}
+
+func (dialect postgresDialect) limitOffset(limit int64, offset int64) string {
+	if limit <= 0 {
+		return fmt.Sprintf(" OFFSET %v", offset)
+	}
+	return fmt.Sprintf(" LIMIT %v OFFSET %v", limit, offset)
+}
+
+func (dialect postgresDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (dialect postgresDialect) jsonRef(jsonExpr string) sqlJSONRef {
+	return sqlJSONRef{
+		typeExpr:  fmt.Sprintf("jsonb_typeof(%v)", jsonExpr),
+		valueExpr: fmt.Sprintf("(%v #>> '{}')", jsonExpr),
+		member: func(key string) string {
+			return fmt.Sprintf("(%v ->> '%v')", jsonExpr, key)
+		},
+		elements: fmt.Sprintf("jsonb_array_elements(%v)", jsonExpr),
+	}
+}
+
+func (dialect postgresDialect) fieldRef(path []string) sqlJSONRef {
+	return dialect.jsonRef(fmt.Sprintf("(data #> '{%v}')", strings.Join(path, ",")))
+}
+
+func (dialect postgresDialect) elementRef(alias string) sqlJSONRef {
+	return dialect.jsonRef(fmt.Sprintf("%v.value", alias))
+}
+
+func (dialect postgresDialect) typeIs(ref sqlJSONRef, kind sqlValueKind) string {
+	switch kind {
+	case sqlKindNull:
+		return fmt.Sprintf("COALESCE(%v, 'null') = 'null'", ref.typeExpr)
+	case sqlKindNumber:
+		return fmt.Sprintf("COALESCE(%v, '') = 'number'", ref.typeExpr)
+	case sqlKindString:
+		return fmt.Sprintf("COALESCE(%v, '') = 'string'", ref.typeExpr)
+	case sqlKindBool:
+		return fmt.Sprintf("COALESCE(%v, '') = 'boolean'", ref.typeExpr)
+	case sqlKindObjectId:
+		return fmt.Sprintf("(COALESCE(%v, '') = 'object' AND %v IS NOT NULL)", ref.typeExpr, ref.member("$oid"))
+	case sqlKindDate:
+		return fmt.Sprintf("(COALESCE(%v, '') = 'object' AND %v IS NOT NULL)", ref.typeExpr, ref.member("$date"))
+	default:
+		return fmt.Sprintf("COALESCE(%v, '') = 'array'", ref.typeExpr)
+	}
+}
+
+func (dialect postgresDialect) value(ref sqlJSONRef, kind sqlValueKind) string {
+	switch kind {
+	case sqlKindNumber:
+		return fmt.Sprintf("%v::numeric", ref.valueExpr)
+	case sqlKindString:
+		// compare strings byte by byte, like mongo does
+		return fmt.Sprintf(`%v COLLATE "C"`, ref.valueExpr)
+	case sqlKindBool:
+		return fmt.Sprintf("(CASE WHEN %v::boolean THEN 1 ELSE 0 END)", ref.valueExpr)
+	case sqlKindObjectId:
+		return ref.member("$oid")
+	case sqlKindDate:
+		return fmt.Sprintf("%v::numeric", ref.member("$date"))
+	default:
+		return ref.valueExpr
+	}
+}
@@ -0,0 +1,429 @@
+package datasource
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqlQueryPlan splits a pipeline into the leading stages that are translated to SQL and the remaining ones, which
+// are evaluated in memory with the results of the query
+type sqlQueryPlan struct {
+	where     []string
+	orderBy   []string
+	limit     int64
+	offset    int64
+	args      []interface{}
+	remaining wst.A
+}
+
+func (plan *sqlQueryPlan) whereClause() string {
+	if len(plan.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(plan.where, " AND ")
+}
+
+func (plan *sqlQueryPlan) orderByClause() string {
+	if len(plan.orderBy) == 0 {
+		return ""
+	}
+	return " ORDER BY " + strings.Join(plan.orderBy, ", ")
+}
+
+type sqlQueryBuilder struct {
+	dialect sqlDialect
+	args    []interface{}
+	aliases int
+}
+
+func (builder *sqlQueryBuilder) bind(value interface{}) string {
+	builder.args = append(builder.args, value)
+	return builder.dialect.placeholder(len(builder.args))
+}
+
+// planQuery translates $match, $sort, $skip and $limit stages while the results are the same as running them in
+// mongo. As soon as a stage cannot be translated, it and the following stages are left for the in-memory evaluation
+func (builder *sqlQueryBuilder) planQuery(pipeline wst.A) *sqlQueryPlan {
+	plan := &sqlQueryPlan{}
+	hasLimit := false
+	for idx, stage := range pipeline {
+		translated := false
+		if len(stage) == 1 {
+			for stageName, stageValue := range stage {
+				switch stageName {
+				case "$match":
+					if hasLimit || plan.offset > 0 {
+						break
+					}
+					where, ok := toM(stageValue)
+					if !ok {
+						break
+					}
+					var clause string
+					if clause, translated = builder.where(where); translated {
+						plan.where = append(plan.where, clause)
+					}
+				case "$sort":
+					if hasLimit || plan.offset > 0 || len(plan.orderBy) > 0 {
+						break
+					}
+					var orderBy []string
+					if orderBy, translated = builder.orderBy(stageValue); translated {
+						plan.orderBy = orderBy
+					}
+				case "$skip":
+					skip, err := toInt64(stageValue)
+					if err != nil || skip < 0 || hasLimit {
+						break
+					}
+					plan.offset += skip
+					translated = true
+				case "$limit":
+					limit, err := toInt64(stageValue)
+					if err != nil || limit <= 0 {
+						break
+					}
+					if !hasLimit || limit < plan.limit {
+						plan.limit = limit
+					}
+					hasLimit = true
+					translated = true
+				}
+			}
+		}
+		if !translated {
+			plan.remaining = pipeline[idx:]
+			break
+		}
+	}
+	plan.args = builder.args
+	return plan
+}
+
+// where translates a mongo-like where clause. It returns false if any part of the clause cannot be expressed in SQL
+func (builder *sqlQueryBuilder) where(where wst.M) (string, bool) {
+	argsBefore := len(builder.args)
+	clause, ok := builder.translateWhere(where)
+	if !ok {
+		builder.args = builder.args[:argsBefore]
+	}
+	return clause, ok
+}
+
+func (builder *sqlQueryBuilder) translateWhere(where wst.M) (string, bool) {
+	keys := make([]string, 0, len(where))
+	for key := range where {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var clauses []string
+	for _, key := range keys {
+		condition := where[key]
+		switch key {
+		case "$and", "$or", "$nor":
+			items, ok := toSlice(condition)
+			if !ok || len(items) == 0 {
+				return "", false
+			}
+			subClauses := make([]string, len(items))
+			for idx, item := range items {
+				subWhere, ok := toM(item)
+				if !ok {
+					return "", false
+				}
+				subClauses[idx], ok = builder.translateWhere(subWhere)
+				if !ok {
+					return "", false
+				}
+			}
+			switch key {
+			case "$and":
+				clauses = append(clauses, "("+strings.Join(subClauses, " AND ")+")")
+			case "$or":
+				clauses = append(clauses, "("+strings.Join(subClauses, " OR ")+")")
+			case "$nor":
+				clauses = append(clauses, "NOT ("+strings.Join(subClauses, " OR ")+")")
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return "", false
+			}
+			path := strings.Split(key, ".")
+			for _, part := range path {
+				if !sqlSafeFieldRegex.MatchString(part) {
+					return "", false
+				}
+			}
+			clause, ok := builder.condition(path, condition)
+			if !ok {
+				return "", false
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+	if len(clauses) == 0 {
+		return "1 = 1", true
+	}
+	return "(" + strings.Join(clauses, " AND ") + ")", true
+}
+
+func (builder *sqlQueryBuilder) condition(path []string, condition interface{}) (string, bool) {
+	operators, isOperatorMap := toM(condition)
+	if isOperatorMap {
+		for operator := range operators {
+			if !strings.HasPrefix(operator, "$") {
+				// embedded documents are compared in memory
+				return "", false
+			}
+		}
+	}
+	if !isOperatorMap {
+		return builder.compare(path, "$eq", condition)
+	}
+
+	operatorNames := make([]string, 0, len(operators))
+	for operator := range operators {
+		operatorNames = append(operatorNames, operator)
+	}
+	sort.Strings(operatorNames)
+
+	var clauses []string
+	for _, operator := range operatorNames {
+		operand := operators[operator]
+		var clause string
+		var ok bool
+		switch operator {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			clause, ok = builder.compare(path, operator, operand)
+		case "$in", "$nin":
+			var items []interface{}
+			items, ok = toSlice(operand)
+			if !ok {
+				return "", false
+			}
+			alternatives := make([]string, len(items))
+			for idx, item := range items {
+				alternatives[idx], ok = builder.compare(path, "$eq", item)
+				if !ok {
+					return "", false
+				}
+			}
+			if len(alternatives) == 0 {
+				clause = "1 = 0"
+			} else {
+				clause = "(" + strings.Join(alternatives, " OR ") + ")"
+			}
+			if operator == "$nin" {
+				clause = "NOT " + clause
+			}
+		case "$exists":
+			var shouldExist bool
+			shouldExist, ok = operand.(bool)
+			if shouldExist {
+				clause = builder.dialect.fieldRef(path).typeExpr + " IS NOT NULL"
+			} else {
+				clause = builder.dialect.fieldRef(path).typeExpr + " IS NULL"
+			}
+		}
+		if !ok {
+			return "", false
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return "", false
+	}
+	return "(" + strings.Join(clauses, " AND ") + ")", true
+}
+
+var sqlComparisonOperators = map[string]string{
+	"$eq":  "=",
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+// compare follows the mongo semantics: values only match operands of the same kind, and arrays match if any of
+// their elements matches
+func (builder *sqlQueryBuilder) compare(path []string, operator string, operand interface{}) (string, bool) {
+	if operator == "$ne" {
+		clause, ok := builder.compare(path, "$eq", operand)
+		return "NOT " + clause, ok
+	}
+	kind, param, ok := sqlOperand(operand)
+	if !ok {
+		return "", false
+	}
+	dialect := builder.dialect
+	ref := dialect.fieldRef(path)
+	if kind == sqlKindNull {
+		if operator != "$eq" {
+			return "", false
+		}
+		return dialect.typeIs(ref, sqlKindNull), true
+	}
+	if len(path) == 1 && path[0] == "_id" && operator == "$eq" {
+		// use the primary key
+		return fmt.Sprintf("(id = %v AND %v)", builder.bind(idToKey(operand)), dialect.typeIs(ref, kind)), true
+	}
+	sqlOperator := sqlComparisonOperators[operator]
+	builder.aliases++
+	alias := fmt.Sprintf("elem%v", builder.aliases)
+	element := dialect.elementRef(alias)
+	// the type is checked in a CASE because AND does not guarantee the evaluation order, and casts could fail
+	return fmt.Sprintf("(CASE WHEN %v THEN EXISTS (SELECT 1 FROM %v AS %v WHERE CASE WHEN %v THEN %v %v %v ELSE FALSE END) WHEN %v THEN %v %v %v ELSE FALSE END)",
+		dialect.typeIs(ref, sqlKindArray),
+		ref.elements, sqlElementsAlias(dialect, alias),
+		dialect.typeIs(element, kind), dialect.value(element, kind), sqlOperator, builder.bind(param),
+		dialect.typeIs(ref, kind), dialect.value(ref, kind), sqlOperator, builder.bind(param),
+	), true
+}
+
+func sqlElementsAlias(dialect sqlDialect, alias string) string {
+	if _, isPostgres := dialect.(postgresDialect); isPostgres {
+		return fmt.Sprintf("%v(value)", alias)
+	}
+	return alias
+}
+
+// orderBy sorts by the mongo type order first, and then by the value inside each type
+func (builder *sqlQueryBuilder) orderBy(rawSort interface{}) ([]string, bool) {
+	var sortKeys bson.D
+	switch rawSort.(type) {
+	case bson.D:
+		sortKeys = rawSort.(bson.D)
+	default:
+		asM, ok := toM(rawSort)
+		if !ok {
+			return nil, false
+		}
+		keys := make([]string, 0, len(asM))
+		for key := range asM {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sortKeys = append(sortKeys, bson.E{Key: key, Value: asM[key]})
+		}
+	}
+	dialect := builder.dialect
+	var orderBy []string
+	for _, sortKey := range sortKeys {
+		direction, err := toInt64(sortKey.Value)
+		if err != nil || (direction != 1 && direction != -1) {
+			return nil, false
+		}
+		path := strings.Split(sortKey.Key, ".")
+		for _, part := range path {
+			if !sqlSafeFieldRegex.MatchString(part) {
+				return nil, false
+			}
+		}
+		sqlDirection := "ASC"
+		if direction == -1 {
+			sqlDirection = "DESC"
+		}
+		ref := dialect.fieldRef(path)
+		rank := fmt.Sprintf("CASE WHEN %v THEN 1 WHEN %v THEN 2 WHEN %v THEN 3 WHEN %v THEN 7 WHEN %v THEN 9 WHEN %v THEN 5 WHEN %v THEN 8 ELSE 4 END",
+			dialect.typeIs(ref, sqlKindNull), dialect.typeIs(ref, sqlKindNumber), dialect.typeIs(ref, sqlKindString),
+			dialect.typeIs(ref, sqlKindObjectId), dialect.typeIs(ref, sqlKindDate), dialect.typeIs(ref, sqlKindArray),
+			dialect.typeIs(ref, sqlKindBool))
+		numericValue := fmt.Sprintf("CASE WHEN %v THEN %v WHEN %v THEN %v WHEN %v THEN %v END",
+			dialect.typeIs(ref, sqlKindNumber), dialect.value(ref, sqlKindNumber),
+			dialect.typeIs(ref, sqlKindDate), dialect.value(ref, sqlKindDate),
+			dialect.typeIs(ref, sqlKindBool), dialect.value(ref, sqlKindBool))
+		textValue := fmt.Sprintf("CASE WHEN %v THEN %v WHEN %v THEN %v END",
+			dialect.typeIs(ref, sqlKindString), dialect.value(ref, sqlKindString),
+			dialect.typeIs(ref, sqlKindObjectId), dialect.value(ref, sqlKindObjectId))
+		orderBy = append(orderBy,
+			fmt.Sprintf("%v %v", rank, sqlDirection),
+			fmt.Sprintf("%v %v", numericValue, sqlDirection),
+			fmt.Sprintf("%v %v", textValue, sqlDirection),
+		)
+	}
+	return orderBy, len(orderBy) > 0
+}
+
+// sqlOperand returns the kind of the operand and the value bound to the query
+func sqlOperand(operand interface{}) (sqlValueKind, interface{}, bool) {
+	switch v := operand.(type) {
+	case nil, primitive.Null:
+		return sqlKindNull, nil, true
+	case string:
+		return sqlKindString, v, true
+	case bool:
+		if v {
+			return sqlKindBool, 1, true
+		}
+		return sqlKindBool, 0, true
+	case primitive.ObjectID:
+		return sqlKindObjectId, v.Hex(), true
+	case *primitive.ObjectID:
+		if v == nil {
+			return sqlKindNull, nil, true
+		}
+		return sqlKindObjectId, v.Hex(), true
+	case time.Time:
+		return sqlKindDate, v.UnixMilli(), true
+	case primitive.DateTime:
+		return sqlKindDate, int64(v), true
+	}
+	if typeRank(operand) == 2 {
+		return sqlKindNumber, toFloat64(operand), true
+	}
+	return 0, nil, false
+}
+
+// encodeSQLDocument converts the document to relaxed extended JSON. Dates are stored as {"$date": <milliseconds>}
+// instead of ISO strings so that they can be compared and sorted
+func encodeSQLDocument(document interface{}) ([]byte, error) {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var asD primitive.D
+	err = bson.Unmarshal(raw, &asD)
+	if err != nil {
+		return nil, err
+	}
+	return bson.MarshalExtJSON(encodeSQLDates(asD), false, false)
+}
+
+func encodeSQLDates(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.D:
+		out := make(primitive.D, len(v))
+		for idx, e := range v {
+			out[idx] = primitive.E{Key: e.Key, Value: encodeSQLDates(e.Value)}
+		}
+		return out
+	case primitive.A:
+		out := make(primitive.A, len(v))
+		for idx, item := range v {
+			out[idx] = encodeSQLDates(item)
+		}
+		return out
+	case primitive.DateTime:
+		return primitive.D{{Key: "$date", Value: int64(v)}}
+	}
+	return value
+}
+
+func decodeSQLDocument(data []byte) (wst.M, error) {
+	var raw bson.Raw
+	err := bson.UnmarshalExtJSON(data, false, &raw)
+	if err != nil {
+		return nil, err
+	}
+	var document wst.M
+	err = bson.Unmarshal(raw, &document)
+	return document, err
+}
@@ -0,0 +1,3 @@
+// Package sqltests tests the SQL connector with the database/sql drivers. It is a separate module, so that the drivers,
+// which the connector does not import, are not dependencies of westack
+package sqltests
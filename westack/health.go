@@ -0,0 +1,102 @@
+package westack
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// readinessPingTimeout bounds every datasource ping of the readiness probe
+const readinessPingTimeout = 2 * time.Second
+
+func durationMillis(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000.0
+}
+
+func datasourceHealthStatus(ds *datasource.Datasource) wst.M {
+	health := ds.Health()
+	status := wst.M{
+		"state":               health.State.String(),
+		"consecutiveFailures": health.ConsecutiveFailures,
+		"latencyMs":           durationMillis(health.LastLatency),
+	}
+	if !health.LastCheck.IsZero() {
+		status["lastCheck"] = health.LastCheck
+	}
+	if health.LastError != nil {
+		status["error"] = health.LastError.Error()
+	}
+	return status
+}
+
+// healthHandler is the liveness probe. It answers as long as the server can handle requests, and reports the state
+// of the datasources from their last health check without pinging them
+func healthHandler(app *WeStack) func(ctx *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		datasources := wst.M{}
+		for dsName, ds := range *app.datasources {
+			datasources[dsName] = datasourceHealthStatus(ds)
+		}
+		return ctx.JSON(wst.M{
+			"status":        "ok",
+			"uptimeSeconds": time.Since(app.init).Seconds(),
+			"datasources":   datasources,
+		})
+	}
+}
+
+// readinessHandler is the readiness probe. The app is ready when the models are loaded, the admin user is upserted,
+// every datasource answers to a ping and the app is not stopping. It answers 503 otherwise
+func readinessHandler(app *WeStack) func(ctx *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		pingCtx, cancelFn := context.WithTimeout(context.Background(), readinessPingTimeout)
+		defer cancelFn()
+
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		datasources := wst.M{}
+		datasourcesReady := true
+		for dsName, ds := range *app.datasources {
+			wg.Add(1)
+			go func(dsName string, ds *datasource.Datasource) {
+				defer wg.Done()
+				latency, err := ds.Ping(pingCtx)
+				status := datasourceHealthStatus(ds)
+				status["latencyMs"] = durationMillis(latency)
+				status["ready"] = err == nil
+				if err != nil {
+					status["error"] = err.Error()
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				datasources[dsName] = status
+				if err != nil {
+					datasourcesReady = false
+				}
+			}(dsName, ds)
+		}
+		wg.Wait()
+
+		checks := wst.M{
+			"modelsLoaded":  app.modelsLoaded.Load(),
+			"adminUpserted": app.adminUpserted.Load(),
+			"stopping":      app.stopping.Load(),
+			"datasources":   datasourcesReady,
+		}
+		ready := app.modelsLoaded.Load() && app.adminUpserted.Load() && !app.stopping.Load() && datasourcesReady
+		status := fiber.StatusOK
+		if !ready {
+			status = fiber.StatusServiceUnavailable
+		}
+		return ctx.Status(status).JSON(wst.M{
+			"ready":       ready,
+			"checks":      checks,
+			"datasources": datasources,
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package jwtkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// KeyConfig describes a key of the "jwt.keys" config. The keys are PEM encoded, either inline or in a file. A key
+// without private key can only verify tokens, like the previous key during a rotation
+type KeyConfig struct {
+	// Kid identifies the key in the "kid" header of the tokens and in the JWKS
+	Kid string `mapstructure:"kid" json:"kid"`
+	// Algorithm is "RS256" or "ES256"
+	Algorithm      string `mapstructure:"algorithm" json:"algorithm"`
+	PrivateKey     string `mapstructure:"privateKey" json:"privateKey"`
+	PrivateKeyFile string `mapstructure:"privateKeyFile" json:"privateKeyFile"`
+	PublicKey      string `mapstructure:"publicKey" json:"publicKey"`
+	PublicKeyFile  string `mapstructure:"publicKeyFile" json:"publicKeyFile"`
+}
+
+// Config is the "jwt" section of the app config
+type Config struct {
+	// SigningKid is the kid of the key that signs the new tokens. When empty, the tokens are signed with the
+	// HMAC secret of the app
+	SigningKid string      `mapstructure:"signingKid" json:"signingKid"`
+	Keys       []KeyConfig `mapstructure:"keys" json:"keys"`
+	// AcceptHmacTokens keeps accepting the tokens signed with the HMAC secret once there is a signing key, until the
+	// ones issued before configuring it expire
+	AcceptHmacTokens bool `mapstructure:"acceptHmacTokens" json:"acceptHmacTokens"`
+}
+
+// Key is a key that verifies the tokens with its kid, and signs them when it has a private key
+type Key struct {
+	Kid       string
+	Algorithm string
+
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// KeySet signs the tokens with a single key and verifies them with any of its keys, selected by the "kid" header.
+// The tokens without kid are verified with the HMAC secret, which is also the signing key when there is no other one.
+// Once there is a signing key, they are rejected unless AcceptHMAC is enabled
+type KeySet struct {
+	secret     []byte
+	signing    *Key
+	keys       map[string]*Key
+	ordered    []*Key
+	acceptHMAC bool
+}
+
+// NewKeySet creates a key set. signingKid must be the kid of one of keys with a private key, or empty to sign with
+// the HMAC secret
+func NewKeySet(secret []byte, signingKid string, keys ...*Key) (*KeySet, error) {
+	keySet := &KeySet{
+		secret:     secret,
+		keys:       make(map[string]*Key, len(keys)),
+		acceptHMAC: signingKid == "",
+	}
+	for _, key := range keys {
+		if key.Kid == "" {
+			return nil, errors.New("jwt keys must have a kid")
+		}
+		if _, exists := keySet.keys[key.Kid]; exists {
+			return nil, fmt.Errorf("duplicated jwt key %v", key.Kid)
+		}
+		keySet.keys[key.Kid] = key
+		keySet.ordered = append(keySet.ordered, key)
+	}
+	if signingKid != "" {
+		signing := keySet.keys[signingKid]
+		if signing == nil {
+			return nil, fmt.Errorf("jwt signing key %v not found", signingKid)
+		}
+		if signing.privateKey == nil {
+			return nil, fmt.Errorf("jwt signing key %v has no private key", signingKid)
+		}
+		keySet.signing = signing
+	}
+	return keySet, nil
+}
+
+// Load creates the key set described by the config, reading the PEM files
+func Load(config Config, secret []byte) (*KeySet, error) {
+	keys := make([]*Key, 0, len(config.Keys))
+	for _, keyConfig := range config.Keys {
+		key, err := LoadKey(keyConfig)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	keySet, err := NewKeySet(secret, config.SigningKid, keys...)
+	if err != nil {
+		return nil, err
+	}
+	if config.AcceptHmacTokens {
+		keySet.AcceptHMAC(true)
+	}
+	return keySet, nil
+}
+
+// AcceptHMAC sets whether the tokens signed with the HMAC secret are accepted when there is a signing key
+func (keySet *KeySet) AcceptHMAC(accept bool) {
+	keySet.acceptHMAC = accept || keySet.signing == nil
+}
+
+// LoadKey parses the PEM keys of the config. The public key is derived from the private key when only the latter is
+// set
+func LoadKey(config KeyConfig) (*Key, error) {
+	privatePEM, err := readPEM(config.PrivateKey, config.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := readPEM(config.PublicKey, config.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if privatePEM == nil && publicPEM == nil {
+		return nil, fmt.Errorf("jwt key %v has neither private nor public key", config.Kid)
+	}
+
+	var privateKey, publicKey interface{}
+	switch config.Algorithm {
+	case "RS256":
+		if privatePEM != nil {
+			rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private key of jwt key %v: %w", config.Kid, err)
+			}
+			privateKey, publicKey = rsaKey, &rsaKey.PublicKey
+		} else {
+			publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+		}
+	case "ES256":
+		if privatePEM != nil {
+			ecKey, err := jwt.ParseECPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private key of jwt key %v: %w", config.Kid, err)
+			}
+			privateKey, publicKey = ecKey, &ecKey.PublicKey
+		} else {
+			publicKey, err = jwt.ParseECPublicKeyFromPEM(publicPEM)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q of jwt key %v, use RS256 or ES256", config.Algorithm, config.Kid)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of jwt key %v: %w", config.Kid, err)
+	}
+	return NewKey(config.Kid, privateKey, publicKey)
+}
+
+// NewKey creates a key from an *rsa.PrivateKey or *ecdsa.PrivateKey, or only from the public key to verify tokens.
+// RSA keys use RS256 and ECDSA keys, which must be on the P-256 curve, use ES256
+func NewKey(kid string, privateKey interface{}, publicKey interface{}) (*Key, error) {
+	if publicKey == nil {
+		switch v := privateKey.(type) {
+		case *rsa.PrivateKey:
+			publicKey = &v.PublicKey
+		case *ecdsa.PrivateKey:
+			publicKey = &v.PublicKey
+		}
+	}
+	key := &Key{Kid: kid, privateKey: privateKey, publicKey: publicKey}
+	switch v := publicKey.(type) {
+	case *rsa.PublicKey:
+		key.Algorithm, key.method = "RS256", jwt.SigningMethodRS256
+		if _, ok := privateKey.(*rsa.PrivateKey); privateKey != nil && !ok {
+			return nil, fmt.Errorf("the private key of jwt key %v does not match its public key", kid)
+		}
+	case *ecdsa.PublicKey:
+		if v.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("jwt key %v must use the P-256 curve", kid)
+		}
+		key.Algorithm, key.method = "ES256", jwt.SigningMethodES256
+		if _, ok := privateKey.(*ecdsa.PrivateKey); privateKey != nil && !ok {
+			return nil, fmt.Errorf("the private key of jwt key %v does not match its public key", kid)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T of jwt key %v", publicKey, kid)
+	}
+	return key, nil
+}
+
+// PublicKey returns the *rsa.PublicKey or *ecdsa.PublicKey that verifies the tokens of the key
+func (key *Key) PublicKey() interface{} {
+	return key.publicKey
+}
+
+// ParseJWK creates a key that only verifies tokens from a public key in the JSON Web Key format, like the keys that
+// the identity providers publish
+func ParseJWK(jwk JWK) (*Key, error) {
+	decode := func(value string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(raw) == 0 {
+			return nil, fmt.Errorf("invalid parameter of jwk %v", jwk.Kid)
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent of jwk %v", jwk.Kid)
+		}
+		return NewKey(jwk.Kid, nil, &rsa.PublicKey{N: n, E: int(e.Int64())})
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q of jwk %v", jwk.Crv, jwk.Kid)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid point of jwk %v", jwk.Kid)
+		}
+		return NewKey(jwk.Kid, nil, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	default:
+		return nil, fmt.Errorf("unsupported key type %q of jwk %v", jwk.Kty, jwk.Kid)
+	}
+}
+
+func readPEM(inline string, file string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// Sign signs the claims with the signing key, setting its kid in the header, or with the HMAC secret
+func (keySet *KeySet) Sign(claims jwt.Claims) (string, error) {
+	if keySet.signing == nil {
+		if len(keySet.secret) == 0 {
+			return "", errors.New("there is neither a jwt signing key nor an HMAC secret")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(keySet.secret)
+	}
+	token := jwt.NewWithClaims(keySet.signing.method, claims)
+	token.Header["kid"] = keySet.signing.Kid
+	return token.SignedString(keySet.signing.privateKey)
+}
+
+// Keyfunc selects the key that verifies the token, to be passed to jwt.Parse. The algorithm of the token must be the
+// one of the key, so that a public key is never used as an HMAC secret. An empty secret verifies nothing, as anyone
+// could sign with it
+func (keySet *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, hasKid := token.Header["kid"].(string)
+	if !hasKid {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if len(keySet.secret) == 0 || !keySet.acceptHMAC {
+			return nil, errors.New("the tokens signed with the HMAC secret are not accepted")
+		}
+		return keySet.secret, nil
+	}
+	key := keySet.keys[kid]
+	if key == nil {
+		return nil, fmt.Errorf("unknown jwt key %v", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %v for jwt key %v", token.Header["alg"], kid)
+	}
+	return key.publicKey, nil
+}
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// ECDSA
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set, including the ones that only verify tokens, so that other services can
+// verify the tokens signed before a rotation. The HMAC secret is never published
+func (keySet *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(keySet.ordered))}
+	for _, key := range keySet.ordered {
+		jwk := JWK{Kid: key.Kid, Use: "sig", Alg: key.Algorithm}
+		switch publicKey := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32)))
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
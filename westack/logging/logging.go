@@ -0,0 +1,323 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log line. The values match the ones of log/slog
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (level Level) String() string {
+	switch {
+	case level < LevelInfo:
+		return "DEBUG"
+	case level < LevelWarn:
+		return "INFO"
+	case level < LevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error", case-insensitively
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("invalid log level %q", value)
+}
+
+// Format is the output format of the loggers created with New
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// ParseFormat parses "text" or "json", case-insensitively
+func ParseFormat(value string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(value))) {
+	case FormatText, "":
+		return FormatText, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("invalid log format %q", value)
+}
+
+// Logger is a leveled logger in the style of log/slog. args are alternating keys and values, like
+// logger.Info("Created user", "userId", id)
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+	// With returns a logger that includes args in every line
+	With(args ...any) Logger
+	// Enabled reports whether lines of the given level are written, to skip building expensive arguments
+	Enabled(level Level) bool
+}
+
+// leveler is implemented by the loggers that can change their own minimum level, so that WithLevel can also lower
+// it, for example to enable the debug lines of a single model
+type leveler interface {
+	WithLevel(level Level) Logger
+}
+
+// WithLevel returns a logger that writes the lines of level or above. Loggers created with New can lower their level
+// this way, other loggers can only be restricted
+func WithLevel(logger Logger, level Level) Logger {
+	if l, ok := logger.(leveler); ok {
+		return l.WithLevel(level)
+	}
+	return &filteredLogger{Logger: logger, level: level}
+}
+
+type filteredLogger struct {
+	Logger
+	level Level
+}
+
+func (logger *filteredLogger) Enabled(level Level) bool {
+	return level >= logger.level && logger.Logger.Enabled(level)
+}
+
+func (logger *filteredLogger) Debug(msg string, args ...any) {
+	if logger.Enabled(LevelDebug) {
+		logger.Logger.Debug(msg, args...)
+	}
+}
+
+func (logger *filteredLogger) Info(msg string, args ...any) {
+	if logger.Enabled(LevelInfo) {
+		logger.Logger.Info(msg, args...)
+	}
+}
+
+func (logger *filteredLogger) Warn(msg string, args ...any) {
+	if logger.Enabled(LevelWarn) {
+		logger.Logger.Warn(msg, args...)
+	}
+}
+
+func (logger *filteredLogger) Error(msg string, args ...any) {
+	if logger.Enabled(LevelError) {
+		logger.Logger.Error(msg, args...)
+	}
+}
+
+func (logger *filteredLogger) With(args ...any) Logger {
+	return &filteredLogger{Logger: logger.Logger.With(args...), level: logger.level}
+}
+
+// output is shared by a logger and the ones derived from it, so that their lines are not interleaved
+type output struct {
+	lock   sync.Mutex
+	writer io.Writer
+	format Format
+}
+
+type logger struct {
+	out   *output
+	level Level
+	attrs []attr
+}
+
+type attr struct {
+	key   string
+	value any
+}
+
+// New creates a logger that writes the lines of level or above to w
+func New(w io.Writer, format Format, level Level) Logger {
+	return &logger{
+		out:   &output{writer: w, format: format},
+		level: level,
+	}
+}
+
+func (l *logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *logger) Debug(msg string, args ...any) {
+	l.log(LevelDebug, msg, args)
+}
+
+func (l *logger) Info(msg string, args ...any) {
+	l.log(LevelInfo, msg, args)
+}
+
+func (l *logger) Warn(msg string, args ...any) {
+	l.log(LevelWarn, msg, args)
+}
+
+func (l *logger) Error(msg string, args ...any) {
+	l.log(LevelError, msg, args)
+}
+
+func (l *logger) With(args ...any) Logger {
+	if len(args) == 0 {
+		return l
+	}
+	attrs := make([]attr, 0, len(l.attrs)+len(args)/2)
+	attrs = append(attrs, l.attrs...)
+	return &logger{
+		out:   l.out,
+		level: l.level,
+		attrs: appendAttrs(attrs, args),
+	}
+}
+
+func (l *logger) WithLevel(level Level) Logger {
+	return &logger{
+		out:   l.out,
+		level: level,
+		attrs: l.attrs,
+	}
+}
+
+// appendAttrs pairs the keys and values like log/slog does, a value without a key is logged as !BADKEY
+func appendAttrs(attrs []attr, args []any) []attr {
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			attrs = append(attrs, attr{key: "!BADKEY", value: args[0]})
+			args = args[1:]
+			continue
+		}
+		attrs = append(attrs, attr{key: key, value: args[1]})
+		args = args[2:]
+	}
+	return attrs
+}
+
+func (l *logger) log(level Level, msg string, args []any) {
+	if !l.Enabled(level) {
+		return
+	}
+	attrs := appendAttrs(append([]attr{}, l.attrs...), args)
+	now := time.Now()
+
+	var buffer bytes.Buffer
+	if l.out.format == FormatJSON {
+		writeJSON(&buffer, now, level, msg, attrs)
+	} else {
+		writeText(&buffer, now, level, msg, attrs)
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	_, _ = l.out.writer.Write(buffer.Bytes())
+}
+
+func normalizeValue(value any) any {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return value
+}
+
+func writeJSON(buffer *bytes.Buffer, now time.Time, level Level, msg string, attrs []attr) {
+	buffer.WriteString(`{"time":`)
+	writeJSONValue(buffer, now.Format(time.RFC3339Nano))
+	buffer.WriteString(`,"level":`)
+	writeJSONValue(buffer, level.String())
+	buffer.WriteString(`,"msg":`)
+	writeJSONValue(buffer, msg)
+	for _, a := range attrs {
+		buffer.WriteString(",")
+		writeJSONValue(buffer, a.key)
+		buffer.WriteString(":")
+		writeJSONValue(buffer, normalizeValue(a.value))
+	}
+	buffer.WriteString("}\n")
+}
+
+func writeJSONValue(buffer *bytes.Buffer, value any) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprintf("%+v", value))
+	}
+	buffer.Write(encoded)
+}
+
+func writeText(buffer *bytes.Buffer, now time.Time, level Level, msg string, attrs []attr) {
+	buffer.WriteString("time=")
+	buffer.WriteString(now.Format(time.RFC3339Nano))
+	buffer.WriteString(" level=")
+	buffer.WriteString(level.String())
+	buffer.WriteString(" msg=")
+	writeTextValue(buffer, msg)
+	for _, a := range attrs {
+		buffer.WriteString(" ")
+		buffer.WriteString(a.key)
+		buffer.WriteString("=")
+		writeTextValue(buffer, fmt.Sprintf("%+v", normalizeValue(a.value)))
+	}
+	buffer.WriteString("\n")
+}
+
+// writeTextValue quotes the values that would be ambiguous in a key=value line
+func writeTextValue(buffer *bytes.Buffer, value string) {
+	needsQuoting := value == ""
+	for _, r := range value {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			needsQuoting = true
+			break
+		}
+	}
+	if needsQuoting {
+		buffer.WriteString(strconv.Quote(value))
+	} else {
+		buffer.WriteString(value)
+	}
+}
+
+var defaultLock sync.RWMutex
+var defaultLogger = New(os.Stderr, FormatText, LevelInfo)
+
+// Default returns the logger used where there is no app at hand, like in the datasources. The app replaces it with
+// its own logger when it is created
+func Default() Logger {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the logger returned by Default. A nil logger restores the initial one
+func SetDefault(logger Logger) {
+	if logger == nil {
+		logger = New(os.Stderr, FormatText, LevelInfo)
+	}
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	defaultLogger = logger
+}
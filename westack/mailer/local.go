@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ConsoleMailer writes the emails to Writer instead of sending them, for development
+type ConsoleMailer struct {
+	Writer io.Writer
+	From   string
+
+	mutex sync.Mutex
+}
+
+func (mailer *ConsoleMailer) Send(ctx context.Context, message Message) error {
+	message, err := withDefaults(message, mailer.From)
+	if err != nil {
+		return err
+	}
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	_, err = fmt.Fprintf(mailer.Writer, "----- email -----\r\n%s----- end of email -----\r\n", message.Bytes())
+	return err
+}
+
+// FileMailer writes each email to a .eml file of Directory instead of sending it, for development and tests
+type FileMailer struct {
+	Directory string
+	From      string
+}
+
+func (mailer *FileMailer) Send(ctx context.Context, message Message) error {
+	message, err := withDefaults(message, mailer.From)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(mailer.Directory, 0700)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%v-%v.eml", time.Now().Format("20060102T150405"), uuid.NewString())
+	return os.WriteFile(filepath.Join(mailer.Directory, name), message.Bytes(), 0600)
+}
@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is an email. At least one of Text and HTML must be set, and both are sent as alternatives when they are
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers the emails of the app, like the verification and password reset ones
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// SMTPConfig is the "mailer.smtp" section of the app config
+type SMTPConfig struct {
+	Host     string `mapstructure:"host" json:"host"`
+	Port     int    `mapstructure:"port" json:"port"`
+	Username string `mapstructure:"username" json:"username"`
+	Password string `mapstructure:"password" json:"password"`
+	// TLS connects with implicit TLS, usually on port 465. Otherwise, STARTTLS is used when the server supports it
+	TLS bool `mapstructure:"tls" json:"tls"`
+}
+
+// Config is the "mailer" section of the app config
+type Config struct {
+	// Type is "smtp", "console" or "file". No mailer is created when empty
+	Type string `mapstructure:"type" json:"type"`
+	// From is the sender of the emails without one
+	From string     `mapstructure:"from" json:"from"`
+	SMTP SMTPConfig `mapstructure:"smtp" json:"smtp"`
+	// Directory is where the "file" mailer writes the emails
+	Directory string `mapstructure:"directory" json:"directory"`
+}
+
+// New creates the mailer of the config, or nil if its type is empty
+func New(config Config) (Mailer, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case "smtp":
+		if config.SMTP.Host == "" {
+			return nil, fmt.Errorf("mailer.smtp.host is required")
+		}
+		return &SMTPMailer{Config: config.SMTP, From: config.From}, nil
+	case "console":
+		return &ConsoleMailer{Writer: os.Stdout, From: config.From}, nil
+	case "file":
+		if config.Directory == "" {
+			return nil, fmt.Errorf("mailer.directory is required")
+		}
+		return &FileMailer{Directory: config.Directory, From: config.From}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer type %v", config.Type)
+}
+
+// withDefaults checks the message and sets its sender
+func withDefaults(message Message, from string) (Message, error) {
+	if message.From == "" {
+		message.From = from
+	}
+	if message.From == "" {
+		return message, fmt.Errorf("the email has no sender")
+	}
+	if len(message.To) == 0 {
+		return message, fmt.Errorf("the email has no recipients")
+	}
+	if message.Text == "" && message.HTML == "" {
+		return message, fmt.Errorf("the email has no body")
+	}
+	for _, address := range append([]string{message.From}, message.To...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return message, fmt.Errorf("invalid address %q", address)
+		}
+	}
+	return message, nil
+}
+
+// Bytes encodes the message in the MIME format, with quoted-printable UTF-8 bodies
+func (message Message) Bytes() []byte {
+	var buffer bytes.Buffer
+	writeHeader := func(name string, value string) {
+		buffer.WriteString(name + ": " + value + "\r\n")
+	}
+	writeHeader("From", message.From)
+	writeHeader("To", strings.Join(message.To, ", "))
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", strings.ReplaceAll(message.Subject, "\n", " ")))
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("MIME-Version", "1.0")
+
+	writePart := func(contentType string, body string) {
+		writeHeader("Content-Type", contentType+"; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buffer.WriteString("\r\n")
+		writer := quotedprintable.NewWriter(&buffer)
+		_, _ = writer.Write([]byte(body))
+		_ = writer.Close()
+		buffer.WriteString("\r\n")
+	}
+	if message.Text == "" || message.HTML == "" {
+		if message.HTML != "" {
+			writePart("text/html", message.HTML)
+		} else {
+			writePart("text/plain", message.Text)
+		}
+		return buffer.Bytes()
+	}
+
+	boundary := randomBoundary()
+	writeHeader("Content-Type", "multipart/alternative; boundary="+boundary)
+	buffer.WriteString("\r\n")
+	buffer.WriteString("--" + boundary + "\r\n")
+	writePart("text/plain", message.Text)
+	buffer.WriteString("--" + boundary + "\r\n")
+	writePart("text/html", message.HTML)
+	buffer.WriteString("--" + boundary + "--\r\n")
+	return buffer.Bytes()
+}
+
+func randomBoundary() string {
+	value := make([]byte, 16)
+	_, err := rand.Read(value)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(value)
+}
@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTPMailer sends the emails through an SMTP server, authenticating with PLAIN when a username is set
+type SMTPMailer struct {
+	Config SMTPConfig
+	From   string
+}
+
+func (mailer *SMTPMailer) Send(ctx context.Context, message Message) error {
+	message, err := withDefaults(message, mailer.From)
+	if err != nil {
+		return err
+	}
+	port := mailer.Config.Port
+	if port == 0 {
+		port = 25
+		if mailer.Config.TLS {
+			port = 465
+		}
+	}
+	address := net.JoinHostPort(mailer.Config.Host, strconv.Itoa(port))
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if mailer.Config.TLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: mailer.Config.Host}}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, mailer.Config.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && !mailer.Config.TLS {
+		err = client.StartTLS(&tls.Config{ServerName: mailer.Config.Host})
+		if err != nil {
+			return err
+		}
+	}
+	if mailer.Config.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", mailer.Config.Username, mailer.Config.Password, mailer.Config.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(message.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender: %w", err)
+	}
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	for _, to := range message.To {
+		recipient, err := mail.ParseAddress(to)
+		if err != nil {
+			return fmt.Errorf("invalid recipient: %w", err)
+		}
+		err = client.Rcpt(recipient.Address)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message.Bytes())
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
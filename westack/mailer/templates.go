@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// Templates renders the emails from the files of Directory, like "server/templates". An email named "verify-email"
+// has a "verify-email.subject.txt" text template, and a "verify-email.txt" text template, a "verify-email.html" HTML
+// template or both. The files missing in Directory are taken from the built-in templates, if any
+type Templates struct {
+	Directory string
+}
+
+// Render executes the templates of the email with data, which is escaped in the HTML body
+func (templates *Templates) Render(name string, data interface{}) (Message, error) {
+	var message Message
+	subject, err := templates.renderText(name+".subject.txt", data)
+	if err != nil {
+		return message, err
+	}
+	message.Subject = strings.TrimSpace(subject)
+	message.Text, err = templates.renderText(name+".txt", data)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return message, err
+	}
+	message.HTML, err = templates.renderHTML(name+".html", data)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return message, err
+	}
+	if message.Text == "" && message.HTML == "" {
+		return message, fmt.Errorf("email template %v has no body: %w", name, fs.ErrNotExist)
+	}
+	return message, nil
+}
+
+// read returns the file of Directory, or the built-in one
+func (templates *Templates) read(fileName string) (string, error) {
+	if templates.Directory != "" {
+		content, err := os.ReadFile(filepath.Join(templates.Directory, fileName))
+		if err == nil {
+			return string(content), nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	content, err := defaultTemplates.ReadFile("templates/" + fileName)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func (templates *Templates) renderText(fileName string, data interface{}) (string, error) {
+	content, err := templates.read(fileName)
+	if err != nil {
+		return "", err
+	}
+	template, err := texttemplate.New(fileName).Option("missingkey=zero").Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	err = template.Execute(&buffer, data)
+	return buffer.String(), err
+}
+
+func (templates *Templates) renderHTML(fileName string, data interface{}) (string, error) {
+	content, err := templates.read(fileName)
+	if err != nil {
+		return "", err
+	}
+	template, err := htmltemplate.New(fileName).Option("missingkey=zero").Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	err = template.Execute(&buffer, data)
+	return buffer.String(), err
+}
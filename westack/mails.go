@@ -0,0 +1,137 @@
+package westack
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/viper"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/mailer"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const mailTemplatesDirectory = "server/templates"
+
+// loadMailer creates the mailer of the "mailer" section of the config, which is nil unless "mailer.type" is set
+func loadMailer(appViper *viper.Viper) mailer.Mailer {
+	var config mailer.Config
+	err := appViper.UnmarshalKey("mailer", &config)
+	if err != nil {
+		log.Fatalf("Invalid mailer config: %v", err)
+	}
+	appMailer, err := mailer.New(config)
+	if err != nil {
+		log.Fatalf("Could not create the mailer: %v", err)
+	}
+	return appMailer
+}
+
+// Mailer returns the mailer of the app, nil if there is none
+func (app *WeStack) Mailer() mailer.Mailer {
+	return app.mailer
+}
+
+// SendTemplatedMail renders the email template, from server/templates or the built-in ones, and sends it. The data
+// also gets the "appName" of the config
+func (app *WeStack) SendTemplatedMail(ctx context.Context, to string, templateName string, data wst.M) error {
+	if app.mailer == nil {
+		return wst.CreateError(fiber.ErrNotImplemented, "MAILER_NOT_CONFIGURED", fiber.Map{"message": "there is no mailer to send the email"}, "Error")
+	}
+	templateData := wst.M{"appName": app.Viper.GetString("name")}
+	for k, v := range data {
+		templateData[k] = v
+	}
+	message, err := app.mailTemplates.Render(templateName, templateData)
+	if err != nil {
+		return err
+	}
+	message.To = []string{to}
+	return app.mailer.Send(ctx, message)
+}
+
+const defaultEmailVerificationTtl = 2 * 24 * time.Hour
+
+// publicUrl is the url of the app in the links of the emails, from "publicUrl". The url of the request is not used, as
+// its Host header is chosen by the client
+func (app *WeStack) publicUrl() (string, error) {
+	publicUrl := app.Viper.GetString("publicUrl")
+	if publicUrl == "" {
+		return "", wst.CreateError(fiber.ErrNotImplemented, "PUBLIC_URL_NOT_CONFIGURED", fiber.Map{"message": "there is no publicUrl for the links of the emails"}, "Error")
+	}
+	return strings.TrimSuffix(publicUrl, "/"), nil
+}
+
+// emailVerificationToken signs the token of the verification link of the bearer, which is only accepted by the
+// EmailVerificationMethod, once
+func (app *WeStack) emailVerificationToken(ctx *model.EventContext) (string, error) {
+	claims := jwt.MapClaims{"userId": ctx.Bearer.User.Id}
+	tenantClaim := model.TenantClaim(app.Viper)
+	if tenant, ok := ctx.Bearer.Claims[tenantClaim]; ok {
+		claims[tenantClaim] = tenant
+	}
+	return app.signToken(claims, model.EmailVerificationTokenType, app.tokenTtl("emailVerificationTtl", defaultEmailVerificationTtl))
+}
+
+// mailRecipient returns the data of the user that the templates can use, without the password
+func mailRecipient(user *model.Instance) wst.M {
+	data := user.ToJSON()
+	return wst.M{
+		"id":       model.GetIDAsString(user.Id),
+		"email":    data.GetString("email"),
+		"username": data.GetString("username"),
+	}
+}
+
+// sendVerificationMail sends the "verify-email" template with the link to GET /users/verify-mail, which redirects to
+// the "redirectUri" of the body, if any
+func (app *WeStack) sendVerificationMail(loadedModel *model.Model, ctx *model.EventContext) error {
+	user, err := loadedModel.FindById(ctx.Bearer.User.Id, nil, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fiber.ErrUnauthorized
+	}
+	publicUrl, err := app.publicUrl()
+	if err != nil {
+		return err
+	}
+	query := url.Values{"access_token": {ctx.Bearer.Raw}}
+	if redirectUri := ctx.Data.GetString("redirectUri"); redirectUri != "" {
+		query.Set("redirect_uri", redirectUri)
+	}
+	recipient := mailRecipient(user)
+	err = app.SendTemplatedMail(ctx.GetContext(), recipient.GetString("email"), "verify-email", wst.M{
+		"user":      recipient,
+		"verifyUrl": publicUrl + loadedModel.BaseUrl + "/verify-mail?" + query.Encode(),
+	})
+	if err != nil {
+		return err
+	}
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// sendResetPasswordMail sends the "reset-password" template with the token. The link points to "resetPasswordUrl"
+// of the config, which is the page of the client that confirms the reset, when set
+func (app *WeStack) sendResetPasswordMail(user *model.Instance, resetToken string, ctx *model.EventContext) error {
+	data := wst.M{
+		"user":  mailRecipient(user),
+		"token": resetToken,
+		"ttl":   app.tokenTtl("passwordResetTtl", defaultPasswordResetTtl).String(),
+	}
+	if resetPasswordUrl := app.Viper.GetString("resetPasswordUrl"); resetPasswordUrl != "" {
+		separator := "?"
+		if strings.Contains(resetPasswordUrl, "?") {
+			separator = "&"
+		}
+		data["resetUrl"] = resetPasswordUrl + separator + url.Values{"token": {resetToken}}.Encode()
+	}
+	return app.SendTemplatedMail(ctx.GetContext(), data.GetM("user").GetString("email"), "reset-password", data)
+}
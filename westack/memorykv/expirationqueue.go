@@ -0,0 +1,93 @@
+package memorykv
+
+import "container/heap"
+
+type expirationEntry struct {
+	key       string
+	expiresAt int64 // unix timestamp in nanoseconds
+	index     int   // position inside the heap, maintained by heap.Interface
+}
+
+// expirationHeap is a min-heap of entries ordered by expiresAt
+type expirationHeap []*expirationEntry
+
+func (h expirationHeap) Len() int { return len(h) }
+
+func (h expirationHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+
+func (h expirationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expirationHeap) Push(x interface{}) {
+	entry := x.(*expirationEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expirationHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// expirationQueue keeps the keys of a bucket sorted by expiration time.
+// Add, Update and Remove are O(log n) thanks to the key index.
+// It is not safe for concurrent use, the owner bucket must hold its lock while calling it.
+type expirationQueue struct {
+	entries expirationHeap
+	byKey   map[string]*expirationEntry
+}
+
+// Add inserts the key, or updates its expiration if it is already queued
+func (queue *expirationQueue) Add(key string, expiresAt int64) {
+	if entry, ok := queue.byKey[key]; ok {
+		entry.expiresAt = expiresAt
+		heap.Fix(&queue.entries, entry.index)
+		return
+	}
+	entry := &expirationEntry{key: key, expiresAt: expiresAt}
+	heap.Push(&queue.entries, entry)
+	queue.byKey[key] = entry
+}
+
+func (queue *expirationQueue) Update(key string, expiresAt int64) {
+	queue.Add(key, expiresAt)
+}
+
+func (queue *expirationQueue) Remove(key string) {
+	if entry, ok := queue.byKey[key]; ok {
+		heap.Remove(&queue.entries, entry.index)
+		delete(queue.byKey, key)
+	}
+}
+
+// Peek returns the entry closest to expire without removing it
+func (queue *expirationQueue) Peek() (expirationEntry, bool) {
+	if len(queue.entries) == 0 {
+		return expirationEntry{}, false
+	}
+	return *queue.entries[0], true
+}
+
+func (queue *expirationQueue) Len() int64 {
+	return int64(len(queue.entries))
+}
+
+func (queue *expirationQueue) Clear() {
+	queue.entries = make(expirationHeap, 0)
+	queue.byKey = make(map[string]*expirationEntry)
+}
+
+func newExpirationQueue() *expirationQueue {
+	return &expirationQueue{
+		entries: make(expirationHeap, 0),
+		byKey:   make(map[string]*expirationEntry),
+	}
+}
@@ -3,6 +3,7 @@ package memorykv
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -29,15 +30,28 @@ type MemoryKvDb interface {
 	GetBucket(name string) MemoryKvBucket
 	Stats() map[string]MemoryKvStats
 	Purge() error
+
+	// Publish sends the payload to every current subscriber of the channel, without blocking.
+	// Subscribers whose buffer is full miss the message.
+	Publish(channel string, payload []byte) error
+	// Subscribe returns a buffered channel receiving the payloads published to the channel.
+	// Buckets publish the affected keys on KeyEventChannel(bucketName, KeyEventExpired) and KeyEventChannel(bucketName, KeyEventDel)
+	Subscribe(channel string) <-chan []byte
+	// Unsubscribe stops and closes a subscription returned by Subscribe
+	Unsubscribe(channel string, subscription <-chan []byte)
 }
 
 //goland:noinspection GoNameStartsWithPackageName
 type MemoryKvBucket interface {
 	Get(key string) ([][]byte, error)
 	Set(key string, value [][]byte) error
+	// SetNX sets the key only if it is not set yet, and reports whether it did. It is atomic, so when several writers
+	// set the same key only one of them succeeds
+	SetNX(key string, value [][]byte) (bool, error)
 	SetEx(key string, value [][]byte, ttl time.Duration) error
 	Delete(key string) error
 	Expire(key string, ttl time.Duration) error
+	Keys() []string
 	Stats() MemoryKvStats
 	Flush() error
 }
@@ -45,89 +59,11 @@ type MemoryKvBucket interface {
 type kvPair struct {
 	key       string
 	value     [][]byte
-	expiresAt int64 // unix timestamp in seconds
-}
-
-type expirationQueue struct {
-	expirationQueue []kvPair
-}
-
-var expirationLock sync.RWMutex
-
-func (queue *expirationQueue) Add(key string, expiresAt int64) {
-	expirationLock.Lock()
-	inserted := false
-	for i, pair := range queue.expirationQueue {
-		if pair.expiresAt > expiresAt {
-			queue.expirationQueue = append(queue.expirationQueue[:i], append([]kvPair{{key: key, value: nil, expiresAt: expiresAt}}, queue.expirationQueue[i:]...)...)
-			inserted = true
-			break
-		}
-	}
-	if !inserted {
-		queue.expirationQueue = append(queue.expirationQueue, kvPair{key: key, value: nil, expiresAt: expiresAt})
-	}
-	expirationLock.Unlock()
-}
-
-func (queue *expirationQueue) Peek() (string, bool) {
-	expirationLock.RLock()
-	if len(queue.expirationQueue) == 0 {
-		expirationLock.RUnlock()
-		return "", false
-	}
-	pair := queue.expirationQueue[0]
-	expirationLock.RUnlock()
-	return pair.key, true
-}
-
-func (queue *expirationQueue) Remove(key string) {
-	expirationLock.Lock()
-	for i, pair := range queue.expirationQueue {
-		if pair.key == key {
-			queue.expirationQueue = append(queue.expirationQueue[:i], queue.expirationQueue[i+1:]...)
-			break
-		}
-	}
-	expirationLock.Unlock()
-}
-
-func (queue *expirationQueue) Len() int64 {
-	expirationLock.RLock()
-	defer expirationLock.RUnlock()
-	return int64(len(queue.expirationQueue))
+	expiresAt int64 // unix timestamp in nanoseconds
 }
 
-func (queue *expirationQueue) Update(key string, expiresAt int64) {
-	expirationLock.Lock()
-	for i, pair := range queue.expirationQueue {
-		if pair.key == key {
-			queue.expirationQueue = append(queue.expirationQueue[:i], queue.expirationQueue[i+1:]...)
-			break
-		}
-	}
-	expirationLock.Unlock()
-	queue.Add(key, expiresAt)
-}
-
-func (queue *expirationQueue) Cursor() chan kvPair {
-	expirationLock.RLock()
-	defer expirationLock.RUnlock()
-	ch := make(chan kvPair)
-	go func() {
-		for _, pair := range queue.expirationQueue {
-			ch <- pair
-		}
-		close(ch)
-	}()
-	return ch
-}
-
-func newExpirationQueue() *expirationQueue {
-	return &expirationQueue{
-		expirationQueue: make([]kvPair, 0),
-	}
-}
+// Keys set without ttl are kept for one year
+const defaultExpiration = 365 * 24 * time.Hour
 
 //goland:noinspection GoNameStartsWithPackageName
 type MemoryKvBucketImpl struct {
@@ -136,89 +72,140 @@ type MemoryKvBucketImpl struct {
 	expirationQueue *expirationQueue
 	misses          int64
 	hits            int64
-}
 
-var dataLock sync.RWMutex
+	// lock protects both data and expirationQueue
+	lock   sync.RWMutex
+	wakeUp chan struct{}
+	stop   chan struct{}
+
+	// events receives the keyspace notifications of the bucket
+	events *pubSub
+}
 
 func (kvBucket *MemoryKvBucketImpl) Get(key string) ([][]byte, error) {
-	dataLock.RLock()
+	kvBucket.lock.RLock()
 	pair, ok := kvBucket.data[key]
-	dataLock.RUnlock()
-	if ok {
-		kvBucket.hits++
+	kvBucket.lock.RUnlock()
+	if ok && pair.expiresAt > time.Now().UnixNano() {
+		atomic.AddInt64(&kvBucket.hits, 1)
 		return pair.value, nil
 	} else {
-		kvBucket.misses++
+		atomic.AddInt64(&kvBucket.misses, 1)
 		return nil, nil
 	}
 }
 
 func (kvBucket *MemoryKvBucketImpl) Set(key string, value [][]byte) error {
-	dataLock.RLock()
-	pair, ok := kvBucket.data[key]
-	dataLock.RUnlock()
-	if ok {
-		dataLock.Lock()
-		pair.value = value
-		kvBucket.data[key] = pair
-		dataLock.Unlock()
-	} else {
-		dataLock.Lock()
-		kvBucket.data[key] = kvPair{
-			key:   key,
-			value: value,
-		}
-		dataLock.Unlock()
+	expiresAt := time.Now().Add(defaultExpiration).UnixNano()
+	kvBucket.lock.Lock()
+	kvBucket.data[key] = kvPair{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
 	}
-	kvBucket.expirationQueue.Add(key, time.Now().Unix()+86400*365)
+	kvBucket.scheduleExpiration(key, expiresAt)
+	kvBucket.lock.Unlock()
 	return nil
 }
 
-func (kvBucket *MemoryKvBucketImpl) SetEx(key string, value [][]byte, ttl time.Duration) error {
-	err := kvBucket.Set(key, value)
-	if err != nil {
-		return err
+func (kvBucket *MemoryKvBucketImpl) SetNX(key string, value [][]byte) (bool, error) {
+	now := time.Now()
+	expiresAt := now.Add(defaultExpiration).UnixNano()
+	kvBucket.lock.Lock()
+	defer kvBucket.lock.Unlock()
+	if pair, ok := kvBucket.data[key]; ok && pair.expiresAt > now.UnixNano() {
+		return false, nil
 	}
-	err = kvBucket.Expire(key, ttl)
-	if err != nil {
-		return err
+	kvBucket.data[key] = kvPair{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
 	}
+	kvBucket.scheduleExpiration(key, expiresAt)
+	return true, nil
+}
+
+func (kvBucket *MemoryKvBucketImpl) SetEx(key string, value [][]byte, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	kvBucket.lock.Lock()
+	kvBucket.data[key] = kvPair{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	}
+	kvBucket.scheduleExpiration(key, expiresAt)
+	kvBucket.lock.Unlock()
 	return nil
 }
 
 func (kvBucket *MemoryKvBucketImpl) Expire(key string, ttl time.Duration) error {
-	dataLock.RLock()
+	kvBucket.lock.Lock()
+	defer kvBucket.lock.Unlock()
 	pair, ok := kvBucket.data[key]
-	dataLock.RUnlock()
-	if ok {
-		dataLock.Lock()
-		pair.expiresAt = time.Now().Add(ttl).Unix()
-		kvBucket.data[key] = pair
-		dataLock.Unlock()
-		kvBucket.expirationQueue.Update(key, pair.expiresAt)
-		return nil
-	} else {
+	if !ok {
 		return fmt.Errorf("key not found")
 	}
+	pair.expiresAt = time.Now().Add(ttl).UnixNano()
+	kvBucket.data[key] = pair
+	kvBucket.scheduleExpiration(key, pair.expiresAt)
+	return nil
 }
 
 func (kvBucket *MemoryKvBucketImpl) Delete(key string) error {
-	dataLock.Lock()
+	kvBucket.lock.Lock()
+	_, existed := kvBucket.data[key]
 	delete(kvBucket.data, key)
-	dataLock.Unlock()
+	kvBucket.expirationQueue.Remove(key)
+	kvBucket.lock.Unlock()
+	if existed {
+		kvBucket.notifyKeyEvent(KeyEventDel, key)
+	}
 	return nil
 }
 
+func (kvBucket *MemoryKvBucketImpl) notifyKeyEvent(event string, key string) {
+	if kvBucket.events != nil {
+		_ = kvBucket.events.Publish(KeyEventChannel(kvBucket.name, event), []byte(key))
+	}
+}
+
+// Keys returns the keys that are not expired yet, in no particular order
+func (kvBucket *MemoryKvBucketImpl) Keys() []string {
+	now := time.Now().UnixNano()
+	kvBucket.lock.RLock()
+	keys := make([]string, 0, len(kvBucket.data))
+	for key, pair := range kvBucket.data {
+		if pair.expiresAt > now {
+			keys = append(keys, key)
+		}
+	}
+	kvBucket.lock.RUnlock()
+	return keys
+}
+
 func (kvBucket *MemoryKvBucketImpl) Flush() error {
-	dataLock.Lock()
+	kvBucket.lock.Lock()
 	kvBucket.data = make(map[string]kvPair)
-	dataLock.Unlock()
+	kvBucket.expirationQueue.Clear()
+	kvBucket.lock.Unlock()
 	return nil
 }
 
+// scheduleExpiration must be called with kvBucket.lock held
+func (kvBucket *MemoryKvBucketImpl) scheduleExpiration(key string, expiresAt int64) {
+	kvBucket.expirationQueue.Add(key, expiresAt)
+	if next, ok := kvBucket.expirationQueue.Peek(); ok && next.key == key {
+		// The new key is the next one to expire, so the expiration loop must recalculate its timer
+		select {
+		case kvBucket.wakeUp <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
-	dataLock.RLock()
-	defer dataLock.RUnlock()
+	kvBucket.lock.RLock()
+	defer kvBucket.lock.RUnlock()
 	var avgExpirationTime float64
 	var _avgExpirationCount float64
 	var _avgExpirationSum float64
@@ -229,24 +216,26 @@ func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
 	var _avgObjSizeCount float64
 	var _avgObjSizeSum float64
 	var sizeOfPair int64 = int64(unsafe.Sizeof(kvPair{}))
-	for pair := range kvBucket.expirationQueue.Cursor() {
-		if earliestExpirationTime == 0 || earliestExpirationTime > pair.expiresAt {
-			earliestExpirationTime = pair.expiresAt
+	var sizeOfEntry int64 = int64(unsafe.Sizeof(expirationEntry{}))
+	for _, entry := range kvBucket.expirationQueue.entries {
+		expiresAt := entry.expiresAt / int64(time.Second)
+		if earliestExpirationTime == 0 || earliestExpirationTime > expiresAt {
+			earliestExpirationTime = expiresAt
 		}
-		if latestExpirationTime == 0 || latestExpirationTime < pair.expiresAt {
-			latestExpirationTime = pair.expiresAt
+		if latestExpirationTime == 0 || latestExpirationTime < expiresAt {
+			latestExpirationTime = expiresAt
 		}
-		_avgExpirationSum += float64(pair.expiresAt)
+		_avgExpirationSum += float64(expiresAt)
 		_avgExpirationCount += 1
 
-		realPair, ok := kvBucket.data[pair.key]
+		realPair, ok := kvBucket.data[entry.key]
 		if ok {
 			bytelen := 0
 			for _, b := range realPair.value {
 				bytelen += len(b)
 			}
-			totalSize += int64(bytelen) + int64(len(pair.key)*2) // key is stored twice, once as data key, once as expiration queue key
-			totalSize += sizeOfPair * 2                          // pair is stored twice, once as data value, once as expiration queue value
+			totalSize += int64(bytelen) + int64(len(entry.key)*2) // key is stored twice, once as data key, once as expiration queue key
+			totalSize += sizeOfPair + sizeOfEntry
 			_avgObjSizeSum += float64(bytelen)
 			_avgObjSizeCount += 1
 		}
@@ -267,8 +256,8 @@ func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
 	}
 	return MemoryKvStats{
 		Entries:                len(kvBucket.data),
-		Misses:                 kvBucket.misses,
-		Hits:                   kvBucket.hits,
+		Misses:                 atomic.LoadInt64(&kvBucket.misses),
+		Hits:                   atomic.LoadInt64(&kvBucket.hits),
 		AvgExpirationTime:      avgExpirationTime,
 		EarliestExpirationTime: earliestExpirationTimeIso8601,
 		LatestExpirationTime:   latestExpirationTimeIso8601,
@@ -279,47 +268,87 @@ func (kvBucket *MemoryKvBucketImpl) Stats() MemoryKvStats {
 }
 
 func (kvDb *MemoryKvDbImpl) Purge() error {
+	kvDb.lock.Lock()
+	defer kvDb.lock.Unlock()
 	for _, bucket := range kvDb.buckets {
 		err := bucket.Flush()
 		if err != nil {
 			return err
 		}
+		if impl, ok := bucket.(*MemoryKvBucketImpl); ok {
+			close(impl.stop)
+		}
 	}
 	kvDb.buckets = make(map[string]MemoryKvBucket)
+	kvDb.events.closeAll()
 	return nil
 }
 
-func createBucket(name string) MemoryKvBucket {
+func (kvDb *MemoryKvDbImpl) Publish(channel string, payload []byte) error {
+	return kvDb.events.Publish(channel, payload)
+}
+
+func (kvDb *MemoryKvDbImpl) Subscribe(channel string) <-chan []byte {
+	return kvDb.events.Subscribe(channel)
+}
+
+func (kvDb *MemoryKvDbImpl) Unsubscribe(channel string, subscription <-chan []byte) {
+	kvDb.events.Unsubscribe(channel, subscription)
+}
+
+func createBucket(name string, events *pubSub) MemoryKvBucket {
 	kvBucket := &MemoryKvBucketImpl{
 		name:            name,
 		data:            make(map[string]kvPair),
 		expirationQueue: newExpirationQueue(),
+		wakeUp:          make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		events:          events,
 	}
 	go performExpirations(kvBucket)
 	return kvBucket
 }
 
 func performExpirations(kvBucket *MemoryKvBucketImpl) {
+	timer := time.NewTimer(defaultExpiration)
+	defer timer.Stop()
 	for {
-		key, ok := kvBucket.expirationQueue.Peek()
-		if ok {
-			dataLock.RLock()
-			pair, ok := kvBucket.data[key]
-			dataLock.RUnlock()
-			if ok {
-				if pair.expiresAt > time.Now().Unix() {
-					toWait := time.Duration(pair.expiresAt-time.Now().Unix()) * time.Second
-					time.Sleep(toWait)
-				}
-				dataLock.Lock()
-				delete(kvBucket.data, key)
-				dataLock.Unlock()
-				kvBucket.expirationQueue.Remove(key)
-			} else {
-				kvBucket.expirationQueue.Remove(key)
+		var expiredKeys []string
+		kvBucket.lock.Lock()
+		now := time.Now().UnixNano()
+		toWait := defaultExpiration
+		for {
+			next, ok := kvBucket.expirationQueue.Peek()
+			if !ok {
+				break
 			}
-		} else {
-			time.Sleep(1 * time.Second)
+			if next.expiresAt > now {
+				toWait = time.Duration(next.expiresAt - now)
+				break
+			}
+			delete(kvBucket.data, next.key)
+			kvBucket.expirationQueue.Remove(next.key)
+			expiredKeys = append(expiredKeys, next.key)
+		}
+		kvBucket.lock.Unlock()
+
+		for _, key := range expiredKeys {
+			kvBucket.notifyKeyEvent(KeyEventExpired, key)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(toWait)
+
+		select {
+		case <-timer.C:
+		case <-kvBucket.wakeUp:
+		case <-kvBucket.stop:
+			return
 		}
 	}
 }
@@ -328,35 +357,35 @@ func performExpirations(kvBucket *MemoryKvBucketImpl) {
 type MemoryKvDbImpl struct {
 	name    string
 	buckets map[string]MemoryKvBucket
+	lock    sync.RWMutex
+	events  *pubSub
 }
 
-var bucketsLock sync.RWMutex
-
 func (kvDb *MemoryKvDbImpl) GetBucket(name string) MemoryKvBucket {
-	bucketsLock.RLock()
+	kvDb.lock.RLock()
 	bucket, ok := kvDb.buckets[name]
-	bucketsLock.RUnlock()
+	kvDb.lock.RUnlock()
 	if ok {
 		return bucket
 	}
-	bucketsLock.Lock()
-	defer bucketsLock.Unlock()
+	kvDb.lock.Lock()
+	defer kvDb.lock.Unlock()
 	bucket, ok = kvDb.buckets[name]
 	if ok {
 		return bucket
 	}
-	bucket = createBucket(name)
+	bucket = createBucket(name, kvDb.events)
 	kvDb.buckets[name] = bucket
 	return bucket
 }
 
 func (kvDb *MemoryKvDbImpl) Stats() map[string]MemoryKvStats {
 	stats := make(map[string]MemoryKvStats)
-	bucketsLock.RLock()
+	kvDb.lock.RLock()
 	for name, bucket := range kvDb.buckets {
 		stats[name] = bucket.Stats()
 	}
-	bucketsLock.RUnlock()
+	kvDb.lock.RUnlock()
 	return stats
 }
 
@@ -364,5 +393,6 @@ func NewMemoryKvDb(options Options) MemoryKvDb {
 	return &MemoryKvDbImpl{
 		name:    options.Name,
 		buckets: make(map[string]MemoryKvBucket),
+		events:  newPubSub(),
 	}
 }
@@ -0,0 +1,84 @@
+package memorykv
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Number of messages buffered for each subscription. When a subscriber falls behind, new messages are dropped
+// for it instead of blocking the publisher.
+const subscriptionBufferSize = 256
+
+// Keyspace events published by the buckets
+const (
+	KeyEventExpired = "expired"
+	KeyEventDel     = "del"
+)
+
+// KeyEventChannel returns the channel where a bucket publishes the keys affected by an event, following the redis
+// naming convention, e.g. __keyevent@myBucket__:expired
+func KeyEventChannel(bucketName string, event string) string {
+	return fmt.Sprintf("__keyevent@%v__:%v", bucketName, event)
+}
+
+// pubSub fans out published payloads to every subscription of a channel
+type pubSub struct {
+	subscriptions map[string][]chan []byte
+	lock          sync.RWMutex
+}
+
+func (ps *pubSub) Publish(channel string, payload []byte) error {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	for _, subscription := range ps.subscriptions[channel] {
+		select {
+		case subscription <- payload:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ps *pubSub) Subscribe(channel string) <-chan []byte {
+	subscription := make(chan []byte, subscriptionBufferSize)
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.subscriptions[channel] = append(ps.subscriptions[channel], subscription)
+	return subscription
+}
+
+func (ps *pubSub) Unsubscribe(channel string, subscription <-chan []byte) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	subscriptions := ps.subscriptions[channel]
+	for idx, candidate := range subscriptions {
+		if candidate == subscription {
+			close(candidate)
+			subscriptions = append(subscriptions[:idx], subscriptions[idx+1:]...)
+			break
+		}
+	}
+	if len(subscriptions) == 0 {
+		delete(ps.subscriptions, channel)
+	} else {
+		ps.subscriptions[channel] = subscriptions
+	}
+}
+
+// closeAll closes every subscription so that consumers ranging over them can return
+func (ps *pubSub) closeAll() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for _, subscriptions := range ps.subscriptions {
+		for _, subscription := range subscriptions {
+			close(subscription)
+		}
+	}
+	ps.subscriptions = make(map[string][]chan []byte)
+}
+
+func newPubSub() *pubSub {
+	return &pubSub{
+		subscriptions: make(map[string][]chan []byte),
+	}
+}
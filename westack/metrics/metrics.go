@@ -0,0 +1,354 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds, suited to request and query latencies
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is the registry exposed by the /system/metrics endpoint
+var DefaultRegistry = NewRegistry()
+
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	lock       sync.RWMutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: map[string]collector{},
+	}
+}
+
+// register returns the collector already registered with the same name, if any, so that packages can declare their
+// metrics as package variables and apps can be created more than once
+func (registry *Registry) register(c collector) collector {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if existing, ok := registry.collectors[c.name()]; ok {
+		return existing
+	}
+	registry.collectors[c.name()] = c
+	return c
+}
+
+// WriteText writes all the metrics sorted by name
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.lock.RLock()
+	names := make([]string, 0, len(registry.collectors))
+	for name := range registry.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, registry.collectors[name])
+	}
+	registry.lock.RUnlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+type metricDesc struct {
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (desc *metricDesc) name() string {
+	return desc.metricName
+}
+
+func (desc *metricDesc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", desc.metricName, escapeHelp(desc.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", desc.metricName, desc.metricType)
+}
+
+func (desc *metricDesc) checkLabels(labelValues []string) {
+	if len(labelValues) != len(desc.labelNames) {
+		panic(fmt.Sprintf("metric %v expects %v label values, got %v", desc.metricName, len(desc.labelNames), len(labelValues)))
+	}
+}
+
+// labelsKey joins the label values with a separator that cannot appear in valid UTF-8 text
+func labelsKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func formatLabels(labelNames []string, labelValues []string, extraName string, extraValue string) string {
+	if len(labelNames) == 0 && extraName == "" {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteString("{")
+	for i, labelName := range labelNames {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(labelName)
+		builder.WriteString(`="`)
+		builder.WriteString(escapeLabelValue(labelValues[i]))
+		builder.WriteString(`"`)
+	}
+	if extraName != "" {
+		if len(labelNames) > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(extraName)
+		builder.WriteString(`="`)
+		builder.WriteString(extraValue)
+		builder.WriteString(`"`)
+	}
+	builder.WriteString("}")
+	return builder.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       float64
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	metricDesc
+	lock   sync.Mutex
+	values map[string]*labeledValue
+}
+
+// NewCounterVec registers a counter, or returns the one already registered with the same name
+func (registry *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return registry.register(&CounterVec{
+		metricDesc: metricDesc{metricName: name, help: help, metricType: "counter", labelNames: labelNames},
+		values:     map[string]*labeledValue{},
+	}).(*CounterVec)
+}
+
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add increases the counter by value, which must not be negative
+func (counter *CounterVec) Add(value float64, labelValues ...string) {
+	counter.checkLabels(labelValues)
+	key := labelsKey(labelValues)
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	entry, ok := counter.values[key]
+	if !ok {
+		entry = &labeledValue{labelValues: append([]string{}, labelValues...)}
+		counter.values[key] = entry
+	}
+	entry.value += value
+}
+
+// Value returns the current value of the counter for the given labels
+func (counter *CounterVec) Value(labelValues ...string) float64 {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	if entry, ok := counter.values[labelsKey(labelValues)]; ok {
+		return entry.value
+	}
+	return 0
+}
+
+func (counter *CounterVec) write(w *bufio.Writer) {
+	counter.lock.Lock()
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entry := counter.values[key]
+		lines = append(lines, counter.metricName+formatLabels(counter.labelNames, entry.labelValues, "", "")+" "+formatValue(entry.value))
+	}
+	counter.lock.Unlock()
+
+	counter.writeHeader(w)
+	for _, line := range lines {
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+}
+
+type histogramValue struct {
+	labelValues []string
+	// bucketCounts are not cumulative, they are accumulated when written
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	metricDesc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// NewHistogramVec registers a histogram, or returns the one already registered with the same name. Buckets are the
+// upper bounds, DefBuckets is used when nil
+func (registry *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+	return registry.register(&HistogramVec{
+		metricDesc: metricDesc{metricName: name, help: help, metricType: "histogram", labelNames: labelNames},
+		buckets:    sortedBuckets,
+		values:     map[string]*histogramValue{},
+	}).(*HistogramVec)
+}
+
+func (histogram *HistogramVec) Observe(value float64, labelValues ...string) {
+	histogram.checkLabels(labelValues)
+	key := labelsKey(labelValues)
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	entry, ok := histogram.values[key]
+	if !ok {
+		entry = &histogramValue{
+			labelValues:  append([]string{}, labelValues...),
+			bucketCounts: make([]uint64, len(histogram.buckets)),
+		}
+		histogram.values[key] = entry
+	}
+	if index := sort.SearchFloat64s(histogram.buckets, value); index < len(histogram.buckets) {
+		entry.bucketCounts[index]++
+	}
+	entry.count++
+	entry.sum += value
+}
+
+// Count returns how many values were observed for the given labels
+func (histogram *HistogramVec) Count(labelValues ...string) uint64 {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+	if entry, ok := histogram.values[labelsKey(labelValues)]; ok {
+		return entry.count
+	}
+	return 0
+}
+
+func (histogram *HistogramVec) write(w *bufio.Writer) {
+	histogram.lock.Lock()
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, key := range keys {
+		entry := histogram.values[key]
+		var cumulative uint64
+		for i, upperBound := range histogram.buckets {
+			cumulative += entry.bucketCounts[i]
+			lines = append(lines, histogram.metricName+"_bucket"+formatLabels(histogram.labelNames, entry.labelValues, "le", formatValue(upperBound))+" "+strconv.FormatUint(cumulative, 10))
+		}
+		lines = append(lines, histogram.metricName+"_bucket"+formatLabels(histogram.labelNames, entry.labelValues, "le", "+Inf")+" "+strconv.FormatUint(entry.count, 10))
+		labels := formatLabels(histogram.labelNames, entry.labelValues, "", "")
+		lines = append(lines, histogram.metricName+"_sum"+labels+" "+formatValue(entry.sum))
+		lines = append(lines, histogram.metricName+"_count"+labels+" "+strconv.FormatUint(entry.count, 10))
+	}
+	histogram.lock.Unlock()
+
+	histogram.writeHeader(w)
+	for _, line := range lines {
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+}
+
+// FuncMetric is a gauge or a counter whose values are collected when the metrics are written, for values that
+// are already tracked somewhere else
+type FuncMetric struct {
+	metricDesc
+	lock    sync.RWMutex
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge that calls collect on every scrape. collect must call emit once per label values.
+// Registering a metric with the name of an existing one replaces its collect function
+func (registry *Registry) NewGaugeFunc(name string, help string, labelNames []string, collect func(emit func(value float64, labelValues ...string))) *FuncMetric {
+	return registry.newFuncMetric("gauge", name, help, labelNames, collect)
+}
+
+// NewCounterFunc is like NewGaugeFunc for values that only increase
+func (registry *Registry) NewCounterFunc(name string, help string, labelNames []string, collect func(emit func(value float64, labelValues ...string))) *FuncMetric {
+	return registry.newFuncMetric("counter", name, help, labelNames, collect)
+}
+
+func (registry *Registry) newFuncMetric(metricType string, name string, help string, labelNames []string, collect func(emit func(value float64, labelValues ...string))) *FuncMetric {
+	metric := registry.register(&FuncMetric{
+		metricDesc: metricDesc{metricName: name, help: help, metricType: metricType, labelNames: labelNames},
+	}).(*FuncMetric)
+	metric.lock.Lock()
+	defer metric.lock.Unlock()
+	metric.collect = collect
+	return metric
+}
+
+func (metric *FuncMetric) write(w *bufio.Writer) {
+	metric.lock.RLock()
+	collect := metric.collect
+	metric.lock.RUnlock()
+
+	var values []labeledValue
+	collect(func(value float64, labelValues ...string) {
+		metric.checkLabels(labelValues)
+		values = append(values, labeledValue{labelValues: append([]string{}, labelValues...), value: value})
+	})
+	sort.Slice(values, func(i, j int) bool {
+		return labelsKey(values[i].labelValues) < labelsKey(values[j].labelValues)
+	})
+
+	metric.writeHeader(w)
+	for _, entry := range values {
+		w.WriteString(metric.metricName + formatLabels(metric.labelNames, entry.labelValues, "", "") + " " + formatValue(entry.value) + "\n")
+	}
+}
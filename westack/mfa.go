@@ -0,0 +1,266 @@
+package westack
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/ratelimit"
+	"github.com/fredyk/westack-go/westack/totp"
+)
+
+const defaultMfaChallengeTtl = 5 * time.Minute
+const mfaRecoveryCodesCount = 10
+
+// mfaAttemptsLimit bounds the wrong codes per user, as there are only a million of them
+var mfaAttemptsLimit = ratelimit.Limit{Max: 5, Window: 15 * time.Minute}
+
+// mfaProperties are the properties of the users with the two-factor secrets, hidden and only written by the
+// two-factor routes
+var mfaProperties = []string{"totpSecret", "totpPendingSecret", "totpLastStep", "recoveryCodes"}
+
+func invalidMfaCodeError(fiberError *fiber.Error) error {
+	return wst.CreateError(fiberError, "INVALID_MFA_CODE", fiber.Map{"message": "invalid two-factor code"}, "Error")
+}
+
+// loginResult returns the tokens of a user that proved their identity, or a challenge token if they have two-factor
+// authentication, to be exchanged for the tokens at POST /users/2fa/verify
+func (app *WeStack) loginResult(user *model.Instance, ctx *model.EventContext) (fiber.Map, error) {
+	userIdHex := model.GetIDAsString(user.Id)
+	if user.ToJSON()["totpEnabled"] == true {
+		challengeTtl := app.tokenTtl("mfaChallengeTtl", defaultMfaChallengeTtl)
+		challengeToken, err := app.signToken(jwt.MapClaims{
+			"userId": userIdHex,
+		}, model.MfaChallengeTokenType, challengeTtl)
+		if err != nil {
+			return nil, err
+		}
+		return fiber.Map{
+			"mfaRequired": true,
+			"mfaToken":    challengeToken,
+			"userId":      userIdHex,
+			"ttl":         int64(challengeTtl.Seconds()),
+		}, nil
+	}
+	return app.loginResultWithoutMfa(user, ctx)
+}
+
+// setupMfaFromRequest handles POST /users/2fa/setup. The secret is pending until a code is verified with it, so that
+// the users are not locked out by a failed setup
+func (app *WeStack) setupMfaFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	user, err := mfaBearerUser(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	data := user.ToJSON()
+	if data["totpEnabled"] == true {
+		return wst.CreateError(fiber.ErrConflict, "MFA_ALREADY_ENABLED", fiber.Map{"message": "two-factor authentication is already enabled"}, "Error")
+	}
+
+	secret := totp.GenerateSecret()
+	_, err = user.UpdateAttributes(wst.M{"totpPendingSecret": secret}, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	issuer := app.Viper.GetString("mfa.issuer")
+	if issuer == "" {
+		issuer = app.Viper.GetString("name")
+	}
+	account := data.GetString("email")
+	if account == "" {
+		account = data.GetString("username")
+	}
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = wst.M{
+		"secret":     secret,
+		"otpauthUri": totp.URI(issuer, account, secret),
+	}
+	return nil
+}
+
+// verifyMfaFromRequest handles POST /users/2fa/verify. With an access token, it enables two-factor authentication
+// with the pending secret and returns the recovery codes. With a challenge token, it returns the tokens of the login
+// if the "code" or the "recoveryCode" of the body is valid
+func (app *WeStack) verifyMfaFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	user, err := mfaBearerUser(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	attemptsKey := "mfa:" + model.GetIDAsString(user.Id)
+	if retryAfter := app.rateLimiter.RetryAfter(attemptsKey); retryAfter > 0 {
+		return model.RateLimitedError(ctx.Ctx, "TOO_MANY_MFA_ATTEMPTS", retryAfter)
+	}
+
+	data := user.ToJSON()
+	systemContext := systemContextFrom(ctx)
+	isChallenge := ctx.Bearer.Claims["typ"] == model.MfaChallengeTokenType
+	if !isChallenge {
+		pendingSecret := data.GetString("totpPendingSecret")
+		if pendingSecret == "" {
+			return wst.CreateError(fiber.ErrBadRequest, "MFA_SETUP_REQUIRED", fiber.Map{"message": "call POST /2fa/setup first"}, "Error")
+		}
+		step, ok := totp.Validate(pendingSecret, ctx.Data.GetString("code"), time.Now())
+		if !ok {
+			app.rateLimiter.Hit(attemptsKey, mfaAttemptsLimit)
+			return invalidMfaCodeError(fiber.ErrBadRequest)
+		}
+		app.rateLimiter.Reset(attemptsKey)
+
+		recoveryCodes, recoveryCodeHashes := generateRecoveryCodes()
+		_, err = user.UpdateAttributes(wst.M{
+			"totpEnabled":       true,
+			"totpSecret":        pendingSecret,
+			"totpPendingSecret": nil,
+			"totpLastStep":      step,
+			"recoveryCodes":     recoveryCodeHashes,
+		}, systemContext)
+		if err != nil {
+			return err
+		}
+		ctx.Logger().Info("Enabled two-factor authentication", "userId", user.Id)
+		ctx.StatusCode = fiber.StatusOK
+		ctx.Result = wst.M{"recoveryCodes": recoveryCodes}
+		return nil
+	}
+
+	if data["totpEnabled"] != true {
+		return invalidMfaCodeError(fiber.ErrUnauthorized)
+	}
+	var changes wst.M
+	if recoveryCode := ctx.Data.GetString("recoveryCode"); recoveryCode != "" {
+		remaining, used := useRecoveryCode(instanceStrings(data["recoveryCodes"]), recoveryCode)
+		if used {
+			changes = wst.M{"recoveryCodes": remaining}
+			ctx.Logger().Info("Used a recovery code", "userId", user.Id, "remaining", len(remaining))
+		}
+	} else {
+		step, ok := totp.Validate(data.GetString("totpSecret"), ctx.Data.GetString("code"), time.Now())
+		// the codes cannot be replayed, and the older ones are rejected too
+		if ok && step > claimStep(data["totpLastStep"]) {
+			changes = wst.M{"totpLastStep": step}
+		}
+	}
+	if changes == nil {
+		app.rateLimiter.Hit(attemptsKey, mfaAttemptsLimit)
+		return invalidMfaCodeError(fiber.ErrUnauthorized)
+	}
+	app.rateLimiter.Reset(attemptsKey)
+
+	// the challenge can only be used once
+	err = app.tokenDenylist.Revoke(ctx.GetContext(), model.TokenID(ctx.Bearer.Claims), model.TokenExpiresAt(ctx.Bearer.Claims))
+	if err == model.ErrTokenRevoked {
+		return invalidMfaCodeError(fiber.ErrUnauthorized)
+	} else if err != nil {
+		return err
+	}
+	user, err = user.UpdateAttributes(changes, systemContext)
+	if err != nil {
+		return err
+	}
+	result, err := app.loginResultWithoutMfa(user, ctx)
+	if err != nil {
+		return err
+	}
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = result
+	return nil
+}
+
+// loginResultWithoutMfa returns the tokens of a user who passed the two-factor challenge
+func (app *WeStack) loginResultWithoutMfa(user *model.Instance, ctx *model.EventContext) (fiber.Map, error) {
+	roleNames, err := app.userRoleNames(*user, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return app.issueTokens(user, roleNames, "")
+}
+
+// mfaBearerUser returns the user of the bearer token. The API keys cannot manage the two-factor authentication
+func mfaBearerUser(loadedModel *model.Model, ctx *model.EventContext) (*model.Instance, error) {
+	if ctx.Bearer == nil || ctx.Bearer.User == nil || ctx.Bearer.Claims["typ"] == model.ApiKeyTokenType {
+		return nil, fiber.ErrUnauthorized
+	}
+	user, err := loadedModel.FindById(ctx.Bearer.User.Id, nil, systemContextFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fiber.ErrUnauthorized
+	}
+	return user, nil
+}
+
+// generateRecoveryCodes returns the single-use codes that replace a TOTP code when the device is lost, and their
+// hashes, which are the only ones stored
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, mfaRecoveryCodesCount)
+	hashes := make([]string, mfaRecoveryCodesCount)
+	for i := range codes {
+		value := make([]byte, 10)
+		_, err := rand.Read(value)
+		if err != nil {
+			panic(err)
+		}
+		encoded := strings.ToLower(base32.StdEncoding.EncodeToString(value))
+		codes[i] = encoded[:8] + "-" + encoded[8:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))))
+	return hex.EncodeToString(hash[:])
+}
+
+// useRecoveryCode returns the hashes without the one of the code, if it is among them
+func useRecoveryCode(hashes []string, code string) ([]string, bool) {
+	codeHash := hashRecoveryCode(code)
+	remaining := make([]string, 0, len(hashes))
+	used := false
+	for _, hash := range hashes {
+		if !used && subtle.ConstantTimeCompare([]byte(hash), []byte(codeHash)) == 1 {
+			used = true
+			continue
+		}
+		remaining = append(remaining, hash)
+	}
+	return remaining, used
+}
+
+// claimStep reads the last used TOTP period, whose type depends on the datasource
+func claimStep(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// checkMfaWrite keeps the two-factor properties of the users read-only for the REST API
+func checkMfaWrite(ctx *model.EventContext) error {
+	if isSystemContext(ctx) {
+		return nil
+	}
+	for _, property := range append([]string{"totpEnabled"}, mfaProperties...) {
+		if _, ok := (*ctx.Data)[property]; ok {
+			return wst.CreateError(fiber.ErrForbidden, "MFA_READ_ONLY", fiber.Map{"message": "two-factor authentication is managed by the /2fa routes"}, "Error")
+		}
+	}
+	return nil
+}
@@ -1,9 +1,10 @@
 package model
 
 import (
-	"fmt"
 	"github.com/mailru/easyjson"
 	"io"
+
+	"github.com/fredyk/westack-go/westack/logging"
 )
 
 type Chunk struct {
@@ -27,21 +28,22 @@ type ChunkGeneratorReader struct {
 	currentChunk          Chunk
 	currentChunkReadIndex int
 	debug                 bool
+	logger                logging.Logger
 }
 
 func (reader *ChunkGeneratorReader) Read(p []byte) (n int, err error) {
 	if reader.debug {
-		fmt.Printf("DEBUG: ChunkGeneratorReader.Read() called with len(p)=%d\n", len(p))
+		reader.logger.Debug("ChunkGeneratorReader.Read()", "len", len(p))
 	}
 	if reader.currentChunkReadIndex == reader.currentChunk.length {
 		if reader.debug {
-			fmt.Printf("DEBUG: ChunkGeneratorReader.Read() reached end of chunk (%d, %d)\n", reader.currentChunkReadIndex, reader.currentChunk.length)
+			reader.logger.Debug("ChunkGeneratorReader.Read() reached end of chunk", "readIndex", reader.currentChunkReadIndex, "length", reader.currentChunk.length)
 		}
 		reader.currentChunk, err = reader.chunkGenerator.NextChunk()
 		if err != nil {
 			if err == io.EOF {
 				if reader.debug {
-					fmt.Printf("DEBUG: ChunkGeneratorReader.Read() reached EOF\n")
+					reader.logger.Debug("ChunkGeneratorReader.Read() reached EOF")
 				}
 			}
 			return n, err
@@ -52,7 +54,7 @@ func (reader *ChunkGeneratorReader) Read(p []byte) (n int, err error) {
 	reader.currentChunkReadIndex += n
 
 	if reader.debug {
-		fmt.Printf("DEBUG: ChunkGeneratorReader.Read() returning %d bytes\n", n)
+		reader.logger.Debug("ChunkGeneratorReader.Read() returning", "bytes", n)
 	}
 
 	return
@@ -65,6 +67,7 @@ type cursorChunkGenerator struct {
 	isFirst      bool
 	eof          bool
 	docsCount    int
+	logger       logging.Logger
 }
 
 func (chunkGenerator *cursorChunkGenerator) ContentType() string {
@@ -92,7 +95,7 @@ func (chunkGenerator *cursorChunkGenerator) GenerateNextChunk() (err error) {
 		nextInstance, err = chunkGenerator.cursor.Next()
 		if err != nil {
 			if chunkGenerator.Debug {
-				fmt.Printf("ERROR: ChunkGenerator.GenerateNextChunk() failed to get next instance: %v\n", err)
+				chunkGenerator.logger.Debug("ChunkGenerator.GenerateNextChunk() failed to get next instance", "error", err)
 			}
 			return err
 
@@ -107,7 +110,7 @@ func (chunkGenerator *cursorChunkGenerator) GenerateNextChunk() (err error) {
 			asBytes, err = easyjson.Marshal(asM)
 			if err != nil {
 				if chunkGenerator.Debug {
-					fmt.Printf("ERROR: ChunkGenerator.GenerateNextChunk() failed to marshal instance: %v\n", err)
+					chunkGenerator.logger.Debug("ChunkGenerator.GenerateNextChunk() failed to marshal instance", "error", err)
 				}
 				return err
 			}
@@ -132,6 +135,7 @@ func (chunkGenerator *cursorChunkGenerator) Reader(eventContext *EventContext) i
 		chunkGenerator: chunkGenerator,
 		eventContext:   eventContext,
 		debug:          chunkGenerator.Debug,
+		logger:         withRequestID(chunkGenerator.logger, eventContext),
 	}
 }
 
@@ -140,10 +144,12 @@ func (chunkGenerator *cursorChunkGenerator) SetDebug(debug bool) {
 }
 
 func NewCursorChunkGenerator(loadedModel *Model, cursor Cursor) ChunkGenerator {
+	logger := loadedModel.Logger()
 	result := cursorChunkGenerator{
 		cursor:  cursor,
-		Debug:   loadedModel.App.Debug,
+		Debug:   logger.Enabled(logging.LevelDebug),
 		isFirst: true,
+		logger:  logger,
 	}
 	return &result
 }
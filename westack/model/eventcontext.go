@@ -1,8 +1,7 @@
 package model
 
 import (
-	"fmt"
-	"log"
+	"context"
 	"strings"
 
 	fiber "github.com/gofiber/fiber/v2"
@@ -30,6 +29,36 @@ type EventContext struct {
 	SkipFieldProtection    bool
 	OperationName          wst.OperationName
 	Handled                bool
+	// Context carries the tracing span and cancellation of the operation. When nil, it is inherited from BaseContext
+	Context context.Context
+	// RequestID is the X-Request-ID of the request, added to the log lines. When empty, it is inherited from BaseContext
+	RequestID string
+	// Tenant is the tenant of the request, which scopes the operations on the multi-tenant models. When empty, it is
+	// inherited from BaseContext
+	Tenant string
+
+	// cancelContext releases the timeout of the remote method. A streamed result takes it over, to release it once sent
+	cancelContext context.CancelFunc
+}
+
+// GetContext returns the context of the operation, inherited from the base contexts, or context.Background()
+func (eventContext *EventContext) GetContext() context.Context {
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.Context != nil {
+			return current.Context
+		}
+	}
+	return context.Background()
+}
+
+// GetTenant returns the tenant of the operation, inherited from the base contexts, or "" if there is none
+func (eventContext *EventContext) GetTenant() string {
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.Tenant != "" {
+			return current.Tenant
+		}
+	}
+	return ""
 }
 
 func (eventContext *EventContext) UpdateEphemeral(newData *wst.M) {
@@ -63,40 +92,56 @@ func (eventContext *EventContext) GetBearer(loadedModel *Model) (error, *BearerT
 	roles := make([]BearerRole, 0)
 	bearerClaims := jwt.MapClaims{}
 	rawToken := ""
+	currentRoles := false
 	if len(authBearerPair) == 2 {
 
 		rawToken = authBearerPair[1]
 
-		token, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
-
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-
-			return loadedModel.App.JwtSecretKey, nil
-		})
+		token, err := jwt.Parse(rawToken, loadedModel.App.JwtKeys.Keyfunc)
 
 		if token != nil {
-			if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-				bearerClaims = claims
-				claimRoles := claims["roles"]
-				userId := claims["userId"]
-				user = &BearerUser{
-					Id:   userId,
-					Data: claims,
-				}
-				if claimRoles != nil {
-					for _, role := range claimRoles.([]interface{}) {
-						roles = append(roles, BearerRole{
-							Name: role.(string),
-						})
-					}
-				}
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok || !token.Valid {
+				withRequestID(loadedModel.Logger(), eventContext).Debug("Invalid bearer token", "error", err)
+			} else if typ, _ := claims["typ"].(string); typ != "" && typ != AccessTokenType && !eventContext.acceptsTokenType(typ) {
+				withRequestID(loadedModel.Logger(), eventContext).Debug("Only access tokens can be used as bearer", "typ", typ)
+			} else if revoked, err := loadedModel.isTokenRevoked(eventContext, claims); err != nil {
+				return err, nil
+			} else if revoked {
+				withRequestID(loadedModel.Logger(), eventContext).Debug("Revoked bearer token", "jti", TokenID(claims))
 			} else {
-				log.Println(err)
+				bearerClaims = claims
+				user, roles = bearerFromClaims(claims)
+				currentRoles = typ != MfaChallengeTokenType && typ != EmailVerificationTokenType
 			}
 		}
 
+	} else if rawApiKey := string(c.Request().Header.Peek(ApiKeyHeader)); rawApiKey != "" {
+
+		claims, err := loadedModel.authenticateApiKey(eventContext, rawApiKey)
+		if err != nil {
+			return err, nil
+		}
+		if claims == nil {
+			withRequestID(loadedModel.Logger(), eventContext).Debug("Invalid API key")
+		} else {
+			bearerClaims = claims
+			user, roles = bearerFromClaims(claims)
+		}
+
+	}
+
+	// the tenant is resolved before the roles, which may be per tenant
+	tenant, err := loadedModel.resolveTenant(eventContext, user, bearerClaims)
+	if err != nil {
+		return err, nil
+	}
+	eventContext.Tenant = tenant
+	if currentRoles {
+		roles, err = loadedModel.currentRoles(eventContext, user, roles)
+		if err != nil {
+			return err, nil
+		}
 	}
 	return nil, &BearerToken{
 		User:   user,
@@ -106,3 +151,35 @@ func (eventContext *EventContext) GetBearer(loadedModel *Model) (error, *BearerT
 	}
 
 }
+
+// acceptsTokenType reports whether the token type is a two-factor challenge or an email verification token sent to the
+// method that accepts it
+func (eventContext *EventContext) acceptsTokenType(typ string) bool {
+	if eventContext.Remote == nil {
+		return false
+	}
+	switch typ {
+	case MfaChallengeTokenType:
+		return eventContext.Remote.Name == MfaVerifyMethod
+	case EmailVerificationTokenType:
+		return eventContext.Remote.Name == EmailVerificationMethod
+	}
+	return false
+}
+
+// bearerFromClaims returns the user and roles of the claims of an access token or an API key
+func bearerFromClaims(claims jwt.MapClaims) (*BearerUser, []BearerRole) {
+	user := &BearerUser{
+		Id:   claims["userId"],
+		Data: claims,
+	}
+	roles := make([]BearerRole, 0)
+	if claimRoles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range claimRoles {
+			roles = append(roles, BearerRole{
+				Name: role.(string),
+			})
+		}
+	}
+	return user, roles
+}
@@ -1,9 +1,10 @@
 package model
 
 import (
-	"fmt"
 	"github.com/mailru/easyjson"
 	"io"
+
+	"github.com/fredyk/westack-go/westack/logging"
 )
 
 type InstanceAChunkGenerator struct {
@@ -14,6 +15,7 @@ type InstanceAChunkGenerator struct {
 	currentChunkIndex int
 	currentChunk      Chunk
 	contentType       string
+	logger            logging.Logger
 }
 
 func (chunkGenerator *InstanceAChunkGenerator) ContentType() string {
@@ -55,7 +57,7 @@ func (chunkGenerator *InstanceAChunkGenerator) GenerateNextChunk() (err error) {
 		asBytes, err = easyjson.Marshal(asM)
 		if err != nil {
 			if chunkGenerator.Debug {
-				fmt.Printf("ERROR: ChunkGenerator.GenerateNextChunk() failed to marshal instance %d/%d: %v\n", chunkGenerator.currentChunkIndex, chunkGenerator.totalChunks, err)
+				chunkGenerator.logger.Debug("ChunkGenerator.GenerateNextChunk() failed to marshal instance", "chunk", chunkGenerator.currentChunkIndex, "totalChunks", chunkGenerator.totalChunks, "error", err)
 			}
 			return
 		}
@@ -63,7 +65,7 @@ func (chunkGenerator *InstanceAChunkGenerator) GenerateNextChunk() (err error) {
 		chunkGenerator.currentChunk.length += len(asBytes)
 	}
 	if chunkGenerator.Debug {
-		fmt.Printf("Generated chunk %d/%d\n", chunkGenerator.currentChunkIndex, chunkGenerator.totalChunks)
+		chunkGenerator.logger.Debug("Generated chunk", "chunk", chunkGenerator.currentChunkIndex, "totalChunks", chunkGenerator.totalChunks)
 	}
 	return
 }
@@ -73,6 +75,7 @@ func (chunkGenerator *InstanceAChunkGenerator) Reader(eventContext *EventContext
 		chunkGenerator: chunkGenerator,
 		eventContext:   eventContext,
 		debug:          chunkGenerator.Debug,
+		logger:         withRequestID(chunkGenerator.logger, eventContext),
 	}
 
 }
@@ -82,12 +85,14 @@ func (chunkGenerator *InstanceAChunkGenerator) SetDebug(debug bool) {
 }
 
 func NewInstanceAChunkGenerator(loadedModel *Model, input InstanceA, contentType string) ChunkGenerator {
+	logger := loadedModel.Logger()
 	result := InstanceAChunkGenerator{
 		contentType:       contentType,
 		currentChunkIndex: 0,
 		totalChunks:       len(input) + 2,
 		input:             input,
-		Debug:             loadedModel.App.Debug,
+		Debug:             logger.Enabled(logging.LevelDebug),
+		logger:            logger,
 	}
 	return &result
 }
@@ -3,7 +3,6 @@ package model
 import (
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
 	"strconv"
 
@@ -13,6 +12,7 @@ import (
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/tracing"
 )
 
 type Instance struct {
@@ -103,8 +103,8 @@ func (modelInstance *Instance) Transform(out interface{}) (err error) {
 		err = bson.UnmarshalWithRegistry(modelInstance.Model.App.Bson.Registry, modelInstance.bytes, out)
 		//Err = json.Unmarshal(modelInstance.bytes, out)
 		//Err = easyjson.Unmarshal(modelInstance.bytes, out)
-		if err != nil && modelInstance.Model.App.Debug {
-			fmt.Printf("Error while unmarshalling instance: %s", err)
+		if err != nil {
+			modelInstance.Model.Logger().Debug("Could not unmarshal instance", "id", modelInstance.Id, "error", err)
 		}
 	}
 	return
@@ -176,6 +176,14 @@ func (modelInstance *Instance) UpdateAttributes(data interface{}, baseContext *E
 		}
 		deepLevel++
 	}
+	err := modelInstance.Model.checkTenantScope(baseContext)
+	if err != nil {
+		return nil, err
+	}
+	err = modelInstance.checkTenantUpdate(finalData, baseContext.GetTenant())
+	if err != nil {
+		return nil, err
+	}
 	if !baseContext.DisableTypeConversions {
 		_, err := datasource.ReplaceObjectIds(finalData)
 		if err != nil {
@@ -219,12 +227,45 @@ func (modelInstance *Instance) UpdateAttributes(data interface{}, baseContext *E
 	for key := range *modelInstance.Model.Config.Relations {
 		delete(finalData, key)
 	}
-	_, err := modelInstance.Model.Datasource.UpdateById(modelInstance.Model.CollectionName, modelInstance.Id, &finalData)
+	var audit *pendingAudit
+	var auditAfter wst.M
+	if modelInstance.Model.IsAudited() {
+		// the stored document, as the instance may be outdated or have its hidden properties removed
+		stored, err := modelInstance.Model.FindById(modelInstance.Id, nil, &EventContext{BaseContext: eventContext})
+		if err != nil {
+			return nil, err
+		}
+		before := stored.ToJSON()
+		auditAfter = wst.M{}
+		for key, value := range before {
+			auditAfter[key] = value
+		}
+		for key, value := range finalData {
+			auditAfter[key] = value
+		}
+		audit, err = modelInstance.Model.beginAudit(eventContext, AuditOperationUpdate, modelInstance.Id, before, auditAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	span := modelInstance.Model.traceDatasourceCall(eventContext.GetContext(), "UpdateById")
+	_, err = modelInstance.Model.Datasource.UpdateById(eventContext.GetContext(), modelInstance.Model.CollectionName, modelInstance.Id, &finalData)
+	tracing.End(span, err)
 
 	if err != nil {
+		if audit != nil {
+			audit.end(err, nil)
+		}
 		return nil, err
 	} else {
 		err := modelInstance.Reload(eventContext)
+		if audit != nil {
+			// the changes expected are recorded if the stored document cannot be read
+			if err == nil {
+				auditAfter = modelInstance.ToJSON()
+			}
+			audit.end(nil, auditAfter)
+		}
 		modelInstance.HideProperties()
 		if err != nil {
 			return nil, err
@@ -436,7 +477,7 @@ func (modelInstance *Instance) GetA(path string) *wst.A {
 		}
 		return out
 	default:
-		log.Printf("WARNING: GetA: %v <%s> is not an array\n", path, modelInstance.data[path])
+		modelInstance.Model.Logger().Warn("GetA: the property is not an array", "path", path, "type", fmt.Sprintf("%T", modelInstance.data[path]))
 		return nil
 	}
 }
@@ -452,15 +493,12 @@ func (modelInstance *Instance) requireBytes() (err error) {
 		//bson.DefaultRegistry.RegisterDecoder(primitive.ObjectID{}, bson.ObjectIDDecoder{})
 
 		//modelInstance.bytes, Err = bson.Marshal(modelInstance.data)
-		if modelInstance.Model.App.Debug {
-			log.Printf("DEBUG: marshalling at requireBytes(): %v\n", modelInstance.data)
-		}
 		//modelInstance.bytes, Err = bson.MarshalWithRegistry(modelInstance.Model.App.Bson.Registry, modelInstance.data)
 		modelInstance.bytes, err = modelInstance.MarshalBSON()
 		//modelInstance.bytes, Err = easyjson.Marshal(modelInstance.data)
 	}
-	if err != nil && modelInstance.Model.App.Debug {
-		log.Printf("ERROR: while marshalling Instance: %v\n", err)
+	if err != nil {
+		modelInstance.Model.Logger().Debug("Could not marshal instance", "id", modelInstance.Id, "error", err)
 	}
 	return err
 }
@@ -470,9 +508,7 @@ func (modelInstance *Instance) requireBytes() (err error) {
 func (modelInstance *Instance) MarshalBSON() (out []byte, err error) {
 	// marshal modelInstance.data
 	toMarshal := modelInstance.data
-	if modelInstance.Model.App.Debug {
-		log.Printf("DEBUG: marshalling Instance: %v\n", toMarshal)
-	}
+	modelInstance.Model.Logger().Debug("Marshalling instance", "id", modelInstance.Id)
 	//bytes, Err := easyjson.Marshal(toMarshal)
 	//w.Raw(bytes, Err)
 	//if modelInstance.Model.App.Debug {
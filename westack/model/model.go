@@ -5,24 +5,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
-	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/casbin/casbin/v2"
 	casbinmodel "github.com/casbin/casbin/v2/model"
-	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"github.com/casbin/casbin/v2/persist"
 	"github.com/fredyk/westack-go/westack/memorykv"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/ratelimit"
+	"github.com/fredyk/westack-go/westack/tracing"
 )
 
 type Property struct {
@@ -66,6 +68,21 @@ type CacheConfig struct {
 	ExcludeFields []string   `json:"excludeFields"`
 }
 
+// TimeoutConfig bounds the time the remote methods of the model may spend before answering 504 Gateway Timeout
+type TimeoutConfig struct {
+	// Default is the timeout, in seconds, of every remote method of the model. 0 disables it
+	Default float64 `json:"default"`
+	// Methods overrides Default for some remote methods, by name, like {"findMany": 2.5}
+	Methods map[string]float64 `json:"methods"`
+}
+
+// MultiTenantConfig stores the tenant of each instance in a property, and scopes the operations on the model to the
+// tenant of the request
+type MultiTenantConfig struct {
+	// Field is the property with the tenant, "tenantId" by default
+	Field string `json:"field"`
+}
+
 type MongoConfig struct {
 	//Database string `json:"database"`
 	Collection string `json:"collection"`
@@ -82,6 +99,13 @@ type Config struct {
 	Casbin     CasbinConfig          `json:"casbin"`
 	Cache      CacheConfig           `json:"cache"`
 	Mongo      MongoConfig           `json:"mongo"`
+	Timeout    TimeoutConfig         `json:"timeout"`
+	// MultiTenant makes the model multi-tenant, with the casbin domains of its policies as tenants
+	MultiTenant *MultiTenantConfig `json:"multiTenant,omitempty"`
+	// Audit records the creates, updates and deletes of the instances in the audit log of the app
+	Audit bool `json:"audit,omitempty"`
+	// LogLevel overrides the level of the app logger for this model: "debug", "info", "warn" or "error"
+	LogLevel string `json:"logLevel,omitempty"`
 }
 
 type SimplifiedConfig struct {
@@ -91,11 +115,12 @@ type SimplifiedConfig struct {
 type DataSourceConfig struct {
 	Name      string `json:"name"`
 	Connector string `json:"connector"`
-	Host      string `json:"host"`
-	Port      int    `json:"port"`
-	Database  string `json:"database"`
+	Host      string `json:"host,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Database  string `json:"database,omitempty"`
 	User      string `json:"user"`
 	Password  string `json:"password"`
+	Directory string `json:"directory,omitempty"`
 }
 
 type Model struct {
@@ -107,7 +132,7 @@ type Model struct {
 	App              *wst.IApp              `json:"-"`
 	BaseUrl          string                 `json:"-"`
 	CasbinModel      *casbinmodel.Model
-	CasbinAdapter    **fileadapter.Adapter
+	CasbinAdapter    persist.Adapter
 	Enforcer         *casbin.Enforcer
 	DisabledHandlers map[string]bool
 	NilInstance      *Instance
@@ -117,7 +142,9 @@ type Model struct {
 	remoteMethodsMap map[string]*OperationItem
 
 	authCache           map[string]map[string]map[string]bool
+	bearerRoles         map[string][]string
 	hasHiddenProperties bool
+	logger              logging.Logger
 }
 
 func (loadedModel *Model) GetModelRegistry() *map[string]*Model {
@@ -140,6 +167,7 @@ func New(config *Config, modelRegistry *map[string]*Model) *Model {
 		eventHandlers:    map[string]func(eventContext *EventContext) error{},
 		remoteMethodsMap: map[string]*OperationItem{},
 		authCache:        map[string]map[string]map[string]bool{},
+		bearerRoles:      map[string][]string{},
 	}
 	loadedModel.NilInstance = &Instance{
 		Model: loadedModel,
@@ -210,7 +238,7 @@ func (loadedModel *Model) Build(data wst.M, sameLevelCache *buildCache, baseCont
 			rawRelatedData := data[relationName]
 			relatedModel, err := loadedModel.App.FindModel(relationConfig.Model)
 			if err != nil {
-				fmt.Printf("ERROR: Model.Build() --> %v\n", err)
+				loadedModel.requestLogger(targetBaseContext).Error("Could not find related model", "relation", relationName, "error", err)
 				return Instance{}, nil
 			}
 			if relatedModel != nil {
@@ -222,10 +250,9 @@ func (loadedModel *Model) Build(data wst.M, sameLevelCache *buildCache, baseCont
 					strict := loadedModel.App.Viper.GetBool("strictSingleRelatedDocumentCheck")
 					if v, ok := sameLevelCache.singleRelatedDocumentsById[modelInstance.Id.(primitive.ObjectID).Hex()]; ok {
 						if strict {
-							fmt.Printf("ERROR: Model.Build() --> Found multiple single related documents at %v.%v with the same parent %v.Id=%v\n", loadedModel.Name, relationName, loadedModel.Name, v.Id.(primitive.ObjectID).Hex())
 							return Instance{}, fmt.Errorf("found multiple single related documents at %v.%v with the same parent %v.Id=%v", loadedModel.Name, relationName, loadedModel.Name, v.Id.(primitive.ObjectID).Hex())
 						} else {
-							fmt.Printf("WARNING: Model.Build() --> Found multiple single related documents at %v.%v with the same parent %v.Id=%v\n", loadedModel.Name, relationName, loadedModel.Name, v.Id.(primitive.ObjectID).Hex())
+							loadedModel.requestLogger(targetBaseContext).Warn("Found multiple single related documents with the same parent", "relation", relationName, "parentId", v.Id.(primitive.ObjectID).Hex())
 						}
 					} else {
 						sameLevelCache.singleRelatedDocumentsById[modelInstance.Id.(primitive.ObjectID).Hex()] = modelInstance
@@ -236,7 +263,7 @@ func (loadedModel *Model) Build(data wst.M, sameLevelCache *buildCache, baseCont
 					} else {
 						relatedInstance, err = relatedModel.(*Model).Build(rawRelatedData.(wst.M), sameLevelCache, targetBaseContext)
 						if err != nil {
-							fmt.Printf("ERROR: Model.Build() --> %v\n", err)
+							loadedModel.requestLogger(targetBaseContext).Error("Could not build related instance", "relation", relationName, "error", err)
 							return Instance{}, err
 						}
 					}
@@ -251,7 +278,7 @@ func (loadedModel *Model) Build(data wst.M, sameLevelCache *buildCache, baseCont
 						for idx, v := range rawRelatedData.(primitive.A) {
 							result[idx], err = relatedModel.(*Model).Build(v.(wst.M), sameLevelCache, targetBaseContext)
 							if err != nil {
-								fmt.Printf("ERROR: Model.Build() --> %v\n", err)
+								loadedModel.requestLogger(targetBaseContext).Error("Could not build related instance", "relation", relationName, "error", err)
 								return Instance{}, err
 							}
 						}
@@ -272,7 +299,7 @@ func (loadedModel *Model) Build(data wst.M, sameLevelCache *buildCache, baseCont
 	if loadedModel.DisabledHandlers["__operation__after_load"] != true {
 		err := loadedModel.GetHandler("__operation__after_load")(eventContext)
 		if err != nil {
-			fmt.Println("Warning", err)
+			loadedModel.requestLogger(targetBaseContext).Warn("Discarding instance after load", "error", err)
 			return Instance{}, nil
 		}
 	}
@@ -307,10 +334,19 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 		deepLevel++
 	}
 
+	err := loadedModel.checkTenantScope(baseContext)
+	if err != nil {
+		return newErrorCursor(err)
+	}
+	filterMap = loadedModel.tenantFilter(filterMap, baseContext.GetTenant())
 	lookups, err := loadedModel.ExtractLookupsFromFilter(filterMap, baseContext.DisableTypeConversions)
 	if err != nil {
 		return newErrorCursor(err)
 	}
+	err = loadedModel.scopeLookups(lookups, baseContext)
+	if err != nil {
+		return newErrorCursor(err)
+	}
 
 	eventContext := &EventContext{
 		BaseContext: targetBaseContext,
@@ -372,7 +408,9 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 	//	delete(finalData, key)
 	//}
 
-	dsCursor, err := loadedModel.Datasource.FindMany(loadedModel.CollectionName, lookups)
+	span := loadedModel.traceDatasourceCall(baseContext.GetContext(), "FindMany")
+	dsCursor, err := loadedModel.Datasource.FindMany(baseContext.GetContext(), loadedModel.CollectionName, lookups)
+	tracing.End(span, err)
 	if err != nil {
 		return newErrorCursor(err)
 	}
@@ -398,20 +436,20 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 			defer func(cursor Cursor) {
 				err := cursor.Close()
 				if err != nil {
-					fmt.Printf("ERROR: Could not close cursor: %v\n", err)
+					loadedModel.requestLogger(baseContext).Error("Could not close cursor", "error", err)
 				}
 			}(cursor)
 			defer func(dsCursor datasource.MongoCursorI, ctx context.Context) {
 				err := dsCursor.Close(ctx)
 				if err != nil {
-					fmt.Printf("ERROR: Could not close cursor: %v\n", err)
+					loadedModel.requestLogger(baseContext).Error("Could not close datasource cursor", "error", err)
 				}
 			}(dsCursor, context.Background())
 			disabledCache := loadedModel.App.Viper.GetBool("disableCache")
 			sameLevelCache := NewBuildCache()
 			var safeCacheDs *datasource.Datasource
 			documentsToCacheByKey := make(map[string]wst.A)
-			for dsCursor.Next(context.Background()) {
+			for dsCursor.Next(baseContext.GetContext()) {
 				var document wst.M
 				err := dsCursor.Decode(&document)
 				if err != nil {
@@ -504,7 +542,7 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 						}
 
 						if isUniqueId {
-							err3 := insertCacheEntries(safeCacheDs, loadedModel, wst.M{"_entries": wst.A{toCache}, "_redId": canonicalId})
+							err3 := insertCacheEntries(baseContext.GetContext(), safeCacheDs, loadedModel, wst.M{"_entries": wst.A{toCache}, "_redId": canonicalId})
 							if err3 != nil {
 								return err3
 							}
@@ -520,9 +558,13 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 				}
 
 			}
+			// Next also returns false when the request context is done, which must not look like the end of the results
+			if err := baseContext.GetContext().Err(); err != nil {
+				return err
+			}
 
 			for key, documents := range documentsToCacheByKey {
-				err := insertCacheEntries(safeCacheDs, loadedModel, wst.M{"_entries": documents, "_redId": key})
+				err := insertCacheEntries(baseContext.GetContext(), safeCacheDs, loadedModel, wst.M{"_entries": documents, "_redId": key})
 				if err != nil {
 					return err
 				}
@@ -535,9 +577,7 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 			return nil
 		}()
 		if err != nil {
-			if loadedModel.App.Debug {
-				log.Println("CACHE ERROR:", err)
-			}
+			loadedModel.requestLogger(baseContext).Debug("Could not load the documents", "error", err)
 			cursor.Error(err)
 		}
 	}()
@@ -545,15 +585,12 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 	return cursor
 }
 
-func insertCacheEntries(safeCacheDs *datasource.Datasource, loadedModel *Model, toCache wst.M) error {
-	cached, err := safeCacheDs.Create(loadedModel.CollectionName, &toCache)
+func insertCacheEntries(ctx context.Context, safeCacheDs *datasource.Datasource, loadedModel *Model, toCache wst.M) error {
+	cached, err := safeCacheDs.Create(ctx, loadedModel.CollectionName, &toCache)
 	if err != nil {
 		return err
 	}
-	if loadedModel.App.Debug {
-		fmt.Printf("[DEBUG] cached %v(len=%v) in memorykv\n", toCache["_redId"], len(toCache["_entries"].(wst.A)))
-		fmt.Printf("[DEBUG] cached doc %v in memorykv\n", cached)
-	}
+	loadedModel.Logger().Debug("Cached documents in memorykv", "key", toCache["_redId"], "count", len(toCache["_entries"].(wst.A)), "cached", cached)
 	return nil
 }
 
@@ -565,23 +602,12 @@ func doExpireCacheKey(safeCacheDs *datasource.Datasource, loadedModel *Model, ca
 	case "memorykv":
 		db := safeCacheDs.Db.(memorykv.MemoryKvDb)
 		bucket := db.GetBucket(loadedModel.CollectionName)
-		if loadedModel.App.Debug {
-			log.Println("CACHING", loadedModel.Name)
-		}
-		if loadedModel.App.Debug {
-			log.Println("CACHING CANONICAL ID", canonicalId)
-		}
 		ttl := time.Duration(loadedModel.Config.Cache.Ttl) * time.Second
-		if loadedModel.App.Debug {
-			fmt.Printf("[DEBUG] trying to expire %v in %v seconds\n", canonicalId, ttl)
-		}
 		err := bucket.Expire(canonicalId, ttl)
 		if err != nil {
 			return err
 		}
-		if loadedModel.App.Debug {
-			fmt.Printf("[DEBUG] expiring %v in %v seconds\n", canonicalId, ttl)
-		}
+		loadedModel.Logger().Debug("Expiring cache key", "key", canonicalId, "ttl", ttl)
 	default:
 		return errors.New(fmt.Sprintf("Unsupported cache connector %v", connectorName))
 	}
@@ -603,10 +629,19 @@ func (loadedModel *Model) Count(filterMap *wst.Filter, baseContext *EventContext
 		deepLevel++
 	}
 
+	err := loadedModel.checkTenantScope(baseContext)
+	if err != nil {
+		return 0, err
+	}
+	filterMap = loadedModel.tenantFilter(filterMap, baseContext.GetTenant())
 	lookups, err := loadedModel.ExtractLookupsFromFilter(filterMap, baseContext.DisableTypeConversions)
 	if err != nil {
 		return 0, err
 	}
+	err = loadedModel.scopeLookups(lookups, baseContext)
+	if err != nil {
+		return 0, err
+	}
 
 	eventContext := &EventContext{
 		BaseContext: targetBaseContext,
@@ -622,7 +657,9 @@ func (loadedModel *Model) Count(filterMap *wst.Filter, baseContext *EventContext
 
 	eventContext.Filter = filterMap
 
-	count, err := loadedModel.Datasource.Count(loadedModel.CollectionName, lookups)
+	span := loadedModel.traceDatasourceCall(eventContext.GetContext(), "Count")
+	count, err := loadedModel.Datasource.Count(eventContext.GetContext(), loadedModel.CollectionName, lookups)
+	tracing.End(span, err)
 	if err != nil {
 		return 0, err
 	}
@@ -650,6 +687,8 @@ func (loadedModel *Model) FindById(id interface{}, filterMap *wst.Filter, baseCo
 		if err != nil {
 			_id = id
 		}
+	case *primitive.ObjectID:
+		_id = *id.(*primitive.ObjectID)
 	default:
 		_id = id
 	}
@@ -734,6 +773,14 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 			break
 		}
 	}
+	err := loadedModel.checkTenantScope(baseContext)
+	if err != nil {
+		return nil, err
+	}
+	err = loadedModel.stampTenant(finalData, baseContext.GetTenant())
+	if err != nil {
+		return nil, err
+	}
 	if !baseContext.DisableTypeConversions {
 		_, err := datasource.ReplaceObjectIds(finalData)
 		if err != nil {
@@ -774,7 +821,33 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 	for key := range *loadedModel.Config.Relations {
 		delete(finalData, key)
 	}
-	document, err := loadedModel.Datasource.Create(loadedModel.CollectionName, &finalData)
+	var audit *pendingAudit
+	if loadedModel.IsAudited() {
+		// the id is set like the connectors do, so that the entry has it before the instance is created
+		if finalData["_id"] == nil {
+			if finalData["id"] != nil {
+				finalData["_id"] = finalData["id"]
+			} else {
+				finalData["_id"] = primitive.NewObjectID()
+			}
+			delete(finalData, "id")
+		}
+		var err error
+		audit, err = loadedModel.beginAudit(eventContext, AuditOperationCreate, finalData["_id"], nil, finalData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	span := loadedModel.traceDatasourceCall(eventContext.GetContext(), "Create")
+	document, err := loadedModel.Datasource.Create(eventContext.GetContext(), loadedModel.CollectionName, &finalData)
+	tracing.End(span, err)
+	if audit != nil {
+		var after wst.M
+		if document != nil {
+			after = *document
+		}
+		audit.end(err, after)
+	}
 
 	if err != nil {
 		return nil, err
@@ -796,7 +869,11 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 
 }
 
-func (loadedModel *Model) DeleteById(id interface{}) (datasource.DeleteResult, error) {
+func (loadedModel *Model) DeleteById(id interface{}, ctx *EventContext) (datasource.DeleteResult, error) {
+	err := loadedModel.checkTenantScope(ctx)
+	if err != nil {
+		return datasource.DeleteResult{}, err
+	}
 
 	var finalId interface{}
 	switch id.(type) {
@@ -814,12 +891,19 @@ func (loadedModel *Model) DeleteById(id interface{}) (datasource.DeleteResult, e
 		finalId = *id.(*primitive.ObjectID)
 		break
 	default:
-		if loadedModel.App.Debug {
-			fmt.Println(fmt.Sprintf("WARNING: Invalid input for Model.DeleteById() <- %s", id))
-		}
+		loadedModel.Logger().Warn("Invalid id for DeleteById", "id", id)
 	}
 	//TODO: Invoke hook for __operation__before_delete and __operation__after_delete
-	return loadedModel.Datasource.DeleteById(loadedModel.CollectionName, finalId)
+	if loadedModel.IsAudited() {
+		return loadedModel.auditedDelete(loadedModel.tenantWhere(wst.M{"_id": finalId}, ctx.GetTenant()), ctx)
+	}
+	if tenant := ctx.GetTenant(); tenant != "" && loadedModel.IsMultiTenant() {
+		// an instance of another tenant is not found, like one that does not exist
+		return loadedModel.Datasource.DeleteMany(ctx.GetContext(), loadedModel.CollectionName, &wst.A{
+			{"$match": loadedModel.tenantWhere(wst.M{"_id": finalId}, tenant)},
+		})
+	}
+	return loadedModel.Datasource.DeleteById(ctx.GetContext(), loadedModel.CollectionName, finalId)
 }
 
 func (loadedModel *Model) DeleteMany(where *wst.Where, ctx *EventContext) (result datasource.DeleteResult, err error) {
@@ -829,12 +913,47 @@ func (loadedModel *Model) DeleteMany(where *wst.Where, ctx *EventContext) (resul
 	if len(*where) == 0 {
 		return result, errors.New("where cannot be empty")
 	}
+	err = loadedModel.checkTenantScope(ctx)
+	if err != nil {
+		return result, err
+	}
+	if loadedModel.IsAudited() {
+		return loadedModel.auditedDelete(loadedModel.tenantWhere(wst.M(*where), ctx.GetTenant()), ctx)
+	}
 	whereLookups := &wst.A{
 		{
-			"$match": wst.M(*where),
+			"$match": loadedModel.tenantWhere(wst.M(*where), ctx.GetTenant()),
 		},
 	}
-	return loadedModel.Datasource.DeleteMany(loadedModel.CollectionName, whereLookups)
+	return loadedModel.Datasource.DeleteMany(ctx.GetContext(), loadedModel.CollectionName, whereLookups)
+}
+
+// auditedDelete deletes the instances that match, recording the stored documents. Only the instances found are
+// deleted, so that none is deleted without its entry
+func (loadedModel *Model) auditedDelete(match wst.M, ctx *EventContext) (result datasource.DeleteResult, err error) {
+	documents, err := loadedModel.auditSnapshots(ctx, match)
+	if err != nil || len(documents) == 0 {
+		return result, err
+	}
+	ids := make([]interface{}, 0, len(documents))
+	audits := make([]*pendingAudit, 0, len(documents))
+	defer func() {
+		for _, audit := range audits {
+			audit.end(err, nil)
+		}
+	}()
+	for _, document := range documents {
+		audit, err := loadedModel.beginAudit(ctx, AuditOperationDelete, document["_id"], document, nil)
+		if err != nil {
+			// the instances of the entries already recorded are not deleted either
+			return result, err
+		}
+		audits = append(audits, audit)
+		ids = append(ids, document["_id"])
+	}
+	return loadedModel.Datasource.DeleteMany(ctx.GetContext(), loadedModel.CollectionName, &wst.A{
+		{"$match": wst.M{"$and": wst.A{match, {"_id": wst.M{"$in": ids}}}}},
+	})
 }
 
 type RemoteMethodOptionsHttp struct {
@@ -861,6 +980,8 @@ type RemoteMethodOptions struct {
 	Description string
 	Accepts     RemoteMethodOptionsHttpArgs
 	Http        RemoteMethodOptionsHttp
+	// RateLimit bounds the requests of each client to the method, identified by its user or, if anonymous, its IP
+	RateLimit *ratelimit.Limit
 }
 
 type OperationItem struct {
@@ -894,10 +1015,7 @@ func wrapEventHandler(model *Model, eventKey string, handler func(eventContext *
 		handler = func(eventContext *EventContext) error {
 			currentHandlerError := currentHandler(eventContext)
 			if currentHandlerError != nil {
-				if model.App.Debug {
-					fmt.Println("WARNING: Stop handling on error", currentHandlerError)
-					debug.PrintStack()
-				}
+				model.requestLogger(eventContext).Debug("Stop handling on error", "event", eventKey, "error", currentHandlerError)
 				return currentHandlerError
 			} else {
 				return newHandler(eventContext)
@@ -916,6 +1034,11 @@ func (loadedModel *Model) Observe(operation string, handler func(eventContext *E
 	loadedModel.On(eventKey, handler)
 }
 
+// HasHandler reports whether a handler was registered for the event with On or Observe
+func (loadedModel *Model) HasHandler(event string) bool {
+	return loadedModel.eventHandlers[event] != nil
+}
+
 var handlerMutex = sync.Mutex{}
 
 func (loadedModel *Model) GetHandler(event string) func(eventContext *EventContext) error {
@@ -924,20 +1047,23 @@ func (loadedModel *Model) GetHandler(event string) func(eventContext *EventConte
 		handlerMutex.Lock()
 		loadedModel.DisabledHandlers[event] = true
 		handlerMutex.Unlock()
-		res = func(eventContext *EventContext) error {
-			if loadedModel.App.Debug {
-				fmt.Println("no handler found for ", loadedModel.Name, ".", event)
-			}
+		return func(eventContext *EventContext) error {
+			loadedModel.requestLogger(eventContext).Debug("No handler found", "event", event)
 			return nil
 		}
 	}
-	return res
+	return func(eventContext *EventContext) error {
+		return loadedModel.traceHandler("Hook "+loadedModel.Name+"."+event, eventContext, func() error {
+			return res(eventContext)
+		}, attribute.String("westack.event", event))
+	}
 }
 
 func (loadedModel *Model) Initialize() {
 	if len(loadedModel.Config.Hidden) > 0 {
 		loadedModel.hasHiddenProperties = true
 	}
+	loadedModel.logger = loadedModel.buildLogger()
 }
 
 func GetIDAsString(idToConvert interface{}) string {
@@ -0,0 +1,238 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// Operations of the audit entries
+const (
+	AuditOperationCreate = "create"
+	AuditOperationUpdate = "update"
+	AuditOperationDelete = "delete"
+)
+
+// Statuses of the audit entries. The entries are recorded as pending before the operation, so that no operation is
+// performed without its entry, and completed after it. An entry left pending means that the app stopped, or could not
+// complete it, so its operation may have been performed or not
+const (
+	AuditStatusPending   = "pending"
+	AuditStatusCommitted = "committed"
+	AuditStatusFailed    = "failed"
+)
+
+// AuditCollection is the collection of the audit entries, when they are not stored in an audit model
+const AuditCollection = "AuditEntry"
+
+// DefaultAuditLimit is the number of entries returned by AuditLog.Find when no limit is given
+const DefaultAuditLimit = 100
+
+// AuditLog stores the audit entries of the create, update and delete operations on the models with the "audit" option
+type AuditLog struct {
+	Datasource *datasource.Datasource
+	Collection string
+}
+
+func NewAuditLog(ds *datasource.Datasource, collection string) *AuditLog {
+	if collection == "" {
+		collection = AuditCollection
+	}
+	return &AuditLog{Datasource: ds, Collection: collection}
+}
+
+// Record stores an entry, with its "id" or else a random one
+func (auditLog *AuditLog) Record(ctx context.Context, entry wst.M) error {
+	document := wst.M{"_id": uuid.NewString()}
+	for key, value := range entry {
+		if key == "id" {
+			document["_id"] = value
+		} else {
+			document[key] = value
+		}
+	}
+	_, err := auditLog.Datasource.Create(ctx, auditLog.Collection, &document)
+	return err
+}
+
+// Update sets fields of an entry
+func (auditLog *AuditLog) Update(ctx context.Context, entryId string, fields wst.M) error {
+	_, err := auditLog.Datasource.UpdateById(ctx, auditLog.Collection, entryId, &fields)
+	return err
+}
+
+// Find returns the latest entries of a model and instance, newest first. Empty values match any model, instance or
+// tenant
+func (auditLog *AuditLog) Find(ctx context.Context, modelName string, modelId string, tenant string, limit int) ([]wst.M, error) {
+	match := wst.M{}
+	if modelName != "" {
+		match["model"] = modelName
+	}
+	if modelId != "" {
+		match["modelId"] = modelId
+	}
+	if tenant != "" {
+		match["tenant"] = tenant
+	}
+	if limit <= 0 {
+		limit = DefaultAuditLimit
+	}
+	cursor, err := auditLog.Datasource.FindMany(ctx, auditLog.Collection, &wst.A{
+		{"$match": match},
+		{"$sort": wst.M{"at": -1}},
+		{"$limit": limit},
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]wst.M, 0)
+	err = cursor.All(ctx, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		delete(entry, "_id")
+	}
+	return entries, nil
+}
+
+// IsAudited reports whether the model has the "audit" option, and the app can record the entries
+func (loadedModel *Model) IsAudited() bool {
+	return loadedModel.Config != nil && loadedModel.Config.Audit && loadedModel.App != nil && loadedModel.App.RecordAudit != nil && loadedModel.App.UpdateAudit != nil
+}
+
+// pendingAudit is an entry recorded before its operation, to be completed once the operation is performed
+type pendingAudit struct {
+	model        *Model
+	eventContext *EventContext
+	id           string
+	operation    string
+	modelId      interface{}
+	before       wst.M
+}
+
+// beginAudit records the pending entry of an operation on an instance, with the changes expected between the stored
+// documents before and after it. The before document of a create and the after document of a delete are nil. The
+// operation must not be performed if it fails
+func (loadedModel *Model) beginAudit(eventContext *EventContext, operation string, id interface{}, before wst.M, after wst.M) (*pendingAudit, error) {
+	entry := wst.M{
+		"id":        uuid.NewString(),
+		"model":     loadedModel.Name,
+		"modelId":   auditId(id),
+		"operation": operation,
+		"status":    AuditStatusPending,
+		"at":        time.Now(),
+		"changes":   loadedModel.auditChanges(before, after),
+	}
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.Bearer != nil && current.Bearer.User != nil {
+			if current.Bearer.User.System {
+				entry["system"] = true
+			} else if current.Bearer.User.Id != nil {
+				entry["userId"] = auditId(current.Bearer.User.Id)
+			}
+			break
+		}
+	}
+	if requestID := eventContext.GetRequestID(); requestID != "" {
+		entry["requestId"] = requestID
+	}
+	if tenant := eventContext.GetTenant(); tenant != "" {
+		entry["tenant"] = tenant
+	}
+	err := loadedModel.App.RecordAudit(eventContext.GetContext(), entry)
+	if err != nil {
+		withRequestID(loadedModel.Logger(), eventContext).Error("Could not record the audit entry", "operation", operation, "id", id, "error", err)
+		return nil, err
+	}
+	return &pendingAudit{
+		model:        loadedModel,
+		eventContext: eventContext,
+		id:           entry.GetString("id"),
+		operation:    operation,
+		modelId:      id,
+		before:       before,
+	}, nil
+}
+
+// end completes the entry with the outcome of the operation and, when it was performed, the changes of the stored
+// document after it. The operation cannot be undone, so a failure is only logged and the entry is left pending, instead
+// of reporting a performed operation as failed
+func (audit *pendingAudit) end(operationErr error, after wst.M) {
+	fields := wst.M{"status": AuditStatusCommitted}
+	if operationErr != nil {
+		fields["status"] = AuditStatusFailed
+	} else {
+		fields["changes"] = audit.model.auditChanges(audit.before, after)
+	}
+	err := audit.model.App.UpdateAudit(audit.eventContext.GetContext(), audit.id, fields)
+	if err != nil {
+		withRequestID(audit.model.Logger(), audit.eventContext).Error("Could not complete the audit entry", "operation", audit.operation, "id", audit.modelId, "entryId", audit.id, "error", err)
+	}
+}
+
+// auditChanges returns the fields that differ between the documents, with their values before and after. The values of
+// the hidden properties are not recorded, only that they changed
+func (loadedModel *Model) auditChanges(before wst.M, after wst.M) wst.M {
+	changes := wst.M{}
+	compare := func(key string) {
+		if key == "_id" || key == "id" || (*loadedModel.Config.Relations)[key] != nil {
+			return
+		}
+		if _, done := changes[key]; done {
+			return
+		}
+		beforeValue, afterValue := before[key], after[key]
+		if reflect.DeepEqual(beforeValue, afterValue) {
+			return
+		}
+		for _, hidden := range loadedModel.Config.Hidden {
+			if hidden == key {
+				changes[key] = wst.M{"hidden": true}
+				return
+			}
+		}
+		changes[key] = wst.M{"before": beforeValue, "after": afterValue}
+	}
+	for key := range before {
+		compare(key)
+	}
+	for key := range after {
+		compare(key)
+	}
+	return changes
+}
+
+// auditSnapshots returns the stored documents that match a deletion, before it is performed
+func (loadedModel *Model) auditSnapshots(ctx *EventContext, match wst.M) ([]wst.M, error) {
+	cursor, err := loadedModel.Datasource.FindMany(ctx.GetContext(), loadedModel.CollectionName, &wst.A{{"$match": match}})
+	if err != nil {
+		return nil, err
+	}
+	var documents []wst.M
+	err = cursor.All(ctx.GetContext(), &documents)
+	return documents, err
+}
+
+// auditId returns the id of an instance or user as stored in the audit entries, to query them by the id of the url
+func auditId(id interface{}) string {
+	switch id := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return id
+	case primitive.ObjectID:
+		return id.Hex()
+	case *primitive.ObjectID:
+		return id.Hex()
+	default:
+		return fmt.Sprintf("%v", id)
+	}
+}
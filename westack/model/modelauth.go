@@ -2,40 +2,71 @@ package model
 
 import (
 	"fmt"
-	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	casbinmodel "github.com/casbin/casbin/v2/model"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
 	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/metrics"
+	"github.com/fredyk/westack-go/westack/tracing"
 )
 
 var AuthMutex = sync.RWMutex{}
 
-func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action string, eventContext *EventContext) (error, bool) {
+var authCacheRequests = metrics.DefaultRegistry.NewCounterVec("westack_auth_cache_requests_total", "Authorization checks answered from the cache (hit) or by casbin (miss)", "model", "result")
+
+func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action string, eventContext *EventContext) (err error, allowed bool) {
 
 	if token != nil && token.User != nil && token.User.System == true {
 		return nil, true
 	}
 
+	_, span := tracing.Start(eventContext.GetContext(), "EnforceEx "+loadedModel.Name+"."+action,
+		attribute.String("westack.model", loadedModel.Name),
+		attribute.String("westack.action", action),
+		attribute.String("westack.object", objId),
+	)
+	defer func() {
+		span.SetAttributes(attribute.Bool("westack.allowed", allowed))
+		if err == fiber.ErrUnauthorized {
+			span.End()
+		} else {
+			tracing.End(span, err)
+		}
+	}()
+
+	logger := loadedModel.requestLogger(eventContext)
 	if token == nil {
-		log.Printf("WARNING: Trying to enforce without token at %v.%v\n", loadedModel.Name, action)
+		logger.Warn("Trying to enforce without token", "action", action)
 	}
 
 	var bearerUserIdSt string
+	var cacheSubject string
 	var targetObjId string
 
+	// the enforcers of the multi-tenant models have the tenant as casbin domain
+	tenant := ""
+	if loadedModel.IsMultiTenant() {
+		tenant = eventContext.GetTenant()
+	}
+
 	var locked bool
 
 	if token == nil || token.User == nil {
 		bearerUserIdSt = "_EVERYONE_"
+		cacheSubject = bearerUserIdSt + "|" + tenant
 		targetObjId = "*"
 		AuthMutex.RLock()
-		if result, isPresent := loadedModel.authCache[bearerUserIdSt][targetObjId][action]; isPresent {
-			if loadedModel.App.Debug || !result {
-				log.Printf("DEBUG: Cache hit for %v.%v ---> %v\n", loadedModel.Name, action, result)
-			}
+		if result, isPresent := loadedModel.authCache[cacheSubject][targetObjId][action]; isPresent {
+			logAuthDecision(logger, result)("Auth cache hit", "action", action, "allowed", result)
 			AuthMutex.RUnlock()
+			authCacheRequests.Inc(loadedModel.Name, "hit")
 			return nil, result
 		} else {
 			AuthMutex.RUnlock()
@@ -44,33 +75,18 @@ func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action str
 	} else {
 
 		bearerUserIdSt = fmt.Sprintf("%v", token.User.Id)
+		// the roles are part of the key, so that the decisions are not reused when they change
+		cacheSubject = bearerUserIdSt + "|" + tenant + "|" + bearerRolesKey(token.Roles)
 		targetObjId = objId
 
-		var created int64
-		var ttl int64
-		// try to cast
-		if v, ok := token.Claims["created"].(int64); ok {
-			created = v
-		} else {
-			created = int64(token.Claims["created"].(float64))
-		}
-		if v, ok := token.Claims["ttl"].(int64); ok {
-			ttl = v
-		} else {
-			ttl = int64(token.Claims["ttl"].(float64))
-		}
-		expiresAtTimestamp := created + ttl
-		if time.Now().Unix() > expiresAtTimestamp {
-			if loadedModel.App.Debug {
-				fmt.Println("Token expired for user", bearerUserIdSt)
-			}
+		if time.Now().After(TokenExpiresAt(token.Claims)) {
+			logger.Debug("Token expired", "userId", bearerUserIdSt)
 			return fiber.ErrUnauthorized, false
 		}
 
-		if result, isPresent := loadedModel.authCache[bearerUserIdSt][targetObjId][action]; isPresent {
-			if loadedModel.App.Debug || !result {
-				log.Printf("DEBUG: Cache hit for %v.%v ---> %v\n", loadedModel.Name, action, result)
-			}
+		if result, isPresent := loadedModel.authCache[cacheSubject][targetObjId][action]; isPresent {
+			logAuthDecision(logger, result)("Auth cache hit", "action", action, "allowed", result)
+			authCacheRequests.Inc(loadedModel.Name, "hit")
 			return nil, result
 		}
 
@@ -78,21 +94,7 @@ func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action str
 		defer AuthMutex.Unlock()
 		locked = true
 
-		_, err := loadedModel.Enforcer.AddRoleForUser(bearerUserIdSt, "_EVERYONE_")
-		if err != nil {
-			return err, false
-		}
-		_, err = loadedModel.Enforcer.AddRoleForUser(bearerUserIdSt, "_AUTHENTICATED_")
-		if err != nil {
-			return err, false
-		}
-		for _, r := range token.Roles {
-			_, err := loadedModel.Enforcer.AddRoleForUser(bearerUserIdSt, r.Name)
-			if err != nil {
-				return err, false
-			}
-		}
-		err = loadedModel.Enforcer.SavePolicy()
+		err := loadedModel.syncBearerRoles(bearerUserIdSt, tenant, token.Roles)
 		if err != nil {
 			return err, false
 		}
@@ -104,28 +106,119 @@ func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action str
 		defer AuthMutex.Unlock()
 	}
 
-	allow, exp, err := loadedModel.Enforcer.EnforceEx(bearerUserIdSt, targetObjId, action)
+	authCacheRequests.Inc(loadedModel.Name, "miss")
+	request := []interface{}{bearerUserIdSt, targetObjId, action}
+	if loadedModel.IsMultiTenant() {
+		request = []interface{}{bearerUserIdSt, tenant, targetObjId, action}
+	}
+	allow, exp, err := loadedModel.Enforcer.EnforceEx(request...)
 
-	if loadedModel.App.Debug || !allow {
+	if logger.Enabled(logging.LevelDebug) || !allow {
+		args := []any{"action", action, "subject", bearerUserIdSt, "object", targetObjId, "allowed", allow}
+		if tenant != "" {
+			args = append(args, "tenant", tenant)
+		}
 		if len(exp) > 0 {
-			log.Println("Explain", exp)
+			args = append(args, "explain", exp)
 		}
-		fmt.Printf("DEBUG: EnforceEx for %v.%v (subj=%v,obj=%v) ---> %v\n", loadedModel.Name, action, bearerUserIdSt, targetObjId, allow)
 		if eventContext.Remote != nil && eventContext.Remote.Name != "" {
-			fmt.Printf("DEBUG: ... at remote method %v %v%v\n", strings.ToUpper(eventContext.Remote.Http.Verb), loadedModel.BaseUrl, eventContext.Remote.Http.Path)
+			args = append(args, "remoteMethod", strings.ToUpper(eventContext.Remote.Http.Verb)+" "+loadedModel.BaseUrl+eventContext.Remote.Http.Path)
 		}
+		logAuthDecision(logger, allow)("EnforceEx", args...)
 	}
 	if err != nil {
-		updateAuthCache(loadedModel, bearerUserIdSt, targetObjId, action, false)
+		updateAuthCache(loadedModel, cacheSubject, targetObjId, action, false)
 		return err, false
 	}
 	if allow {
-		updateAuthCache(loadedModel, bearerUserIdSt, targetObjId, action, true)
+		updateAuthCache(loadedModel, cacheSubject, targetObjId, action, true)
 		return nil, true
 	}
 	return fiber.ErrUnauthorized, false
 }
 
+// syncBearerRoles sets the roles of the subject in the enforcer, in the tenant for the multi-tenant models, removing
+// the ones that it had in a previous request and no longer has. The links are derived from the tokens on each request,
+// so they are only kept in memory: neither stored by the adapter nor notified to the other instances, which would
+// reload all the rules on every request. Must be called with the AuthMutex locked
+func (loadedModel *Model) syncBearerRoles(subject string, tenant string, roles []BearerRole) error {
+	roleNames := []string{"_EVERYONE_", "_AUTHENTICATED_"}
+	for _, r := range roles {
+		roleNames = append(roleNames, r.Name)
+	}
+	current := make(map[string]bool, len(roleNames))
+	for _, roleName := range roleNames {
+		current[roleName] = true
+	}
+	domain := loadedModel.RoleDomain(tenant)
+	key := subject + "|" + tenant
+	casbModel := loadedModel.Enforcer.GetModel()
+	for _, previous := range loadedModel.bearerRoles[key] {
+		if !current[previous] {
+			rule := append([]string{subject, previous}, domain...)
+			if casbModel.RemovePolicy("g", "g", rule) {
+				err := loadedModel.Enforcer.BuildIncrementalRoleLinks(casbinmodel.PolicyRemove, "g", [][]string{rule})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, roleName := range roleNames {
+		rule := append([]string{subject, roleName}, domain...)
+		if casbModel.HasPolicy("g", "g", rule) {
+			continue
+		}
+		casbModel.AddPolicy("g", "g", rule)
+		err := loadedModel.Enforcer.BuildIncrementalRoleLinks(casbinmodel.PolicyAdd, "g", [][]string{rule})
+		if err != nil {
+			return err
+		}
+	}
+	loadedModel.bearerRoles[key] = roleNames
+	return nil
+}
+
+// bearerRolesKey identifies the set of roles of a bearer
+func bearerRolesKey(roles []BearerRole) string {
+	roleNames := make([]string, len(roles))
+	for i, r := range roles {
+		roleNames[i] = r.Name
+	}
+	sort.Strings(roleNames)
+	return strings.Join(roleNames, ",")
+}
+
+// ClearAuthCache forgets the cached decisions, after a change of the policies or of the role hierarchy
+func (loadedModel *Model) ClearAuthCache() {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	loadedModel.authCache = make(map[string]map[string]map[string]bool)
+}
+
+// SavePolicy writes all the rules of the enforcer to the CSV file of the model. The other adapters store each rule when
+// it is added or removed, so they need no full save
+func (loadedModel *Model) SavePolicy() error {
+	if _, ok := loadedModel.CasbinAdapter.(*fileadapter.Adapter); !ok {
+		return nil
+	}
+	return loadedModel.Enforcer.SavePolicy()
+}
+
+// ReloadPolicy loads the rules again, after another instance of the app changed them, and forgets the decisions and
+// the roles of the bearers set with the previous rules
+func (loadedModel *Model) ReloadPolicy() error {
+	AuthMutex.Lock()
+	defer AuthMutex.Unlock()
+	err := loadedModel.Enforcer.LoadPolicy()
+	if err != nil {
+		return err
+	}
+	loadedModel.bearerRoles = map[string][]string{}
+	loadedModel.ClearAuthCache()
+	return nil
+}
+
 func updateAuthCache(loadedModel *Model, bearerUserIdSt string, targetObjId string, action string, allow bool) {
 	cacheLock.Lock()
 	defer cacheLock.Unlock()
@@ -160,3 +253,11 @@ func addObjectAuthCacheEntry(loadedModel *Model, bearerUserIdSt string, targetOb
 func addActionAuthCacheEntry(loadedModel *Model, bearerUserIdSt string, targetObjId string, action string, allow bool) {
 	loadedModel.authCache[bearerUserIdSt][targetObjId][action] = allow
 }
+
+// logAuthDecision logs the denials as info, as they are usually the answer to "why do I get a 401?"
+func logAuthDecision(logger logging.Logger, allowed bool) func(msg string, args ...any) {
+	if allowed {
+		return logger.Debug
+	}
+	return logger.Info
+}
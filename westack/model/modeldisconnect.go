@@ -0,0 +1,38 @@
+package model
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// disconnectPollInterval is how often the connection of a running remote method is checked for a client disconnect
+const disconnectPollInterval = 50 * time.Millisecond
+
+// cancelOnDisconnect returns a context that is cancelled when the client closes the connection, so that the datasource
+// calls of a request whose client went away are aborted. fasthttp does not notify the handlers when a connection is
+// closed, so the connection is peeked every disconnectPollInterval, without reading the pipelined requests, until the
+// returned function is called
+func cancelOnDisconnect(parent context.Context, conn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	closed := connectionClosedCheck(conn)
+	if closed == nil {
+		return ctx, cancel
+	}
+	go func() {
+		ticker := time.NewTicker(disconnectPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if closed() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, cancel
+}
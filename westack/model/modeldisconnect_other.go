@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package model
+
+import "net"
+
+// connectionClosedCheck is not supported on this platform, where the requests only end when they finish or time out
+func connectionClosedCheck(conn net.Conn) func() bool {
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package model
+
+import (
+	"net"
+	"syscall"
+)
+
+// connectionClosedCheck returns a function that reports whether the peer closed the connection, by peeking its socket
+// without consuming the data, or nil when the connection is not a socket, like the ones of app.Test()
+func connectionClosedCheck(conn net.Conn) func() bool {
+	// the closure of a TLS connection is the one of the underlying socket
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	buffer := make([]byte, 1)
+	return func() bool {
+		closed := false
+		err := rawConn.Read(func(fd uintptr) bool {
+			// the sockets of the net package are non-blocking, so the peek returns EAGAIN while there is no data
+			n, _, err := syscall.Recvfrom(int(fd), buffer, syscall.MSG_PEEK)
+			closed = (n == 0 && err == nil) || (err != nil && err != syscall.EAGAIN && err != syscall.EWOULDBLOCK && err != syscall.EINTR)
+			return true
+		})
+		return closed || err != nil
+	}
+}
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/fredyk/westack-go/westack/logging"
+)
+
+// RequestIDHeader is read to propagate the request id of the callers, and written in every response
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDLocalsKey = "westack.requestId"
+
+// maxRequestIDLength bounds the propagated ids, which end up in every log line of the request
+const maxRequestIDLength = 128
+
+// RequestID returns the id of the request, taken from the X-Request-ID header when it is valid or generated otherwise,
+// and sets it in the response
+func RequestID(c *fiber.Ctx) string {
+	if requestID, ok := c.Locals(requestIDLocalsKey).(string); ok {
+		return requestID
+	}
+	requestID := string(c.Request().Header.Peek(RequestIDHeader))
+	if !isValidRequestID(requestID) {
+		requestID = uuid.NewString()
+	}
+	c.Locals(requestIDLocalsKey, requestID)
+	c.Set(RequestIDHeader, requestID)
+	return requestID
+}
+
+// isValidRequestID only accepts printable ASCII without spaces, so that the ids cannot forge log lines
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] <= ' ' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// GetRequestID returns the request id of the context, inherited from the base contexts
+func (eventContext *EventContext) GetRequestID() string {
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.RequestID != "" {
+			return current.RequestID
+		}
+	}
+	return ""
+}
+
+// GetModel returns the model of the context, inherited from the base contexts
+func (eventContext *EventContext) GetModel() *Model {
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.Model != nil {
+			return current.Model
+		}
+	}
+	return nil
+}
+
+// Logger returns the logger of the model of the context, adding the request id when there is one
+func (eventContext *EventContext) Logger() logging.Logger {
+	loadedModel := eventContext.GetModel()
+	if loadedModel == nil {
+		return withRequestID(logging.Default(), eventContext)
+	}
+	return loadedModel.requestLogger(eventContext)
+}
+
+func withRequestID(logger logging.Logger, eventContext *EventContext) logging.Logger {
+	if eventContext == nil {
+		return logger
+	}
+	if requestID := eventContext.GetRequestID(); requestID != "" {
+		return logger.With("requestId", requestID)
+	}
+	return logger
+}
+
+// Logger returns the logger of the model, which adds the model name to every line and writes the lines allowed by
+// the "logLevel" of the model config, or by the app logger when it is not set
+func (loadedModel *Model) Logger() logging.Logger {
+	if loadedModel.logger == nil {
+		return loadedModel.buildLogger()
+	}
+	return loadedModel.logger
+}
+
+func (loadedModel *Model) buildLogger() logging.Logger {
+	var logger logging.Logger
+	if loadedModel.App != nil && loadedModel.App.Logger != nil {
+		logger = loadedModel.App.Logger
+	} else {
+		logger = logging.Default()
+	}
+	logger = logger.With("model", loadedModel.Name)
+	if loadedModel.Config != nil && loadedModel.Config.LogLevel != "" {
+		level, err := logging.ParseLevel(loadedModel.Config.LogLevel)
+		if err != nil {
+			logger.Warn("Ignoring the logLevel of the model", "error", err)
+		} else {
+			logger = logging.WithLevel(logger, level)
+		}
+	}
+	return logger
+}
+
+// requestLogger is the model logger with the request id of eventContext, if any
+func (loadedModel *Model) requestLogger(eventContext *EventContext) logging.Logger {
+	return withRequestID(loadedModel.Logger(), eventContext)
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// checkRateLimit counts the request in the RateLimit of the remote method, if any. The clients are the users of the
+// tokens and API keys, and the IP of the anonymous requests
+func (loadedModel *Model) checkRateLimit(eventContext *EventContext, options RemoteMethodOptions, token *BearerToken) error {
+	if options.RateLimit == nil || loadedModel.App == nil || loadedModel.App.RateLimiter == nil {
+		return nil
+	}
+	client := "ip:" + eventContext.Ctx.IP()
+	if token != nil && token.User != nil && token.User.Id != nil {
+		client = "user:" + GetIDAsString(token.User.Id)
+	}
+	key := fmt.Sprintf("remote:%v.%v:%v", loadedModel.Name, options.Name, client)
+
+	limiter := loadedModel.App.RateLimiter
+	retryAfter := limiter.RetryAfter(key)
+	if retryAfter == 0 {
+		// the request that reaches the limit is still served, the next ones are rejected
+		limiter.Hit(key, *options.RateLimit)
+		return nil
+	}
+	loadedModel.requestLogger(eventContext).Warn("Rate limit exceeded", "method", options.Name, "client", client, "retryAfter", retryAfter)
+	return RateLimitedError(eventContext.Ctx, "TOO_MANY_REQUESTS", retryAfter)
+}
+
+// RateLimitedError sets the Retry-After header, in seconds, and returns a 429 error with the given code
+func RateLimitedError(c *fiber.Ctx, code string, retryAfter time.Duration) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(seconds, 10))
+	return wst.CreateError(fiber.ErrTooManyRequests, code, fiber.Map{
+		"message":    fmt.Sprintf("too many requests, retry after %v seconds", seconds),
+		"retryAfter": seconds,
+	}, "Error")
+}
@@ -4,15 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/attribute"
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/tracing"
 )
 
 var AllowedStages = []string{
@@ -339,12 +341,12 @@ func (loadedModel *Model) ExtractLookupsFromFilter(filterMap *wst.Filter, disabl
 		}
 	}
 
-	if loadedModel.App.Debug {
-		marshalled, err := json.MarshalIndent(lookups, "", "  ")
+	if logger := loadedModel.Logger(); logger.Enabled(logging.LevelDebug) {
+		marshalled, err := json.Marshal(lookups)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("DEBUG: lookups %v\n", string(marshalled))
+		logger.Debug("Extracted lookups", "lookups", string(marshalled))
 	}
 
 	return lookups, nil
@@ -441,6 +443,22 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 		return nil
 	}
 
+	ctx, span := tracing.Start(baseContext.GetContext(), "mergeRelated "+loadedModel.Name+"."+includeItem.Relation,
+		attribute.String("westack.model", loadedModel.Name),
+		attribute.String("westack.relation", includeItem.Relation),
+		attribute.Int("westack.relation_depth", int(relationDeepLevel)),
+		attribute.Int("westack.documents", len(*documents)),
+	)
+	// baseContext is shared with the goroutine that reads the cursor, so the span is set on a copy
+	spanContext := *baseContext
+	spanContext.Context = ctx
+	err := loadedModel.mergeRelatedDocuments(relationDeepLevel, documents, includeItem, &spanContext)
+	tracing.End(span, err)
+	return err
+}
+
+func (loadedModel *Model) mergeRelatedDocuments(relationDeepLevel byte, documents *wst.A, includeItem wst.IncludeItem, baseContext *EventContext) error {
+
 	parentDocs := documents
 
 	relationName := includeItem.Relation
@@ -450,20 +468,17 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 
 	parentModel := loadedModel
 	parentRelationName := relationName
+	logger := loadedModel.requestLogger(baseContext)
 
 	if relatedLoadedModel == nil {
-		log.Println()
-		log.Printf("WARNING: related model %v not found for relation %v.%v", relatedModelName, loadedModel.Name, relationName)
-		log.Println()
+		logger.Warn("Related model not found", "relation", relationName, "relatedModel", relatedModelName)
 		return nil
 	}
 
 	//if relation.Options.SkipAuth && relationDeepLevel > 1 {
 	// Only skip auth checking for relations above the level 1
 	if relation.Options.SkipAuth {
-		if loadedModel.App.Debug {
-			log.Printf("DEBUG: SkipAuth %v.%v\n", loadedModel.Name, relationName)
-		}
+		logger.Debug("Skip auth for relation", "relation", relationName)
 	} else {
 		objId := "*"
 		if len(*documents) == 1 {
@@ -471,9 +486,7 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 		}
 
 		action := fmt.Sprintf("__get__%v", relationName)
-		if loadedModel.App.Debug {
-			log.Printf("DEBUG: Check %v.%v\n", loadedModel.Name, action)
-		}
+		logger.Debug("Check relation auth", "action", action)
 		err, allowed := loadedModel.EnforceEx(baseContext.Bearer, objId, action, baseContext)
 		if err != nil && err != fiber.ErrUnauthorized {
 			return err
@@ -486,6 +499,10 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 	}
 
 	if relatedLoadedModel.Datasource.Name != loadedModel.Datasource.Name {
+		err := relatedLoadedModel.checkTenantScope(baseContext)
+		if err != nil {
+			return err
+		}
 		switch relation.Type {
 		case "belongsTo", "hasOne", "hasMany":
 			keyFrom := ""
@@ -521,7 +538,8 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 			disabledCache := loadedModel.App.Viper.GetBool("disableCache")
 			for documentIdx, document := range *documents {
 
-				if !disabledCache && wasEmptyWhere && relatedLoadedModel.Config.Cache.Datasource != "" /* && keyFrom == relatedLoadedModel.Config.Cache.Keys*/ {
+				// the cache of a multi-tenant model has the instances of all the tenants
+				if !disabledCache && wasEmptyWhere && relatedLoadedModel.Config.Cache.Datasource != "" && !relatedLoadedModel.IsMultiTenant() /* && keyFrom == relatedLoadedModel.Config.Cache.Keys*/ {
 
 					cacheDs, err := loadedModel.App.FindDatasource(relatedLoadedModel.Config.Cache.Datasource)
 					if err != nil {
@@ -563,15 +581,13 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 							} else {
 								var cachedDocs []wst.M
 
-								cacheLookups := &wst.A{wst.M{"$match": wst.M{keyFrom: cacheKeyTo}}}
-								if loadedModel.App.Debug {
-									log.Printf("DEBUG: cacheLookups %v\n", cacheLookups)
-								}
-								cursor, err := safeCacheDs.FindMany(relatedLoadedModel.CollectionName, cacheLookups)
+								cacheLookups := &wst.A{wst.M{"$match": wst.M{"_redId": cacheKeyTo}}}
+								logger.Debug("Looking up the cache", "key", cacheKeyTo)
+								cursor, err := safeCacheDs.FindMany(baseContext.GetContext(), relatedLoadedModel.CollectionName, cacheLookups)
 								if err != nil {
 									return err
 								}
-								err = cursor.All(context.Background(), &cachedDocs)
+								err = cursor.All(baseContext.GetContext(), &cachedDocs)
 								if err != nil {
 									cursor.Close(context.Background())
 									return err
@@ -611,9 +627,7 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 						return err
 					}
 				} else {
-					if loadedModel.App.Debug {
-						log.Printf("Found cache for %v.%v[%v]\n", loadedModel.Name, relationName, documentIdx)
-					}
+					logger.Debug("Found cache for relation", "relation", relationName, "documentIdx", documentIdx)
 				}
 
 				if loadedModel.hasHiddenProperties {
@@ -670,7 +684,7 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 								} else if relatedInstance, ok := doc[parentRelationName].(wst.M); ok {
 									documentsValue[0] = relatedInstance
 								} else {
-									log.Printf("WARNING: Invalid type for %v.%v %s\n", loadedModel.Name, relationName, doc[parentRelationName])
+									logger.Warn("Invalid type for relation", "relation", relationName, "type", fmt.Sprintf("%T", doc[parentRelationName]))
 								}
 
 								//documents = &documentsValue
@@ -689,7 +703,7 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 								} else if asA, ok := doc[parentRelationName].(wst.A); ok {
 									nestedDocuments = append(nestedDocuments, asA...)
 								} else {
-									log.Println("WARNING: unknown type for relation", relationName, "in", loadedModel.Name)
+									logger.Warn("Unknown type for relation", "relation", relationName, "type", fmt.Sprintf("%T", doc[parentRelationName]))
 									continue
 								}
 
@@ -699,9 +713,7 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 
 					}
 					loadedModel := relatedLoadedModel
-					if loadedModel.App.Debug {
-						log.Printf("Dispatch nested relation %v.%v.%v (n=%v, m=%v)\n", parentModel.Name, parentRelationName, relationName, len(*parentDocs), len(nestedDocuments))
-					}
+					logger.Debug("Dispatch nested relation", "parentModel", parentModel.Name, "relation", parentRelationName+"."+relationName, "parentDocuments", len(*parentDocs), "nestedDocuments", len(nestedDocuments))
 					err := loadedModel.mergeRelated(relationDeepLevel+1, &nestedDocuments, includeItem, baseContext)
 					if err != nil {
 						return err
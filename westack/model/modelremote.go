@@ -1,9 +1,9 @@
 package model
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -12,9 +12,14 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/metrics"
+	"github.com/fredyk/westack-go/westack/tracing"
 )
 
 func (loadedModel *Model) SendError(ctx *fiber.Ctx, err error) error {
@@ -34,6 +39,15 @@ func (loadedModel *Model) SendError(ctx *fiber.Ctx, err error) error {
 				"details":    err.(*wst.WeStackError).Details,
 			},
 		})
+	case *fiber.Error:
+		return ctx.Status(err.(*fiber.Error).Code).JSON(fiber.Map{
+			"error": fiber.Map{
+				"statusCode": err.(*fiber.Error).Code,
+				"name":       "Error",
+				"error":      err.Error(),
+				"message":    err.Error(),
+			},
+		})
 	default:
 		return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fiber.Map{
@@ -74,7 +88,7 @@ func (loadedModel *Model) RemoteMethod(handler func(context *EventContext) error
 		}
 	}
 
-	_, err := loadedModel.Enforcer.AddRoleForUser(options.Name, "*")
+	_, err := loadedModel.Enforcer.AddRoleForUser(options.Name, "*", loadedModel.RoleDomain(AnyTenant)...)
 	if err != nil {
 		panic(err)
 	}
@@ -138,11 +152,20 @@ func (loadedModel *Model) RemoteMethod(handler func(context *EventContext) error
 	return toInvoke(path, createFiberHandler(options, loadedModel, verb, path)).Name(loadedModel.Name + "." + options.Name)
 }
 
+var httpRequestsTotal = metrics.DefaultRegistry.NewCounterVec("westack_http_requests_total", "Requests handled by the remote methods", "model", "method", "status")
+var httpRequestDuration = metrics.DefaultRegistry.NewHistogramVec("westack_http_request_duration_seconds", "Latency of the remote methods, including the time queued", nil, "model", "method")
+
 var activeRequestsPerModel = make(map[string]int)
 var activeRequestsMutex sync.RWMutex
 
 func createFiberHandler(options RemoteMethodOptions, loadedModel *Model, verb string, path string) func(ctx *fiber.Ctx) error {
 	return func(ctx *fiber.Ctx) error {
+		start := time.Now()
+		defer func() {
+			httpRequestsTotal.Inc(loadedModel.Name, options.Name, strconv.Itoa(ctx.Response().StatusCode()))
+			httpRequestDuration.Observe(time.Since(start).Seconds(), loadedModel.Name, options.Name)
+		}()
+
 		// Limit to 2 concurrent requests per model, new requests will be queued
 		activeRequestsMutex.Lock()
 		if _, ok := activeRequestsPerModel[loadedModel.Name]; !ok {
@@ -162,19 +185,60 @@ func createFiberHandler(options RemoteMethodOptions, loadedModel *Model, verb st
 			activeRequestsMutex.Unlock()
 		}()
 
+		requestContext := tracing.ExtractRequestContext(ctx.UserContext(), &ctx.Request().Header)
+		requestContext, span := tracing.Tracer().Start(requestContext, loadedModel.Name+"."+options.Name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", ctx.Method()),
+				attribute.String("http.route", loadedModel.BaseUrl+path),
+				attribute.String("westack.model", loadedModel.Name),
+				attribute.String("westack.method", options.Name),
+			),
+		)
+		defer func() {
+			span.SetAttributes(attribute.Int("http.status_code", ctx.Response().StatusCode()))
+			if ctx.Response().StatusCode() >= fiber.StatusInternalServerError {
+				span.SetStatus(codes.Error, fiber.ErrInternalServerError.Message)
+			}
+			span.End()
+		}()
+		requestContext, cancelOnClose := cancelOnDisconnect(requestContext, ctx.Context().Conn())
+		requestContext, cancelTimeout := loadedModel.withRemoteMethodTimeout(requestContext, options.Name)
+		cancelRequest := func() {
+			if cancelTimeout != nil {
+				cancelTimeout()
+			}
+			cancelOnClose()
+		}
+		ctx.SetUserContext(requestContext)
+
 		eventContext := &EventContext{
-			Ctx:    ctx,
-			Remote: &options,
+			Ctx:           ctx,
+			Remote:        &options,
+			Context:       requestContext,
+			RequestID:     RequestID(ctx),
+			cancelContext: cancelRequest,
 		}
+		defer func() {
+			if eventContext.cancelContext != nil {
+				eventContext.cancelContext()
+			}
+		}()
 		eventContext.Model = loadedModel
 		err2 := loadedModel.HandleRemoteMethod(options.Name, eventContext)
 		if err2 != nil {
+			span.RecordError(err2)
 
 			if err2 == fiber.ErrUnauthorized {
 				err2 = wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": "Unauthorized"}, "Error")
+			} else if errors.Is(requestContext.Err(), context.DeadlineExceeded) {
+				err2 = timeoutError(loadedModel, options.Name)
+			} else if errors.Is(requestContext.Err(), context.Canceled) {
+				loadedModel.requestLogger(eventContext).Info("Client disconnected", "method", options.Name, "verb", strings.ToUpper(verb), "path", loadedModel.BaseUrl+path)
+				return nil
 			}
 
-			log.Printf("Error in remote method %v.%v (%v %v%v): %v\n", loadedModel.Name, options.Name, strings.ToUpper(verb), loadedModel.BaseUrl, path, err2.Error())
+			loadedModel.requestLogger(eventContext).Error("Error in remote method", "method", options.Name, "verb", strings.ToUpper(verb), "path", loadedModel.BaseUrl+path, "error", err2)
 			return loadedModel.SendError(eventContext.Ctx, err2)
 		}
 		return nil
@@ -238,6 +302,11 @@ func createOpenAPIPathDef(loadedModel *Model, description string, rawPathParams
 	return pathDef
 }
 
+// HasRemoteMethod reports whether the model has a remote method with the name, which is also its casbin action
+func (loadedModel *Model) HasRemoteMethod(name string) bool {
+	return loadedModel.remoteMethodsMap[name] != nil
+}
+
 func (loadedModel *Model) HandleRemoteMethod(name string, eventContext *EventContext) error {
 
 	operationItem := loadedModel.remoteMethodsMap[name]
@@ -254,12 +323,18 @@ func (loadedModel *Model) HandleRemoteMethod(name string, eventContext *EventCon
 	if err != nil {
 		return err
 	}
+	if loadedModel.IsMultiTenant() && eventContext.GetTenant() == "" {
+		return tenantRequiredError()
+	}
+
+	err = loadedModel.checkRateLimit(eventContext, options, token)
+	if err != nil {
+		return err
+	}
 
 	action := options.Name
 
-	if loadedModel.App.Debug {
-		log.Println(fmt.Sprintf("DEBUG: Check auth for %v.%v (%v %v)", loadedModel.Name, options.Name, c.Method(), c.Path()))
-	}
+	loadedModel.requestLogger(eventContext).Debug("Check auth", "method", options.Name, "verb", c.Method(), "path", c.Path())
 
 	objId := "*"
 	if eventContext.ModelID != nil {
@@ -390,17 +465,23 @@ func (loadedModel *Model) HandleRemoteMethod(name string, eventContext *EventCon
 				eventContext.Ctx.Set("Transfer-Encoding", "chunked")
 				eventContext.Ctx.Response().Header.Set("Transfer-Encoding", "chunked")
 
-				return eventContext.Ctx.SendStream(resultAsGenerator.Reader(eventContext), -1)
+				reader := resultAsGenerator.Reader(eventContext)
+				if eventContext.cancelContext != nil {
+					// the documents are read from the datasource while the response is sent, after returning
+					reader = &cancelOnCloseReader{Reader: reader, cancel: eventContext.cancelContext}
+					eventContext.cancelContext = nil
+				}
+				return eventContext.Ctx.SendStream(reader, -1)
 
 			} else {
-				fmt.Printf("Unknown type: %T after remote method %v\n", eventContext.Result, name)
+				loadedModel.requestLogger(eventContext).Warn("Unknown result type after remote method", "method", name, "type", fmt.Sprintf("%T", eventContext.Result))
 				eventContext.Handled = false
 			}
 		}
 	}
 	resp := eventContext.Ctx.Response()
 	if resp.StatusCode() == 0 {
-		fmt.Printf("WARNING: No result found after remote method %v\n", name)
+		loadedModel.requestLogger(eventContext).Warn("No result found after remote method", "method", name)
 		return eventContext.Ctx.Status(fiber.StatusNoContent).SendString("")
 	}
 	return nil
@@ -0,0 +1,329 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// AnyTenant is the casbin domain of the policies and role links that apply to all the tenants
+const AnyTenant = "*"
+
+// Defaults of the "multiTenancy.claim" and "multiTenancy.header" settings of the app
+const (
+	DefaultTenantClaim  = "tenantId"
+	DefaultTenantHeader = "X-Tenant-ID"
+)
+
+const defaultTenantField = "tenantId"
+
+// tenantRegexp excludes the casbin patterns, like "*", so that a tenant never matches the policies of other tenants
+var tenantRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// IsMultiTenant reports whether the model has the "multiTenant" option
+func (loadedModel *Model) IsMultiTenant() bool {
+	return loadedModel.Config != nil && loadedModel.Config.MultiTenant != nil
+}
+
+// TenantField returns the property with the tenant of the instances of a multi-tenant model
+func (loadedModel *Model) TenantField() string {
+	if loadedModel.Config.MultiTenant.Field == "" {
+		return defaultTenantField
+	}
+	return loadedModel.Config.MultiTenant.Field
+}
+
+// RoleDomain returns the casbin domain to pass to the role functions of the enforcer: the tenant for the multi-tenant
+// models, whose enforcers have domains, and none for the rest
+func (loadedModel *Model) RoleDomain(tenant string) []string {
+	if !loadedModel.IsMultiTenant() {
+		return nil
+	}
+	return []string{tenant}
+}
+
+// TenantClaim returns the claim of the access tokens with the tenant of the user, from "multiTenancy.claim"
+func TenantClaim(v *viper.Viper) string {
+	if claim := v.GetString("multiTenancy.claim"); claim != "" {
+		return claim
+	}
+	return DefaultTenantClaim
+}
+
+// resolveTenant returns the tenant of the request: the tenant claim of the bearer, or else the "multiTenancy.header"
+// header, or else the first subdomain when "multiTenancy.subdomain" is enabled. A header or subdomain that differs
+// from the claim is rejected, so that the users cannot reach the instances of other tenants. Without claim, the users
+// can only request the tenants where they were assigned a role. The anonymous requests can request any tenant, where
+// they only get the "$everyone" policies
+func (loadedModel *Model) resolveTenant(eventContext *EventContext, user *BearerUser, claims jwt.MapClaims) (string, error) {
+	v := loadedModel.App.Viper
+	claimTenant, _ := claims[TenantClaim(v)].(string)
+	requested := ""
+	if c := eventContext.Ctx; c != nil {
+		header := v.GetString("multiTenancy.header")
+		if header == "" {
+			header = DefaultTenantHeader
+		}
+		requested = strings.TrimSpace(string(c.Request().Header.Peek(header)))
+		if requested == "" && v.GetBool("multiTenancy.subdomain") {
+			if subdomains := c.Subdomains(); len(subdomains) > 0 {
+				requested = subdomains[0]
+			}
+		}
+	}
+	if claimTenant != "" {
+		if requested != "" && requested != claimTenant {
+			return "", tenantMismatchError()
+		}
+		return claimTenant, ValidateTenant(claimTenant)
+	}
+	if requested == "" {
+		return "", nil
+	}
+	err := ValidateTenant(requested)
+	if err != nil {
+		return "", err
+	}
+	if user != nil && user.Id != nil {
+		member, err := loadedModel.isTenantMember(eventContext, user, requested)
+		if err != nil {
+			return "", err
+		}
+		if !member {
+			return "", wst.CreateError(fiber.ErrForbidden, "TENANT_NOT_ALLOWED", fiber.Map{"message": "the user is not a member of the tenant"}, "Error")
+		}
+	}
+	return requested, nil
+}
+
+// ValidateTenant rejects the tenants that are not alphanumeric, which could match the policies of other tenants
+func ValidateTenant(tenant string) error {
+	if !tenantRegexp.MatchString(tenant) {
+		return wst.CreateError(fiber.ErrBadRequest, "INVALID_TENANT", fiber.Map{"message": "the tenant must be alphanumeric, and may contain _ . -"}, "ValidationError")
+	}
+	return nil
+}
+
+// isTenantMember asks the app whether the user was assigned a role in the tenant
+func (loadedModel *Model) isTenantMember(eventContext *EventContext, user *BearerUser, tenant string) (bool, error) {
+	if loadedModel.App.IsTenantMember == nil {
+		return false, nil
+	}
+	return loadedModel.App.IsTenantMember(eventContext.GetContext(), fmt.Sprintf("%v", user.Id), tenant)
+}
+
+func tenantMismatchError() error {
+	return wst.CreateError(fiber.ErrForbidden, "TENANT_MISMATCH", fiber.Map{"message": "the tenant does not match the tenant of the request"}, "Error")
+}
+
+func tenantRequiredError() error {
+	return wst.CreateError(fiber.ErrBadRequest, "TENANT_REQUIRED", fiber.Map{"message": "the tenant of the request is required"}, "ValidationError")
+}
+
+// tenantString returns the tenant stored in an instance, which may have been converted to an ObjectID
+func tenantString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case primitive.ObjectID:
+		return value.Hex()
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// tenantFilter returns a copy of the filter whose where is scoped to the tenant. The where is scoped instead of the
+// pipeline so that the cache keys and the hooks see the tenant too
+func (loadedModel *Model) tenantFilter(filterMap *wst.Filter, tenant string) *wst.Filter {
+	if tenant == "" || !loadedModel.IsMultiTenant() {
+		return filterMap
+	}
+	scoped := wst.Filter{}
+	if filterMap != nil {
+		scoped = *filterMap
+	}
+	where := wst.Where{}
+	if scoped.Where != nil {
+		for key, value := range *scoped.Where {
+			where[key] = value
+		}
+	}
+	where[loadedModel.TenantField()] = tenant
+	scoped.Where = &where
+	return &scoped
+}
+
+// isSystemOperation reports whether the operation is performed by the system, which can reach the instances of all the
+// tenants
+func isSystemOperation(eventContext *EventContext) bool {
+	for current := eventContext; current != nil; current = current.BaseContext {
+		if current.Bearer != nil && current.Bearer.User != nil {
+			return current.Bearer.User.System
+		}
+	}
+	return false
+}
+
+// checkTenantScope refuses the operations on the instances of a multi-tenant model without tenant, which would reach
+// the instances of all the tenants, unless they are performed by the system
+func (loadedModel *Model) checkTenantScope(eventContext *EventContext) error {
+	if !loadedModel.IsMultiTenant() || eventContext.GetTenant() != "" || isSystemOperation(eventContext) {
+		return nil
+	}
+	return tenantRequiredError()
+}
+
+// scopeLookups scopes to the tenant the pipelines of the lookups of multi-tenant models, like the ones of the included
+// relations, which the datasource reads along with the instances. Without tenant they are refused, unless the system
+// performs them, and so are the lookups of multi-tenant models without a pipeline to scope
+func (loadedModel *Model) scopeLookups(lookups *wst.A, eventContext *EventContext) error {
+	if lookups == nil {
+		return nil
+	}
+	tenant := eventContext.GetTenant()
+	system := isSystemOperation(eventContext)
+	if tenant == "" && system {
+		return nil
+	}
+	for _, stage := range *lookups {
+		for _, key := range []string{"$graphLookup", "$unionWith"} {
+			if from, ok := asLookupM(stage[key]); ok {
+				collectionName := from.GetString("from")
+				if key == "$unionWith" {
+					collectionName = from.GetString("coll")
+				}
+				if related := loadedModel.modelByCollection(collectionName); related != nil && related.IsMultiTenant() {
+					return unscopedLookupError(related)
+				}
+			}
+		}
+		lookup, ok := asLookupM(stage["$lookup"])
+		if !ok {
+			continue
+		}
+		related := loadedModel.modelByCollection(lookup.GetString("from"))
+		scoped := related != nil && related.IsMultiTenant()
+		if scoped && tenant == "" {
+			return tenantRequiredError()
+		}
+		rawPipeline, hasPipeline := lookup["pipeline"]
+		if !hasPipeline {
+			if scoped {
+				return unscopedLookupError(related)
+			}
+			continue
+		}
+		pipeline, ok := asLookupPipeline(rawPipeline)
+		if !ok {
+			return fmt.Errorf("invalid $lookup pipeline type %T", rawPipeline)
+		}
+		if scoped {
+			pipeline = append(wst.A{{"$match": wst.M{related.TenantField(): tenant}}}, pipeline...)
+		}
+		err := loadedModel.scopeLookups(&pipeline, eventContext)
+		if err != nil {
+			return err
+		}
+		lookup["pipeline"] = pipeline
+	}
+	return nil
+}
+
+func unscopedLookupError(related *Model) error {
+	return wst.CreateError(fiber.ErrBadRequest, "UNSCOPED_LOOKUP", fiber.Map{"message": fmt.Sprintf("the lookups of the multi-tenant model %v must have a pipeline", related.Name)}, "ValidationError")
+}
+
+// asLookupM returns the options of a lookup stage, which may come from a decoded filter
+func asLookupM(value interface{}) (wst.M, bool) {
+	switch value := value.(type) {
+	case wst.M:
+		return value, true
+	case map[string]interface{}:
+		return value, true
+	default:
+		return nil, false
+	}
+}
+
+// asLookupPipeline returns the stages of the pipeline of a lookup, which may come from a decoded filter
+func asLookupPipeline(value interface{}) (wst.A, bool) {
+	switch value := value.(type) {
+	case wst.A:
+		return value, true
+	case []wst.M:
+		return value, true
+	case []interface{}:
+		pipeline := make(wst.A, len(value))
+		for i, item := range value {
+			stage, ok := asLookupM(item)
+			if !ok {
+				return nil, false
+			}
+			pipeline[i] = stage
+		}
+		return pipeline, true
+	default:
+		return nil, false
+	}
+}
+
+func (loadedModel *Model) modelByCollection(collectionName string) *Model {
+	for _, other := range *loadedModel.modelRegistry {
+		if other.CollectionName == collectionName && other.Datasource == loadedModel.Datasource {
+			return other
+		}
+	}
+	return nil
+}
+
+// stampTenant sets the tenant on the data of a new instance. A different tenant in the data is rejected
+func (loadedModel *Model) stampTenant(data wst.M, tenant string) error {
+	if tenant == "" || !loadedModel.IsMultiTenant() {
+		return nil
+	}
+	field := loadedModel.TenantField()
+	if value, ok := data[field]; ok && value != nil && tenantString(value) != tenant {
+		return tenantMismatchError()
+	}
+	data[field] = tenant
+	return nil
+}
+
+// checkTenantUpdate rejects the updates of the instances of other tenants, and the changes of the tenant of an instance
+func (modelInstance *Instance) checkTenantUpdate(data wst.M, tenant string) error {
+	loadedModel := modelInstance.Model
+	if tenant == "" || !loadedModel.IsMultiTenant() {
+		return nil
+	}
+	field := loadedModel.TenantField()
+	stored := tenantString(modelInstance.ToJSON()[field])
+	if stored != tenant {
+		return tenantMismatchError()
+	}
+	if value, ok := data[field]; ok && tenantString(value) != stored {
+		return tenantMismatchError()
+	}
+	return nil
+}
+
+// tenantWhere returns a copy of the where of a deletion, scoped to the tenant
+func (loadedModel *Model) tenantWhere(where wst.M, tenant string) wst.M {
+	if tenant == "" || !loadedModel.IsMultiTenant() {
+		return where
+	}
+	scoped := wst.M{}
+	for key, value := range where {
+		scoped[key] = value
+	}
+	scoped[loadedModel.TenantField()] = tenant
+	return scoped
+}
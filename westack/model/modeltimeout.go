@@ -0,0 +1,58 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// RemoteMethodTimeout returns the timeout of the remote method, from the "timeout" section of the model config.
+// 0 means that the method is not bounded
+func (loadedModel *Model) RemoteMethodTimeout(methodName string) time.Duration {
+	if loadedModel.Config == nil {
+		return 0
+	}
+	seconds := loadedModel.Config.Timeout.Default
+	if methodSeconds, ok := loadedModel.Config.Timeout.Methods[methodName]; ok {
+		seconds = methodSeconds
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// withRemoteMethodTimeout bounds ctx with the timeout of the remote method. The returned function is nil when the
+// method has no timeout
+func (loadedModel *Model) withRemoteMethodTimeout(ctx context.Context, methodName string) (context.Context, context.CancelFunc) {
+	timeout := loadedModel.RemoteMethodTimeout(methodName)
+	if timeout <= 0 {
+		return ctx, nil
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError is returned instead of the error of a remote method whose context expired, because the error of the
+// datasource, like "context deadline exceeded" or a driver specific one, is not meaningful to the clients
+func timeoutError(loadedModel *Model, methodName string) error {
+	return wst.CreateError(fiber.ErrGatewayTimeout, "TIMEOUT", fiber.Map{
+		"message": fmt.Sprintf("%v.%v did not complete within %v", loadedModel.Name, methodName, loadedModel.RemoteMethodTimeout(methodName)),
+	}, "Error")
+}
+
+// cancelOnCloseReader releases the context of a streamed result once the response is sent. fasthttp closes the body
+// streams that implement io.Closer
+type cancelOnCloseReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (reader *cancelOnCloseReader) Close() error {
+	reader.cancel()
+	return nil
+}
@@ -0,0 +1,241 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// Token types, in the "typ" claim. The access tokens issued before the claim was added have no type
+const (
+	AccessTokenType  = "access"
+	RefreshTokenType = "refresh"
+	// ApiKeyTokenType is the type of the claims built from an API key, which are never signed
+	ApiKeyTokenType = "apikey"
+	// PasswordResetTokenType is the type of the single-use tokens sent to reset a password
+	PasswordResetTokenType = "passwordReset"
+	// MfaChallengeTokenType is the type of the tokens returned by the login of the users with two-factor
+	// authentication, which are only accepted by the MfaVerifyMethod remote method
+	MfaChallengeTokenType = "mfa"
+	// EmailVerificationTokenType is the type of the tokens of the links of the verification emails, which are only
+	// accepted by the EmailVerificationMethod remote method
+	EmailVerificationTokenType = "emailVerification"
+)
+
+// MfaVerifyMethod is the remote method of the User models that exchanges a challenge token and a code for the tokens
+const MfaVerifyMethod = "verifyMfa"
+
+// EmailVerificationMethod is the remote method of the User models that verifies the email of the user of the link
+const EmailVerificationMethod = "performEmailVerification"
+
+// ApiKeyHeader is the header with the API key of the machine clients, used when there is no bearer token
+const ApiKeyHeader = "X-API-Key"
+
+// TokenExpiresAt returns the expiration of a token, from its "created" and "ttl" claims, both in milliseconds
+func TokenExpiresAt(claims jwt.MapClaims) time.Time {
+	return time.UnixMilli(claimInt64(claims["created"]) + claimInt64(claims["ttl"]))
+}
+
+// TokenID returns the "jti" claim of a token, empty for the tokens issued before it was added
+func TokenID(claims jwt.MapClaims) string {
+	jti, _ := claims["jti"].(string)
+	return jti
+}
+
+// TokenFamily returns the "fam" claim of a token, the id shared by the tokens of a login and all their refreshes. It is
+// empty for the tokens issued before it was added
+func TokenFamily(claims jwt.MapClaims) string {
+	family, _ := claims["fam"].(string)
+	return family
+}
+
+// TokenFamilyKey is the id of the denylist entry that revokes all the tokens of a family
+func TokenFamilyKey(family string) string {
+	return "family:" + family
+}
+
+// TokenUserKey is the id of the denylist entry that revokes the tokens of a user issued before a password change
+func TokenUserKey(userId string) string {
+	return "user:" + userId
+}
+
+// claimInt64 reads a numeric claim, which is a float64 once the token is parsed
+func claimInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// isTokenRevoked consults the denylist of the app, if any, for the token and its family
+func (loadedModel *Model) isTokenRevoked(eventContext *EventContext, claims jwt.MapClaims) (bool, error) {
+	if loadedModel.App == nil || loadedModel.App.IsTokenRevoked == nil {
+		return false, nil
+	}
+	if jti := TokenID(claims); jti != "" {
+		revoked, err := loadedModel.App.IsTokenRevoked(eventContext.GetContext(), jti)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	if family := TokenFamily(claims); family != "" {
+		revoked, err := loadedModel.App.IsTokenRevoked(eventContext.GetContext(), TokenFamilyKey(family))
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	if loadedModel.App.IsUserTokenRevoked != nil {
+		return loadedModel.App.IsUserTokenRevoked(eventContext.GetContext(), wst.M(claims))
+	}
+	return false, nil
+}
+
+// currentRoles returns the roles that the user of an access token has now in the tenant of the request, so that the
+// role changes apply without a new login. The roles of the claims are used when the app does not provide them
+func (loadedModel *Model) currentRoles(eventContext *EventContext, user *BearerUser, claimRoles []BearerRole) ([]BearerRole, error) {
+	if loadedModel.App == nil || loadedModel.App.UserRoles == nil || user.Id == nil {
+		return claimRoles, nil
+	}
+	roleNames, err := loadedModel.App.UserRoles(eventContext.GetContext(), fmt.Sprintf("%v", user.Id), eventContext.GetTenant())
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]BearerRole, len(roleNames))
+	for i, roleName := range roleNames {
+		roles[i] = BearerRole{Name: roleName}
+	}
+	return roles, nil
+}
+
+// authenticateApiKey returns the claims of the API key, or nil if the key is invalid, revoked or expired
+func (loadedModel *Model) authenticateApiKey(eventContext *EventContext, rawKey string) (jwt.MapClaims, error) {
+	if loadedModel.App == nil || loadedModel.App.AuthenticateApiKey == nil {
+		return nil, nil
+	}
+	claims, err := loadedModel.App.AuthenticateApiKey(eventContext.GetContext(), rawKey)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+	return jwt.MapClaims(claims), nil
+}
+
+// RevokedTokensCollection is the collection where the ids of the revoked tokens are stored
+const RevokedTokensCollection = "RevokedToken"
+
+// ErrTokenRevoked is returned when revoking a token that was already revoked
+var ErrTokenRevoked = errors.New("token already revoked")
+
+// TokenDenylist keeps the ids ("jti" claim) of the revoked tokens until they expire, so that they are rejected even if
+// their signature is valid
+type TokenDenylist struct {
+	Datasource *datasource.Datasource
+}
+
+func NewTokenDenylist(ds *datasource.Datasource) *TokenDenylist {
+	return &TokenDenylist{Datasource: ds}
+}
+
+// Revoke adds the token id to the denylist until expiresAt. The id is the primary key of the entry, so when two
+// requests revoke the same token only one of them succeeds, and the other one gets ErrTokenRevoked
+func (denylist *TokenDenylist) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return errors.New("the token has no id")
+	}
+	_, err := denylist.Datasource.Create(ctx, RevokedTokensCollection, &wst.M{
+		"_id":       jti,
+		"expiresAt": expiresAt.UnixMilli(),
+	})
+	if err != nil {
+		if revoked, checkErr := denylist.IsRevoked(ctx, jti); checkErr == nil && revoked {
+			return ErrTokenRevoked
+		}
+		return err
+	}
+	// the expired tokens are rejected anyway, so their entries are no longer needed
+	_, err = denylist.Datasource.DeleteMany(ctx, RevokedTokensCollection, &wst.A{
+		{"$match": wst.M{"expiresAt": wst.M{"$lt": time.Now().UnixMilli()}}},
+	})
+	return err
+}
+
+// RevokeFamily revokes all the tokens of a family, issued until now, until expiresAt
+func (denylist *TokenDenylist) RevokeFamily(ctx context.Context, family string, expiresAt time.Time) error {
+	if family == "" {
+		return errors.New("the token has no family")
+	}
+	err := denylist.Revoke(ctx, TokenFamilyKey(family), expiresAt)
+	if err == ErrTokenRevoked {
+		return nil
+	}
+	return err
+}
+
+// RevokeUserTokens revokes the tokens of the user issued until now, until expiresAt. It is used when the password of
+// the user changes, so the API keys, which are revoked one by one, are kept
+func (denylist *TokenDenylist) RevokeUserTokens(ctx context.Context, userId string, expiresAt time.Time) error {
+	if userId == "" {
+		return errors.New("the user has no id")
+	}
+	key := TokenUserKey(userId)
+	revokedAt := time.Now().UnixMilli()
+	_, err := denylist.Datasource.Create(ctx, RevokedTokensCollection, &wst.M{
+		"_id":       key,
+		"revokedAt": revokedAt,
+		"expiresAt": expiresAt.UnixMilli(),
+	})
+	if err != nil {
+		if revoked, checkErr := denylist.IsRevoked(ctx, key); checkErr != nil || !revoked {
+			return err
+		}
+		// the tokens of the user were revoked before, so the entry now revokes the ones issued since then too
+		_, err = denylist.Datasource.UpdateById(ctx, RevokedTokensCollection, key, &wst.M{
+			"revokedAt": revokedAt,
+			"expiresAt": expiresAt.UnixMilli(),
+		})
+	}
+	return err
+}
+
+// IsUserTokenRevoked reports whether the token was issued before the tokens of its user were revoked. The API keys
+// are not affected
+func (denylist *TokenDenylist) IsUserTokenRevoked(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+	userId, _ := claims["userId"].(string)
+	if userId == "" || claims["typ"] == ApiKeyTokenType {
+		return false, nil
+	}
+	cursor, err := denylist.Datasource.FindMany(ctx, RevokedTokensCollection, &wst.A{{"$match": wst.M{"_id": TokenUserKey(userId)}}})
+	if err != nil {
+		return false, err
+	}
+	var entries []wst.M
+	err = cursor.All(ctx, &entries)
+	if err != nil || len(entries) == 0 {
+		return false, err
+	}
+	return claimInt64(claims["created"]) <= claimInt64(entries[0]["revokedAt"]), nil
+}
+
+// IsRevoked reports whether the token id is in the denylist
+func (denylist *TokenDenylist) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	cursor, err := denylist.Datasource.FindMany(ctx, RevokedTokensCollection, &wst.A{{"$match": wst.M{"_id": jti}}})
+	if err != nil {
+		return false, err
+	}
+	var entries []wst.M
+	err = cursor.All(ctx, &entries)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/fredyk/westack-go/westack/tracing"
+)
+
+// traceDatasourceCall starts a span for a call to the datasource of the model. The span is a leaf, so the returned
+// context is discarded
+func (loadedModel *Model) traceDatasourceCall(ctx context.Context, operation string) trace.Span {
+	_, span := tracing.Start(ctx, "Datasource."+operation,
+		attribute.String("westack.model", loadedModel.Name),
+		attribute.String("westack.datasource", loadedModel.Datasource.Name),
+		attribute.String("db.collection.name", loadedModel.CollectionName),
+	)
+	return span
+}
+
+// traceHandler runs the handler in a child span of the event context, which is set as the context of eventContext
+// while the handler runs, so that the operations it starts are nested in it
+func (loadedModel *Model) traceHandler(spanName string, eventContext *EventContext, handler func() error, attributes ...attribute.KeyValue) (err error) {
+	if eventContext == nil {
+		return handler()
+	}
+	ctx, span := tracing.Start(eventContext.GetContext(), spanName, append(attributes, attribute.String("westack.model", loadedModel.Name))...)
+	previousContext := eventContext.Context
+	eventContext.Context = ctx
+	defer func() {
+		eventContext.Context = previousContext
+		tracing.End(span, err)
+	}()
+	return handler()
+}
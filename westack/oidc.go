@@ -0,0 +1,485 @@
+package westack
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/jwtkeys"
+	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/passwords"
+)
+
+const oidcStateTokenType = "oidc"
+const oidcStateCookie = "wst_oidc"
+const oidcStateTtl = 10 * time.Minute
+
+var oidcHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcJwksRefreshInterval bounds how often the keys of a provider are fetched again for an unknown kid
+const oidcJwksRefreshInterval = time.Minute
+
+// oidcProvider is an entry of the "oidc.providers" section of the config. The endpoints are discovered from the
+// issuer when they are not set
+type oidcProvider struct {
+	Name                  string   `mapstructure:"-"`
+	Issuer                string   `mapstructure:"issuer"`
+	AuthorizationEndpoint string   `mapstructure:"authorizationEndpoint"`
+	TokenEndpoint         string   `mapstructure:"tokenEndpoint"`
+	UserinfoEndpoint      string   `mapstructure:"userinfoEndpoint"`
+	JwksUri               string   `mapstructure:"jwksUri"`
+	ClientId              string   `mapstructure:"clientId"`
+	ClientSecret          string   `mapstructure:"clientSecret"`
+	RedirectUrl           string   `mapstructure:"redirectUrl"`
+	Scopes                []string `mapstructure:"scopes"`
+	// TrustEmail links the users by email even if the provider does not send "email_verified": true
+	TrustEmail bool `mapstructure:"trustEmail"`
+
+	discoveryMutex sync.Mutex
+	discovered     bool
+
+	keysMutex     sync.Mutex
+	keys          map[string]*jwtkeys.Key
+	keysFetchedAt time.Time
+}
+
+// endpoints fetches the OpenID configuration of the issuer the first time it is needed, so that the app boots even if
+// the provider is down
+func (provider *oidcProvider) endpoints(ctx context.Context) error {
+	provider.discoveryMutex.Lock()
+	defer provider.discoveryMutex.Unlock()
+	if provider.discovered || (provider.AuthorizationEndpoint != "" && provider.TokenEndpoint != "" && provider.UserinfoEndpoint != "" && provider.JwksUri != "") {
+		return nil
+	}
+	if provider.Issuer == "" {
+		return fmt.Errorf("oidc provider %v has no issuer nor endpoints", provider.Name)
+	}
+	var discovery struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JwksUri               string `json:"jwks_uri"`
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(provider.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	err = doOidcRequest(request, &discovery)
+	if err != nil {
+		return fmt.Errorf("could not discover the oidc provider %v: %w", provider.Name, err)
+	}
+	if provider.AuthorizationEndpoint == "" {
+		provider.AuthorizationEndpoint = discovery.AuthorizationEndpoint
+	}
+	if provider.TokenEndpoint == "" {
+		provider.TokenEndpoint = discovery.TokenEndpoint
+	}
+	if provider.UserinfoEndpoint == "" {
+		provider.UserinfoEndpoint = discovery.UserinfoEndpoint
+	}
+	if provider.JwksUri == "" {
+		provider.JwksUri = discovery.JwksUri
+	}
+	provider.discovered = true
+	return nil
+}
+
+func (provider *oidcProvider) redirectUrl(c *fiber.Ctx) string {
+	if provider.RedirectUrl != "" {
+		return provider.RedirectUrl
+	}
+	return c.BaseURL() + "/auth/" + provider.Name + "/callback"
+}
+
+// exchangeCode redeems the authorization code, sending the PKCE verifier, and returns the access token and the id_token
+// of the provider
+func (provider *oidcProvider) exchangeCode(c *fiber.Ctx, code string, verifier string) (string, string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.redirectUrl(c)},
+		"client_id":     {provider.ClientId},
+		"code_verifier": {verifier},
+	}
+	if provider.ClientSecret != "" {
+		form.Set("client_secret", provider.ClientSecret)
+	}
+	request, err := http.NewRequestWithContext(c.UserContext(), "POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IdToken     string `json:"id_token"`
+	}
+	err = doOidcRequest(request, &tokens)
+	if err != nil {
+		return "", "", err
+	}
+	if tokens.AccessToken == "" || tokens.IdToken == "" {
+		return "", "", fmt.Errorf("the token response has no access_token or id_token")
+	}
+	return tokens.AccessToken, tokens.IdToken, nil
+}
+
+// verifyIdToken checks the signature of the id_token with the keys of the provider, that it was issued by the provider
+// for this client and has not expired, and that it has the nonce of the login attempt. It returns its claims
+func (provider *oidcProvider) verifyIdToken(ctx context.Context, idToken string, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := provider.signingKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %v for the key %v", token.Method.Alg(), kid)
+		}
+		return key.PublicKey(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid id_token")
+	}
+	issuer, _ := claims["iss"].(string)
+	if provider.Issuer != "" && strings.TrimSuffix(issuer, "/") != strings.TrimSuffix(provider.Issuer, "/") {
+		return nil, fmt.Errorf("the id_token was issued by %v", claims["iss"])
+	}
+	if !oidcAudienceContains(claims["aud"], provider.ClientId) {
+		return nil, fmt.Errorf("the id_token was issued for another client")
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, fmt.Errorf("the id_token has no expiration")
+	}
+	tokenNonce, _ := claims["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("the id_token has no sub")
+	}
+	return claims, nil
+}
+
+// signingKey returns the key of the provider with the kid. The keys are fetched again when the kid is unknown, as
+// after a rotation, but not more often than oidcJwksRefreshInterval
+func (provider *oidcProvider) signingKey(ctx context.Context, kid string) (*jwtkeys.Key, error) {
+	provider.keysMutex.Lock()
+	defer provider.keysMutex.Unlock()
+	if key := provider.keys[kid]; key != nil {
+		return key, nil
+	}
+	if provider.JwksUri == "" {
+		return nil, fmt.Errorf("oidc provider %v has no jwksUri", provider.Name)
+	}
+	if time.Since(provider.keysFetchedAt) < oidcJwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key %v", kid)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", provider.JwksUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks jwtkeys.JWKS
+	err = doOidcRequest(request, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the keys of the oidc provider %v: %w", provider.Name, err)
+	}
+	provider.keysFetchedAt = time.Now()
+	provider.keys = make(map[string]*jwtkeys.Key)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwtkeys.ParseJWK(jwk)
+		if err != nil {
+			// the providers may publish keys of other types, the rest are still usable
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != key.Algorithm {
+			continue
+		}
+		provider.keys[jwk.Kid] = key
+	}
+	if key := provider.keys[kid]; key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %v", kid)
+}
+
+func oidcAudienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, value := range aud {
+			if value == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userinfo returns the claims of the user that signed in
+func (provider *oidcProvider) userinfo(c *fiber.Ctx, accessToken string) (wst.M, error) {
+	request, err := http.NewRequestWithContext(c.UserContext(), "GET", provider.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	var claims wst.M
+	err = doOidcRequest(request, &claims)
+	return claims, err
+}
+
+func doOidcRequest(request *http.Request, out interface{}) error {
+	request.Header.Set("Accept", "application/json")
+	response, err := oidcHttpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v returned %v: %v", request.Method, request.URL.Path, response.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// loadOidcProviders reads the "oidc.providers" section of the config
+func (app *WeStack) loadOidcProviders() (map[string]*oidcProvider, error) {
+	providers := make(map[string]*oidcProvider)
+	for name := range app.Viper.GetStringMap("oidc.providers") {
+		provider := &oidcProvider{}
+		err := app.Viper.UnmarshalKey("oidc.providers."+name, provider)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oidc provider %v: %w", name, err)
+		}
+		provider.Name = name
+		if provider.ClientId == "" {
+			return nil, fmt.Errorf("oidc provider %v has no clientId", name)
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// loadOidcRoutes mounts /auth/<provider>/login, which redirects to the provider, and /auth/<provider>/callback,
+// which signs in the user with the authorization code flow and PKCE and returns the same tokens as the login method
+func (app *WeStack) loadOidcRoutes() {
+	providers, err := app.loadOidcProviders()
+	if err != nil {
+		app.logger.Error("Could not load the oidc providers", "error", err)
+		return
+	}
+	if len(providers) == 0 {
+		return
+	}
+	userModels := app.FindModelsWithClass("User")
+	if len(userModels) == 0 {
+		app.logger.Error("Could not load the oidc providers", "error", "user model not found")
+		return
+	}
+	userModel := userModels[0]
+
+	findProvider := func(c *fiber.Ctx) (*oidcProvider, error) {
+		provider := providers[c.Params("provider")]
+		if provider == nil {
+			return nil, wst.CreateError(fiber.ErrNotFound, "OIDC_PROVIDER_NOT_FOUND", fiber.Map{"message": fmt.Sprintf("unknown provider %v", c.Params("provider"))}, "Error")
+		}
+		err := provider.endpoints(c.UserContext())
+		if err != nil {
+			userModel.Logger().Error("Oidc provider unavailable", "requestId", model.RequestID(c), "provider", provider.Name, "error", err)
+			return nil, wst.CreateError(fiber.ErrBadGateway, "OIDC_PROVIDER_UNAVAILABLE", fiber.Map{"message": "the identity provider is not available"}, "Error")
+		}
+		return provider, nil
+	}
+
+	app.Server.Get("/auth/:provider/login", func(c *fiber.Ctx) error {
+		provider, err := findProvider(c)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		state, verifier, nonce := randomTokenValue(), randomTokenValue(), randomTokenValue()
+		stateToken, err := app.jwtKeys.Sign(jwt.MapClaims{
+			"typ":      oidcStateTokenType,
+			"jti":      uuid.NewString(),
+			"provider": provider.Name,
+			"state":    state,
+			"verifier": verifier,
+			"nonce":    nonce,
+			"created":  time.Now().UnixMilli(),
+			"ttl":      oidcStateTtl.Milliseconds(),
+		})
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		setOidcStateCookie(c, provider, stateToken, int(oidcStateTtl.Seconds()))
+		challenge := sha256.Sum256([]byte(verifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {provider.ClientId},
+			"redirect_uri":          {provider.redirectUrl(c)},
+			"scope":                 {strings.Join(provider.Scopes, " ")},
+			"state":                 {state},
+			"nonce":                 {nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		separator := "?"
+		if strings.Contains(provider.AuthorizationEndpoint, "?") {
+			separator = "&"
+		}
+		return c.Redirect(provider.AuthorizationEndpoint+separator+query.Encode(), fiber.StatusFound)
+	})
+
+	app.Server.Get("/auth/:provider/callback", func(c *fiber.Ctx) error {
+		provider, err := findProvider(c)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		logger := userModel.Logger().With("requestId", model.RequestID(c), "provider", provider.Name)
+		if providerError := c.Query("error"); providerError != "" {
+			logger.Info("Oidc login rejected by the provider", "error", providerError)
+			return userModel.SendError(c, oidcLoginFailedError())
+		}
+		verifier, nonce, err := app.checkOidcState(c, provider)
+		if err != nil {
+			logger.Info("Invalid oidc state", "error", err)
+			return userModel.SendError(c, wst.CreateError(fiber.ErrUnauthorized, "INVALID_OIDC_STATE", fiber.Map{"message": "invalid or expired login attempt"}, "Error"))
+		}
+		// the cookie is cleared with the same path it was set with, or the browser keeps it
+		setOidcStateCookie(c, provider, "", -1)
+
+		accessToken, idToken, err := provider.exchangeCode(c, c.Query("code"), verifier)
+		if err != nil {
+			logger.Warn("Could not exchange the oidc code", "error", err)
+			return userModel.SendError(c, oidcLoginFailedError())
+		}
+		idClaims, err := provider.verifyIdToken(c.UserContext(), idToken, nonce)
+		if err != nil {
+			logger.Warn("Invalid oidc id_token", "error", err)
+			return userModel.SendError(c, oidcLoginFailedError())
+		}
+		// the userinfo only completes the claims of the id_token, and must be of the same subject
+		claims, err := provider.userinfo(c, accessToken)
+		if err != nil {
+			logger.Warn("Could not get the oidc userinfo", "error", err)
+			return userModel.SendError(c, oidcLoginFailedError())
+		}
+		if claims.GetString("sub") != idClaims["sub"] {
+			logger.Warn("The oidc userinfo is of another subject", "sub", idClaims["sub"], "userinfoSub", claims["sub"])
+			return userModel.SendError(c, oidcLoginFailedError())
+		}
+		for key, value := range idClaims {
+			claims[key] = value
+		}
+		email := strings.ToLower(strings.TrimSpace(claims.GetString("email")))
+		if email == "" || (!provider.TrustEmail && claims["email_verified"] != true) {
+			logger.Info("Oidc user without a verified email", "sub", claims["sub"])
+			return userModel.SendError(c, wst.CreateError(fiber.ErrUnauthorized, "OIDC_EMAIL_NOT_VERIFIED", fiber.Map{"message": "the identity provider did not return a verified email"}, "Error"))
+		}
+
+		systemContext := &model.EventContext{
+			Bearer:  &model.BearerToken{User: &model.BearerUser{System: true}},
+			Context: c.UserContext(),
+			Ctx:     c,
+		}
+		user, err := userModel.FindOne(&wst.Filter{Where: &wst.Where{"email": email}}, systemContext)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		if user != nil && !user.GetBoolean("emailVerified", false) {
+			// whoever registered the email first did not prove to own it, so the account is not handed to the owner of
+			// the email at the provider. The owner can verify the email, or reset the password, to take it over
+			logger.Info("Oidc login of an unverified local user", "userId", user.Id)
+			return userModel.SendError(c, wst.CreateError(fiber.ErrConflict, "OIDC_ACCOUNT_NOT_VERIFIED", fiber.Map{"message": "an account with this email exists but its email is not verified"}, "Error"))
+		}
+		if user == nil {
+			// the user has no password to log in with, and can set one with the password reset
+			user, err = userModel.Create(wst.M{
+				"email":         email,
+				"password":      passwordHash(passwords.UnusableHash),
+				"emailVerified": true,
+			}, systemContext)
+			if err != nil {
+				return userModel.SendError(c, err)
+			}
+			logger.Info("Created oidc user", "userId", user.Id)
+		}
+
+		result, err := app.loginResult(user, systemContext)
+		if err != nil {
+			return userModel.SendError(c, err)
+		}
+		return c.JSON(result)
+	})
+}
+
+// setOidcStateCookie sets the cookie of the login attempt, or clears it with a negative maxAge. It is Lax, so that the
+// browser sends it back when the provider redirects to the callback
+func setOidcStateCookie(c *fiber.Ctx, provider *oidcProvider, value string, maxAge int) {
+	cookie := &fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/auth/" + provider.Name,
+		MaxAge:   maxAge,
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.Expires = time.Unix(0, 0)
+	}
+	c.Cookie(cookie)
+}
+
+// checkOidcState compares the state returned by the provider with the one of the cookie set by the login route, and
+// returns the PKCE verifier and the nonce of the id_token
+func (app *WeStack) checkOidcState(c *fiber.Ctx, provider *oidcProvider) (string, string, error) {
+	token, err := jwt.Parse(c.Cookies(oidcStateCookie), app.jwtKeys.Keyfunc)
+	if err != nil {
+		return "", "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["typ"] != oidcStateTokenType || claims["provider"] != provider.Name {
+		return "", "", fmt.Errorf("invalid state cookie")
+	}
+	if time.Now().After(model.TokenExpiresAt(claims)) {
+		return "", "", fmt.Errorf("expired state cookie")
+	}
+	state, _ := claims["state"].(string)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		return "", "", fmt.Errorf("state mismatch")
+	}
+	verifier, _ := claims["verifier"].(string)
+	nonce, _ := claims["nonce"].(string)
+	return verifier, nonce, nil
+}
+
+func oidcLoginFailedError() error {
+	return wst.CreateError(fiber.ErrUnauthorized, "OIDC_LOGIN_FAILED", fiber.Map{"message": "login with the identity provider failed"}, "Error")
+}
@@ -0,0 +1,146 @@
+package westack
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/passwords"
+)
+
+// passwordHash is a password that is already hashed, which the before save hook of the users stores as it is
+type passwordHash string
+
+// loadPasswordPolicy reads the "passwordPolicy" section of the config
+func loadPasswordPolicy(appViper *viper.Viper) *passwords.Policy {
+	var policy passwords.Policy
+	err := appViper.UnmarshalKey("passwordPolicy", &policy)
+	if err != nil {
+		log.Fatalf("Invalid passwordPolicy config: %v", err)
+	}
+	return &policy
+}
+
+// loadPasswordHasher creates the hasher of the "passwordHasher" section of the config, bcrypt by default
+func loadPasswordHasher(appViper *viper.Viper) passwords.Hasher {
+	var config passwords.HasherConfig
+	err := appViper.UnmarshalKey("passwordHasher", &config)
+	if err != nil {
+		log.Fatalf("Invalid passwordHasher config: %v", err)
+	}
+	hasher, err := passwords.NewHasher(config)
+	if err != nil {
+		log.Fatalf("Could not create the password hasher: %v", err)
+	}
+	return hasher
+}
+
+func passwordPolicyError(codes []string) error {
+	if len(codes) == 1 && codes[0] == "presence" {
+		return wst.CreateError(fiber.ErrBadRequest, "PASSWORD_BLANK", fiber.Map{"message": "Invalid password"}, "ValidationError")
+	}
+	return wst.CreateError(fiber.ErrBadRequest, "PASSWORD_POLICY", fiber.Map{"message": "the password does not meet the password policy", "codes": wst.M{"password": codes}}, "ValidationError")
+}
+
+// hashUserPassword checks the new password of a user against the policy and hashes it, from the before save hook.
+// On updates, the previous hashes are kept in "passwordHistory" to reject the reused passwords
+func (app *WeStack) hashUserPassword(loadedModel *model.Model, ctx *model.EventContext) error {
+	data := *ctx.Data
+	if _, ok := data["passwordHistory"]; ok && !isSystemContext(ctx) {
+		return wst.CreateError(fiber.ErrForbidden, "PASSWORD_HISTORY_READ_ONLY", fiber.Map{"message": "passwordHistory cannot be written"}, "Error")
+	}
+	if hash, ok := data["password"].(passwordHash); ok {
+		data["password"] = string(hash)
+		return nil
+	}
+	if !ctx.IsNewInstance && (data["password"] == nil || data["password"] == "") {
+		return nil
+	}
+
+	password, _ := data["password"].(string)
+	codes := app.passwordPolicy.Check(password)
+	if len(codes) > 0 {
+		return passwordPolicyError(codes)
+	}
+	if !ctx.IsNewInstance {
+		ctx.Logger().Debug("Update user password")
+	}
+	if !ctx.IsNewInstance && ctx.ModelID != nil && app.passwordPolicy.History > 0 {
+		history, err := app.checkPasswordHistory(loadedModel, ctx, password)
+		if err != nil {
+			return err
+		}
+		data["passwordHistory"] = history
+	}
+
+	hashed, err := app.passwordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	data["password"] = hashed
+	return nil
+}
+
+// checkPasswordHistory rejects the password if it is one of the last ones of the user, and returns the history
+// updated with the current password
+func (app *WeStack) checkPasswordHistory(loadedModel *model.Model, ctx *model.EventContext, password string) ([]string, error) {
+	stored, err := loadedModel.FindById(ctx.ModelID, nil, systemContextFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, nil
+	}
+	storedData := stored.ToJSON()
+	previous := append([]string{storedData.GetString("password")}, instanceStrings(storedData["passwordHistory"])...)
+	history := make([]string, 0, app.passwordPolicy.History)
+	for _, hash := range previous {
+		if len(history) == app.passwordPolicy.History {
+			break
+		}
+		if hash == "" || hash == passwords.UnusableHash {
+			continue
+		}
+		reused, _ := passwords.Verify(app.passwordHasher, hash, password)
+		if reused {
+			return nil, passwordPolicyError([]string{"history"})
+		}
+		history = append(history, hash)
+	}
+	// the current password is checked too, so the history keeps one less
+	if len(history) == app.passwordPolicy.History {
+		history = history[:len(history)-1]
+	}
+	return history, nil
+}
+
+// verifyUserPassword checks the password of a user. When the stored hash has another algorithm or older parameters
+// than the hasher of the app, it is replaced by a new one
+func (app *WeStack) verifyUserPassword(user *model.Instance, password string, ctx *model.EventContext) bool {
+	hash := user.ToJSON().GetString("password")
+	valid, err := passwords.Verify(app.passwordHasher, hash, password)
+	if err != nil {
+		if errors.Is(err, passwords.ErrUnknownHash) {
+			ctx.Logger().Warn("Unknown password hash format", "userId", user.Id)
+		}
+		return false
+	}
+	if valid && passwords.NeedsRehash(app.passwordHasher, hash) {
+		rehashed, err := app.passwordHasher.Hash(password)
+		if err == nil {
+			rehashContext := systemContextFrom(ctx)
+			rehashContext.DisableTypeConversions = true
+			_, err = user.UpdateAttributes(wst.M{"password": passwordHash(rehashed)}, rehashContext)
+		}
+		if err != nil {
+			ctx.Logger().Warn("Could not rehash the password", "userId", user.Id, "error", err)
+		} else {
+			ctx.Logger().Debug("Rehashed the password", "userId", user.Id)
+		}
+	}
+	return valid
+}
@@ -0,0 +1,178 @@
+package westack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/passwords"
+)
+
+const defaultPasswordResetTtl = time.Hour
+
+func invalidResetTokenError() error {
+	return wst.CreateError(fiber.ErrUnauthorized, "INVALID_RESET_TOKEN", fiber.Map{"message": "invalid or expired reset token"}, "Error")
+}
+
+// passwordFingerprint identifies the current password of a user without revealing its hash, so that the reset tokens
+// issued before a password change are rejected
+func passwordFingerprint(user *model.Instance) string {
+	hash := sha256.Sum256([]byte(user.ToJSON().GetString("password")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// issuePasswordResetToken signs a token that allows to set a new password for the user once, within the
+// "tokens.passwordResetTtl" seconds
+func (app *WeStack) issuePasswordResetToken(user *model.Instance) (string, error) {
+	return app.signToken(jwt.MapClaims{
+		"userId":   model.GetIDAsString(user.Id),
+		"password": passwordFingerprint(user),
+	}, model.PasswordResetTokenType, app.tokenTtl("passwordResetTtl", defaultPasswordResetTtl))
+}
+
+// resetPasswordFromRequest handles POST /users/reset-password. The token is passed to the "sendResetPasswordEmail"
+// handler in ctx.Data["resetToken"], with the user as ctx.Instance, to be sent to the user. Without handler, it is sent
+// with the mailer of the app. The response is the same whether the email exists or not
+func (app *WeStack) resetPasswordFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	email := strings.TrimSpace(ctx.Data.GetString("email"))
+	if email == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "EMAIL_PRESENCE", fiber.Map{"message": "email is required", "codes": wst.M{"email": []string{"presence"}}}, "ValidationError")
+	}
+
+	user, err := loadedModel.FindOne(&wst.Filter{Where: &wst.Where{"email": email}}, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		ctx.Logger().Debug("Password reset for an unknown email", "email", email)
+		ctx.StatusCode = fiber.StatusNoContent
+		return nil
+	}
+	resetToken, err := app.issuePasswordResetToken(user)
+	if err != nil {
+		return err
+	}
+
+	ctx.Instance = user
+	(*ctx.Data)["resetToken"] = resetToken
+	if loadedModel.HasHandler("sendResetPasswordEmail") {
+		err = loadedModel.GetHandler("sendResetPasswordEmail")(ctx)
+	} else if app.mailer != nil {
+		err = app.sendResetPasswordMail(user, resetToken, ctx)
+	} else {
+		ctx.Logger().Warn("The password reset token was not sent, register a sendResetPasswordEmail handler or configure a mailer")
+	}
+	if err != nil {
+		return err
+	}
+	if ctx.Result == nil && ctx.StatusCode == 0 {
+		ctx.StatusCode = fiber.StatusNoContent
+	}
+	return nil
+}
+
+// confirmResetPasswordFromRequest handles POST /users/reset-password/confirm, which sets the password of the user of the
+// token. The token is revoked once the password is set, so it can only be used once, and so are the tokens issued to
+// the user before
+func (app *WeStack) confirmResetPasswordFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	password := ctx.Data.GetString("password")
+	if codes := app.passwordPolicy.Check(password); len(codes) > 0 {
+		return passwordPolicyError(codes)
+	}
+	token, err := jwt.Parse(ctx.Data.GetString("token"), app.jwtKeys.Keyfunc)
+	if err != nil || !token.Valid {
+		return invalidResetTokenError()
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != model.PasswordResetTokenType || model.TokenID(claims) == "" {
+		return invalidResetTokenError()
+	}
+	if time.Now().After(model.TokenExpiresAt(claims)) {
+		return invalidResetTokenError()
+	}
+	revoked, err := app.tokenDenylist.IsRevoked(ctx.GetContext(), model.TokenID(claims))
+	if err != nil {
+		return err
+	}
+	if revoked {
+		ctx.Logger().Warn("Reused password reset token", "userId", claims["userId"], "jti", model.TokenID(claims))
+		return invalidResetTokenError()
+	}
+
+	systemContext := systemContextFrom(ctx)
+	user, err := loadedModel.FindById(claims["userId"], nil, systemContext)
+	if err != nil || user == nil || claims["password"] != passwordFingerprint(user) {
+		return invalidResetTokenError()
+	}
+
+	_, err = user.UpdateAttributes(wst.M{"password": password}, systemContext)
+	if err != nil {
+		return err
+	}
+	ctx.Logger().Info("Password reset", "userId", claims["userId"])
+	// the new password already changed the fingerprint of the token, the denylist entry rejects it before the lookup
+	err = app.tokenDenylist.Revoke(ctx.GetContext(), model.TokenID(claims), model.TokenExpiresAt(claims))
+	if err != nil && err != model.ErrTokenRevoked {
+		ctx.Logger().Warn("Could not revoke the password reset token", "userId", claims["userId"], "error", err)
+	}
+	err = app.revokeUserTokens(ctx.GetContext(), user)
+	if err != nil {
+		return err
+	}
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// changePasswordFromRequest handles POST /users/change-password, which sets the password of the bearer after checking
+// the old one. The tokens issued to the user before, including the bearer, are revoked
+func (app *WeStack) changePasswordFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	if ctx.Bearer == nil || ctx.Bearer.User == nil || ctx.Bearer.Claims["typ"] == model.ApiKeyTokenType {
+		return wst.CreateError(fiber.ErrForbidden, "PASSWORD_CHANGE_NOT_ALLOWED", fiber.Map{"message": "the password can only be changed by its user"}, "Error")
+	}
+	newPassword := ctx.Data.GetString("newPassword")
+	if strings.TrimSpace(newPassword) == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "PASSWORD_BLANK", fiber.Map{"message": "Invalid password"}, "ValidationError")
+	}
+
+	systemContext := systemContextFrom(ctx)
+	user, err := loadedModel.FindById(ctx.Bearer.User.Id, nil, systemContext)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fiber.ErrUnauthorized
+	}
+	valid, _ := passwords.Verify(app.passwordHasher, user.ToJSON().GetString("password"), ctx.Data.GetString("oldPassword"))
+	if !valid {
+		return wst.CreateError(fiber.ErrBadRequest, "INVALID_PASSWORD", fiber.Map{"message": "the old password is not valid", "codes": wst.M{"oldPassword": []string{"invalid"}}}, "ValidationError")
+	}
+
+	_, err = user.UpdateAttributes(wst.M{"password": newPassword}, systemContext)
+	if err != nil {
+		return err
+	}
+	ctx.Logger().Info("Password changed", "userId", user.Id)
+	err = app.revokeUserTokens(ctx.GetContext(), user)
+	if err != nil {
+		return err
+	}
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// systemContextFrom returns a system context that keeps the request context, request id and tenant of ctx, for the
+// reads and writes that the bearer is not allowed to do by itself
+func systemContextFrom(ctx *model.EventContext) *model.EventContext {
+	return &model.EventContext{
+		Bearer:    &model.BearerToken{User: &model.BearerUser{System: true}},
+		Context:   ctx.GetContext(),
+		RequestID: ctx.GetRequestID(),
+		Tenant:    ctx.GetTenant(),
+	}
+}
@@ -0,0 +1,193 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned when no hasher recognizes the format of a stored hash
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// UnusableHash is stored for the users without a password of their own, like the ones created by a social login. No
+// password matches it
+const UnusableHash = "!"
+
+// Hasher hashes the passwords of the users before they are stored
+type Hasher interface {
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches a hash of this hasher
+	Verify(hash string, password string) (bool, error)
+	// Handles reports whether the hash has the format of this hasher
+	Handles(hash string) bool
+	// NeedsRehash reports whether the hash was created with other parameters than the current ones
+	NeedsRehash(hash string) bool
+}
+
+// HasherConfig is the "passwordHasher" section of the app config
+type HasherConfig struct {
+	// Algorithm is "bcrypt", the default, or "argon2id"
+	Algorithm string `mapstructure:"algorithm" json:"algorithm"`
+	// Cost is the bcrypt cost, 10 by default
+	Cost int `mapstructure:"cost" json:"cost"`
+	// Memory is the argon2id memory in KiB, 64 MiB by default
+	Memory uint32 `mapstructure:"memory" json:"memory"`
+	// Iterations is the argon2id number of passes, 3 by default
+	Iterations uint32 `mapstructure:"iterations" json:"iterations"`
+	// Parallelism is the argon2id number of threads, 2 by default
+	Parallelism uint8 `mapstructure:"parallelism" json:"parallelism"`
+}
+
+// NewHasher creates the hasher of the config
+func NewHasher(config HasherConfig) (Hasher, error) {
+	switch config.Algorithm {
+	case "", "bcrypt":
+		hasher := &BcryptHasher{Cost: config.Cost}
+		if hasher.Cost == 0 {
+			hasher.Cost = bcrypt.DefaultCost
+		}
+		if hasher.Cost < bcrypt.MinCost || hasher.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost %v", hasher.Cost)
+		}
+		return hasher, nil
+	case "argon2id":
+		hasher := &Argon2idHasher{Memory: config.Memory, Iterations: config.Iterations, Parallelism: config.Parallelism}
+		if hasher.Memory == 0 {
+			hasher.Memory = 64 * 1024
+		}
+		if hasher.Iterations == 0 {
+			hasher.Iterations = 3
+		}
+		if hasher.Parallelism == 0 {
+			hasher.Parallelism = 2
+		}
+		return hasher, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher %v", config.Algorithm)
+}
+
+// builtinHashers verify the hashes created by a previous configuration
+var builtinHashers = []Hasher{&BcryptHasher{}, &Argon2idHasher{}}
+
+// Verify checks the password against the hash with the hasher, or with the built-in hasher of its format, so that
+// the users can still log in after the algorithm changes
+func Verify(hasher Hasher, hash string, password string) (bool, error) {
+	if hash == UnusableHash {
+		return false, nil
+	}
+	if hasher.Handles(hash) {
+		return hasher.Verify(hash, password)
+	}
+	for _, builtinHasher := range builtinHashers {
+		if builtinHasher.Handles(hash) {
+			return builtinHasher.Verify(hash, password)
+		}
+	}
+	return false, ErrUnknownHash
+}
+
+// NeedsRehash reports whether the hash should be replaced by a new one of the hasher
+func NeedsRehash(hasher Hasher, hash string) bool {
+	return !hasher.Handles(hash) || hasher.NeedsRehash(hash)
+}
+
+// BcryptHasher hashes with bcrypt
+type BcryptHasher struct {
+	Cost int
+}
+
+func (hasher *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (hasher *BcryptHasher) Verify(hash string, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (hasher *BcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (hasher *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != hasher.Cost
+}
+
+// Argon2idHasher hashes with argon2id, in the PHC string format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const argon2idSaltLength = 16
+const argon2idKeyLength = 32
+
+func (hasher *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, hasher.Iterations, hasher.Memory, hasher.Parallelism, argon2idKeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, hasher.Memory, hasher.Iterations,
+		hasher.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (hasher *Argon2idHasher) Verify(hash string, password string) (bool, error) {
+	params, salt, key, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (hasher *Argon2idHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (hasher *Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := parseArgon2idHash(hash)
+	return err != nil || params != *hasher
+}
+
+func parseArgon2idHash(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %v", parts[2])
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key: %v", err)
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,89 @@
+package passwords
+
+import (
+	_ "embed"
+	"strings"
+	"unicode"
+)
+
+//go:embed common.txt
+var commonPasswordsList string
+
+var commonPasswords = func() map[string]bool {
+	passwords := map[string]bool{}
+	for _, password := range strings.Split(commonPasswordsList, "\n") {
+		if password = strings.TrimSpace(password); password != "" {
+			passwords[password] = true
+		}
+	}
+	return passwords
+}()
+
+// Policy is the "passwordPolicy" section of the app config. The zero policy only rejects the blank passwords
+type Policy struct {
+	MinLength        int  `mapstructure:"minLength" json:"minLength"`
+	RequireLowercase bool `mapstructure:"requireLowercase" json:"requireLowercase"`
+	RequireUppercase bool `mapstructure:"requireUppercase" json:"requireUppercase"`
+	RequireDigit     bool `mapstructure:"requireDigit" json:"requireDigit"`
+	RequireSymbol    bool `mapstructure:"requireSymbol" json:"requireSymbol"`
+	// DenyCommonPasswords rejects the passwords of the built-in list of the most common ones
+	DenyCommonPasswords bool `mapstructure:"denyCommonPasswords" json:"denyCommonPasswords"`
+	// Denylist has other rejected passwords, like the name of the app. The comparison ignores the case
+	Denylist []string `mapstructure:"denylist" json:"denylist"`
+	// History is the number of the last passwords of a user, including the current one, that cannot be reused
+	History int `mapstructure:"history" json:"history"`
+}
+
+// Check returns the codes of the rules that the password breaks: "presence", "length", "lowercase", "uppercase",
+// "digit", "symbol" or "denylist"
+func (policy *Policy) Check(password string) []string {
+	if strings.TrimSpace(password) == "" {
+		return []string{"presence"}
+	}
+	var codes []string
+	if len([]rune(password)) < policy.MinLength {
+		codes = append(codes, "length")
+	}
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireLowercase && !hasLower {
+		codes = append(codes, "lowercase")
+	}
+	if policy.RequireUppercase && !hasUpper {
+		codes = append(codes, "uppercase")
+	}
+	if policy.RequireDigit && !hasDigit {
+		codes = append(codes, "digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		codes = append(codes, "symbol")
+	}
+	if policy.denied(password) {
+		codes = append(codes, "denylist")
+	}
+	return codes
+}
+
+func (policy *Policy) denied(password string) bool {
+	lowered := strings.ToLower(password)
+	if policy.DenyCommonPasswords && commonPasswords[lowered] {
+		return true
+	}
+	for _, denied := range policy.Denylist {
+		if strings.ToLower(denied) == lowered {
+			return true
+		}
+	}
+	return false
+}
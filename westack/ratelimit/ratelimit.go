@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fredyk/westack-go/westack/memorykv"
+)
+
+// Bucket is the memorykv bucket where the counters and lockouts are stored
+const Bucket = "RateLimit"
+
+type Limit struct {
+	// Max is the number of hits allowed per key and window. Once reached, the key is locked out
+	Max int
+	// Window is the duration of the fixed window where the hits are counted
+	Window time.Duration
+	// Lockout is how long the key is rejected once it reaches Max. Defaults to Window
+	Lockout time.Duration
+}
+
+// Limiter counts the hits of each key, like an IP or an account, in fixed windows. The counters expire with their
+// window, so the bucket only holds the keys that were hit recently
+type Limiter struct {
+	bucket memorykv.MemoryKvBucket
+	// mutex makes the read and write of a counter atomic, as memorykv has no increment
+	mutex sync.Mutex
+}
+
+func New(bucket memorykv.MemoryKvBucket) *Limiter {
+	return &Limiter{bucket: bucket}
+}
+
+// RetryAfter returns how long the key is still locked out, or 0 if it is not
+func (limiter *Limiter) RetryAfter(key string) time.Duration {
+	value, err := limiter.bucket.Get("lock:" + key)
+	if err != nil || len(value) == 0 {
+		return 0
+	}
+	lockedUntil, err := strconv.ParseInt(string(value[0]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	retryAfter := time.Until(time.UnixMilli(lockedUntil))
+	if retryAfter < 0 {
+		return 0
+	}
+	return retryAfter
+}
+
+// Hit counts a hit of the key in the current window. When the hits reach limit.Max, the key is locked out and the
+// lockout is returned
+func (limiter *Limiter) Hit(key string, limit Limit) time.Duration {
+	if limit.Max <= 0 || limit.Window <= 0 {
+		return 0
+	}
+	now := time.Now()
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	hits := int64(0)
+	windowEnd := now.Add(limit.Window).UnixMilli()
+	if value, err := limiter.bucket.Get("hits:" + key); err == nil && len(value) == 2 {
+		savedHits, hitsErr := strconv.ParseInt(string(value[0]), 10, 64)
+		savedWindowEnd, windowErr := strconv.ParseInt(string(value[1]), 10, 64)
+		if hitsErr == nil && windowErr == nil && savedWindowEnd > now.UnixMilli() {
+			hits, windowEnd = savedHits, savedWindowEnd
+		}
+	}
+	hits++
+	if hits < int64(limit.Max) {
+		_ = limiter.bucket.SetEx("hits:"+key, [][]byte{
+			[]byte(strconv.FormatInt(hits, 10)),
+			[]byte(strconv.FormatInt(windowEnd, 10)),
+		}, time.UnixMilli(windowEnd).Sub(now))
+		return 0
+	}
+
+	lockout := limit.Lockout
+	if lockout <= 0 {
+		lockout = limit.Window
+	}
+	_ = limiter.bucket.Delete("hits:" + key)
+	_ = limiter.bucket.SetEx("lock:"+key, [][]byte{[]byte(strconv.FormatInt(now.Add(lockout).UnixMilli(), 10))}, lockout)
+	return lockout
+}
+
+// Reset forgets the hits of the key, like after a successful login. A lockout in progress is kept
+func (limiter *Limiter) Reset(key string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	_ = limiter.bucket.Delete("hits:" + key)
+}
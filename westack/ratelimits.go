@@ -0,0 +1,141 @@
+package westack
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/memorykv"
+	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/ratelimit"
+)
+
+const defaultLoginMaxAttemptsPerIp = 20
+const defaultLoginMaxAttemptsPerAccount = 5
+const defaultLoginWindow = 15 * time.Minute
+
+// loadRateLimiter stores the counters of the failed logins and of the remote methods with a RateLimit in the
+// "rateLimit.datasource" datasource, which must use the memorykv connector. By default, an internal one is created
+func (app *WeStack) loadRateLimiter() {
+	dsName := app.Viper.GetString("rateLimit.datasource")
+	var ds *datasource.Datasource
+	if dsName != "" {
+		var err error
+		ds, err = app.FindDatasource(dsName)
+		if err != nil {
+			log.Fatalf("Invalid rateLimit.datasource: %v", err)
+		}
+	} else {
+		dsViper := viper.New()
+		dsViper.Set("rateLimit.connector", "memorykv")
+		ds = datasource.New("rateLimit", dsViper, context.Background())
+		err := ds.Initialize()
+		if err != nil {
+			log.Fatalf("Could not create the rate limit datasource: %v", err)
+		}
+	}
+	db, ok := ds.Db.(memorykv.MemoryKvDb)
+	if !ok {
+		log.Fatalf("Invalid rateLimit.datasource: %v does not use the memorykv connector", ds.Name)
+	}
+	app.rateLimiter = ratelimit.New(db.GetBucket(ratelimit.Bucket))
+}
+
+// RateLimiter returns the limiter of the app, to count the hits of custom routes
+func (app *WeStack) RateLimiter() *ratelimit.Limiter {
+	return app.rateLimiter
+}
+
+// loginLimit reads a limit of the failed logins from the "rateLimit.login" section of the config, with the window and
+// lockout in seconds. A negative maximum disables the limit
+func (app *WeStack) loginLimit(maxKey string, defaultMax int) ratelimit.Limit {
+	limit := ratelimit.Limit{Max: defaultMax, Window: defaultLoginWindow}
+	if app.Viper.IsSet("rateLimit.login." + maxKey) {
+		limit.Max = app.Viper.GetInt("rateLimit.login." + maxKey)
+	}
+	if seconds := app.Viper.GetFloat64("rateLimit.login.window"); seconds > 0 {
+		limit.Window = time.Duration(seconds * float64(time.Second))
+	}
+	if seconds := app.Viper.GetFloat64("rateLimit.login.lockout"); seconds > 0 {
+		limit.Lockout = time.Duration(seconds * float64(time.Second))
+	}
+	return limit
+}
+
+// loginKeys returns the keys of the counters of the IP and the account of a login
+func loginKeys(ctx *model.EventContext, account string) (ipKey string, accountKey string) {
+	if ctx.Ctx != nil {
+		ipKey = "login:ip:" + ctx.Ctx.IP()
+	}
+	return ipKey, "login:account:" + strings.ToLower(account)
+}
+
+// checkLoginLockout rejects the login before the password is compared if its IP or account are locked out
+func (app *WeStack) checkLoginLockout(ctx *model.EventContext, account string) error {
+	ipKey, accountKey := loginKeys(ctx, account)
+	retryAfter := app.rateLimiter.RetryAfter(accountKey)
+	if ipKey != "" {
+		retryAfter = maxDuration(retryAfter, app.rateLimiter.RetryAfter(ipKey))
+	}
+	if retryAfter > 0 {
+		ctx.Logger().Warn("Login locked out", "account", account, "retryAfter", retryAfter)
+		return model.RateLimitedError(ctx.Ctx, "TOO_MANY_LOGIN_ATTEMPTS", retryAfter)
+	}
+	return nil
+}
+
+// loginFailed counts the failed login for its IP and account, and invokes the "after login failed" hook, which gets
+// the credentials without the password, the reason and the lockout, if any, in ctx.Data
+func (app *WeStack) loginFailed(loadedModel *model.Model, ctx *model.EventContext, account string, reason string) error {
+	ipKey, accountKey := loginKeys(ctx, account)
+	lockout := app.rateLimiter.Hit(accountKey, app.loginLimit("maxAttemptsPerAccount", defaultLoginMaxAttemptsPerAccount))
+	if ipKey != "" {
+		lockout = maxDuration(lockout, app.rateLimiter.Hit(ipKey, app.loginLimit("maxAttemptsPerIp", defaultLoginMaxAttemptsPerIp)))
+	}
+	if lockout > 0 {
+		ctx.Logger().Warn("Too many failed logins", "account", account, "lockout", lockout)
+	}
+
+	if loadedModel.DisabledHandlers["__operation__after_login_failed"] != true {
+		hookData := wst.M{
+			"email":    ctx.Data.GetString("email"),
+			"username": ctx.Data.GetString("username"),
+			"reason":   reason,
+			"lockout":  lockout.Seconds(),
+		}
+		if ctx.Ctx != nil {
+			hookData["ip"] = ctx.Ctx.IP()
+		}
+		hookContext := &model.EventContext{
+			BaseContext: ctx,
+			Model:       loadedModel,
+			Data:        &hookData,
+			Instance:    ctx.Instance,
+		}
+		err := loadedModel.GetHandler("__operation__after_login_failed")(hookContext)
+		if err != nil {
+			return err
+		}
+	}
+	return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+}
+
+// loginSucceeded resets the failed logins of the account. Those of the IP are kept, as a client that tries many
+// accounts may guess the password of some of them
+func (app *WeStack) loginSucceeded(ctx *model.EventContext, account string) {
+	_, accountKey := loginKeys(ctx, account)
+	app.rateLimiter.Reset(accountKey)
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,7 +1,15 @@
 package westack
 
 import (
+	"context"
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/model"
@@ -65,9 +73,9 @@ func UpsertUserWithRoles(app *WeStack, userToUpsert UserWithRoles, eventContext
 		if err != nil {
 			return
 		}
-		fmt.Printf("User %v created with id %v\n", userToUpsert.Username, user.Id)
+		userModel.Logger().Info("Created user", "username", userToUpsert.Username, "userId", user.Id)
 	} else {
-		fmt.Printf("User %v already exists\n", userToUpsert.Username)
+		userModel.Logger().Debug("User already exists", "username", userToUpsert.Username)
 	}
 
 	for _, roleName := range userToUpsert.Roles {
@@ -80,9 +88,10 @@ func UpsertUserWithRoles(app *WeStack, userToUpsert UserWithRoles, eventContext
 		// check if role mapping exists
 		roleMapping, err = app.roleMappingModel.FindOne(&wst.Filter{
 			Where: &wst.Where{
-				"principalType": "USER",
-				"principalId":   user.Id,
-				"roleId":        role.Id,
+				"principalType":        "USER",
+				"principalId":          user.Id,
+				"roleId":               role.Id,
+				roleMappingTenantField: nil,
 			},
 		}, eventContext)
 		if err != nil {
@@ -97,9 +106,10 @@ func UpsertUserWithRoles(app *WeStack, userToUpsert UserWithRoles, eventContext
 			if err != nil {
 				return
 			}
-			fmt.Printf("Assigned role %v to user %v with mapping id %v\n", roleName, userToUpsert.Username, roleMapping.Id)
+			app.roleMappingModel.Logger().Info("Assigned role to user", "role", roleName, "username", userToUpsert.Username, "roleMappingId", roleMapping.Id)
+			app.userRoles.forget(model.GetIDAsString(user.Id))
 		} else {
-			fmt.Printf("Role mapping already exists for user %s and role %s\n", userToUpsert.Username, roleName)
+			app.roleMappingModel.Logger().Debug("Role mapping already exists", "role", roleName, "username", userToUpsert.Username)
 		}
 
 	}
@@ -127,10 +137,595 @@ func findRoleWithModel(eventContext *model.EventContext, roleName string, roleMo
 		if err != nil {
 			return
 		}
-		fmt.Printf("Created role %s with ID: %s\n", roleName, roleInstance.Id)
+		roleModel.Logger().Info("Created role", "role", roleName, "roleId", roleInstance.Id)
 	} else {
-		fmt.Printf("Role %s already exists\n", roleName)
+		roleModel.Logger().Debug("Role already exists", "role", roleName)
 	}
 
 	return
 }
+
+// manageRolesAction is the casbin action of the role management routes of the User models, allowed to the "admin"
+// role by default
+const manageRolesAction = "manageRoles"
+
+var roleManagementMethods = []string{"listRoles", "createRole", "setRoleInherits", "deleteRole", "assignRole", "unassignRole"}
+
+const defaultRolesCacheTtl = 10 * time.Second
+
+// roleMappingTenantField is the tenant of the role mappings assigned in a tenant. The role mappings without it apply to
+// all the tenants
+const roleMappingTenantField = "tenantId"
+
+// roleMappingTenantWhere matches the role mappings that apply in the tenant
+func roleMappingTenantWhere(tenant string) interface{} {
+	if tenant == "" {
+		return nil
+	}
+	return wst.M{"$in": []interface{}{nil, tenant}}
+}
+
+var roleNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]*$`)
+
+// actionNames are the casbin actions of the "g" rules of the models, which share the namespace of the roles. A role
+// with the name of an action would replace its links, and grant it the permissions of the inherited roles
+var actionNames = []string{"read", "write", "findMany", "findById", "count", "create", "instance_updateAttributes",
+	"instance_delete", manageRolesAction, readAuditAction, readMetricsAction}
+
+// principalNames are the roles that casbin gives to the users without a role mapping: "USER" to all of them, and the
+// "$" principals of the policies. A role with one of these names would make every user inherit its roles
+var principalNames = []string{"USER", "$everyone", "$authenticated", "$owner"}
+
+// isReservedRoleName reports whether the name cannot be the name of a role, because it is a principal or an action
+func (app *WeStack) isReservedRoleName(name string) bool {
+	for _, principal := range principalNames {
+		if name == principal {
+			return true
+		}
+	}
+	return app.isActionName(name)
+}
+
+// isActionName reports whether the name is a casbin action of some model: a built-in action or a remote method
+func (app *WeStack) isActionName(name string) bool {
+	for _, action := range actionNames {
+		if name == action {
+			return true
+		}
+	}
+	for _, method := range roleManagementMethods {
+		if name == method {
+			return true
+		}
+	}
+	for _, loadedModel := range *app.modelRegistry {
+		if loadedModel.HasRemoteMethod(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// userRolesCache keeps the roles of the users, per tenant, for "roles.cacheTtl" seconds, so that they are not read on
+// every request. The changes through the role management routes are applied at once, and the other ones within the ttl
+type userRolesCache struct {
+	mutex   sync.Mutex
+	entries map[string]userRolesCacheEntry
+}
+
+type userRolesCacheEntry struct {
+	roleNames []string
+	// member is true when some of the roles were assigned in the tenant
+	member    bool
+	expiresAt time.Time
+}
+
+func newUserRolesCache() *userRolesCache {
+	return &userRolesCache{entries: map[string]userRolesCacheEntry{}}
+}
+
+// userRolesCacheKey is the key of the roles of a user in a tenant. The user id is a prefix, to forget all its tenants
+func userRolesCacheKey(userId string, tenant string) string {
+	return userId + "|" + tenant
+}
+
+func (cache *userRolesCache) get(userId string, tenant string) (userRolesCacheEntry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[userRolesCacheKey(userId, tenant)]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return userRolesCacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (cache *userRolesCache) set(userId string, tenant string, entry userRolesCacheEntry, ttl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if len(cache.entries) >= 1024 {
+		for key, entry := range cache.entries {
+			if now.After(entry.expiresAt) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	entry.expiresAt = now.Add(ttl)
+	cache.entries[userRolesCacheKey(userId, tenant)] = entry
+}
+
+// forget removes the roles of the user in all the tenants
+func (cache *userRolesCache) forget(userId string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	prefix := userRolesCacheKey(userId, "")
+	for key := range cache.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+func (cache *userRolesCache) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = map[string]userRolesCacheEntry{}
+}
+
+// rolesCacheTtl reads "roles.cacheTtl", in seconds. Zero disables the cache
+func (app *WeStack) rolesCacheTtl() time.Duration {
+	if !app.Viper.IsSet("roles.cacheTtl") {
+		return defaultRolesCacheTtl
+	}
+	return time.Duration(app.Viper.GetFloat64("roles.cacheTtl") * float64(time.Second))
+}
+
+// currentUserRoles returns the roles of the user of an access token in the tenant of the request, which replace the
+// ones of its claims
+func (app *WeStack) currentUserRoles(ctx context.Context, userId string, tenant string) ([]string, error) {
+	entry, err := app.cachedUserRoles(ctx, userId, tenant)
+	return entry.roleNames, err
+}
+
+// isTenantMember reports whether the user was assigned a role in the tenant, so that it can request the tenant
+func (app *WeStack) isTenantMember(ctx context.Context, userId string, tenant string) (bool, error) {
+	entry, err := app.cachedUserRoles(ctx, userId, tenant)
+	return entry.member, err
+}
+
+func (app *WeStack) cachedUserRoles(ctx context.Context, userId string, tenant string) (userRolesCacheEntry, error) {
+	if entry, ok := app.userRoles.get(userId, tenant); ok {
+		return entry, nil
+	}
+	var id interface{} = userId
+	if objectId, err := primitive.ObjectIDFromHex(userId); err == nil {
+		id = objectId
+	}
+	roleNames, member, err := app.findUserRoles(ctx, id, tenant)
+	if err != nil {
+		return userRolesCacheEntry{}, err
+	}
+	entry := userRolesCacheEntry{roleNames: roleNames, member: member}
+	if ttl := app.rolesCacheTtl(); ttl > 0 {
+		app.userRoles.set(userId, tenant, entry, ttl)
+	}
+	return entry, nil
+}
+
+// loadRoleHierarchy adds the inheritance of the stored roles to the enforcers, once they are created
+func (app *WeStack) loadRoleHierarchy() error {
+	roleModel := app.findRoleModel()
+	if roleModel == nil {
+		return nil
+	}
+	roles, err := roleModel.FindMany(nil, &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{System: true}}}).All()
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		data := role.ToJSON()
+		if app.isReservedRoleName(data.GetString("name")) {
+			roleModel.Logger().Warn("Ignoring the inheritance of a role with a reserved name", "role", data.GetString("name"))
+			continue
+		}
+		err = app.applyRoleInheritance(data.GetString("name"), instanceStrings(data["inherits"]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRoleInheritance replaces the roles that a role inherits in the enforcers of all the models, as casbin "g"
+// rules, so that its users get the permissions of the inherited roles too. The hierarchy is the same in all the tenants
+func (app *WeStack) applyRoleInheritance(roleName string, inherits []string) error {
+	model.AuthMutex.Lock()
+	defer model.AuthMutex.Unlock()
+	for _, loadedModel := range *app.modelRegistry {
+		if loadedModel.Enforcer == nil {
+			continue
+		}
+		domain := loadedModel.RoleDomain(model.AnyTenant)
+		_, err := loadedModel.Enforcer.DeleteRolesForUser(roleName, domain...)
+		if err != nil {
+			return err
+		}
+		for _, inherited := range inherits {
+			_, err = loadedModel.Enforcer.AddRoleForUser(roleName, inherited, domain...)
+			if err != nil {
+				return err
+			}
+		}
+		err = loadedModel.SavePolicy()
+		if err != nil {
+			return err
+		}
+		loadedModel.ClearAuthCache()
+	}
+	return nil
+}
+
+func (app *WeStack) findRoleModel() *model.Model {
+	roleModels := app.FindModelsWithClass("Role")
+	if len(roleModels) == 0 || app.roleMappingModel == nil {
+		return nil
+	}
+	return roleModels[0]
+}
+
+func rolesNotConfiguredError() error {
+	return wst.CreateError(fiber.ErrNotImplemented, "ROLES_NOT_CONFIGURED", fiber.Map{"message": "there is no Role model"}, "Error")
+}
+
+func reservedRoleNameError(roleName string) error {
+	return wst.CreateError(fiber.ErrBadRequest, "RESERVED_ROLE_NAME", fiber.Map{"message": fmt.Sprintf("%v is a reserved name", roleName), "codes": wst.M{"name": []string{"reserved"}}}, "ValidationError")
+}
+
+// checkGlobalRoleManagement only lets the requests without tenant change the role definitions, as the hierarchy is the
+// same in all the tenants. Otherwise the admins of a tenant could grant roles to the users of every other tenant
+func checkGlobalRoleManagement(ctx *model.EventContext) error {
+	if ctx.GetTenant() != "" {
+		return wst.CreateError(fiber.ErrForbidden, "TENANT_CANNOT_DEFINE_ROLES", fiber.Map{"message": "the roles can only be defined without a tenant"}, "Error")
+	}
+	return nil
+}
+
+func roleNotFoundError(roleName string) error {
+	return wst.CreateError(fiber.ErrNotFound, "ROLE_NOT_FOUND", fiber.Map{"message": fmt.Sprintf("role %v not found", roleName)}, "Error")
+}
+
+// roleJSON is the representation of a role in the responses of the role management routes
+func roleJSON(role *model.Instance) wst.M {
+	data := role.ToJSON()
+	return wst.M{
+		"id":       role.Id,
+		"name":     data.GetString("name"),
+		"inherits": instanceStrings(data["inherits"]),
+	}
+}
+
+// rolesByName returns all the roles, by name
+func rolesByName(roleModel *model.Model, ctx *model.EventContext) (map[string]*model.Instance, error) {
+	roles, err := roleModel.FindMany(nil, systemContextFrom(ctx)).All()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*model.Instance, len(roles))
+	for i := range roles {
+		result[roles[i].ToJSON().GetString("name")] = &roles[i]
+	}
+	return result, nil
+}
+
+// checkRoleInherits validates the roles inherited by roleName: they must exist and must not inherit roleName, directly
+// or through other roles
+func checkRoleInherits(roles map[string]*model.Instance, roleName string, inherits []string) error {
+	for _, inherited := range inherits {
+		if _, ok := roles[inherited]; !ok {
+			return wst.CreateError(fiber.ErrBadRequest, "ROLE_NOT_FOUND", fiber.Map{"message": fmt.Sprintf("inherited role %v not found", inherited), "codes": wst.M{"inherits": []string{"exists"}}}, "ValidationError")
+		}
+	}
+	visited := map[string]bool{}
+	pending := append([]string{}, inherits...)
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if current == roleName {
+			return wst.CreateError(fiber.ErrBadRequest, "ROLE_INHERITANCE_CYCLE", fiber.Map{"message": fmt.Sprintf("role %v cannot inherit itself", roleName), "codes": wst.M{"inherits": []string{"cycle"}}}, "ValidationError")
+		}
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		if role, ok := roles[current]; ok {
+			pending = append(pending, instanceStrings(role.ToJSON()["inherits"])...)
+		}
+	}
+	return nil
+}
+
+// listRolesFromRequest handles GET /users/roles
+func (app *WeStack) listRolesFromRequest(ctx *model.EventContext) error {
+	roleModel := app.findRoleModel()
+	if roleModel == nil {
+		return rolesNotConfiguredError()
+	}
+	roles, err := roleModel.FindMany(&wst.Filter{Order: &wst.Order{"name ASC"}}, systemContextFrom(ctx)).All()
+	if err != nil {
+		return err
+	}
+	result := make(wst.A, len(roles))
+	for i := range roles {
+		result[i] = roleJSON(&roles[i])
+	}
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = result
+	return nil
+}
+
+// createRoleFromRequest handles POST /users/roles with the "name" of the role and the "inherits" roles
+func (app *WeStack) createRoleFromRequest(ctx *model.EventContext) error {
+	roleModel := app.findRoleModel()
+	if roleModel == nil {
+		return rolesNotConfiguredError()
+	}
+	err := checkGlobalRoleManagement(ctx)
+	if err != nil {
+		return err
+	}
+	roleName := strings.TrimSpace(ctx.Data.GetString("name"))
+	if !roleNameRegexp.MatchString(roleName) {
+		return wst.CreateError(fiber.ErrBadRequest, "INVALID_ROLE_NAME", fiber.Map{"message": "the role name must be alphanumeric, and may contain _ . : -", "codes": wst.M{"name": []string{"format"}}}, "ValidationError")
+	}
+	if app.isReservedRoleName(roleName) {
+		return reservedRoleNameError(roleName)
+	}
+	roles, err := rolesByName(roleModel, ctx)
+	if err != nil {
+		return err
+	}
+	if roles[roleName] != nil {
+		return wst.CreateError(fiber.ErrConflict, "ROLE_EXISTS", fiber.Map{"message": fmt.Sprintf("role %v already exists", roleName), "codes": wst.M{"name": []string{"uniqueness"}}}, "ValidationError")
+	}
+	inherits := instanceStrings((*ctx.Data)["inherits"])
+	err = checkRoleInherits(roles, roleName, inherits)
+	if err != nil {
+		return err
+	}
+
+	role, err := roleModel.Create(wst.M{"name": roleName, "inherits": inherits}, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	err = app.applyRoleInheritance(roleName, inherits)
+	if err != nil {
+		return err
+	}
+	ctx.Logger().Info("Created role", "role", roleName, "inherits", inherits)
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = roleJSON(role)
+	return nil
+}
+
+// setRoleInheritsFromRequest handles PUT /users/roles/:role/inherits, which replaces the roles that the role inherits
+func (app *WeStack) setRoleInheritsFromRequest(ctx *model.EventContext) error {
+	roleModel := app.findRoleModel()
+	if roleModel == nil {
+		return rolesNotConfiguredError()
+	}
+	err := checkGlobalRoleManagement(ctx)
+	if err != nil {
+		return err
+	}
+	roleName := ctx.Ctx.Params("role")
+	roles, err := rolesByName(roleModel, ctx)
+	if err != nil {
+		return err
+	}
+	role := roles[roleName]
+	if role == nil {
+		return roleNotFoundError(roleName)
+	}
+	// the roles stored before their names were reserved can only be deleted
+	if app.isReservedRoleName(roleName) {
+		return reservedRoleNameError(roleName)
+	}
+	inherits := instanceStrings((*ctx.Data)["inherits"])
+	err = checkRoleInherits(roles, roleName, inherits)
+	if err != nil {
+		return err
+	}
+
+	role, err = role.UpdateAttributes(wst.M{"inherits": inherits}, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	err = app.applyRoleInheritance(roleName, inherits)
+	if err != nil {
+		return err
+	}
+	ctx.Logger().Info("Changed role inheritance", "role", roleName, "inherits", inherits)
+	ctx.StatusCode = fiber.StatusOK
+	ctx.Result = roleJSON(role)
+	return nil
+}
+
+// deleteRoleFromRequest handles DELETE /users/roles/:role, which also removes the role from its users and from the
+// roles that inherit it
+func (app *WeStack) deleteRoleFromRequest(ctx *model.EventContext) error {
+	roleModel := app.findRoleModel()
+	if roleModel == nil {
+		return rolesNotConfiguredError()
+	}
+	err := checkGlobalRoleManagement(ctx)
+	if err != nil {
+		return err
+	}
+	roleName := ctx.Ctx.Params("role")
+	roles, err := rolesByName(roleModel, ctx)
+	if err != nil {
+		return err
+	}
+	role := roles[roleName]
+	if role == nil {
+		return roleNotFoundError(roleName)
+	}
+
+	systemContext := systemContextFrom(ctx)
+	for otherName, other := range roles {
+		inherits := instanceStrings(other.ToJSON()["inherits"])
+		remaining := make([]string, 0, len(inherits))
+		for _, inherited := range inherits {
+			if inherited != roleName {
+				remaining = append(remaining, inherited)
+			}
+		}
+		if len(remaining) == len(inherits) || otherName == roleName {
+			continue
+		}
+		_, err = other.UpdateAttributes(wst.M{"inherits": remaining}, systemContext)
+		if err != nil {
+			return err
+		}
+		err = app.applyRoleInheritance(otherName, remaining)
+		if err != nil {
+			return err
+		}
+	}
+	// the role mappings of all the tenants, as the caller has no tenant
+	_, err = app.roleMappingModel.DeleteMany(&wst.Where{"roleId": role.Id}, systemContext)
+	if err != nil {
+		return err
+	}
+	_, err = roleModel.DeleteById(role.Id, systemContext)
+	if err != nil {
+		return err
+	}
+	// the links of an action are not the ones of the role
+	if !app.isActionName(roleName) {
+		err = app.applyRoleInheritance(roleName, nil)
+		if err != nil {
+			return err
+		}
+	}
+	app.userRoles.clear()
+	ctx.Logger().Info("Deleted role", "role", roleName)
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// assignRoleFromRequest handles PUT /users/roles/:role/users/:userId
+func (app *WeStack) assignRoleFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	role, user, err := app.roleAndUserFromRequest(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	tenant, err := roleMappingTenant(ctx)
+	if err != nil {
+		return err
+	}
+	systemContext := systemContextFrom(ctx)
+	roleMapping, err := app.roleMappingModel.FindOne(&wst.Filter{Where: &wst.Where{
+		"principalType":        "USER",
+		"principalId":          user.Id,
+		"roleId":               role.Id,
+		roleMappingTenantField: tenant,
+	}}, systemContext)
+	if err != nil {
+		return err
+	}
+	if roleMapping == nil {
+		data := wst.M{
+			"principalType": "USER",
+			"principalId":   user.Id,
+			"roleId":        role.Id,
+		}
+		if tenant != nil {
+			data[roleMappingTenantField] = tenant
+		}
+		_, err = app.roleMappingModel.Create(data, systemContext)
+		if err != nil {
+			return err
+		}
+		ctx.Logger().Info("Assigned role to user", "role", role.ToJSON().GetString("name"), "userId", user.Id, "tenant", tenant)
+	}
+	app.userRoles.forget(model.GetIDAsString(user.Id))
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// unassignRoleFromRequest handles DELETE /users/roles/:role/users/:userId
+func (app *WeStack) unassignRoleFromRequest(loadedModel *model.Model, ctx *model.EventContext) error {
+	role, user, err := app.roleAndUserFromRequest(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	tenant, err := roleMappingTenant(ctx)
+	if err != nil {
+		return err
+	}
+	userId := model.GetIDAsString(user.Id)
+	_, err = app.roleMappingModel.DeleteMany(&wst.Where{
+		"principalType":        "USER",
+		"$or":                  []wst.M{{"principalId": user.Id}, {"principalId": userId}},
+		"roleId":               role.Id,
+		roleMappingTenantField: tenant,
+	}, systemContextFrom(ctx))
+	if err != nil {
+		return err
+	}
+	app.userRoles.forget(userId)
+	ctx.Logger().Info("Unassigned role from user", "role", role.ToJSON().GetString("name"), "userId", user.Id)
+	ctx.StatusCode = fiber.StatusNoContent
+	return nil
+}
+
+// roleMappingTenant returns the tenant of the role mapping of a request, from the "tenant" query param or else the
+// tenant of the request, or nil for the role mappings of all the tenants. The members of a tenant, who request it,
+// cannot assign roles in other tenants
+func roleMappingTenant(ctx *model.EventContext) (interface{}, error) {
+	tenant := ctx.Ctx.Query("tenant")
+	requestTenant := ctx.GetTenant()
+	if tenant == "" {
+		tenant = requestTenant
+	}
+	if tenant == "" {
+		return nil, nil
+	}
+	if requestTenant != "" && tenant != requestTenant {
+		return nil, wst.CreateError(fiber.ErrForbidden, "TENANT_MISMATCH", fiber.Map{"message": "the tenant does not match the tenant of the request"}, "Error")
+	}
+	err := model.ValidateTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (app *WeStack) roleAndUserFromRequest(loadedModel *model.Model, ctx *model.EventContext) (*model.Instance, *model.Instance, error) {
+	roleModel := app.findRoleModel()
+	if roleModel == nil {
+		return nil, nil, rolesNotConfiguredError()
+	}
+	roleName := ctx.Ctx.Params("role")
+	systemContext := systemContextFrom(ctx)
+	role, err := roleModel.FindOne(&wst.Filter{Where: &wst.Where{"name": roleName}}, systemContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if role == nil {
+		return nil, nil, roleNotFoundError(roleName)
+	}
+	userId, err := primitive.ObjectIDFromHex(ctx.Ctx.Params("userId"))
+	if err != nil {
+		return nil, nil, wst.CreateError(fiber.ErrNotFound, "USER_NOT_FOUND", fiber.Map{"message": "user not found"}, "Error")
+	}
+	user, err := loadedModel.FindById(userId, nil, systemContext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, wst.CreateError(fiber.ErrNotFound, "USER_NOT_FOUND", fiber.Map{"message": "user not found"}, "Error")
+	}
+	return role, user, nil
+}
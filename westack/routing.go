@@ -3,17 +3,16 @@ package westack
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/logging"
 	"github.com/fredyk/westack-go/westack/model"
 )
 
@@ -21,13 +20,11 @@ func (app *WeStack) loadNotFoundRoutes() {
 	for _, entry := range *app.modelRegistry {
 		loadedModel := entry
 		if !loadedModel.Config.Public {
-			if app.debug {
-				log.Println("WARNING: Model", loadedModel.Name, "is not public")
-			}
+			loadedModel.Logger().Debug("Model is not public")
 			continue
 		}
 		(*loadedModel.Router).Use(func(ctx *fiber.Ctx) error {
-			log.Println("WARNING: Unresolved method in " + loadedModel.Name + ": " + ctx.Method() + " " + ctx.Path())
+			loadedModel.Logger().Warn("Unresolved method", "requestId", model.RequestID(ctx), "verb", ctx.Method(), "path", ctx.Path())
 			return ctx.Status(404).JSON(fiber.Map{"error": fiber.Map{"status": 404, "message": fmt.Sprintf("Shared class %#v has no method handling %v %v", loadedModel.Name, ctx.Method(), ctx.Path())}})
 		})
 	}
@@ -37,7 +34,7 @@ func (app *WeStack) loadModelsFixedRoutes() {
 	for _, entry := range *app.modelRegistry {
 		loadedModel := entry
 
-		e, err := casbin.NewEnforcer(*loadedModel.CasbinModel, *loadedModel.CasbinAdapter, app.debug)
+		e, err := casbin.NewEnforcer(*loadedModel.CasbinModel, loadedModel.CasbinAdapter, loadedModel.Logger().Enabled(logging.LevelDebug))
 		if err != nil {
 			panic(err)
 		}
@@ -45,15 +42,17 @@ func (app *WeStack) loadModelsFixedRoutes() {
 		loadedModel.Enforcer = e
 
 		e.EnableAutoSave(true)
+		if loadedModel.IsMultiTenant() {
+			// the role links of the "*" domain, like the actions and the role hierarchy, apply to all the tenants
+			e.AddNamedDomainMatchingFunc("g", "keyMatch", util.KeyMatch)
+		}
 		e.AddFunction("isOwner", func(arguments ...interface{}) (interface{}, error) {
 
 			subId := arguments[0]
 			objId := arguments[1]
 			policyObj := arguments[2]
 
-			if loadedModel.App.Debug {
-				log.Println(fmt.Sprintf("isOwner() of %v ?", policyObj))
-			}
+			loadedModel.Logger().Debug("isOwner()", "policyObject", policyObj)
 
 			switch objId.(type) {
 			case primitive.ObjectID:
@@ -88,7 +87,8 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			}
 
 			roleKey := fmt.Sprintf("%v_OWNERS", objId)
-			usersForRole, err := loadedModel.Enforcer.GetUsersForRole(roleKey)
+			// the owners are the same in all the tenants
+			usersForRole, err := loadedModel.Enforcer.GetUsersForRole(roleKey, loadedModel.RoleDomain(model.AnyTenant)...)
 			if err != nil {
 				return false, err
 			}
@@ -97,7 +97,7 @@ func (app *WeStack) loadModelsFixedRoutes() {
 				objUserId := ""
 				if loadedModel.Config.Base == "User" {
 					objUserId = model.GetIDAsString(objId)
-					_, err := loadedModel.Enforcer.AddRoleForUser(objUserId, roleKey)
+					_, err := loadedModel.Enforcer.AddRoleForUser(objUserId, roleKey, loadedModel.RoleDomain(model.AnyTenant)...)
 					if err != nil {
 						return nil, err
 					}
@@ -123,11 +123,11 @@ func (app *WeStack) loadModelsFixedRoutes() {
 							if user != nil {
 								objUserId = model.GetIDAsString(user.Id)
 
-								_, err := loadedModel.Enforcer.AddRoleForUser(objUserId, roleKey)
+								_, err := loadedModel.Enforcer.AddRoleForUser(objUserId, roleKey, loadedModel.RoleDomain(model.AnyTenant)...)
 								if err != nil {
 									return nil, err
 								}
-								err = loadedModel.Enforcer.SavePolicy()
+								err = loadedModel.SavePolicy()
 								if err != nil {
 									return nil, err
 								}
@@ -156,42 +156,53 @@ func (app *WeStack) loadModelsFixedRoutes() {
 
 		})
 
-		_, err = e.AddRoleForUser("findMany", replaceVarNames("read"))
+		// the actions are the same in all the tenants
+		actionDomain := loadedModel.RoleDomain(model.AnyTenant)
+		_, err = e.AddRoleForUser("findMany", replaceVarNames("read"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
-		_, err = e.AddRoleForUser("findById", replaceVarNames("read"))
+		_, err = e.AddRoleForUser("findById", replaceVarNames("read"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
-		_, err = e.AddRoleForUser("count", replaceVarNames("read"))
+		_, err = e.AddRoleForUser("count", replaceVarNames("read"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
 
-		_, err = e.AddRoleForUser("create", replaceVarNames("write"))
+		_, err = e.AddRoleForUser("create", replaceVarNames("write"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
-		_, err = e.AddRoleForUser("instance_updateAttributes", replaceVarNames("write"))
+		_, err = e.AddRoleForUser("instance_updateAttributes", replaceVarNames("write"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
-		_, err = e.AddRoleForUser("instance_delete", replaceVarNames("write"))
+		_, err = e.AddRoleForUser("instance_delete", replaceVarNames("write"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
 
-		_, err = e.AddRoleForUser("read", replaceVarNames("*"))
+		if loadedModel.Config.Base == "User" {
+			for _, method := range roleManagementMethods {
+				_, err = e.AddRoleForUser(method, manageRolesAction, actionDomain...)
+				if err != nil {
+					panic(err)
+				}
+			}
+		}
+
+		_, err = e.AddRoleForUser("read", replaceVarNames("*"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
-		_, err = e.AddRoleForUser("write", replaceVarNames("*"))
+		_, err = e.AddRoleForUser("write", replaceVarNames("*"), actionDomain...)
 		if err != nil {
 			panic(err)
 		}
 
-		err = e.SavePolicy()
+		err = loadedModel.SavePolicy()
 		if err != nil {
 			panic(err)
 		}
@@ -201,7 +212,9 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			panic(err)
 		}
 
-		if app.debug {
+		app.watchPolicies(loadedModel)
+
+		if loadedModel.Logger().Enabled(logging.LevelDebug) {
 			loadedModel.CasbinModel.PrintModel()
 		}
 
@@ -214,15 +227,11 @@ func (app *WeStack) loadModelsFixedRoutes() {
 		}
 
 		if !loadedModel.Config.Public {
-			if app.debug {
-				log.Println("WARNING: Model", loadedModel.Name, "is not public")
-			}
+			loadedModel.Logger().Debug("Model is not public")
 			continue
 		}
 
-		if app.debug {
-			log.Println("Mount GET " + loadedModel.BaseUrl)
-		}
+		loadedModel.Logger().Debug("Mount route", "verb", "GET", "path", loadedModel.BaseUrl)
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 			return handleEvent(eventContext, loadedModel, "findMany")
 		}, model.RemoteMethodOptions{
@@ -244,9 +253,7 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 		})
 
-		if app.debug {
-			log.Println("Mount GET " + loadedModel.BaseUrl + "/count")
-		}
+		loadedModel.Logger().Debug("Mount route", "verb", "GET", "path", loadedModel.BaseUrl+"/count")
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 			return handleEvent(eventContext, loadedModel, "count")
 		}, model.RemoteMethodOptions{
@@ -268,9 +275,7 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 		})
 
-		if app.debug {
-			log.Println("Mount POST " + loadedModel.BaseUrl)
-		}
+		loadedModel.Logger().Debug("Mount route", "verb", "POST", "path", loadedModel.BaseUrl)
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 			//var data *wst.M
 			//err := json.Unmarshal(eventContext.Ctx.Body(), &data)
@@ -296,6 +301,43 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 		})
 
+		if loadedModel.Config.Base == "ApiKey" {
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "issue")
+			}, model.RemoteMethodOptions{
+				Name:        "issue",
+				Description: "Issues an API key for the bearer, with some of their roles as scopes",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    false,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/issue",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "revoke")
+			}, model.RemoteMethodOptions{
+				Name:        "revoke",
+				Description: "Revokes an API key",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/:id/revoke",
+					Verb: "post",
+				},
+			},
+			)
+
+		}
+
 		if loadedModel.Config.Base == "User" {
 
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
@@ -319,6 +361,48 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 			)
 
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "refresh")
+			}, model.RemoteMethodOptions{
+				Name:        "refresh",
+				Description: "Exchanges a refresh token for new access and refresh tokens",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/refresh",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "logout")
+			}, model.RemoteMethodOptions{
+				Name:        "logout",
+				Description: "Revokes the bearer token, and the refresh token in the body if any",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    false,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/logout",
+					Verb: "post",
+				},
+			},
+			)
+
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 
 				err, token := eventContext.GetBearer(loadedModel)
@@ -349,14 +433,13 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 			)
 
-			if app.debug {
-				log.Println("Mount POST " + loadedModel.BaseUrl + "/reset-password")
-			}
+			loadedModel.Logger().Debug("Mount route", "verb", "POST", "path", loadedModel.BaseUrl+"/reset-password")
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
-				// Developer must implement this event
-				return handleEvent(eventContext, loadedModel, "sendResetPasswordEmail")
+				// The token is sent by the "sendResetPasswordEmail" handler, which the developer must implement
+				return handleEvent(eventContext, loadedModel, "resetPassword")
 			}, model.RemoteMethodOptions{
-				Name: "resetPassword",
+				Name:        "resetPassword",
+				Description: "Issues a password reset token for the user with the email",
 				Accepts: model.RemoteMethodOptionsHttpArgs{
 					{
 						Arg:         "data",
@@ -372,20 +455,99 @@ func (app *WeStack) loadModelsFixedRoutes() {
 				},
 			})
 
+			loadedModel.Logger().Debug("Mount route", "verb", "POST", "path", loadedModel.BaseUrl+"/reset-password/confirm")
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "confirmResetPassword")
+			}, model.RemoteMethodOptions{
+				Name:        "confirmResetPassword",
+				Description: "Sets a new password with a password reset token",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/reset-password/confirm",
+					Verb: "post",
+				},
+			})
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "changePassword")
+			}, model.RemoteMethodOptions{
+				Name:        "changePassword",
+				Description: "Changes the password of the bearer, given the old one",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/change-password",
+					Verb: "post",
+				},
+			})
+
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
-				fmt.Println("verify user ", eventContext.Bearer.User.Id)
-				eventContext.Bearer.Claims["created"] = time.Now().Unix()
-				eventContext.Bearer.Claims["ttl"] = 86400 * 2 * 1000
-				eventContext.Bearer.Claims["allowsEmailVerification"] = true
+				return handleEvent(eventContext, loadedModel, "setupMfa")
+			}, model.RemoteMethodOptions{
+				Name:        "setupMfa",
+				Description: "Generates a TOTP secret for the bearer, enabled once a code is verified with it",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    false,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/2fa/setup",
+					Verb: "post",
+				},
+			})
 
-				token := jwt.NewWithClaims(jwt.SigningMethodHS256, eventContext.Bearer.Claims)
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, model.MfaVerifyMethod)
+			}, model.RemoteMethodOptions{
+				Name:        model.MfaVerifyMethod,
+				Description: "Enables two-factor authentication, or exchanges a login challenge token and a code for the tokens",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/2fa/verify",
+					Verb: "post",
+				},
+			})
 
-				tokenString, err := token.SignedString(loadedModel.App.JwtSecretKey)
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				eventContext.Logger().Debug("Verify user", "userId", eventContext.Bearer.User.Id)
+				tokenString, err := app.emailVerificationToken(eventContext)
 				if err != nil {
 					return err
 				}
+				// the handlers send the link with this token, which only verifies the email
 				eventContext.Bearer.Raw = tokenString
 
+				if !loadedModel.HasHandler("sendVerificationEmail") && app.mailer != nil {
+					return app.sendVerificationMail(loadedModel, eventContext)
+				}
 				return handleEvent(eventContext, loadedModel, "sendVerificationEmail")
 			}, model.RemoteMethodOptions{
 				Name: "sendVerificationEmail",
@@ -410,7 +572,7 @@ func (app *WeStack) loadModelsFixedRoutes() {
 				if userId == "" {
 					return errors.New("no user id found in bearer")
 				}
-				if eventContext.Bearer.Claims["allowsEmailVerification"] == true {
+				if eventContext.Bearer.Claims["typ"] == model.EmailVerificationTokenType {
 					user, err := loadedModel.FindById(userId, nil, eventContext)
 					if err != nil {
 						return err
@@ -422,16 +584,19 @@ func (app *WeStack) loadModelsFixedRoutes() {
 					if err != nil {
 						return err
 					}
-					if app.debug {
-						log.Println("Updated user ", updated)
+					// the links are single use
+					err = app.tokenDenylist.Revoke(eventContext.GetContext(), model.TokenID(eventContext.Bearer.Claims), model.TokenExpiresAt(eventContext.Bearer.Claims))
+					if err != nil && err != model.ErrTokenRevoked {
+						return err
 					}
+					eventContext.Logger().Debug("Verified user email", "userId", updated.Id)
 					redirectToUrl := eventContext.Ctx.Query("redirect_uri")
 					return eventContext.Ctx.Redirect(redirectToUrl)
 				}
 
-				return handleEvent(eventContext, loadedModel, "performEmailVerification")
+				return handleEvent(eventContext, loadedModel, model.EmailVerificationMethod)
 			}, model.RemoteMethodOptions{
-				Name: "performEmailVerification",
+				Name: model.EmailVerificationMethod,
 				Accepts: model.RemoteMethodOptionsHttpArgs{
 					{
 						Arg:         "access_token",
@@ -447,6 +612,90 @@ func (app *WeStack) loadModelsFixedRoutes() {
 				},
 			})
 
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "listRoles")
+			}, model.RemoteMethodOptions{
+				Name:        "listRoles",
+				Description: "Lists the roles and the roles that they inherit",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/roles",
+					Verb: "get",
+				},
+			})
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "createRole")
+			}, model.RemoteMethodOptions{
+				Name:        "createRole",
+				Description: "Creates a role, which may inherit the permissions of other roles",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/roles",
+					Verb: "post",
+				},
+			})
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "setRoleInherits")
+			}, model.RemoteMethodOptions{
+				Name:        "setRoleInherits",
+				Description: "Replaces the roles inherited by a role",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/roles/:role/inherits",
+					Verb: "put",
+				},
+			})
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "deleteRole")
+			}, model.RemoteMethodOptions{
+				Name:        "deleteRole",
+				Description: "Deletes a role and removes it from its users",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/roles/:role",
+					Verb: "delete",
+				},
+			})
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "assignRole")
+			}, model.RemoteMethodOptions{
+				Name:        "assignRole",
+				Description: "Assigns a role to a user",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/roles/:role/users/:userId",
+					Verb: "put",
+				},
+			})
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "unassignRole")
+			}, model.RemoteMethodOptions{
+				Name:        "unassignRole",
+				Description: "Removes a role from a user",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/roles/:role/users/:userId",
+					Verb: "delete",
+				},
+			})
+
 		}
 	}
 }
@@ -455,15 +704,11 @@ func (app *WeStack) loadModelsDynamicRoutes() {
 	for _, entry := range *app.modelRegistry {
 		loadedModel := entry
 		if !loadedModel.Config.Public {
-			if app.debug {
-				log.Println("WARNING: Model", loadedModel.Name, "is not public")
-			}
+			loadedModel.Logger().Debug("Model is not public")
 			continue
 		}
 
-		if app.debug {
-			log.Println("Mount GET " + loadedModel.BaseUrl + "/:id")
-		}
+		loadedModel.Logger().Debug("Mount route", "verb", "GET", "path", loadedModel.BaseUrl+"/:id")
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 
 			id := eventContext.Ctx.Params("id")
@@ -492,9 +737,7 @@ func (app *WeStack) loadModelsDynamicRoutes() {
 			},
 		})
 
-		if app.debug {
-			log.Println("Mount PATCH " + loadedModel.BaseUrl + "/:id")
-		}
+		loadedModel.Logger().Debug("Mount route", "verb", "PATCH", "path", loadedModel.BaseUrl+"/:id")
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 			id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
 			if err != nil {
@@ -525,9 +768,7 @@ func (app *WeStack) loadModelsDynamicRoutes() {
 			},
 		})
 
-		if app.debug {
-			log.Println("Mount DELETE " + loadedModel.BaseUrl + "/:id")
-		}
+		loadedModel.Logger().Debug("Mount route", "verb", "DELETE", "path", loadedModel.BaseUrl+"/:id")
 		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 			id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
 			if err != nil {
@@ -9,6 +9,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
 )
 
 func swaggerDocsHandler(app *WeStack) func(ctx *fiber.Ctx) error {
@@ -23,7 +24,7 @@ func swaggerDocsHandler(app *WeStack) func(ctx *fiber.Ctx) error {
 		} else {
 			remoteForwardedForIp = ctx.IP()
 		}
-		fmt.Printf("Request /swagger/doc.json from %s (forwarded = %t)\n", remoteForwardedForIp, forwarded)
+		app.logger.Debug("Request /swagger/doc.json", "requestId", model.RequestID(ctx), "remoteIp", remoteForwardedForIp, "forwarded", forwarded)
 
 		hostname := ctx.Hostname()
 
@@ -0,0 +1,144 @@
+package westack
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/memorykv"
+	"github.com/fredyk/westack-go/westack/metrics"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+// readMetricsAction is the casbin action of the User models that allows reading the metrics, allowed to the "admin"
+// role by default
+const readMetricsAction = "readMetrics"
+
+// metricsScope is the scope of the API keys that only read the metrics. Any user allowed the readMetricsAction can
+// issue them, so that the scraper does not hold the roles of an admin
+const metricsScope = "metrics"
+
+// registerAppMetrics registers the metrics that are read from the app state on every scrape. They go to a registry of
+// the app, so that every app of the process reports its own datasources
+func registerAppMetrics(app *WeStack) {
+	registry := metrics.NewRegistry()
+	app.metricsRegistry = registry
+
+	registry.NewGaugeFunc("westack_datasource_up", "Whether the circuit breaker of the datasource is closed", []string{"datasource"}, func(emit func(value float64, labelValues ...string)) {
+		for dsName, ds := range *app.datasources {
+			up := 0.0
+			if ds.CircuitState() == datasource.CircuitClosed {
+				up = 1
+			}
+			emit(up, dsName)
+		}
+	})
+
+	eachMemoryKvBucket := func(callback func(dsName string, bucketName string, stats memorykv.MemoryKvStats)) {
+		for dsName, ds := range *app.datasources {
+			kvDb, ok := ds.Db.(memorykv.MemoryKvDb)
+			if !ok {
+				continue
+			}
+			for bucketName, stats := range kvDb.Stats() {
+				callback(dsName, bucketName, stats)
+			}
+		}
+	}
+	labels := []string{"datasource", "bucket"}
+	registry.NewGaugeFunc("westack_memorykv_entries", "Keys stored in the memorykv bucket", labels, func(emit func(value float64, labelValues ...string)) {
+		eachMemoryKvBucket(func(dsName string, bucketName string, stats memorykv.MemoryKvStats) {
+			emit(float64(stats.Entries), dsName, bucketName)
+		})
+	})
+	registry.NewGaugeFunc("westack_memorykv_size_bytes", "Size of the values stored in the memorykv bucket", labels, func(emit func(value float64, labelValues ...string)) {
+		eachMemoryKvBucket(func(dsName string, bucketName string, stats memorykv.MemoryKvStats) {
+			emit(float64(stats.TotalSize), dsName, bucketName)
+		})
+	})
+	registry.NewGaugeFunc("westack_memorykv_expiration_queue_size", "Keys waiting to expire in the memorykv bucket", labels, func(emit func(value float64, labelValues ...string)) {
+		eachMemoryKvBucket(func(dsName string, bucketName string, stats memorykv.MemoryKvStats) {
+			emit(float64(stats.ExpirationQueueSize), dsName, bucketName)
+		})
+	})
+	registry.NewCounterFunc("westack_memorykv_hits_total", "Reads of the memorykv bucket that found the key", labels, func(emit func(value float64, labelValues ...string)) {
+		eachMemoryKvBucket(func(dsName string, bucketName string, stats memorykv.MemoryKvStats) {
+			emit(float64(stats.Hits), dsName, bucketName)
+		})
+	})
+	registry.NewCounterFunc("westack_memorykv_misses_total", "Reads of the memorykv bucket that did not find the key", labels, func(emit func(value float64, labelValues ...string)) {
+		eachMemoryKvBucket(func(dsName string, bucketName string, stats memorykv.MemoryKvStats) {
+			emit(float64(stats.Misses), dsName, bucketName)
+		})
+	})
+}
+
+// metricsHandler writes the metrics of the app and the ones of metrics.DefaultRegistry, which are shared by the whole
+// process. The request must carry the "metrics.token" of config.json as bearer, or its bearer must be allowed the
+// readMetricsAction of the User model, like the API keys with the metricsScope
+func metricsHandler(app *WeStack, userModel *model.Model) func(ctx *fiber.Ctx) error {
+	scrapeToken := app.Viper.GetString("metrics.token")
+	return func(ctx *fiber.Ctx) error {
+		if scrapeToken != "" && isScrapeToken(ctx, scrapeToken) {
+			return writeMetrics(app, ctx)
+		}
+		eventContext := &model.EventContext{
+			Ctx:       ctx,
+			Context:   ctx.UserContext(),
+			RequestID: model.RequestID(ctx),
+		}
+		err, token := eventContext.GetBearer(userModel)
+		if err != nil {
+			return userModel.SendError(ctx, err)
+		}
+		err, allowed := userModel.EnforceEx(token, "*", readMetricsAction, eventContext)
+		if err != nil {
+			return userModel.SendError(ctx, err)
+		}
+		if !allowed {
+			return fiber.ErrUnauthorized
+		}
+		return writeMetrics(app, ctx)
+	}
+}
+
+// writeMetrics sends the metrics in the Prometheus text format
+func writeMetrics(app *WeStack, ctx *fiber.Ctx) error {
+	var buffer bytes.Buffer
+	err := app.metricsRegistry.WriteText(&buffer)
+	if err != nil {
+		return err
+	}
+	err = metrics.DefaultRegistry.WriteText(&buffer)
+	if err != nil {
+		return err
+	}
+	ctx.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return ctx.Send(buffer.Bytes())
+}
+
+// isScrapeToken reports whether the bearer of the request is the scrape token, compared in constant time
+func isScrapeToken(ctx *fiber.Ctx, scrapeToken string) bool {
+	authorization := ctx.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(scrapeToken)) == 1
+}
+
+// loadMetricsRoutes mounts GET /system/metrics when "metrics.enabled" is true in config.json
+func (app *WeStack) loadMetricsRoutes() {
+	if !app.Viper.GetBool("metrics.enabled") {
+		return
+	}
+	userModels := app.FindModelsWithClass("User")
+	if len(userModels) == 0 {
+		app.logger.Error("Could not load the metrics routes", "error", "user model not found")
+		return
+	}
+	registerAppMetrics(app)
+	app.Server.Get("/system/metrics", metricsHandler(app, userModels[0]))
+}
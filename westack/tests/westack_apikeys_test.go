@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+func Test_ApiKeys(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	tokens, err := loginUser(user["email"].(string), "abcd1234.", t)
+	assert.NoError(t, err)
+	bearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	var issued wst.M
+	status := requestJson(t, "POST", "/api/v1/api-keys/issue", wst.M{"name": "ci", "scopes": []string{"USER"}, "ttl": 3600}, bearer, &issued).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	key := issued.GetString("key")
+	assert.True(t, strings.HasPrefix(key, "wsk_"))
+	assert.Nil(t, issued["keyHash"])
+	assert.Equal(t, user["id"], issued["userId"])
+	apiKey := map[string]string{"X-API-Key": key}
+
+	// the scopes must be roles of the user
+	var result wst.M
+	status = requestJson(t, "POST", "/api/v1/api-keys/issue", wst.M{"scopes": []string{"admin"}}, bearer, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "SCOPE_NOT_ALLOWED", result.GetM("error").GetString("code"))
+
+	// the keys are authenticated
+	status = requestJson(t, "POST", "/api/v1/notes", wst.M{"title": "From an API key"}, apiKey, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	status = requestJson(t, "POST", "/api/v1/notes", wst.M{"title": "From an invalid API key"}, map[string]string{"X-API-Key": key + "x"}, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// but they cannot issue other keys, nor be written through the REST API
+	status = requestJson(t, "POST", "/api/v1/api-keys/issue", wst.M{}, apiKey, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "API_KEY_ISSUER_NOT_ALLOWED", result.GetM("error").GetString("code"))
+	status = requestJson(t, "POST", "/api/v1/api-keys", wst.M{"keyHash": "forged", "userId": user["id"], "scopes": []string{"admin"}}, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	var read wst.M
+	status = requestJson(t, "GET", "/api/v1/api-keys/"+issued.GetString("id"), nil, bearer, &read).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, read["keyHash"])
+	assert.NotNil(t, read["lastUsedAt"])
+
+	status = requestJson(t, "POST", "/api/v1/api-keys/"+issued.GetString("id")+"/revoke", wst.M{}, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	status = requestJson(t, "POST", "/api/v1/notes", wst.M{"title": "From a revoked API key"}, apiKey, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+}
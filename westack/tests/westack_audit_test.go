@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/fredyk/westack-go/westack"
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+func Test_AuditLog(t *testing.T) {
+
+	t.Parallel()
+
+	randN := createRandomInt()
+	_, err := westack.UpsertUserWithRoles(app, westack.UserWithRoles{
+		Username: fmt.Sprintf("auditor-%v", randN),
+		Password: "abcd1234.",
+		Roles:    []string{"admin"},
+	}, systemContext)
+	assert.NoError(t, err)
+	var tokens wst.M
+	status := requestJson(t, "POST", "/api/v1/users/login", wst.M{"username": fmt.Sprintf("auditor-%v", randN), "password": "abcd1234."}, nil, &tokens).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	admin := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	user := createUserThroughNetwork(t)
+	tokens, err = loginUser(user.GetString("email"), "abcd1234.", t)
+	assert.NoError(t, err)
+	bearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	var invoice wst.M
+	status = requestJson(t, "POST", "/api/v1/invoices", wst.M{"amount": 10, "internalNotes": "first"}, bearer, &invoice).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	invoiceId := invoice.GetString("id")
+	status = requestJson(t, "PATCH", "/api/v1/invoices/"+invoiceId, wst.M{"amount": 20, "internalNotes": "second"}, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	status = requestJson(t, "DELETE", "/api/v1/invoices/"+invoiceId, nil, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// only the admins read the audit log
+	status = requestJson(t, "GET", "/system/audit?model=Invoice&id="+invoiceId, nil, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status = requestJson(t, "GET", "/system/audit?model=Invoice&id="+invoiceId+"&limit=0", nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	var entries []wst.M
+	status = requestJson(t, "GET", "/system/audit?model=Invoice&id="+invoiceId, nil, admin, &entries).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, entries, 3)
+	byOperation := map[string]wst.M{}
+	for _, entry := range entries {
+		assert.Equal(t, "Invoice", entry.GetString("model"))
+		assert.Equal(t, invoiceId, entry.GetString("modelId"))
+		assert.Equal(t, user.GetString("id"), entry.GetString("userId"))
+		assert.NotEmpty(t, entry.GetString("requestId"))
+		assert.NotEmpty(t, entry.GetString("at"))
+		assert.Equal(t, "committed", entry.GetString("status"))
+		byOperation[entry.GetString("operation")] = entry
+	}
+
+	created := byOperation["create"].GetM("changes")
+	assert.EqualValues(t, 10, created.GetM("amount")["after"])
+	assert.Nil(t, created.GetM("amount")["before"])
+
+	// the values of the hidden properties are not recorded
+	updated := byOperation["update"].GetM("changes")
+	assert.EqualValues(t, 10, updated.GetM("amount")["before"])
+	assert.EqualValues(t, 20, updated.GetM("amount")["after"])
+	assert.Equal(t, true, updated.GetM("internalNotes")["hidden"])
+	assert.Nil(t, updated.GetM("internalNotes")["after"])
+
+	deleted := byOperation["delete"].GetM("changes")
+	assert.EqualValues(t, 20, deleted.GetM("amount")["before"])
+	assert.Nil(t, deleted.GetM("amount")["after"])
+
+	// the entries are recorded before the operations, and the ones that fail are marked as failed
+	status = requestJson(t, "POST", "/api/v1/invoices", wst.M{"amount": 30}, bearer, &invoice).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	invoiceModel, err := app.FindModel("Invoice")
+	assert.NoError(t, err)
+	invoiceObjectId, err := primitive.ObjectIDFromHex(invoice.GetString("id"))
+	assert.NoError(t, err)
+	_, err = invoiceModel.Create(wst.M{"_id": invoiceObjectId, "amount": 40}, systemContext)
+	assert.Error(t, err)
+	status = requestJson(t, "GET", "/system/audit?model=Invoice&id="+invoice.GetString("id"), nil, admin, &entries).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	statuses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		statuses = append(statuses, entry.GetString("status"))
+	}
+	assert.ElementsMatch(t, []string{"committed", "failed"}, statuses)
+
+}
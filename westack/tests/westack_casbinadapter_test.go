@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	casbinmodel "github.com/casbin/casbin/v2/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fredyk/westack-go/westack/casbinadapter"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+const casbinAdapterTestModel = `
+[request_definition]
+r = sub, obj, act
+[policy_definition]
+p = sub, obj, act
+[role_definition]
+g = _, _
+[policy_effect]
+e = some(where (p.eft == allow))
+[matchers]
+m = g(r.sub, p.sub) && r.obj == p.obj && r.act == p.act
+`
+
+func newCasbinAdapterEnforcer(t *testing.T, ds *datasource.Datasource, modelName string) *casbin.Enforcer {
+	m, err := casbinmodel.NewModelFromString(casbinAdapterTestModel)
+	assert.NoError(t, err)
+	e, err := casbin.NewEnforcer(m, casbinadapter.NewAdapter(ds, modelName))
+	assert.NoError(t, err)
+	return e
+}
+
+func Test_CasbinDatasourceAdapter(t *testing.T) {
+
+	t.Parallel()
+
+	dsViper := viper.New()
+	dsViper.Set("policies.connector", "memorykv")
+	ds := datasource.New("policies", dsViper, context.Background())
+	assert.NoError(t, ds.Initialize())
+
+	first := newCasbinAdapterEnforcer(t, ds, "Note")
+	_, err := first.AddPolicy("editor", "notes", "write")
+	assert.NoError(t, err)
+	_, err = first.AddRoleForUser("alice", "editor")
+	assert.NoError(t, err)
+	_, err = first.AddRoleForUser("bob", "editor")
+	assert.NoError(t, err)
+
+	// the rules are stored one by one, and those of other models are not loaded
+	other := newCasbinAdapterEnforcer(t, ds, "Other")
+	_, err = other.AddPolicy("editor", "notes", "read")
+	assert.NoError(t, err)
+	second := newCasbinAdapterEnforcer(t, ds, "Note")
+	allowed, err := second.Enforce("alice", "notes", "write")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = second.Enforce("alice", "notes", "read")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	// adding a stored rule again, like another instance would, is not an error
+	assert.NoError(t, casbinadapter.NewAdapter(ds, "Note").AddPolicy("g", "g", []string{"alice", "editor"}))
+
+	_, err = first.DeleteRoleForUser("bob", "editor")
+	assert.NoError(t, err)
+	_, err = first.DeleteRolesForUser("alice")
+	assert.NoError(t, err)
+	assert.NoError(t, second.LoadPolicy())
+	for _, user := range []string{"alice", "bob"} {
+		allowed, err = second.Enforce(user, "notes", "write")
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+	}
+
+	// a full save replaces the rules of the model only
+	_, err = first.AddRoleForUser("carol", "editor")
+	assert.NoError(t, err)
+	assert.NoError(t, first.SavePolicy())
+	assert.NoError(t, second.LoadPolicy())
+	allowed, err = second.Enforce("carol", "notes", "write")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.NoError(t, other.LoadPolicy())
+	assert.True(t, other.HasPolicy("editor", "notes", "read"))
+
+	// seeding the rules of the config adds the missing ones, and keeps the ones added at runtime
+	config, err := casbinmodel.NewModelFromString(casbinAdapterTestModel)
+	assert.NoError(t, err)
+	config.AddPolicy("p", "p", []string{"editor", "notes", "write"})
+	config.AddPolicy("p", "p", []string{"viewer", "notes", "read"})
+	assert.NoError(t, casbinadapter.NewAdapter(ds, "Note").SeedPolicy(config))
+	assert.NoError(t, second.LoadPolicy())
+	assert.True(t, second.HasPolicy("viewer", "notes", "read"))
+	allowed, err = second.Enforce("carol", "notes", "write")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+}
+
+func Test_CasbinDatasourceWatcher(t *testing.T) {
+
+	t.Parallel()
+
+	dsViper := viper.New()
+	dsViper.Set("policies.connector", "memorykv")
+	ds := datasource.New("policies", dsViper, context.Background())
+	assert.NoError(t, ds.Initialize())
+
+	first := newCasbinAdapterEnforcer(t, ds, "Note")
+	second := newCasbinAdapterEnforcer(t, ds, "Note")
+	var watchers []*casbinadapter.Watcher
+	for _, e := range []*casbin.Enforcer{first, second} {
+		watcher, err := casbinadapter.NewWatcher(ds, "Note", 50*time.Millisecond)
+		assert.NoError(t, err)
+		defer watcher.Close()
+		assert.NoError(t, e.SetWatcher(watcher))
+		watchers = append(watchers, watcher)
+	}
+	// the enforcers are not safe for concurrent use, and the callbacks run in the goroutine of the watcher
+	var mutex sync.Mutex
+	var selfReloads atomic.Int32
+	var reloadedModel atomic.Value
+	assert.NoError(t, watchers[0].SetUpdateCallback(func(modelName string) {
+		selfReloads.Add(1)
+	}))
+	assert.NoError(t, watchers[1].SetUpdateCallback(func(modelName string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		_ = second.LoadPolicy()
+		reloadedModel.Store(modelName)
+	}))
+
+	mutex.Lock()
+	_, err := first.AddPolicy("editor", "notes", "write")
+	assert.NoError(t, err)
+	_, err = first.AddRoleForUser("alice", "editor")
+	assert.NoError(t, err)
+	mutex.Unlock()
+
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		allowed, _ := second.Enforce("alice", "notes", "write")
+		return allowed
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "Note", reloadedModel.Load())
+	// the changes of an instance are not notified back to it
+	assert.Equal(t, int32(0), selfReloads.Load())
+
+}
@@ -2,11 +2,16 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	wst "github.com/fredyk/westack-go/westack/common"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/fredyk/westack-go/westack/datasource"
@@ -27,6 +32,10 @@ func Test_Datasource_Initialize_ConnectError(t *testing.T) {
 
 	t.Parallel()
 
+	if app.DsViper.GetString("db0.connector") != "mongodb" {
+		t.Skip("db0 is not a mongodb datasource")
+	}
+
 	prevHost := app.DsViper.GetString("db.host")
 	ds := datasource.New("db0", app.DsViper, context.Background())
 	ds.SubViper.Set("host", "<invalid host>")
@@ -45,6 +54,29 @@ func Test_Datasource_Initialize_ConnectError(t *testing.T) {
 
 }
 
+func Test_Datasource_Initialize_FileConnectError(t *testing.T) {
+
+	t.Parallel()
+
+	// the directory of the file datasource cannot be created under a regular file
+	parent := filepath.Join(t.TempDir(), "not-a-directory")
+	err := os.WriteFile(parent, []byte{}, 0644)
+	assert.NoError(t, err)
+
+	dsViper := viper.New()
+	dsViper.Set("files.connector", "file")
+	dsViper.Set("files.directory", filepath.Join(parent, "data"))
+	ds := datasource.New("files", dsViper, context.Background())
+	err = ds.Initialize()
+	assert.Error(t, err)
+	assert.Regexp(t, "not a directory", err.Error(), "error message should be 'not a directory'")
+
+	ds.SubViper.Set("directory", t.TempDir())
+	err = ds.Initialize()
+	assert.NoError(t, err)
+
+}
+
 func Test_DatasourceClose(t *testing.T) {
 
 	t.Parallel()
@@ -59,7 +91,7 @@ func Test_DatasourceClose(t *testing.T) {
 	// Based on suggestion from @tanryberdi: https://github.com/fredyk/westack-go/pull/480#discussion_r1312634782
 	// Attempt to perform a query. We don't mind the queried collection because the client
 	// is disconnected anyway
-	result, err := ds.FindMany("unknownCollection", nil)
+	result, err := ds.FindMany(context.Background(), "unknownCollection", nil)
 	assert.Errorf(t, err, "client is disconnected")
 	assert.Nil(t, result)
 
@@ -100,7 +132,7 @@ func Test_DatasourceDeleteManyNilWhere(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ds)
 
-	result, err := ds.DeleteMany("InvalidModel", nil)
+	result, err := ds.DeleteMany(context.Background(), "InvalidModel", nil)
 	assert.Error(t, err)
 	assert.EqualValuesf(t, 0, result.DeletedCount, "result: %v", result)
 	assert.EqualErrorf(t, err, "whereLookups cannot be nil", err.Error())
@@ -115,7 +147,7 @@ func Test_DatasourceDeleteManyMultipleLookups(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ds)
 
-	result, err := ds.DeleteMany("InvalidModel", &wst.A{
+	result, err := ds.DeleteMany(context.Background(), "InvalidModel", &wst.A{
 		{},
 		{},
 	})
@@ -133,7 +165,7 @@ func Test_DatasourceDeleteManyNilLookupEntry(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ds)
 
-	result, err := ds.DeleteMany("InvalidModel", &wst.A{
+	result, err := ds.DeleteMany(context.Background(), "InvalidModel", &wst.A{
 		nil,
 	})
 	assert.Error(t, err)
@@ -150,7 +182,7 @@ func Test_DatasourceDeleteManyInvalidLookupEntry(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ds)
 
-	result, err := ds.DeleteMany("InvalidModel", &wst.A{
+	result, err := ds.DeleteMany(context.Background(), "InvalidModel", &wst.A{
 		{"$foo": "bar"},
 	})
 	assert.Error(t, err)
@@ -167,7 +199,7 @@ func Test_DatasourceDeleteManyLookupEntryWithMultipleFields(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ds)
 
-	result, err := ds.DeleteMany("InvalidModel", &wst.A{
+	result, err := ds.DeleteMany(context.Background(), "InvalidModel", &wst.A{
 		{"$match": "<unfound>", "$foo": "bar"},
 	})
 	assert.Error(t, err)
@@ -184,7 +216,7 @@ func Test_DatasourceDeleteManyLookupEntryWithEmptyMatch(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, ds)
 
-	result, err := ds.DeleteMany("InvalidModel", &wst.A{
+	result, err := ds.DeleteMany(context.Background(), "InvalidModel", &wst.A{
 		{"$match": wst.M{}},
 	})
 	assert.Error(t, err)
@@ -221,3 +253,130 @@ func Test_DatasourceDeleteManyOK(t *testing.T) {
 	assert.EqualValuesf(t, 2, result.DeletedCount, "result: %v", result)
 
 }
+
+// countingConnector is implemented outside the datasource package, like a third-party connector would be
+type countingConnector struct {
+	datasource.PersistedConnector
+	created int
+}
+
+func (connector *countingConnector) GetName() string {
+	return "counting"
+}
+
+func (connector *countingConnector) IsLocal() bool {
+	return true
+}
+
+func (connector *countingConnector) Create(ctx context.Context, collectionName string, data *wst.M) (*wst.M, error) {
+	connector.created++
+	return connector.PersistedConnector.Create(ctx, collectionName, data)
+}
+
+func Test_DatasourceRegisterConnector(t *testing.T) {
+
+	t.Parallel()
+
+	var factoryKey string
+	var connector *countingConnector
+	datasource.RegisterConnector("counting", func(dsKey string, cfg *viper.Viper, opts *datasource.Options) (datasource.PersistedConnector, error) {
+		factoryKey = dsKey
+		connector = &countingConnector{PersistedConnector: datasource.NewMemoryKVConnector(dsKey)}
+		return connector, nil
+	})
+	assert.True(t, datasource.IsConnectorRegistered("counting"))
+	assert.False(t, datasource.IsConnectorRegistered("unregistered"))
+
+	dsViper := viper.New()
+	dsViper.Set("custom.connector", "counting")
+	ds := datasource.New("custom", dsViper, context.Background())
+	err := ds.Initialize()
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", factoryKey)
+
+	created, err := ds.Create(context.Background(), "Note", &wst.M{"title": "Custom connector"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, connector.created)
+
+	cursor, err := ds.FindMany(context.Background(), "Note", &wst.A{{"$match": wst.M{"_id": (*created)["_id"]}}})
+	assert.NoError(t, err)
+	var found []wst.M
+	err = cursor.All(context.Background(), &found)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Custom connector"}, reduceByKey(found, "title"))
+
+	err = ds.Close()
+	assert.NoError(t, err)
+
+}
+
+// flakyConnector fails the pings and the reconnections while failing is set
+type flakyConnector struct {
+	datasource.PersistedConnector
+	failing atomic.Bool
+	pings   atomic.Int32
+}
+
+func (connector *flakyConnector) Ping(parentCtx context.Context) error {
+	connector.pings.Add(1)
+	if connector.failing.Load() {
+		return errors.New("connection lost")
+	}
+	return connector.PersistedConnector.Ping(parentCtx)
+}
+
+func (connector *flakyConnector) Connect(parentCtx context.Context) error {
+	if connector.failing.Load() {
+		return errors.New("connection refused")
+	}
+	return connector.PersistedConnector.Connect(parentCtx)
+}
+
+func Test_DatasourceCircuitBreaker(t *testing.T) {
+
+	t.Parallel()
+
+	var connector *flakyConnector
+	datasource.RegisterConnector("flaky", func(dsKey string, cfg *viper.Viper, opts *datasource.Options) (datasource.PersistedConnector, error) {
+		connector = &flakyConnector{PersistedConnector: datasource.NewMemoryKVConnector(dsKey)}
+		return connector, nil
+	})
+
+	dsViper := viper.New()
+	dsViper.Set("flaky.connector", "flaky")
+	dsViper.Set("flaky.healthCheckInterval", 0.01)
+	dsViper.Set("flaky.reconnectMaxBackoff", 0.04)
+	dsViper.Set("flaky.circuitBreakerThreshold", 2)
+	ds := datasource.New("flaky", dsViper, context.Background())
+	err := ds.Initialize()
+	assert.NoError(t, err)
+	assert.Equal(t, datasource.CircuitClosed, ds.CircuitState())
+
+	connector.failing.Store(true)
+	assert.Eventually(t, func() bool {
+		return ds.CircuitState() == datasource.CircuitOpen
+	}, 2*time.Second, 5*time.Millisecond)
+	health := ds.Health()
+	assert.GreaterOrEqual(t, health.ConsecutiveFailures, 2)
+	assert.Error(t, health.LastError)
+
+	_, err = ds.Create(context.Background(), "Note", &wst.M{"title": "While open"})
+	assert.ErrorIs(t, err, datasource.ErrCircuitOpen)
+
+	connector.failing.Store(false)
+	assert.Eventually(t, func() bool {
+		return ds.CircuitState() == datasource.CircuitClosed
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, ds.Health().ConsecutiveFailures)
+
+	_, err = ds.Create(context.Background(), "Note", &wst.M{"title": "After reconnecting"})
+	assert.NoError(t, err)
+
+	// Close must stop the health checks
+	err = ds.Close()
+	assert.NoError(t, err)
+	pings := connector.pings.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, pings, connector.pings.Load())
+
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+func newFileDatasource(t *testing.T, directory string, format string) *datasource.Datasource {
+	dsViper := viper.New()
+	dsViper.Set("files.connector", "file")
+	dsViper.Set("files.directory", directory)
+	dsViper.Set("files.format", format)
+	ds := datasource.New("files", dsViper, context.Background())
+	err := ds.Initialize()
+	assert.NoError(t, err)
+	return ds
+}
+
+func Test_FileDatasource(t *testing.T) {
+
+	t.Parallel()
+
+	for _, format := range []string{"json", "bson"} {
+		t.Run(format, func(t *testing.T) {
+			directory := t.TempDir()
+			ds := newFileDatasource(t, directory, format)
+
+			created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			author, err := ds.Create(context.Background(), "Author", &wst.M{"name": "Jane"})
+			assert.NoError(t, err)
+			authorId := (*author)["_id"]
+			assert.IsType(t, primitive.ObjectID{}, authorId)
+
+			for i := 0; i < 3; i++ {
+				_, err := ds.Create(context.Background(), "Book", &wst.M{
+					"title":    fmt.Sprintf("Book %v", i),
+					"index":    i,
+					"created":  created,
+					"authorId": authorId,
+				})
+				assert.NoError(t, err)
+			}
+
+			_, err = ds.Create(context.Background(), "Author", &wst.M{"_id": authorId, "name": "Duplicated"})
+			assert.Error(t, err)
+
+			findAll := func(ds *datasource.Datasource, lookups wst.A) []wst.M {
+				cursor, err := ds.FindMany(context.Background(), "Book", &lookups)
+				assert.NoError(t, err)
+				var documents []wst.M
+				err = cursor.All(context.Background(), &documents)
+				assert.NoError(t, err)
+				return documents
+			}
+
+			documents := findAll(ds, wst.A{
+				{"$match": wst.M{"index": wst.M{"$gte": 1}}},
+				{"$sort": bson.D{{Key: "index", Value: -1}}},
+				{"$lookup": wst.M{
+					"from": "Author",
+					"let":  wst.M{"authorId": "$authorId"},
+					"pipeline": wst.A{
+						{"$match": wst.M{"$expr": wst.M{"$and": wst.A{
+							{"$eq": []string{"$_id", "$$authorId"}},
+						}}}},
+					},
+					"as": "author",
+				}},
+				{"$unwind": wst.M{"path": "$author", "preserveNullAndEmptyArrays": true}},
+			})
+			assert.Equal(t, []string{"Book 2", "Book 1"}, reduceByKey(documents, "title"))
+			assert.Equal(t, "Jane", documents[0]["author"].(wst.M)["name"])
+
+			_, err = ds.UpdateById(context.Background(), "Book", documents[0]["_id"], &wst.M{"title": "Book 2 updated"})
+			assert.NoError(t, err)
+
+			deleteResult, err := ds.DeleteMany(context.Background(), "Book", &wst.A{{"$match": wst.M{"index": 0}}})
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, deleteResult.DeletedCount)
+
+			// A new datasource on the same directory must read what the previous one wrote
+			err = ds.Close()
+			assert.NoError(t, err)
+			reopened := newFileDatasource(t, directory, format)
+
+			documents = findAll(reopened, wst.A{
+				{"$sort": bson.D{{Key: "index", Value: 1}}},
+			})
+			assert.Equal(t, []string{"Book 1", "Book 2 updated"}, reduceByKey(documents, "title"))
+			assert.Equal(t, authorId, documents[0]["authorId"])
+			assert.Equal(t, primitive.NewDateTimeFromTime(created), documents[0]["created"])
+
+			count, err := reopened.Count(context.Background(), "Author", &wst.A{{"$match": wst.M{"name": "Jane"}}})
+			assert.NoError(t, err)
+			assert.EqualValues(t, 1, count)
+
+			// The writes that cannot be persisted leave the loaded collection as it was
+			err = os.RemoveAll(directory)
+			assert.NoError(t, err)
+			_, err = reopened.Create(context.Background(), "Book", &wst.M{"title": "Book 3", "index": 3})
+			assert.Error(t, err)
+			_, err = reopened.UpdateById(context.Background(), "Book", documents[0]["_id"], &wst.M{"title": "Book 1 updated"})
+			assert.Error(t, err)
+			_, err = reopened.DeleteMany(context.Background(), "Book", &wst.A{{"$match": wst.M{"index": 2}}})
+			assert.Error(t, err)
+			documents = findAll(reopened, wst.A{
+				{"$sort": bson.D{{Key: "index", Value: 1}}},
+			})
+			assert.Equal(t, []string{"Book 1", "Book 2 updated"}, reduceByKey(documents, "title"))
+
+			err = reopened.Close()
+			assert.NoError(t, err)
+			_, err = reopened.FindMany(context.Background(), "Book", nil)
+			assert.Error(t, err)
+		})
+	}
+
+}
@@ -45,6 +45,7 @@ var customerModel *model.Model
 var orderModel *model.Model
 var storeModel *model.Model
 var footerModel *model.Model
+var emptyModel *model.Model
 var systemContext *model.EventContext
 
 func Test_GRPCCallWithQueryParamsOK(t *testing.T) {
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+func Test_HealthEndpoint(t *testing.T) {
+
+	t.Parallel()
+
+	var result wst.M
+	status := requestJson(t, "GET", "/system/health", nil, nil, &result).StatusCode
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "ok", result.GetString("status"))
+	assert.Greater(t, result["uptimeSeconds"], 0.0)
+
+	datasources, ok := result["datasources"].(map[string]interface{})
+	assert.True(t, ok)
+	db, ok := datasources["db0"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "closed", db["state"])
+	assert.GreaterOrEqual(t, db["latencyMs"], 0.0)
+
+}
+
+func Test_ReadinessEndpoint(t *testing.T) {
+
+	t.Parallel()
+
+	var result wst.M
+	status := requestJson(t, "GET", "/system/ready", nil, nil, &result).StatusCode
+
+	// Other tests break some datasources on purpose, so only the healthy ones are checked
+	ready, _ := result["ready"].(bool)
+	if ready {
+		assert.Equal(t, 200, status)
+	} else {
+		assert.Equal(t, 503, status)
+	}
+
+	checks, ok := result["checks"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, true, checks["modelsLoaded"])
+	assert.Equal(t, true, checks["adminUpserted"])
+	assert.Equal(t, false, checks["stopping"])
+
+	datasources, ok := result["datasources"].(map[string]interface{})
+	assert.True(t, ok)
+	for _, dsName := range []string{"db0", "memorykv"} {
+		ds, ok := datasources[dsName].(map[string]interface{})
+		assert.Truef(t, ok, "missing datasource %v", dsName)
+		assert.Equal(t, true, ds["ready"])
+		assert.GreaterOrEqual(t, ds["latencyMs"], 0.0)
+	}
+
+}
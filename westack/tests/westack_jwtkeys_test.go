@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fredyk/westack-go/westack/jwtkeys"
+)
+
+func Test_JwtKeysRotation(t *testing.T) {
+
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	oldKey, err := jwtkeys.NewKey("old", rsaKey, nil)
+	assert.NoError(t, err)
+	oldKeySet, err := jwtkeys.NewKeySet(nil, "old", oldKey)
+	assert.NoError(t, err)
+	oldToken, err := oldKeySet.Sign(jwt.MapClaims{"userId": "old"})
+	assert.NoError(t, err)
+
+	// during the rotation, the old key only verifies tokens
+	publicDer, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	ecDer, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(t, err)
+	keySet, err := jwtkeys.Load(jwtkeys.Config{
+		SigningKid: "new",
+		Keys: []jwtkeys.KeyConfig{
+			{Kid: "old", Algorithm: "RS256", PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))},
+			{Kid: "new", Algorithm: "ES256", PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDer}))},
+		},
+	}, nil)
+	assert.NoError(t, err)
+
+	newToken, err := keySet.Sign(jwt.MapClaims{"userId": "new"})
+	assert.NoError(t, err)
+	for _, rawToken := range []string{oldToken, newToken} {
+		token, err := jwt.Parse(rawToken, keySet.Keyfunc)
+		assert.NoError(t, err)
+		assert.True(t, token.Valid)
+	}
+	parsed, _ := jwt.Parse(newToken, keySet.Keyfunc)
+	assert.Equal(t, "new", parsed.Header["kid"])
+	assert.Equal(t, "ES256", parsed.Header["alg"])
+
+	_, err = jwtkeys.Load(jwtkeys.Config{SigningKid: "old", Keys: []jwtkeys.KeyConfig{
+		{Kid: "old", Algorithm: "RS256", PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))},
+	}}, nil)
+	assert.Error(t, err)
+
+	jwks := keySet.JWKS()
+	assert.Len(t, jwks.Keys, 2)
+	assert.Equal(t, "RSA", jwks.Keys[0].Kty)
+	assert.Equal(t, "AQAB", jwks.Keys[0].E)
+	assert.Equal(t, "EC", jwks.Keys[1].Kty)
+	assert.Equal(t, "P-256", jwks.Keys[1].Crv)
+	assert.Len(t, jwks.Keys[1].X, 43)
+
+}
+
+func Test_JwtKeysRejectAlgorithmConfusion(t *testing.T) {
+
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	key, err := jwtkeys.NewKey("rsa", rsaKey, nil)
+	assert.NoError(t, err)
+	keySet, err := jwtkeys.NewKeySet([]byte("secret"), "rsa", key)
+	assert.NoError(t, err)
+
+	// an HMAC token signed with the public key must not be accepted for the RSA key
+	publicDer, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userId": "forged"})
+	forged.Header["kid"] = "rsa"
+	rawForged, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+	assert.NoError(t, err)
+	_, err = jwt.Parse(rawForged, keySet.Keyfunc)
+	assert.Error(t, err)
+
+	forged.Header["kid"] = "unknown"
+	rawForged, err = forged.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = jwt.Parse(rawForged, keySet.Keyfunc)
+	assert.Error(t, err)
+
+	// the tokens signed with the secret before configuring the keys are only valid when they are explicitly accepted
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userId": "legacy"}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = jwt.Parse(legacy, keySet.Keyfunc)
+	assert.Error(t, err)
+	keySet.AcceptHMAC(true)
+	_, err = jwt.Parse(legacy, keySet.Keyfunc)
+	assert.NoError(t, err)
+
+}
+
+func Test_JwtKeysRejectEmptyHmacSecret(t *testing.T) {
+
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	key, err := jwtkeys.NewKey("ec", ecKey, nil)
+	assert.NoError(t, err)
+
+	// anyone can sign a token with an empty secret
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userId": "forged"}).SignedString([]byte{})
+	assert.NoError(t, err)
+	for _, acceptHmac := range []bool{false, true} {
+		keySet, err := jwtkeys.NewKeySet(nil, "ec", key)
+		assert.NoError(t, err)
+		keySet.AcceptHMAC(acceptHmac)
+		token, err := jwt.Parse(forged, keySet.Keyfunc)
+		assert.Error(t, err)
+		assert.False(t, token != nil && token.Valid)
+	}
+
+	keySet, err := jwtkeys.NewKeySet(nil, "")
+	assert.NoError(t, err)
+	_, err = keySet.Sign(jwt.MapClaims{"userId": "unsigned"})
+	assert.Error(t, err)
+	_, err = jwt.Parse(forged, keySet.Keyfunc)
+	assert.Error(t, err)
+
+}
+
+func Test_JwksEndpoint(t *testing.T) {
+
+	t.Parallel()
+
+	var jwks jwtkeys.JWKS
+	response := requestJson(t, "GET", "/.well-known/jwks.json", nil, nil, &jwks)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	// the HMAC secret of the test app is never published
+	assert.NotNil(t, jwks.Keys)
+	for _, key := range jwks.Keys {
+		assert.NotEqual(t, "oct", key.Kty)
+	}
+
+}
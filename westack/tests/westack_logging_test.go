@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+func Test_LoggingJSON(t *testing.T) {
+
+	t.Parallel()
+
+	var buffer bytes.Buffer
+	logger := logging.New(&buffer, logging.FormatJSON, logging.LevelInfo).With("model", "Note")
+	logger.Debug("hidden")
+	logger.Info("Created note", "noteId", 7, "orphan")
+	logging.WithLevel(logger, logging.LevelDebug).Debug("visible")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var first map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "INFO", first["level"])
+	assert.Equal(t, "Created note", first["msg"])
+	assert.Equal(t, "Note", first["model"])
+	assert.EqualValues(t, 7, first["noteId"])
+	assert.Equal(t, "orphan", first["!BADKEY"])
+
+	var second map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, "DEBUG", second["level"])
+	assert.Equal(t, "Note", second["model"])
+
+}
+
+func Test_LoggingText(t *testing.T) {
+
+	t.Parallel()
+
+	var buffer bytes.Buffer
+	logger := logging.New(&buffer, logging.FormatText, logging.LevelDebug)
+	logging.WithLevel(logger, logging.LevelWarn).Info("hidden")
+	logger.Warn("Slow query", "collection", "Note", "filter", `{"title": "a"}`)
+	assert.Regexp(t, `^time=\S+ level=WARN msg="Slow query" collection=Note filter="{\\"title\\": \\"a\\"}"\n$`, buffer.String())
+
+	level, err := logging.ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, logging.LevelWarn, level)
+	_, err = logging.ParseLevel("verbose")
+	assert.Error(t, err)
+
+}
+
+func Test_LoggingEventContextRequestID(t *testing.T) {
+
+	var buffer bytes.Buffer
+	previous := logging.Default()
+	logging.SetDefault(logging.New(&buffer, logging.FormatJSON, logging.LevelDebug))
+	defer logging.SetDefault(previous)
+
+	eventContext := &model.EventContext{
+		BaseContext: &model.EventContext{RequestID: "req-1234"},
+	}
+	assert.Equal(t, "req-1234", eventContext.GetRequestID())
+	eventContext.Logger().Info("Handled by a hook")
+
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["msg"] == "Handled by a hook" {
+			assert.Equal(t, "req-1234", entry["requestId"])
+			return
+		}
+	}
+	t.Errorf("missing log line in %v", buffer.String())
+
+}
+
+func Test_RequestIDHeader(t *testing.T) {
+
+	t.Parallel()
+
+	resp := requestJson(t, "GET", "/api/v1/notes/count", nil, map[string]string{model.RequestIDHeader: "propagated-id-1"}, nil)
+	assert.Equal(t, "propagated-id-1", resp.Header.Get(model.RequestIDHeader))
+
+	resp = requestJson(t, "GET", "/api/v1/notes/count", nil, map[string]string{model.RequestIDHeader: "invalid id\nwith a forged line"}, nil)
+	generated := resp.Header.Get(model.RequestIDHeader)
+	assert.NotEmpty(t, generated)
+	assert.NotContains(t, generated, " ")
+
+}
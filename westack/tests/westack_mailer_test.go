@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// startSmtpStandIn accepts the emails sent to 127.0.0.1:8022, as configured in the tests config, and delivers them to
+// the returned channel
+func startSmtpStandIn(t *testing.T) <-chan *mail.Message {
+	listener, err := net.Listen("tcp", "127.0.0.1:8022")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	messages := make(chan *mail.Message, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSmtp(conn, messages)
+		}
+	}()
+	return messages
+}
+
+func serveSmtp(conn net.Conn, messages chan<- *mail.Message) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		_, _ = conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 end with <CRLF>.<CRLF>")
+			message, err := mail.ReadMessage(readSmtpData(reader))
+			if err != nil {
+				reply("554 invalid message")
+				continue
+			}
+			messages <- message
+			reply("250 OK")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func readSmtpData(reader *bufio.Reader) io.Reader {
+	var data strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil || line == ".\r\n" {
+			break
+		}
+		data.WriteString(strings.TrimPrefix(line, "."))
+	}
+	return strings.NewReader(data.String())
+}
+
+// mailParts returns the decoded bodies of the email by content type
+func mailParts(t *testing.T, message *mail.Message) map[string]string {
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	parts := map[string]string{}
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		// the quoted-printable parts are decoded by the multipart reader
+		content, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		parts[partType] = string(content)
+	}
+	return parts
+}
+
+func Test_VerificationMail(t *testing.T) {
+
+	messages := startSmtpStandIn(t)
+
+	user := createUserThroughNetwork(t)
+	tokens, err := loginUser(user["email"].(string), "abcd1234.", t)
+	assert.NoError(t, err)
+	bearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	status := requestJson(t, "POST", "/api/v1/users/verify-mail", wst.M{"redirectUri": "http://localhost:8019/verified"}, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+
+	var message *mail.Message
+	select {
+	case message = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the verification email was not sent")
+	}
+	assert.Equal(t, user["email"], message.Header.Get("To"))
+	assert.Equal(t, "westack tests <no-reply@example.com>", message.Header.Get("From"))
+	// the subject is overridden in server/templates
+	assert.Equal(t, "Welcome to tests, verify your email", message.Header.Get("Subject"))
+	parts := mailParts(t, message)
+	assert.Contains(t, parts["text/html"], "<a href=")
+	verifyUrl := regexp.MustCompile(`https?://\S+/verify-mail\?\S+`).FindString(parts["text/plain"])
+	assert.NotEmpty(t, verifyUrl)
+
+	response := requestJson(t, "GET", verifyUrl, nil, nil, nil)
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "http://localhost:8019/verified", response.Header.Get("Location"))
+
+	var self wst.M
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, bearer, &self).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, self["emailVerified"])
+
+	// the token of the link only verifies the email, once
+	parsedUrl, err := url.Parse(verifyUrl)
+	assert.NoError(t, err)
+	linkBearer := map[string]string{"Authorization": "Bearer " + parsedUrl.Query().Get("access_token")}
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, linkBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	response = requestJson(t, "GET", verifyUrl, nil, nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+}
@@ -0,0 +1,262 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/memorykv"
+)
+
+// Number of keys loaded in the bucket before measuring each operation
+const memoryKvBenchmarkKeys = 50000
+
+func createPopulatedBucket(b *testing.B, n int) (memorykv.MemoryKvDb, memorykv.MemoryKvBucket) {
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "benchmark"})
+	bucket := db.GetBucket("benchmark")
+	value := [][]byte{[]byte("value")}
+	for i := 0; i < n; i++ {
+		// spread expirations so that inserts land all over the queue
+		err := bucket.SetEx(fmt.Sprintf("key-%v", i), value, time.Duration(i%3600+60)*time.Second)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	return db, bucket
+}
+
+func Benchmark_MemoryKvSet(b *testing.B) {
+	db, bucket := createPopulatedBucket(b, memoryKvBenchmarkKeys)
+	defer db.Purge()
+	value := [][]byte{[]byte("value")}
+	for i := 0; i < b.N; i++ {
+		err := bucket.Set(fmt.Sprintf("new-key-%v", i), value)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_MemoryKvSetEx(b *testing.B) {
+	db, bucket := createPopulatedBucket(b, memoryKvBenchmarkKeys)
+	defer db.Purge()
+	value := [][]byte{[]byte("value")}
+	for i := 0; i < b.N; i++ {
+		err := bucket.SetEx(fmt.Sprintf("new-key-%v", i), value, time.Duration(i%3600+60)*time.Second)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_MemoryKvExpire(b *testing.B) {
+	db, bucket := createPopulatedBucket(b, memoryKvBenchmarkKeys)
+	defer db.Purge()
+	for i := 0; i < b.N; i++ {
+		err := bucket.Expire(fmt.Sprintf("key-%v", i%memoryKvBenchmarkKeys), time.Duration(i%3600+60)*time.Second)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_MemoryKvSetExParallelBuckets(b *testing.B) {
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "benchmark"})
+	defer db.Purge()
+	value := [][]byte{[]byte("value")}
+	b.RunParallel(func(pb *testing.PB) {
+		bucket := db.GetBucket(fmt.Sprintf("bucket-%v", createRandomInt()))
+		i := 0
+		for pb.Next() {
+			err := bucket.SetEx(fmt.Sprintf("key-%v", i), value, time.Duration(i%3600+60)*time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func Test_MemoryKvExpiration(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "test"})
+	defer db.Purge()
+	bucket := db.GetBucket("test")
+
+	err := bucket.SetEx("short", [][]byte{[]byte("a")}, 100*time.Millisecond)
+	assert.NoError(t, err)
+	err = bucket.SetEx("long", [][]byte{[]byte("b")}, 10*time.Second)
+	assert.NoError(t, err)
+	err = bucket.Set("persistent", [][]byte{[]byte("c")})
+	assert.NoError(t, err)
+
+	value, err := bucket.Get("short")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, value)
+
+	time.Sleep(300 * time.Millisecond)
+
+	value, err = bucket.Get("short")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+
+	stats := bucket.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.EqualValues(t, 2, stats.ExpirationQueueSize)
+
+	err = bucket.Delete("long")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, bucket.Stats().ExpirationQueueSize)
+
+	err = bucket.Expire("unknown", time.Second)
+	assert.Error(t, err)
+
+}
+
+func Test_MemoryKvDatasourceQueries(t *testing.T) {
+
+	t.Parallel()
+
+	ds, err := app.FindDatasource("memorykv")
+	assert.NoError(t, err)
+
+	collectionName := fmt.Sprintf("QueryTest%v", createRandomInt())
+	for i := 0; i < 10; i++ {
+		_, err := ds.Create(context.Background(), collectionName, &wst.M{
+			"title": fmt.Sprintf("Note %v", i),
+			"index": i,
+			"tags":  []string{"even", "odd"}[i%2 : i%2+1],
+		})
+		assert.NoError(t, err)
+	}
+
+	findAll := func(lookups wst.A) []wst.M {
+		cursor, err := ds.FindMany(context.Background(), collectionName, &lookups)
+		assert.NoError(t, err)
+		var documents []wst.M
+		err = cursor.All(context.Background(), &documents)
+		assert.NoError(t, err)
+		return documents
+	}
+
+	documents := findAll(wst.A{
+		{"$match": wst.M{"index": wst.M{"$gte": 2, "$lt": 8}}},
+		{"$sort": bson.D{{Key: "index", Value: -1}}},
+		{"$skip": int64(1)},
+		{"$limit": int64(3)},
+	})
+	assert.Equal(t, []string{"Note 6", "Note 5", "Note 4"}, reduceByKey(documents, "title"))
+
+	documents = findAll(wst.A{
+		{"$match": wst.M{
+			"$or": []interface{}{
+				wst.M{"title": wst.M{"$regex": "^note [01]$", "$options": "i"}},
+				wst.M{"index": wst.M{"$in": []interface{}{8, 9}}},
+			},
+			"tags": "even",
+		}},
+		{"$sort": bson.D{{Key: "index", Value: 1}}},
+	})
+	assert.Equal(t, []string{"Note 0", "Note 8"}, reduceByKey(documents, "title"))
+
+	count, err := ds.Count(context.Background(), collectionName, &wst.A{{"$match": wst.M{"tags": "odd"}}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, count)
+
+	updated, err := ds.UpdateById(context.Background(), collectionName, documents[0]["_id"], &wst.M{"title": "Updated"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Updated", (*updated)["title"])
+
+	deleteResult, err := ds.DeleteMany(context.Background(), collectionName, &wst.A{{"$match": wst.M{"tags": "odd"}}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, deleteResult.DeletedCount)
+
+	deleteResult, err = ds.DeleteById(context.Background(), collectionName, documents[0]["_id"])
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleteResult.DeletedCount)
+
+	count, err = ds.Count(context.Background(), collectionName, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, count)
+
+	_, err = ds.FindMany(context.Background(), collectionName, &wst.A{{"$group": wst.M{"_id": nil}}})
+	assert.Error(t, err)
+
+}
+
+func Test_MemoryKvConcurrentCreate(t *testing.T) {
+
+	t.Parallel()
+
+	ds, err := app.FindDatasource("memorykv")
+	assert.NoError(t, err)
+
+	// only one of the creates of the same id succeeds, as in the token denylist
+	collectionName := fmt.Sprintf("ConcurrentCreateTest%v", createRandomInt())
+	var created int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := ds.Create(context.Background(), collectionName, &wst.M{"_id": "same", "writer": i})
+			if err == nil {
+				atomic.AddInt64(&created, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, created)
+
+}
+
+func Test_MemoryKvPubSub(t *testing.T) {
+
+	t.Parallel()
+
+	db := memorykv.NewMemoryKvDb(memorykv.Options{Name: "test"})
+	bucket := db.GetBucket("events")
+
+	messages := db.Subscribe("notes")
+	expired := db.Subscribe(memorykv.KeyEventChannel("events", memorykv.KeyEventExpired))
+	deleted := db.Subscribe(memorykv.KeyEventChannel("events", memorykv.KeyEventDel))
+
+	err := db.Publish("notes", []byte("created"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("created"), <-messages)
+
+	err = bucket.SetEx("short", [][]byte{[]byte("a")}, 50*time.Millisecond)
+	assert.NoError(t, err)
+	err = bucket.Set("removed", [][]byte{[]byte("b")})
+	assert.NoError(t, err)
+	err = bucket.Delete("removed")
+	assert.NoError(t, err)
+
+	select {
+	case key := <-expired:
+		assert.Equal(t, "short", string(key))
+	case <-time.After(time.Second):
+		t.Error("expected an expiration notification")
+	}
+	assert.Equal(t, "removed", string(<-deleted))
+
+	db.Unsubscribe("notes", messages)
+	_, open := <-messages
+	assert.False(t, open)
+
+	err = db.Purge()
+	assert.NoError(t, err)
+	_, open = <-deleted
+	assert.False(t, open)
+
+}
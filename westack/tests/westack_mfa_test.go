@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/totp"
+)
+
+func Test_TotpCodes(t *testing.T) {
+
+	t.Parallel()
+
+	// RFC 6238 test vectors, truncated to 6 digits. The secret is "12345678901234567890"
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err := totp.Code(secret, totp.Step(time.Unix(59, 0)))
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", code)
+	code, err = totp.Code(secret, totp.Step(time.Unix(1111111109, 0)))
+	assert.NoError(t, err)
+	assert.Equal(t, "081804", code)
+
+	step, ok := totp.Validate(secret, "081804", time.Unix(1111111109+30, 0))
+	assert.True(t, ok)
+	assert.Equal(t, totp.Step(time.Unix(1111111109, 0)), step)
+	_, ok = totp.Validate(secret, "081804", time.Unix(1111111109+90, 0))
+	assert.False(t, ok)
+
+}
+
+func Test_TwoFactorLogin(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	email := user["email"].(string)
+	tokens, err := loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	bearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	var setup wst.M
+	status := requestJson(t, "POST", "/api/v1/users/2fa/setup", wst.M{}, bearer, &setup).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	secret := setup.GetString("secret")
+	assert.True(t, strings.HasPrefix(setup.GetString("otpauthUri"), "otpauth://totp/"))
+
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"code": "000000"}, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	now := time.Now()
+	code, err := totp.Code(secret, totp.Step(now))
+	assert.NoError(t, err)
+	var enabled wst.M
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"code": code}, bearer, &enabled).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	recoveryCodes, _ := enabled["recoveryCodes"].([]interface{})
+	assert.Equal(t, 10, len(recoveryCodes))
+
+	// the secrets cannot be read nor written through the REST API
+	var self wst.M
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, bearer, &self).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, self["totpEnabled"])
+	assert.Nil(t, self["totpSecret"])
+	assert.Nil(t, self["recoveryCodes"])
+	var result wst.M
+	status = requestJson(t, "PATCH", "/api/v1/users/"+user.GetString("id"), wst.M{"totpEnabled": false}, bearer, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "MFA_READ_ONLY", result.GetM("error").GetString("code"))
+
+	// the login returns a challenge, which is not accepted as bearer
+	challenge, err := loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	assert.Equal(t, true, challenge["mfaRequired"])
+	assert.Nil(t, challenge["id"])
+	challengeBearer := map[string]string{"Authorization": "Bearer " + challenge.GetString("mfaToken")}
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, challengeBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the code of the setup cannot be replayed
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"code": code}, challengeBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	nextCode, err := totp.Code(secret, totp.Step(now)+1)
+	assert.NoError(t, err)
+	var verified wst.M
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"code": nextCode}, challengeBearer, &verified).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, verified.GetString("id"))
+	assert.NotEmpty(t, verified.GetString("refreshToken"))
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, map[string]string{"Authorization": "Bearer " + verified.GetString("id")}, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+
+	// the challenge can only be used once
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"recoveryCode": recoveryCodes[0]}, challengeBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the recovery codes replace the TOTP codes, once each
+	challenge, err = loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	challengeBearer = map[string]string{"Authorization": "Bearer " + challenge.GetString("mfaToken")}
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"recoveryCode": recoveryCodes[0]}, challengeBearer, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	challenge, err = loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	challengeBearer = map[string]string{"Authorization": "Bearer " + challenge.GetString("mfaToken")}
+	status = requestJson(t, "POST", "/api/v1/users/2fa/verify", wst.M{"recoveryCode": recoveryCodes[0]}, challengeBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+}
@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/jwtkeys"
+	"github.com/fredyk/westack-go/westack/passwords"
+)
+
+// fakeIdP is the provider "fake" of config.json. It issues the codes of the users that the tests authorize, and signs
+// their id_tokens with its own key
+type fakeIdP struct {
+	mutex        sync.Mutex
+	codes        map[string]fakeIdPGrant
+	accessTokens map[string]string
+	keySet       *jwtkeys.KeySet
+}
+
+type fakeIdPGrant struct {
+	challenge string
+	email     string
+	nonce     string
+}
+
+func startFakeIdP(t *testing.T) *fakeIdP {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	key, err := jwtkeys.NewKey("fake-idp", ecKey, nil)
+	assert.NoError(t, err)
+	keySet, err := jwtkeys.NewKeySet(nil, "fake-idp", key)
+	assert.NoError(t, err)
+	idp := &fakeIdP{codes: map[string]fakeIdPGrant{}, accessTokens: map[string]string{}, keySet: keySet}
+	listener, err := net.Listen("tcp", "127.0.0.1:8021")
+	assert.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 "http://127.0.0.1:8021",
+			"authorization_endpoint": "http://127.0.0.1:8021/authorize",
+			"token_endpoint":         "http://127.0.0.1:8021/token",
+			"userinfo_endpoint":      "http://127.0.0.1:8021/userinfo",
+			"jwks_uri":               "http://127.0.0.1:8021/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(idp.keySet.JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		defer idp.mutex.Unlock()
+		grant, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || r.FormValue("client_secret") != "westack-tests-secret" || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		accessToken := fmt.Sprintf("at-%v", createRandomInt())
+		idp.accessTokens[accessToken] = grant.email
+		idToken, err := idp.keySet.Sign(jwt.MapClaims{
+			"iss":            "http://127.0.0.1:8021",
+			"aud":            "westack-tests",
+			"sub":            grant.email,
+			"email":          grant.email,
+			"email_verified": true,
+			"nonce":          grant.nonce,
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		})
+		assert.NoError(t, err)
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": accessToken, "id_token": idToken, "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		email, ok := idp.accessTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		idp.mutex.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"sub": email, "email": email, "email_verified": true})
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return idp
+}
+
+// authorize simulates the user signing in at the provider and returns the callback query. The id_token gets the nonce
+// of the authorization request, unless another one is given
+func (idp *fakeIdP) authorize(t *testing.T, location string, email string, nonce string) url.Values {
+	authorizeUrl, err := url.Parse(location)
+	assert.NoError(t, err)
+	query := authorizeUrl.Query()
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, "westack-tests", query.Get("client_id"))
+	assert.NotEmpty(t, query.Get("nonce"))
+	if nonce == "" {
+		nonce = query.Get("nonce")
+	}
+	code := fmt.Sprintf("code-%v", createRandomInt())
+	idp.mutex.Lock()
+	idp.codes[code] = fakeIdPGrant{challenge: query.Get("code_challenge"), email: email, nonce: nonce}
+	idp.mutex.Unlock()
+	return url.Values{"code": {code}, "state": {query.Get("state")}}
+}
+
+func oidcLogin(t *testing.T, idp *fakeIdP, email string) (int, wst.M) {
+	return oidcLoginWithNonce(t, idp, email, "")
+}
+
+func oidcLoginWithNonce(t *testing.T, idp *fakeIdP, email string, nonce string) (int, wst.M) {
+	response := requestJson(t, "GET", "/auth/fake/login", nil, nil, nil)
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	cookie := strings.Split(response.Header.Get("Set-Cookie"), ";")[0]
+	assert.Contains(t, cookie, "wst_oidc=")
+	assert.Contains(t, response.Header.Get("Set-Cookie"), "path=/auth/fake")
+	query := idp.authorize(t, response.Header.Get("Location"), email, nonce)
+	var result wst.M
+	response = requestJson(t, "GET", "/auth/fake/callback?"+query.Encode(), nil, map[string]string{"Cookie": cookie}, &result)
+	if response.StatusCode == http.StatusOK {
+		// the cookie is cleared on the path where it was set
+		cleared := response.Header.Get("Set-Cookie")
+		assert.Contains(t, cleared, "wst_oidc=;")
+		assert.Contains(t, cleared, "path=/auth/fake")
+	}
+	return response.StatusCode, result
+}
+
+func Test_OidcLogin(t *testing.T) {
+
+	t.Parallel()
+
+	idp := startFakeIdP(t)
+
+	// a new user is created on the first login
+	email := fmt.Sprintf("oidc.%v@example.com", createRandomInt())
+	status, tokens := oidcLogin(t, idp, email)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEmpty(t, tokens.GetString("refreshToken"))
+	assert.Equal(t, http.StatusOK, getSelf(t, tokens.GetString("id")))
+
+	status, again := oidcLogin(t, idp, email)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, tokens["userId"], again["userId"])
+
+	// the created user has no password to log in with
+	created, err := userModel.FindById(tokens.GetString("userId"), nil, systemContext)
+	assert.NoError(t, err)
+	assert.Equal(t, passwords.UnusableHash, created.ToJSON().GetString("password"))
+	_, err = loginUser(email, passwords.UnusableHash, t)
+	assert.Error(t, err)
+
+	// existing users are only linked by email when they verified it
+	user := createUserThroughNetwork(t)
+	status, result := oidcLogin(t, idp, user.GetString("email"))
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "OIDC_ACCOUNT_NOT_VERIFIED", result.GetM("error").GetString("code"))
+
+	instance, err := userModel.FindById(user.GetString("id"), nil, systemContext)
+	assert.NoError(t, err)
+	_, err = instance.UpdateAttributes(wst.M{"emailVerified": true}, systemContext)
+	assert.NoError(t, err)
+	status, linked := oidcLogin(t, idp, user.GetString("email"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, user["id"], linked["userId"])
+
+	// the id_token must have the nonce of the login attempt
+	status, result = oidcLoginWithNonce(t, idp, email, "replayed")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "OIDC_LOGIN_FAILED", result.GetM("error").GetString("code"))
+
+	// the state must be the one of the cookie set by the login route
+	response := requestJson(t, "GET", "/auth/fake/login", nil, nil, nil)
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	cookie := strings.Split(response.Header.Get("Set-Cookie"), ";")[0]
+
+	response = requestJson(t, "GET", "/auth/fake/callback?code=any&state=forged", nil, map[string]string{"Cookie": cookie}, &result)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, "INVALID_OIDC_STATE", result.GetM("error").GetString("code"))
+
+	response = requestJson(t, "GET", "/auth/fake/callback?code=any&state=forged", nil, nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response = requestJson(t, "GET", "/auth/unknown/login", nil, nil, &result)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	assert.Equal(t, "OIDC_PROVIDER_NOT_FOUND", result.GetM("error").GetString("code"))
+
+}
@@ -0,0 +1,243 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/passwords"
+)
+
+// resetTokens holds the last password reset token of each email, see the "sendResetPasswordEmail" handler
+var resetTokens sync.Map
+
+func Test_ResetPassword(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	email := user["email"].(string)
+
+	status := requestJson(t, "POST", "/api/v1/users/reset-password", wst.M{"email": email}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	resetToken, found := resetTokens.Load(email)
+	assert.True(t, found)
+
+	// the response does not reveal whether the email exists
+	status = requestJson(t, "POST", "/api/v1/users/reset-password", wst.M{"email": "unknown." + email}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// the token is not a bearer token
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, map[string]string{"Authorization": "Bearer " + resetToken.(string)}, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	tokens, err := loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+
+	// a password rejected by the policy does not use the token
+	var result wst.M
+	status = requestJson(t, "POST", "/api/v1/users/reset-password/confirm", wst.M{"token": resetToken, "password": "abc"}, nil, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "PASSWORD_POLICY", result.GetM("error").GetString("code"))
+
+	status = requestJson(t, "POST", "/api/v1/users/reset-password/confirm", wst.M{"token": resetToken, "password": "efgh5678."}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	newTokens, err := loginUser(email, "efgh5678.", t)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, getSelf(t, newTokens.GetString("id")))
+
+	// the tokens issued before the reset are revoked
+	assert.Equal(t, http.StatusUnauthorized, getSelf(t, tokens.GetString("id")))
+	status = requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": tokens.GetString("refreshToken")}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// and it can only be used once
+	status = requestJson(t, "POST", "/api/v1/users/reset-password/confirm", wst.M{"token": resetToken, "password": "ijkl9012."}, nil, &result).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "INVALID_RESET_TOKEN", result.GetM("error").GetString("code"))
+
+}
+
+func Test_ChangePassword(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	email := user["email"].(string)
+	tokens, err := loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	bearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	// a reset token issued before the change is no longer valid after it
+	status := requestJson(t, "POST", "/api/v1/users/reset-password", wst.M{"email": email}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	resetToken, _ := resetTokens.Load(email)
+
+	var result wst.M
+	status = requestJson(t, "POST", "/api/v1/users/change-password", wst.M{"oldPassword": "wrong", "newPassword": "efgh5678."}, bearer, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "INVALID_PASSWORD", result.GetM("error").GetString("code"))
+
+	status = requestJson(t, "POST", "/api/v1/users/change-password", wst.M{"oldPassword": "abcd1234.", "newPassword": "efgh5678."}, bearer, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	newTokens, err := loginUser(email, "efgh5678.", t)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, getSelf(t, newTokens.GetString("id")))
+
+	// the tokens issued before the change are revoked, including the bearer
+	assert.Equal(t, http.StatusUnauthorized, getSelf(t, tokens.GetString("id")))
+	status = requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": tokens.GetString("refreshToken")}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status = requestJson(t, "POST", "/api/v1/users/reset-password/confirm", wst.M{"token": resetToken, "password": "ijkl9012."}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// anonymous requests are rejected
+	status = requestJson(t, "POST", "/api/v1/users/change-password", wst.M{"oldPassword": "efgh5678.", "newPassword": "ijkl9012."}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+}
+
+func Test_PasswordPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	policy := passwords.Policy{
+		MinLength:           10,
+		RequireLowercase:    true,
+		RequireUppercase:    true,
+		RequireDigit:        true,
+		RequireSymbol:       true,
+		DenyCommonPasswords: true,
+		Denylist:            []string{"Westack-go.2023"},
+	}
+	assert.Equal(t, []string{"presence"}, policy.Check("  "))
+	assert.Equal(t, []string{"length", "uppercase", "digit", "symbol"}, policy.Check("abc"))
+	assert.Equal(t, []string{"length", "lowercase", "symbol", "denylist"}, policy.Check("PASSWORD1"))
+	assert.Equal(t, []string{"denylist"}, policy.Check("westack-GO.2023"))
+	assert.Empty(t, policy.Check("Correct-horse-battery-9"))
+
+	// the zero policy only rejects the blank passwords
+	assert.Empty(t, (&passwords.Policy{}).Check("a"))
+
+}
+
+func Test_PasswordHashers(t *testing.T) {
+
+	t.Parallel()
+
+	bcryptHasher, err := passwords.NewHasher(passwords.HasherConfig{Cost: 4})
+	assert.NoError(t, err)
+	argon2idHasher, err := passwords.NewHasher(passwords.HasherConfig{Algorithm: "argon2id", Memory: 1024, Iterations: 1, Parallelism: 1})
+	assert.NoError(t, err)
+	_, err = passwords.NewHasher(passwords.HasherConfig{Algorithm: "md5"})
+	assert.Error(t, err)
+
+	bcryptHash, err := bcryptHasher.Hash("abcd1234.")
+	assert.NoError(t, err)
+	argon2idHash, err := argon2idHasher.Hash("abcd1234.")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^\$argon2id\$v=19\$m=1024,t=1,p=1\$`, argon2idHash)
+
+	// the hashes of another algorithm are still verified, and need a rehash
+	for _, hash := range []string{bcryptHash, argon2idHash} {
+		valid, err := passwords.Verify(argon2idHasher, hash, "abcd1234.")
+		assert.NoError(t, err)
+		assert.True(t, valid)
+		valid, err = passwords.Verify(argon2idHasher, hash, "abcd1234")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	}
+	assert.True(t, passwords.NeedsRehash(argon2idHasher, bcryptHash))
+	assert.False(t, passwords.NeedsRehash(argon2idHasher, argon2idHash))
+	assert.True(t, passwords.NeedsRehash(&passwords.Argon2idHasher{Memory: 2048, Iterations: 1, Parallelism: 1}, argon2idHash))
+	assert.True(t, passwords.NeedsRehash(&passwords.BcryptHasher{Cost: 5}, bcryptHash))
+
+	_, err = passwords.Verify(bcryptHasher, "abcd1234.", "abcd1234.")
+	assert.ErrorIs(t, err, passwords.ErrUnknownHash)
+
+}
+
+func Test_PasswordHistory(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	email := user["email"].(string)
+	tokens, err := loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	bearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	// each change revokes the bearer, so the user logs in again with the new password
+	changePassword := func(oldPassword string, newPassword string) (int, wst.M) {
+		var result wst.M
+		status := requestJson(t, "POST", "/api/v1/users/change-password", wst.M{"oldPassword": oldPassword, "newPassword": newPassword}, bearer, &result).StatusCode
+		if status == http.StatusNoContent {
+			tokens, err := loginUser(email, newPassword, t)
+			assert.NoError(t, err)
+			bearer = map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+		}
+		return status, result
+	}
+	status, result := changePassword("abcd1234.", "abc")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "PASSWORD_POLICY", result.GetM("error").GetString("code"))
+	assert.Equal(t, []interface{}{"length"}, result.GetM("error").GetM("details").GetM("codes")["password"])
+	status, result = changePassword("abcd1234.", "WeStack")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []interface{}{"denylist"}, result.GetM("error").GetM("details").GetM("codes")["password"])
+
+	// the last 3 passwords cannot be reused
+	status, result = changePassword("abcd1234.", "abcd1234.")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, []interface{}{"history"}, result.GetM("error").GetM("details").GetM("codes")["password"])
+	for _, password := range [][]string{{"abcd1234.", "efgh5678."}, {"efgh5678.", "ijkl9012."}} {
+		status, _ = changePassword(password[0], password[1])
+		assert.Equal(t, http.StatusNoContent, status)
+	}
+	status, _ = changePassword("ijkl9012.", "abcd1234.")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = changePassword("ijkl9012.", "mnop3456.")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = changePassword("mnop3456.", "abcd1234.")
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// the history is not exposed
+	var self wst.M
+	status = requestJson(t, "GET", "/api/v1/users/me", nil, bearer, &self).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, self["passwordHistory"])
+
+}
+
+func Test_PasswordRehash(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	email := user["email"].(string)
+	userId, err := primitive.ObjectIDFromHex(user.GetString("id"))
+	assert.NoError(t, err)
+
+	// a hash of an older configuration is replaced on the next successful login
+	oldHash, err := (&passwords.BcryptHasher{Cost: 4}).Hash("abcd1234.")
+	assert.NoError(t, err)
+	_, err = userModel.Datasource.UpdateById(context.Background(), userModel.CollectionName, userId, &wst.M{"password": oldHash})
+	assert.NoError(t, err)
+
+	_, err = loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+	stored, err := userModel.FindById(userId, nil, systemContext)
+	assert.NoError(t, err)
+	newHash := stored.ToJSON().GetString("password")
+	assert.NotEqual(t, oldHash, newHash)
+	assert.False(t, passwords.NeedsRehash(&passwords.BcryptHasher{Cost: 10}, newHash))
+	_, err = loginUser(email, "abcd1234.", t)
+	assert.NoError(t, err)
+
+}
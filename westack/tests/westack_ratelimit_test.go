@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// failedLogins holds the reason of the last failed login of each email, see the "after login failed" hook
+var failedLogins sync.Map
+
+func Test_LoginLockout(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	email := user["email"].(string)
+
+	// maxAttemptsPerAccount is 3 in the tests config
+	for i := 0; i < 3; i++ {
+		var result wst.M
+		status := requestJson(t, "POST", "/api/v1/users/login", wst.M{"email": email, "password": "wrong"}, nil, &result).StatusCode
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "LOGIN_FAILED", result.GetM("error").GetString("code"))
+	}
+	reason, _ := failedLogins.Load(email)
+	assert.Equal(t, "INVALID_PASSWORD", reason)
+
+	// the account is locked out, even with the right password
+	response := requestJson(t, "POST", "/api/v1/users/login", wst.M{"email": email, "password": "abcd1234."}, nil, nil)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	retryAfter, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60)
+
+	// but the other accounts are not
+	otherUser := createUserThroughNetwork(t)
+	_, err = loginUser(otherUser["email"].(string), "abcd1234.", t)
+	assert.NoError(t, err)
+
+}
+
+func Test_RemoteMethodRateLimit(t *testing.T) {
+
+	t.Parallel()
+
+	// the method allows 3 requests per minute
+	for i := 0; i < 3; i++ {
+		var result wst.M
+		status := requestJson(t, "GET", "/api/v1/empties/ping", nil, nil, &result).StatusCode
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, true, result["pong"])
+	}
+	var result wst.M
+	status := requestJson(t, "GET", "/api/v1/empties/ping", nil, nil, &result).StatusCode
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, "TOO_MANY_REQUESTS", result.GetM("error").GetString("code"))
+
+}
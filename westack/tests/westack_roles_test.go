@@ -2,6 +2,7 @@ package tests
 
 import (
 	"fmt"
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -148,3 +149,114 @@ func Test_NewUserAndRoleEmptyRoles(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, user)
 }
+
+func Test_RoleManagementApi(t *testing.T) {
+
+	t.Parallel()
+
+	randN := createRandomInt()
+	_, err := westack.UpsertUserWithRoles(app, westack.UserWithRoles{
+		Username: fmt.Sprintf("admin-%v", randN),
+		Password: "abcd1234.",
+		Roles:    []string{"admin"},
+	}, systemContext)
+	assert.NoError(t, err)
+	var tokens wst.M
+	status := requestJson(t, "POST", "/api/v1/users/login", wst.M{"username": fmt.Sprintf("admin-%v", randN), "password": "abcd1234."}, nil, &tokens).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	admin := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+
+	member := createUserThroughNetwork(t)
+	tokens, err = loginUser(member.GetString("email"), "abcd1234.", t)
+	assert.NoError(t, err)
+	memberBearer := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+	memberRoles := fmt.Sprintf("/api/v1/users/roles/editor-%v/users/%v", randN, member.GetString("id"))
+
+	// only the admins manage the roles
+	status = requestJson(t, "GET", "/api/v1/users/roles", nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/admin/users/%v", member.GetString("id")), nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the "probeViewer" role of the Empty policies may exist from a previous run
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": "probeViewer"}, admin, nil).StatusCode
+	assert.Contains(t, []int{http.StatusOK, http.StatusConflict}, status)
+	var editor wst.M
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": fmt.Sprintf("editor-%v", randN), "inherits": []string{"probeViewer"}}, admin, &editor).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []interface{}{"probeViewer"}, editor["inherits"])
+	var result wst.M
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": fmt.Sprintf("editor-%v", randN)}, admin, &result).StatusCode
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "ROLE_EXISTS", result.GetM("error").GetString("code"))
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": fmt.Sprintf("writer-%v", randN), "inherits": []string{fmt.Sprintf("unknown-%v", randN)}}, admin, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "ROLE_NOT_FOUND", result.GetM("error").GetString("code"))
+
+	// the roles cannot replace the links of the actions, which share their namespace
+	for _, action := range []string{"read", "write", "create", "findMany", "manageRoles", "login"} {
+		status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": action, "inherits": []string{"probeViewer"}}, admin, &result).StatusCode
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "RESERVED_ROLE_NAME", result.GetM("error").GetString("code"))
+	}
+	// nor the roles that casbin gives to every user
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": "USER", "inherits": []string{"admin"}}, admin, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "RESERVED_ROLE_NAME", result.GetM("error").GetString("code"))
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": "$everyone", "inherits": []string{"admin"}}, admin, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	var roles wst.A
+	status = requestJson(t, "GET", "/api/v1/users/roles", nil, admin, &roles).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, reduceByKey(roles, "name"), "read")
+	assert.NotContains(t, reduceByKey(roles, "name"), "USER")
+
+	// a "USER" role stored before the name was reserved cannot inherit roles, but can be deleted
+	roleModel, err := app.FindModel("role")
+	assert.NoError(t, err)
+	_, err = roleModel.Create(wst.M{"name": "USER"}, systemContext)
+	assert.NoError(t, err)
+	status = requestJson(t, "PUT", "/api/v1/users/roles/USER/inherits", wst.M{"inherits": []string{"admin"}}, admin, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "RESERVED_ROLE_NAME", result.GetM("error").GetString("code"))
+	status = requestJson(t, "DELETE", "/api/v1/users/roles/USER", nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/editor-%v/inherits", randN), wst.M{"inherits": []string{fmt.Sprintf("editor-%v", randN)}}, admin, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "ROLE_INHERITANCE_CYCLE", result.GetM("error").GetString("code"))
+
+	status = requestJson(t, "GET", "/api/v1/users/roles", nil, admin, &roles).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, reduceByKey(roles, "name"), fmt.Sprintf("editor-%v", randN))
+
+	// the role changes apply to the access token of the member, without a new login
+	status = requestJson(t, "GET", "/api/v1/empties/probe-role", nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status = requestJson(t, "PUT", memberRoles, nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	status = requestJson(t, "GET", "/api/v1/empties/probe-role", nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/editor-%v/inherits", randN), wst.M{"inherits": []string{}}, admin, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	status = requestJson(t, "GET", "/api/v1/empties/probe-role", nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/editor-%v/inherits", randN), wst.M{"inherits": []string{"probeViewer"}}, admin, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	status = requestJson(t, "GET", "/api/v1/empties/probe-role", nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+
+	status = requestJson(t, "DELETE", memberRoles, nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	status = requestJson(t, "GET", "/api/v1/empties/probe-role", nil, memberBearer, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status = requestJson(t, "DELETE", fmt.Sprintf("/api/v1/users/roles/editor-%v", randN), nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	status = requestJson(t, "GET", "/api/v1/users/roles", nil, admin, &roles).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, reduceByKey(roles, "name"), fmt.Sprintf("editor-%v", randN))
+	status = requestJson(t, "PUT", memberRoles, nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNotFound, status)
+
+}
@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fredyk/westack-go/westack"
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+func tenantHeaders(bearer string, tenant string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + bearer, "X-Tenant-ID": tenant}
+}
+
+func Test_MultiTenantModel(t *testing.T) {
+
+	t.Parallel()
+
+	randN := createRandomInt()
+	_, err := westack.UpsertUserWithRoles(app, westack.UserWithRoles{
+		Username: fmt.Sprintf("tenants-admin-%v", randN),
+		Password: "abcd1234.",
+		Roles:    []string{"admin"},
+	}, systemContext)
+	assert.NoError(t, err)
+	var tokens wst.M
+	status := requestJson(t, "POST", "/api/v1/users/login", wst.M{"username": fmt.Sprintf("tenants-admin-%v", randN), "password": "abcd1234."}, nil, &tokens).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	admin := map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}
+	memberRole := fmt.Sprintf("member-%v", randN)
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": memberRole}, admin, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+
+	// the users are members of the tenants where they are assigned a role
+	acmeUser := createUserThroughNetwork(t)
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/%v/users/%v?tenant=acme", memberRole, acmeUser.GetString("id")), nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	globexUser := createUserThroughNetwork(t)
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/%v/users/%v?tenant=globex", memberRole, globexUser.GetString("id")), nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	var result wst.M
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/%v/users/%v?tenant=*", memberRole, globexUser.GetString("id")), nil, admin, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "INVALID_TENANT", result.GetM("error").GetString("code"))
+
+	tokens, err = loginUser(acmeUser.GetString("email"), "abcd1234.", t)
+	assert.NoError(t, err)
+	acmeBearer := tokens.GetString("id")
+	acme := tenantHeaders(acmeBearer, "acme")
+	tokens, err = loginUser(globexUser.GetString("email"), "abcd1234.", t)
+	assert.NoError(t, err)
+	globex := tenantHeaders(tokens.GetString("id"), "globex")
+	projectName := fmt.Sprintf("project-%v", randN)
+
+	// the tenant is required, cannot be a casbin pattern, and must be one of the user
+	status = requestJson(t, "GET", "/api/v1/projects", nil, map[string]string{"Authorization": "Bearer " + acmeBearer}, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "TENANT_REQUIRED", result.GetM("error").GetString("code"))
+	status = requestJson(t, "GET", "/api/v1/projects", nil, tenantHeaders(acmeBearer, "*"), &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "INVALID_TENANT", result.GetM("error").GetString("code"))
+	status = requestJson(t, "GET", "/api/v1/projects", nil, tenantHeaders(acmeBearer, "globex"), &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "TENANT_NOT_ALLOWED", result.GetM("error").GetString("code"))
+
+	// the instances are stamped with the tenant, which cannot be set to another one
+	var project wst.M
+	status = requestJson(t, "POST", "/api/v1/projects", wst.M{"name": projectName}, acme, &project).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "acme", project.GetString("tenantId"))
+	status = requestJson(t, "POST", "/api/v1/projects", wst.M{"name": projectName, "tenantId": "globex"}, acme, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "TENANT_MISMATCH", result.GetM("error").GetString("code"))
+
+	// the policies are per tenant: "create" is only allowed in acme
+	status = requestJson(t, "POST", "/api/v1/projects", wst.M{"name": projectName}, globex, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the reads are scoped to the tenant
+	filter := url.QueryEscape(fmt.Sprintf(`{"where":{"name":%q}}`, projectName))
+	status = requestJson(t, "GET", "/api/v1/projects/count?filter="+filter, nil, acme, &result).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 1, result["count"])
+	status = requestJson(t, "GET", "/api/v1/projects/count?filter="+filter, nil, globex, &result).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 0, result["count"])
+	status = requestJson(t, "GET", "/api/v1/projects/"+project.GetString("id"), nil, acme, &result).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, projectName, result.GetString("name"))
+
+	// the instances of other tenants are not found
+	status = requestJson(t, "PATCH", "/api/v1/projects/"+project.GetString("id"), wst.M{"name": "renamed"}, globex, nil).StatusCode
+	assert.Equal(t, http.StatusNotFound, status)
+	status = requestJson(t, "DELETE", "/api/v1/projects/"+project.GetString("id"), nil, globex, nil).StatusCode
+	assert.Equal(t, http.StatusNotFound, status)
+	status = requestJson(t, "PATCH", "/api/v1/projects/"+project.GetString("id"), wst.M{"tenantId": "globex"}, acme, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "TENANT_MISMATCH", result.GetM("error").GetString("code"))
+
+	status = requestJson(t, "PATCH", "/api/v1/projects/"+project.GetString("id"), wst.M{"name": projectName + "-renamed"}, acme, &result).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "acme", result.GetString("tenantId"))
+	// the instances of a multi-tenant model included by other models are scoped to the tenant too, and require it
+	milestoneName := fmt.Sprintf("milestone-%v", randN)
+	status = requestJson(t, "POST", "/api/v1/milestones", wst.M{"name": milestoneName, "projectId": project.GetString("id")}, acme, nil).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	filter = url.QueryEscape(fmt.Sprintf(`{"where":{"name":%q},"include":[{"relation":"project"}]}`, milestoneName))
+	var milestones wst.A
+	status = requestJson(t, "GET", "/api/v1/milestones?filter="+filter, nil, acme, &milestones).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, milestones, 1) {
+		assert.Equal(t, projectName+"-renamed", milestones[0].GetM("project").GetString("name"))
+	}
+	status = requestJson(t, "GET", "/api/v1/milestones?filter="+filter, nil, globex, &milestones).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, milestones, 1) {
+		assert.Nil(t, milestones[0]["project"])
+	}
+	status = requestJson(t, "GET", "/api/v1/milestones?filter="+filter, nil, map[string]string{"Authorization": "Bearer " + acmeBearer}, &result).StatusCode
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "TENANT_REQUIRED", result.GetM("error").GetString("code"))
+
+	// and so are the operations of the server without tenant, unless the system performs them
+	projectModel, err := app.FindModel("Project")
+	assert.NoError(t, err)
+	_, err = projectModel.FindMany(nil, &model.EventContext{}).All()
+	assert.Error(t, err)
+	_, err = projectModel.Count(nil, &model.EventContext{})
+	assert.Error(t, err)
+	count, err := projectModel.Count(&wst.Filter{Where: &wst.Where{"name": projectName + "-renamed"}}, systemContext)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, count)
+	milestoneModel, err := app.FindModel("Milestone")
+	assert.NoError(t, err)
+	_, err = milestoneModel.FindMany(&wst.Filter{Include: &wst.Include{{Relation: "project"}}}, &model.EventContext{}).All()
+	assert.Error(t, err)
+
+	status = requestJson(t, "DELETE", "/api/v1/projects/"+project.GetString("id"), nil, acme, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+
+	// the admins of a tenant cannot define the roles, which apply to all the tenants
+	tenantAdmin := createUserThroughNetwork(t)
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/admin/users/%v?tenant=acme", tenantAdmin.GetString("id")), nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	tokens, err = loginUser(tenantAdmin.GetString("email"), "abcd1234.", t)
+	assert.NoError(t, err)
+	acmeAdmin := tenantHeaders(tokens.GetString("id"), "acme")
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": fmt.Sprintf("acme-%v", randN), "inherits": []string{"admin"}}, acmeAdmin, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "TENANT_CANNOT_DEFINE_ROLES", result.GetM("error").GetString("code"))
+	status = requestJson(t, "PUT", fmt.Sprintf("/api/v1/users/roles/%v/inherits", memberRole), wst.M{"inherits": []string{"admin"}}, acmeAdmin, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "TENANT_CANNOT_DEFINE_ROLES", result.GetM("error").GetString("code"))
+	status = requestJson(t, "DELETE", fmt.Sprintf("/api/v1/users/roles/%v", memberRole), nil, acmeAdmin, &result).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+	status = requestJson(t, "POST", "/api/v1/users/roles", wst.M{"name": fmt.Sprintf("acme-%v", randN)}, map[string]string{"Authorization": "Bearer " + tokens.GetString("id")}, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the members of a tenant are no longer allowed in it once their roles there are unassigned
+	status = requestJson(t, "DELETE", fmt.Sprintf("/api/v1/users/roles/%v/users/%v?tenant=acme", memberRole, acmeUser.GetString("id")), nil, admin, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+	status = requestJson(t, "GET", "/api/v1/projects", nil, acme, nil).StatusCode
+	assert.Equal(t, http.StatusForbidden, status)
+
+}
@@ -7,12 +7,17 @@ import (
 	"fmt"
 	"github.com/fredyk/westack-go/westack/datasource"
 	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/ratelimit"
 	"io"
 	"log"
 	"math/big"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +29,10 @@ import (
 
 var app *westack.WeStack
 
+// disconnectedRequests has the channels where the requests with the "waitForDisconnect" query param send the error of
+// their context once it is done
+var disconnectedRequests sync.Map
+
 func init() {
 	app = westack.New(westack.Options{
 		DatasourceOptions: &map[string]*datasource.Options{
@@ -87,6 +96,14 @@ func init() {
 			fmt.Println("saving user")
 			return nil
 		})
+		userModel.Observe("after login failed", func(ctx *model.EventContext) error {
+			failedLogins.Store(ctx.Data.GetString("email"), ctx.Data.GetString("reason"))
+			return nil
+		})
+		userModel.On("sendResetPasswordEmail", func(ctx *model.EventContext) error {
+			resetTokens.Store(ctx.Instance.ToJSON().GetString("email"), ctx.Data.GetString("resetToken"))
+			return nil
+		})
 
 		customerModel, err = app.FindModel("Customer")
 		if err != nil {
@@ -104,6 +121,52 @@ func init() {
 		if err != nil {
 			log.Fatalf("failed to find model: %v", err)
 		}
+		emptyModel, err = app.FindModel("Empty")
+		if err != nil {
+			log.Fatalf("failed to find model: %v", err)
+		}
+		emptyModel.Observe("before load", func(ctx *model.EventContext) error {
+			if ctx.BaseContext.Remote != nil && ctx.BaseContext.Ctx.Query("waitForTimeout") == "true" {
+				// a slow query, that gives up when the timeout of the remote method expires
+				<-ctx.GetContext().Done()
+				return ctx.GetContext().Err()
+			}
+			if key := ctx.BaseContext.Ctx.Query("waitForDisconnect"); ctx.BaseContext.Remote != nil && key != "" {
+				// a slow query, whose client closes the connection before it ends
+				done := make(chan error, 1)
+				disconnectedRequests.Store(key, done)
+				<-ctx.GetContext().Done()
+				done <- ctx.GetContext().Err()
+				return ctx.GetContext().Err()
+			}
+			return nil
+		})
+
+		emptyModel.RemoteMethod(func(ctx *model.EventContext) error {
+			ctx.Result = wst.M{"pong": true}
+			return nil
+		}, model.RemoteMethodOptions{
+			Name: "ping",
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/ping",
+				Verb: "get",
+			},
+			RateLimit: &ratelimit.Limit{
+				Max:    3,
+				Window: time.Minute,
+			},
+		})
+
+		emptyModel.RemoteMethod(func(ctx *model.EventContext) error {
+			ctx.Result = wst.M{"allowed": true}
+			return nil
+		}, model.RemoteMethodOptions{
+			Name: "probeRole",
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/probe-role",
+				Verb: "get",
+			},
+		})
 
 		noteModel.Observe("before load", func(ctx *model.EventContext) error {
 			if ctx.BaseContext.Remote != nil {
@@ -160,6 +223,31 @@ func init() {
 	time.Sleep(300 * time.Millisecond)
 }
 
+// requestJson sends a request to the app with executeRequest. The body is sent as JSON, and the JSON of the response,
+// if any, is decoded into result unless it is nil. The body of the returned response is already read
+func requestJson(t *testing.T, method string, path string, body wst.M, headers map[string]string, result interface{}) *http.Response {
+	request, err := http.NewRequest(method, path, jsonToReader(body))
+	assert.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	response, err := executeRequest(request)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+	out, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	if result != nil && len(out) > 0 && strings.HasPrefix(response.Header.Get("Content-Type"), "application/json") {
+		// the results are reused between requests, so the previous value is not merged into the new one
+		target := reflect.ValueOf(result).Elem()
+		target.Set(reflect.Zero(target.Type()))
+		assert.NoError(t, json.Unmarshal(out, result))
+	}
+	return response
+}
+
 func createUser(t *testing.T, userData wst.M) (wst.M, error) {
 	b := createBody(t, userData)
 
@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+func Test_RemoteMethodTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, time.Second, emptyModel.RemoteMethodTimeout("findMany"))
+	assert.Equal(t, time.Duration(0), emptyModel.RemoteMethodTimeout("count"))
+
+	start := time.Now()
+	var parsed wst.M
+	response := requestJson(t, "GET", "/api/v1/empties?waitForTimeout=true", nil, nil, &parsed)
+	assert.Less(t, time.Since(start), 4*time.Second)
+	assert.Equal(t, http.StatusGatewayTimeout, response.StatusCode)
+	assert.Equal(t, "TIMEOUT", parsed.GetM("error").GetString("code"))
+
+}
+
+func Test_RemoteMethodClientDisconnect(t *testing.T) {
+
+	t.Parallel()
+
+	key := fmt.Sprintf("%v", createRandomInt())
+	conn, err := net.Dial("tcp", "localhost:8019")
+	assert.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "GET /api/v1/empties?waitForDisconnect=%v HTTP/1.1\r\nHost: localhost\r\n\r\n", key)
+	assert.NoError(t, err)
+
+	// the client goes away while the query runs, before the 1 second timeout of findMany
+	var done interface{}
+	assert.Eventually(t, func() bool {
+		var ok bool
+		done, ok = disconnectedRequests.Load(key)
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+	err = conn.Close()
+	assert.NoError(t, err)
+	if done == nil {
+		return
+	}
+	select {
+	case err = <-done.(chan error):
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(3 * time.Second):
+		assert.Fail(t, "the request was not cancelled")
+	}
+
+}
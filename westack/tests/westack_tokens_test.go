@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+func getSelf(t *testing.T, bearer string) int {
+	return requestJson(t, "GET", "/api/v1/users/me", nil, map[string]string{"Authorization": "Bearer " + bearer}, nil).StatusCode
+}
+
+func Test_RefreshTokenRotation(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	tokens, err := loginUser(user["email"].(string), "abcd1234.", t)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokens.GetString("refreshToken"))
+	assert.EqualValues(t, 900, tokens["ttl"])
+
+	// refresh tokens are not valid bearers
+	assert.Equal(t, http.StatusUnauthorized, getSelf(t, tokens.GetString("refreshToken")))
+
+	var refreshed wst.M
+	status := requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": tokens.GetString("refreshToken")}, nil, &refreshed).StatusCode
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, user["id"], refreshed["userId"])
+	assert.NotEqual(t, tokens.GetString("refreshToken"), refreshed.GetString("refreshToken"))
+	assert.Equal(t, http.StatusOK, getSelf(t, refreshed.GetString("id")))
+
+	// the refresh token was rotated, so it cannot be used again
+	var reused wst.M
+	status = requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": tokens.GetString("refreshToken")}, nil, &reused).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "INVALID_REFRESH_TOKEN", reused.GetM("error").GetString("code"))
+
+	// and the reuse revokes the tokens issued with it, but not the ones of other logins
+	assert.Equal(t, http.StatusUnauthorized, getSelf(t, refreshed.GetString("id")))
+	status = requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": refreshed.GetString("refreshToken")}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+	tokens, err = loginUser(user["email"].(string), "abcd1234.", t)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, getSelf(t, tokens.GetString("id")))
+
+	status = requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": "invalid"}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+}
+
+func Test_Logout(t *testing.T) {
+
+	t.Parallel()
+
+	user := createUserThroughNetwork(t)
+	tokens, err := loginUser(user["email"].(string), "abcd1234.", t)
+	assert.NoError(t, err)
+	accessToken := tokens.GetString("id")
+	assert.Equal(t, http.StatusOK, getSelf(t, accessToken))
+
+	status := requestJson(t, "POST", "/api/v1/users/logout", wst.M{"refreshToken": tokens.GetString("refreshToken")}, map[string]string{"Authorization": "Bearer " + accessToken}, nil).StatusCode
+	assert.Equal(t, http.StatusNoContent, status)
+
+	assert.Equal(t, http.StatusUnauthorized, getSelf(t, accessToken))
+	status = requestJson(t, "POST", "/api/v1/users/refresh", wst.M{"refreshToken": tokens.GetString("refreshToken")}, nil, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the token is already revoked
+	status = requestJson(t, "POST", "/api/v1/users/logout", wst.M{}, map[string]string{"Authorization": "Bearer " + accessToken}, nil).StatusCode
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+}
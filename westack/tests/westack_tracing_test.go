@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/tracing"
+)
+
+func Test_TracingSpans(t *testing.T) {
+
+	recorder := tracetest.NewSpanRecorder()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer tracing.SetTracerProvider(nil)
+
+	rootContext, rootSpan := tracing.Start(context.Background(), "test")
+	tracedContext := &model.EventContext{
+		Bearer:  &model.BearerToken{User: &model.BearerUser{System: true}},
+		Context: rootContext,
+	}
+
+	user, err := userModel.Create(wst.M{
+		"username": fmt.Sprintf("traceduser%d", createRandomInt()),
+		"password": "abcd1234.",
+	}, tracedContext)
+	assert.NoError(t, err)
+	note, err := noteModel.Create(wst.M{
+		"title":  "Traced note",
+		"userId": user.Id,
+	}, tracedContext)
+	assert.NoError(t, err)
+
+	notes, err := noteModel.FindMany(&wst.Filter{
+		Where:   &wst.Where{"_id": note.Id},
+		Include: &wst.Include{{Relation: "user"}},
+	}, tracedContext).All()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(notes))
+	rootSpan.End()
+
+	spanNames := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == rootSpan.SpanContext().TraceID() {
+			spanNames[span.Name()] = true
+		}
+	}
+	for _, expected := range []string{
+		"Datasource.Create",
+		"Hook Note.__operation__before_save",
+		"Datasource.FindMany",
+		"mergeRelated Note.user",
+	} {
+		assert.Truef(t, spanNames[expected], "missing span %v in %v", expected, spanNames)
+	}
+
+}
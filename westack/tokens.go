@@ -0,0 +1,223 @@
+package westack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/jwtkeys"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const defaultAccessTokenTtl = 15 * time.Minute
+const defaultRefreshTokenTtl = 14 * 24 * time.Hour
+
+// tokenTtl reads a ttl, in seconds, from the "tokens" section of the config
+func (app *WeStack) tokenTtl(key string, defaultTtl time.Duration) time.Duration {
+	if seconds := app.Viper.GetFloat64("tokens." + key); seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return defaultTtl
+}
+
+// loadJwtKeys reads the RS256 and ES256 keys of the "jwt" section of the config. The tokens are signed with the
+// "jwt.signingKid" key, and the tokens of the other keys are still accepted, to rotate the keys without logging out
+// the users
+func loadJwtKeys(appViper *viper.Viper, secret []byte) *jwtkeys.KeySet {
+	var config jwtkeys.Config
+	err := appViper.UnmarshalKey("jwt", &config)
+	if err != nil {
+		log.Fatalf("Invalid jwt config: %v", err)
+	}
+	keySet, err := jwtkeys.Load(config, secret)
+	if err != nil {
+		log.Fatalf("Could not load the jwt keys: %v", err)
+	}
+	return keySet
+}
+
+// JwtKeys returns the keys that sign and verify the tokens of the app
+func (app *WeStack) JwtKeys() *jwtkeys.KeySet {
+	return app.jwtKeys
+}
+
+// loadTokenDenylist stores the revoked tokens in the "tokens.denylistDatasource" datasource. By default, they are
+// kept in memory, so they are not shared by the instances of the app and are lost on restart
+func (app *WeStack) loadTokenDenylist() {
+	dsName := app.Viper.GetString("tokens.denylistDatasource")
+	var ds *datasource.Datasource
+	if dsName != "" {
+		var err error
+		ds, err = app.FindDatasource(dsName)
+		if err != nil {
+			log.Fatalf("Invalid tokens.denylistDatasource: %v", err)
+		}
+	} else {
+		dsViper := viper.New()
+		dsViper.Set("tokenDenylist.connector", "memorykv")
+		ds = datasource.New("tokenDenylist", dsViper, context.Background())
+		err := ds.Initialize()
+		if err != nil {
+			log.Fatalf("Could not create the token denylist: %v", err)
+		}
+	}
+	app.tokenDenylist = model.NewTokenDenylist(ds)
+}
+
+// TokenDenylist returns the denylist of the app, to revoke tokens from hooks or custom routes
+func (app *WeStack) TokenDenylist() *model.TokenDenylist {
+	return app.tokenDenylist
+}
+
+func (app *WeStack) isTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if app.tokenDenylist == nil {
+		return false, nil
+	}
+	return app.tokenDenylist.IsRevoked(ctx, jti)
+}
+
+func (app *WeStack) isUserTokenRevoked(ctx context.Context, claims wst.M) (bool, error) {
+	if app.tokenDenylist == nil {
+		return false, nil
+	}
+	return app.tokenDenylist.IsUserTokenRevoked(ctx, jwt.MapClaims(claims))
+}
+
+// revokeUserTokens revokes the access and refresh tokens of the user issued until now, after a password change
+func (app *WeStack) revokeUserTokens(ctx context.Context, user *model.Instance) error {
+	return app.tokenDenylist.RevokeUserTokens(ctx, model.GetIDAsString(user.Id), time.Now().Add(app.tokenTtl("refreshTokenTtl", defaultRefreshTokenTtl)))
+}
+
+// signToken adds the type, id and lifetime claims and signs the token
+func (app *WeStack) signToken(claims jwt.MapClaims, tokenType string, ttl time.Duration) (string, error) {
+	claims["typ"] = tokenType
+	claims["jti"] = uuid.NewString()
+	claims["created"] = time.Now().UnixMilli()
+	claims["ttl"] = ttl.Milliseconds()
+	return app.jwtKeys.Sign(claims)
+}
+
+// issueTokens creates a short-lived access token and the refresh token to renew it. The access tokens of the users of a
+// multi-tenant model have the tenant of the user too. Both belong to the family of the refreshed token, or to a new
+// one on login, so that they can be revoked at once
+func (app *WeStack) issueTokens(user *model.Instance, roleNames []string, family string) (fiber.Map, error) {
+	if family == "" {
+		family = uuid.NewString()
+	}
+	userIdHex := model.GetIDAsString(user.Id)
+	accessTokenTtl := app.tokenTtl("accessTokenTtl", defaultAccessTokenTtl)
+	accessClaims := jwt.MapClaims{
+		"userId": userIdHex,
+		"roles":  roleNames,
+		"fam":    family,
+	}
+	if user.Model.IsMultiTenant() {
+		accessClaims[model.TenantClaim(app.Viper)] = user.ToJSON().GetString(user.Model.TenantField())
+	}
+	accessToken, err := app.signToken(accessClaims, model.AccessTokenType, accessTokenTtl)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := app.signToken(jwt.MapClaims{
+		"userId": userIdHex,
+		"fam":    family,
+	}, model.RefreshTokenType, app.tokenTtl("refreshTokenTtl", defaultRefreshTokenTtl))
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"id":           accessToken,
+		"userId":       userIdHex,
+		"ttl":          int64(accessTokenTtl.Seconds()),
+		"refreshToken": refreshToken,
+	}, nil
+}
+
+func invalidRefreshTokenError() error {
+	return wst.CreateError(fiber.ErrUnauthorized, "INVALID_REFRESH_TOKEN", fiber.Map{"message": "invalid refresh token"}, "Error")
+}
+
+// parseRefreshToken checks the signature, type and expiration of a refresh token. The denylist is checked when the
+// token is revoked, see the "refresh" handler
+func (app *WeStack) parseRefreshToken(rawToken string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(rawToken, app.jwtKeys.Keyfunc)
+	if err != nil || !token.Valid {
+		return nil, invalidRefreshTokenError()
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != model.RefreshTokenType || model.TokenID(claims) == "" {
+		return nil, invalidRefreshTokenError()
+	}
+	if time.Now().After(model.TokenExpiresAt(claims)) {
+		return nil, invalidRefreshTokenError()
+	}
+	return claims, nil
+}
+
+// userRoleNames returns the roles of the user in the tenant of the request, to include them in the access tokens
+func (app *WeStack) userRoleNames(user model.Instance, ctx *model.EventContext) ([]string, error) {
+	return app.findUserRoleNames(ctx.GetContext(), user.Id, ctx.GetTenant())
+}
+
+// findUserRoleNames reads the roles of the role mappings of a user in a tenant, plus the "USER" role that all of them
+// have
+func (app *WeStack) findUserRoleNames(ctx context.Context, userId interface{}, tenant string) ([]string, error) {
+	roleNames, _, err := app.findUserRoles(ctx, userId, tenant)
+	return roleNames, err
+}
+
+// findUserRoles reads the roles of a user in a tenant: the ones of its role mappings without tenant, which apply to all
+// the tenants, and the ones assigned in the tenant, which make the user a member of it
+func (app *WeStack) findUserRoles(ctx context.Context, userId interface{}, tenant string) ([]string, bool, error) {
+	roleNames := []string{"USER"}
+	if app.roleMappingModel == nil {
+		return roleNames, false, nil
+	}
+	principalIds := []wst.M{{"principalId": userId}}
+	if objectId, ok := userId.(primitive.ObjectID); ok {
+		principalIds = append(principalIds, wst.M{"principalId": objectId.Hex()})
+	}
+	roleContext := &model.EventContext{
+		BaseContext:            systemContextFrom(&model.EventContext{Context: ctx, Tenant: tenant}),
+		DisableTypeConversions: true,
+	}
+	roleEntries, err := app.roleMappingModel.FindMany(&wst.Filter{Where: &wst.Where{
+		"principalType":        "USER",
+		"$or":                  principalIds,
+		roleMappingTenantField: roleMappingTenantWhere(tenant),
+	}, Include: &wst.Include{{Relation: "role"}}}, roleContext).All()
+	if err != nil {
+		return nil, false, err
+	}
+	member := false
+	for _, roleEntry := range roleEntries {
+		role := roleEntry.GetOne("role")
+		if role != nil {
+			roleNames = append(roleNames, role.ToJSON().GetString("name"))
+			if tenant != "" && roleEntry.ToJSON().GetString(roleMappingTenantField) == tenant {
+				member = true
+			}
+		}
+	}
+	return roleNames, member, nil
+}
+
+// randomTokenValue returns 256 random bits, url-safe encoded
+func randomTokenValue() string {
+	value := make([]byte, 32)
+	_, err := rand.Read(value)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(value)
+}
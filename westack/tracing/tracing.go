@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName identifies the spans created by westack
+const InstrumentationName = "github.com/fredyk/westack-go"
+
+var providerLock sync.RWMutex
+var provider trace.TracerProvider
+
+// SetTracerProvider sets the provider of the westack spans. When it is not set, the global provider from
+// otel.GetTracerProvider() is used, which does not record anything until the application configures it
+func SetTracerProvider(tracerProvider trace.TracerProvider) {
+	providerLock.Lock()
+	defer providerLock.Unlock()
+	provider = tracerProvider
+}
+
+// Tracer returns the tracer used for the westack spans
+func Tracer() trace.Tracer {
+	providerLock.RLock()
+	tracerProvider := provider
+	providerLock.RUnlock()
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	return tracerProvider.Tracer(InstrumentationName)
+}
+
+// Start starts a span as a child of the span in ctx, if any. A nil ctx is treated as context.Background()
+func Start(ctx context.Context, spanName string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return Tracer().Start(ctx, spanName, trace.WithAttributes(attributes...))
+}
+
+// End records err in the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// requestHeaderCarrier adapts the fasthttp request headers to the otel propagators
+type requestHeaderCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (carrier requestHeaderCarrier) Get(key string) string {
+	return string(carrier.header.Peek(key))
+}
+
+func (carrier requestHeaderCarrier) Set(key string, value string) {
+	carrier.header.Set(key, value)
+}
+
+func (carrier requestHeaderCarrier) Keys() []string {
+	var keys []string
+	carrier.header.VisitAll(func(key, value []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+var _ propagation.TextMapCarrier = requestHeaderCarrier{}
+
+// ExtractRequestContext returns ctx with the remote span context sent in the request headers, like traceparent,
+// using the global propagator
+func ExtractRequestContext(ctx context.Context, header *fasthttp.RequestHeader) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, requestHeaderCarrier{header: header})
+}
@@ -15,6 +15,8 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/model"
 )
 
 func gRPCCallWithQueryParams[InputT any, ClientT interface{}, OutputT proto.Message](serviceUrl string, clientConstructor func(cc grpc.ClientConnInterface) ClientT, clientMethod func(ClientT, context.Context, *InputT, ...grpc.CallOption) (OutputT, error)) func(ctx *fiber.Ctx) error {
@@ -22,24 +24,24 @@ func gRPCCallWithQueryParams[InputT any, ClientT interface{}, OutputT proto.Mess
 		//fmt.Printf("%s %T \n", serviceUrl, clientMethod)
 		var rawParamsQuery InputT
 		if err := ctx.QueryParser(&rawParamsQuery); err != nil {
-			fmt.Printf("GRPCCallWithQueryParams Query Parse Error: %s\n", err)
+			logging.Default().Error("GRPCCallWithQueryParams query parse error", "requestId", model.RequestID(ctx), "error", err)
 			return SendError(ctx, err)
 		}
 		client, err := obtainConnectedClient(serviceUrl, clientConstructor)
 		if err != nil {
-			fmt.Printf("GRPCCallWithQueryParams Connect Error: %s\n", err)
+			logging.Default().Error("GRPCCallWithQueryParams connect error", "requestId", model.RequestID(ctx), "error", err)
 			return SendError(ctx, err)
 		}
 
 		res, err := clientMethod(client, ctx.Context(), &rawParamsQuery)
 		if err != nil {
-			fmt.Printf("GRPCCallWithQueryParams Call Error: %v --> %s\n", ctx.Route().Name, err)
+			logging.Default().Error("GRPCCallWithQueryParams call error", "requestId", model.RequestID(ctx), "route", ctx.Route().Name, "error", err)
 			return SendError(ctx, err)
 		}
 		m := jsonpb.Marshaler{EmitDefaults: true}
 		toSend, err := m.MarshalToString(res)
 		if err != nil {
-			fmt.Printf("GRPCCallWithQueryParams Marshal Error: %s\n", err)
+			logging.Default().Error("GRPCCallWithQueryParams marshal error", "requestId", model.RequestID(ctx), "error", err)
 			return SendError(ctx, err)
 		}
 		ctx.Response().Header.SetContentType("application/json")
@@ -64,7 +66,7 @@ func obtainConnectedClient[ClientT interface{}](serviceUrl string, clientConstru
 
 	conn, err := connectGRPCService(serviceUrl)
 	if err != nil {
-		fmt.Printf("GRPCCallWithQueryParams Connect Error: %s\n", err)
+		logging.Default().Error("gRPC connect error", "url", serviceUrl, "error", err)
 		return client, err
 	}
 	// Disconnect and remove from cache after 5 minutes
@@ -77,7 +79,7 @@ func obtainConnectedClient[ClientT interface{}](serviceUrl string, clientConstru
 		<-time.After(5 * time.Minute)
 		err := conn.Close()
 		if err != nil {
-			fmt.Printf("GRPCCallWithQueryParams Disconnect Error: %s\n", err)
+			logging.Default().Error("gRPC disconnect error", "url", serviceUrl, "error", err)
 		}
 	}(conn, serviceUrl, clientConstructorName)
 	client = clientConstructor(conn)
@@ -90,24 +92,24 @@ func gRPCCallWithBody[InputT any, ClientT interface{}, OutputT proto.Message](se
 		//fmt.Printf("%s %T \n", serviceUrl, clientMethod)
 		var rawParamsInput InputT
 		if err := ctx.BodyParser(&rawParamsInput); err != nil {
-			fmt.Printf("GRPCCallWithBody Body Parse Error: %s\n", err)
+			logging.Default().Error("GRPCCallWithBody body parse error", "requestId", model.RequestID(ctx), "error", err)
 			return SendError(ctx, err)
 		}
 		client, err := obtainConnectedClient(serviceUrl, clientConstructor)
 		if err != nil {
-			fmt.Printf("GRPCCallWithBody Connect Error: %s\n", err)
+			logging.Default().Error("GRPCCallWithBody connect error", "requestId", model.RequestID(ctx), "error", err)
 			return SendError(ctx, err)
 		}
 
 		res, err := clientMethod(client, ctx.Context(), &rawParamsInput)
 		if err != nil {
-			fmt.Printf("GRPCCallWithBody Call Error: %v --> %s\n", ctx.Route().Name, err)
+			logging.Default().Error("GRPCCallWithBody call error", "requestId", model.RequestID(ctx), "route", ctx.Route().Name, "error", err)
 			return SendError(ctx, err)
 		}
 		m := jsonpb.Marshaler{EmitDefaults: true}
 		toSend, err := m.MarshalToString(res)
 		if err != nil {
-			fmt.Printf("GRPCCallWithBody Marshal Error: %s\n", err)
+			logging.Default().Error("GRPCCallWithBody marshal error", "requestId", model.RequestID(ctx), "error", err)
 			return SendError(ctx, err)
 		}
 		ctx.Response().Header.SetContentType("application/json")
@@ -116,7 +118,7 @@ func gRPCCallWithBody[InputT any, ClientT interface{}, OutputT proto.Message](se
 }
 
 func connectGRPCService(url string) (*grpc.ClientConn, error) {
-	fmt.Printf("[DEBUG] wst-grpc: Connecting to %s\n", url)
+	logging.Default().Debug("Connecting to gRPC service", "url", url)
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	clientConn, err := grpc.DialContext(ctx, url, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(), grpc.WithBlock())
@@ -144,3 +146,12 @@ func replaceVarNames(definition string) string {
 		return "_" + strings.ToUpper(match[1:]) + "_"
 	})
 }
+
+// policyRule splits a policy of the model config, like "$owner,*,write,allow", into the values of a casbin rule
+func policyRule(policy string) []string {
+	rule := strings.Split(policy, ",")
+	for i, value := range rule {
+		rule[i] = strings.TrimSpace(value)
+	}
+	return rule
+}
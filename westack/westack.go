@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/fredyk/westack-go/westack/lib/swaggerhelperinterface"
 	"github.com/fredyk/westack-go/westack/memorykv"
+	"github.com/fredyk/westack-go/westack/metrics"
 	"io"
 	"log"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"reflect"
 	"runtime/debug"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -23,13 +25,20 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/bsoncodec"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 
 	"github.com/goccy/go-json"
 
 	wst "github.com/fredyk/westack-go/westack/common"
 	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/jwtkeys"
+	"github.com/fredyk/westack-go/westack/logging"
+	"github.com/fredyk/westack-go/westack/mailer"
 	"github.com/fredyk/westack-go/westack/model"
+	"github.com/fredyk/westack-go/westack/passwords"
+	"github.com/fredyk/westack-go/westack/ratelimit"
+	"github.com/fredyk/westack-go/westack/tracing"
 	"github.com/fredyk/westack-go/westack/utils"
 )
 
@@ -49,12 +58,32 @@ type WeStack struct {
 	datasources       *map[string]*datasource.Datasource
 	modelRegistry     *map[string]*model.Model
 	debug             bool
+	logger            logging.Logger
 	restApiRoot       string
 	roleMappingModel  *model.Model
+	apiKeyModel       *model.Model
 	dataSourceOptions *map[string]*datasource.Options
 	init              time.Time
 	jwtSecretKey      []byte
+	jwtKeys           *jwtkeys.KeySet
+	mailer            mailer.Mailer
+	mailTemplates     *mailer.Templates
+	passwordPolicy    *passwords.Policy
+	passwordHasher    passwords.Hasher
+	userRoles         *userRolesCache
+	rateLimiter       *ratelimit.Limiter
 	swaggerHelper     swaggerhelperinterface.SwaggerHelper
+	tokenDenylist     *model.TokenDenylist
+	auditLog          *model.AuditLog
+	metricsRegistry   *metrics.Registry
+
+	// policiesDatasource stores the casbin rules instead of the CSV files, see loadPoliciesDatasource
+	policiesDatasource *datasource.Datasource
+
+	// readiness checks, see readinessHandler
+	modelsLoaded  atomic.Bool
+	adminUpserted atomic.Bool
+	stopping      atomic.Bool
 }
 
 func (app *WeStack) FindModel(modelName string) (*model.Model, error) {
@@ -87,11 +116,16 @@ func (app *WeStack) FindModelsWithClass(modelClass string) (foundModels []*model
 func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 
 	app.loadDataSources()
+	app.loadTokenDenylist()
+	app.loadRateLimiter()
+	app.loadPoliciesDatasource()
 
 	err := app.loadModels()
 	if err != nil {
 		log.Fatalf("Error while loading models: %v", err)
 	}
+	app.loadAuditLog()
+	app.modelsLoaded.Store(true)
 
 	pprofAuthUsername := os.Getenv("PPROF_AUTH_USERNAME")
 	pprofAuthPassword := os.Getenv("PPROF_AUTH_PASSWORD")
@@ -104,12 +138,16 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 		}))
 	}
 
+	app.Middleware(func(c *fiber.Ctx) error {
+		model.RequestID(c)
+		return c.Next()
+	})
+
 	app.Middleware(func(c *fiber.Ctx) error {
 		method := c.Method()
 		err := c.Next()
 		if err != nil {
-			log.Println("Error:", err)
-			log.Printf("%v: %v\n", method, c.OriginalURL())
+			app.logger.Error("Error while handling request", "requestId", model.RequestID(c), "verb", method, "url", c.OriginalURL(), "error", err)
 			switch err.(type) {
 			case *fiber.Error:
 				if err.(*fiber.Error).Code == fiber.StatusNotFound {
@@ -127,8 +165,7 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 	app.Middleware(recover.New(recover.Config{
 		EnableStackTrace: true,
 		StackTraceHandler: func(c *fiber.Ctx, e interface{}) {
-			log.Println(e)
-			debug.PrintStack()
+			app.logger.Error("Recovered from panic", "requestId", model.RequestID(c), "panic", fmt.Sprintf("%v", e), "stack", string(debug.Stack()))
 		},
 	}))
 
@@ -138,6 +175,11 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 
 	app.loadModelsFixedRoutes()
 
+	err = app.loadRoleHierarchy()
+	if err != nil {
+		log.Fatalf("Could not load the role hierarchy: %v", err)
+	}
+
 	systemContext := &model.EventContext{
 		Bearer: &model.BearerToken{User: &model.BearerUser{System: true}},
 	}
@@ -151,6 +193,7 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 	if err != nil {
 		log.Fatalf("Error while creating admin user: %v", err)
 	}
+	app.adminUpserted.Store(true)
 
 	for _, cb := range customRoutesCallbacks {
 		cb(app)
@@ -177,6 +220,16 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 		}})
 	})
 
+	app.Server.Get("/system/health", healthHandler(app))
+	app.Server.Get("/system/ready", readinessHandler(app))
+	app.Server.Get("/.well-known/jwks.json", func(c *fiber.Ctx) error {
+		return c.JSON(app.jwtKeys.JWKS())
+	})
+	app.loadOidcRoutes()
+	app.loadAuditRoutes()
+
+	app.loadMetricsRoutes()
+
 	app.Server.Get("/swagger/doc.json", swaggerDocsHandler(app))
 
 	var swaggerUIStatic []byte
@@ -216,8 +269,7 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 				return err
 			}
 
-			fmt.Printf("DEBUG: Fetched swagger ui static html (%v bytes)\n", len(swaggerUIStatic))
-			fmt.Printf("DEBUG: Swagger Content-Encoding: %v\n", swaggerContentEncoding)
+			app.logger.Debug("Fetched swagger ui static html", "bytes", len(swaggerUIStatic), "contentEncoding", swaggerContentEncoding)
 		}
 
 		ctx.Status(fiber.StatusOK).Set("Content-Type", "text/html; charset=utf-8")
@@ -229,32 +281,43 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 	// Free up memory
 	err = app.swaggerHelper.Dump()
 	if err != nil {
-		fmt.Printf("Error while dumping swagger helper: %v\n", err)
+		app.logger.Error("Error while dumping swagger helper", "error", err)
 	}
 
 }
 
 func (app *WeStack) Start() error {
-	log.Printf("DEBUG Server took %v ms to start\n", time.Now().UnixMilli()-app.init.UnixMilli())
+	app.logger.Info("Server started", "port", app.port, "startupMs", time.Now().UnixMilli()-app.init.UnixMilli())
 	return app.Server.Listen(fmt.Sprintf("0.0.0.0:%v", app.port))
 }
 
+// Logger returns the logger of the app
+func (app *WeStack) Logger() logging.Logger {
+	return app.logger
+}
+
 func (app *WeStack) Middleware(handler fiber.Handler) {
 	app.Server.Use(handler)
 }
 
+// Stop makes /system/ready answer 503, waits Options.ShutdownDelay so that the load balancers stop sending traffic,
+// shuts down the server letting the ongoing requests finish, and closes the datasources
 func (app *WeStack) Stop() error {
-	log.Println("Stopping server")
+	app.logger.Info("Stopping server")
+	app.stopping.Store(true)
+	if app.Options.ShutdownDelay > 0 {
+		time.Sleep(app.Options.ShutdownDelay)
+	}
+	err := app.Server.Shutdown()
+	if err != nil {
+		return err
+	}
 	for _, ds := range *app.datasources {
 		err := ds.Close()
 		if err != nil {
 			return err
 		}
 	}
-	err := app.Server.Shutdown()
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -267,14 +330,30 @@ func GRPCCallWithBody[InputT any, ClientT interface{}, OutputT proto.Message](se
 }
 
 type Options struct {
-	RestApiRoot       string
-	Port              int
-	JwtSecretKey      string
+	RestApiRoot  string
+	Port         int
+	JwtSecretKey string
+	// JwtKeys signs and verifies the tokens. Defaults to the keys of the "jwt" section of config.json, or to the
+	// JwtSecretKey HMAC secret when there are none
+	JwtKeys           *jwtkeys.KeySet
 	DatasourceOptions *map[string]*datasource.Options
 	EnableCompression bool
 	CompressionConfig compress.Config
+	// ShutdownDelay is how long Stop keeps serving requests after the readiness probe starts failing
+	ShutdownDelay time.Duration
+	// TracerProvider receives the spans of the requests, hooks and datasource calls. Defaults to the global provider
+	// of otel, which does not record anything unless the application sets it
+	TracerProvider trace.TracerProvider
+	// Logger receives the log lines of the app. Defaults to a logger on stderr configured by the "logging" section
+	// of config.json and the LOG_LEVEL, LOG_FORMAT and DEBUG environment variables
+	Logger logging.Logger
+	// Mailer sends the verification and password reset emails. Defaults to the mailer of the "mailer" section of
+	// config.json, if any
+	Mailer mailer.Mailer
+	// PasswordHasher hashes the passwords of the users. Defaults to the hasher of the "passwordHasher" section of
+	// config.json, bcrypt with cost 10 when there is none
+	PasswordHasher passwords.Hasher
 
-	debug         bool
 	adminUsername string
 	adminPwd      string
 }
@@ -292,16 +371,14 @@ func New(options ...Options) *WeStack {
 	if len(options) > 0 {
 		finalOptions = options[0]
 	}
+	if finalOptions.TracerProvider != nil {
+		tracing.SetTracerProvider(finalOptions.TracerProvider)
+	}
 	if finalOptions.JwtSecretKey == "" {
 		if s, present := os.LookupEnv("JWT_SECRET"); present {
 			finalOptions.JwtSecretKey = s
 		}
 	}
-	_debug := false
-	if envDebug, _ := os.LookupEnv("DEBUG"); envDebug == "true" {
-		_debug = true
-	}
-
 	adminUsername, present := os.LookupEnv("WST_ADMIN_USERNAME")
 	if !present {
 		log.Fatalf("WST_ADMIN_USERNAME environment variable is not set")
@@ -333,7 +410,7 @@ func New(options ...Options) *WeStack {
 	if err != nil {                // Handle errors reading the config file
 		switch err.(type) {
 		case viper.ConfigFileNotFoundError:
-			log.Println(fmt.Sprintf("WARNING: %v.json not found, fallback to config.json", fileToLoad))
+			logging.Default().Warn("Config file not found, fallback to config.json", "file", fileToLoad+".json")
 			appViper.SetConfigName("config") // name of config file (without extension)
 			err := appViper.ReadInConfig()   // Find and read the config file
 			if err != nil {
@@ -345,6 +422,12 @@ func New(options ...Options) *WeStack {
 		}
 	}
 
+	if finalOptions.Logger == nil {
+		finalOptions.Logger = newLoggerFromConfig(appViper)
+	}
+	logging.SetDefault(finalOptions.Logger)
+	_debug := finalOptions.Logger.Enabled(logging.LevelDebug)
+
 	if finalOptions.RestApiRoot == "" {
 		finalOptions.RestApiRoot = appViper.GetString("restApiRoot")
 	}
@@ -356,12 +439,28 @@ func New(options ...Options) *WeStack {
 		if err != nil {
 			log.Fatalf("Invalid PORT environment variable: %v", err)
 		}
-		if finalOptions.debug {
-			log.Printf("DEBUG: PORT environment variable is set to %v", portFromEnv)
-		}
+		finalOptions.Logger.Debug("PORT environment variable is set", "port", portFromEnv)
 		finalOptions.Port = portFromEnv
 	}
 
+	if finalOptions.JwtKeys == nil {
+		if finalOptions.JwtSecretKey == "" && appViper.GetString("jwt.signingKid") == "" {
+			// an empty secret would let anyone sign tokens
+			finalOptions.Logger.Warn("JWT_SECRET is not set, the tokens are signed with a random secret that is lost on restart and not shared by the instances of the app")
+			finalOptions.JwtSecretKey = randomTokenValue()
+		}
+		finalOptions.JwtKeys = loadJwtKeys(appViper, []byte(finalOptions.JwtSecretKey))
+	}
+	if finalOptions.Mailer == nil {
+		finalOptions.Mailer = loadMailer(appViper)
+	}
+	if finalOptions.Mailer != nil && appViper.GetString("publicUrl") == "" {
+		finalOptions.Logger.Warn("publicUrl is not set, the verification emails cannot be sent")
+	}
+	if finalOptions.PasswordHasher == nil {
+		finalOptions.PasswordHasher = loadPasswordHasher(appViper)
+	}
+
 	var bsonRegistry *bsoncodec.Registry
 	if finalOptions.DatasourceOptions != nil {
 		for _, v := range *finalOptions.DatasourceOptions {
@@ -385,9 +484,16 @@ func New(options ...Options) *WeStack {
 		modelRegistry:     &modelRegistry,
 		datasources:       &datasources,
 		debug:             _debug,
+		logger:            finalOptions.Logger,
 		restApiRoot:       finalOptions.RestApiRoot,
 		port:              finalOptions.Port,
 		jwtSecretKey:      []byte(finalOptions.JwtSecretKey),
+		jwtKeys:           finalOptions.JwtKeys,
+		mailer:            finalOptions.Mailer,
+		mailTemplates:     &mailer.Templates{Directory: mailTemplatesDirectory},
+		passwordPolicy:    loadPasswordPolicy(appViper),
+		passwordHasher:    finalOptions.PasswordHasher,
+		userRoles:         newUserRolesCache(),
 		dataSourceOptions: finalOptions.DatasourceOptions,
 		init:              time.Now(),
 	}
@@ -395,6 +501,32 @@ func New(options ...Options) *WeStack {
 	return &app
 }
 
+// newLoggerFromConfig creates the default logger. The LOG_LEVEL and LOG_FORMAT environment variables take precedence
+// over "logging.level" and "logging.format", and DEBUG=true is kept as a shortcut for the debug level
+func newLoggerFromConfig(appViper *viper.Viper) logging.Logger {
+	levelName := appViper.GetString("logging.level")
+	if envLevel, present := os.LookupEnv("LOG_LEVEL"); present {
+		levelName = envLevel
+	} else if envDebug, _ := os.LookupEnv("DEBUG"); envDebug == "true" {
+		levelName = "debug"
+	}
+	formatName := appViper.GetString("logging.format")
+	if envFormat, present := os.LookupEnv("LOG_FORMAT"); present {
+		formatName = envFormat
+	}
+
+	level, levelErr := logging.ParseLevel(levelName)
+	format, formatErr := logging.ParseFormat(formatName)
+	logger := logging.New(os.Stderr, format, level)
+	if levelErr != nil {
+		logger.Warn("Using the info log level", "error", levelErr)
+	}
+	if formatErr != nil {
+		logger.Warn("Using the text log format", "error", formatErr)
+	}
+	return logger
+}
+
 func InitAndServe() {
 	app := New()
 